@@ -0,0 +1,22 @@
+#!/bin/sh
+# Sets up kiwi on a new machine: installs the CLI if it's missing, then
+# restores your dotfiles and packages from the server.
+#
+#   curl -fsSL https://raw.githubusercontent.com/ojowwalker77/kiwi-cli/main/install.sh | KIWI_TOKEN=... sh
+#
+# KIWI_SERVER picks a server other than the default, KIWI_AGE_KEY decrypts
+# encrypted files, and any arguments are passed on to `kiwi restore` (use
+# `sh -s -- --prefer-local` when piping).
+set -eu
+
+if ! command -v kiwi >/dev/null 2>&1; then
+    if ! command -v cargo >/dev/null 2>&1; then
+        echo "kiwi is built with cargo; install Rust from https://rustup.rs first" >&2
+        exit 1
+    fi
+    echo "Installing kiwi..."
+    cargo install --git https://github.com/ojowwalker77/kiwi-cli
+    PATH="$HOME/.cargo/bin:$PATH"
+fi
+
+exec kiwi restore "$@"
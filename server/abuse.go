@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Abuse detection watches each client address for registration floods,
+// token or password guessing (bursts of 401s) and oversized request bodies.
+// An address that crosses a threshold in [abuse] is blocked from the API with
+// 429 for abuse.block_for. Blocks are kept in memory, so a restart lifts
+// them; each one is written to the audit log, and admins can review and lift
+// them at /admin/abuse.
+const (
+	abuseRegistration = "registration"
+	abuseAuthFailure  = "auth_failure"
+	abuseOversized    = "oversized_request"
+)
+
+// abuseWindows is how far back each kind of event is counted.
+var abuseWindows = map[string]time.Duration{
+	abuseRegistration: time.Hour,
+	abuseAuthFailure:  10 * time.Minute,
+	abuseOversized:    time.Hour,
+}
+
+type AbuseBlock struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Events    int       `json:"events"`
+	BlockedAt time.Time `json:"blocked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Rejected counts requests refused while the block was in place
+	Rejected int `json:"rejected"`
+}
+
+type AbuseBlockList struct {
+	Blocks []*AbuseBlock `json:"blocks"`
+}
+
+type abuseTracker struct {
+	mu     sync.Mutex
+	events map[string]map[string][]time.Time
+	blocks map[string]*AbuseBlock
+}
+
+var abuse = &abuseTracker{
+	events: make(map[string]map[string][]time.Time),
+	blocks: make(map[string]*AbuseBlock),
+}
+
+// abuseThreshold returns how many events of a kind within its window block
+// an address, or zero when that kind isn't watched.
+func abuseThreshold(cfg *Config, kind string) int {
+	switch kind {
+	case abuseRegistration:
+		return cfg.AbuseRegistrations
+	case abuseAuthFailure:
+		return cfg.AbuseAuthFailures
+	case abuseOversized:
+		return cfg.AbuseOversized
+	}
+	return 0
+}
+
+// blocked returns the active block on ip, if any, counting the rejection.
+func (a *abuseTracker) blocked(ip string) *AbuseBlock {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	block := a.blocks[ip]
+	if block == nil {
+		return nil
+	}
+	if expired(block.ExpiresAt) {
+		delete(a.blocks, ip)
+		return nil
+	}
+	block.Rejected++
+	copied := *block
+	return &copied
+}
+
+// record notes an event from ip and blocks it when that makes too many.
+func (a *abuseTracker) record(r *http.Request, ip, kind string) {
+	cfg := currentConfig()
+	threshold := abuseThreshold(cfg, kind)
+	if threshold <= 0 {
+		return
+	}
+	now := time.Now()
+	cutoff := now.Add(-abuseWindows[kind])
+
+	a.mu.Lock()
+	kinds := a.events[ip]
+	if kinds == nil {
+		kinds = make(map[string][]time.Time)
+		a.events[ip] = kinds
+	}
+	recent := kinds[kind][:0]
+	for _, t := range kinds[kind] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	kinds[kind] = recent
+	if len(recent) < threshold || a.blocks[ip] != nil {
+		a.mu.Unlock()
+		return
+	}
+	block := &AbuseBlock{
+		IP:        ip,
+		Reason:    kind,
+		Events:    len(recent),
+		BlockedAt: now.UTC(),
+		ExpiresAt: now.Add(cfg.AbuseBlockFor).UTC(),
+	}
+	a.blocks[ip] = block
+	delete(a.events, ip)
+	a.mu.Unlock()
+
+	log.Printf("Blocked %s for %s: %d %s events in %s", ip, cfg.AbuseBlockFor, block.Events, kind, abuseWindows[kind])
+	audit(r, AuditEvent{
+		Actor:  "system",
+		Action: "abuse.block",
+		Target: ip,
+		Reason: kind,
+		Detail: fmt.Sprintf("%d events in %s; blocked until %s", block.Events, abuseWindows[kind], block.ExpiresAt.Format(time.RFC3339)),
+	})
+}
+
+// unblock lifts a block, reporting whether there was one.
+func (a *abuseTracker) unblock(ip string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.blocks[ip]
+	delete(a.blocks, ip)
+	delete(a.events, ip)
+	return ok
+}
+
+// prune drops expired blocks and event counts that have aged out.
+func (a *abuseTracker) prune() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for ip, block := range a.blocks {
+		if expired(block.ExpiresAt) {
+			delete(a.blocks, ip)
+		}
+	}
+	for ip, kinds := range a.events {
+		for kind, times := range kinds {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > abuseWindows[kind] {
+				delete(kinds, kind)
+			}
+		}
+		if len(kinds) == 0 {
+			delete(a.events, ip)
+		}
+	}
+}
+
+// list returns the active blocks, newest first.
+func (a *abuseTracker) list() []*AbuseBlock {
+	a.prune()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	blocks := make([]*AbuseBlock, 0, len(a.blocks))
+	for _, block := range a.blocks {
+		copied := *block
+		blocks = append(blocks, &copied)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].BlockedAt.After(blocks[j].BlockedAt)
+	})
+	return blocks
+}
+
+// abuseMiddleware refuses API requests from blocked addresses and those with
+// bodies over abuse.max_request_mb, and feeds registrations and 401s to the
+// tracker.
+func abuseMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		if !cfg.AbuseEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := abuseClientIP(r)
+		// The server admin can always get in to review and lift blocks
+		if strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") != os.Getenv(authTokenEnv) {
+			if block := abuse.blocked(ip); block != nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(block.ExpiresAt).Seconds())+1))
+				http.Error(w, "Too many requests - this address is temporarily blocked", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		maxBytes := int64(cfg.AbuseMaxRequestMB) << 20
+		if r.ContentLength > maxBytes {
+			abuse.record(r, ip, abuseOversized)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		switch {
+		case rec.status == http.StatusUnauthorized:
+			abuse.record(r, ip, abuseAuthFailure)
+		case r.Method == http.MethodPost && (r.URL.Path == "/register" || r.URL.Path == "/trial") &&
+			rec.status != http.StatusTooManyRequests && rec.status != http.StatusNotFound:
+			abuse.record(r, ip, abuseRegistration)
+		}
+	})
+}
+
+// abuseClientIP returns the address requests are tracked by. IPv6 clients
+// are tracked by /64, since one host usually has a whole prefix.
+func abuseClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// handleAdminAbuse lists the addresses that are blocked.
+func handleAdminAbuse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AbuseBlockList{Blocks: abuse.list()})
+}
+
+// handleAdminAbuseBlock lifts the block on an address. IPv6 blocks are named
+// by their /64, as in DELETE /admin/abuse/2001:db8::/64.
+func handleAdminAbuseBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.PathValue("ip")
+	if !abuse.unblock(ip) {
+		http.Error(w, "Address not blocked", http.StatusNotFound)
+		return
+	}
+	log.Printf("Unblocked %s", ip)
+	audit(r, AuditEvent{Actor: "admin", Action: "abuse.unblock", Target: ip})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The access log is separate from the application log. KIWI_ACCESS_LOG
+// enables it and names the destination, "stdout" or a file path;
+// KIWI_ACCESS_LOG_FORMAT selects "combined" (the default) or "json".
+const (
+	accessLogEnv       = "KIWI_ACCESS_LOG"
+	accessLogFormatEnv = "KIWI_ACCESS_LOG_FORMAT"
+)
+
+type accessLogger struct {
+	out  *log.Logger
+	json bool
+}
+
+// accessLogUser is filled in by authMiddleware, deeper in the chain than the
+// access log itself.
+type accessLogUser struct {
+	email string
+	// impersonated is set when an admin made the request as the user
+	impersonated bool
+}
+
+type accessLogRecord struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Size       int       `json:"size"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// newAccessLogger opens the access log named by cfg. Files rotate with the
+// same settings as the application log.
+func newAccessLogger(cfg *Config) (*accessLogger, error) {
+	var w io.Writer
+	switch cfg.AccessLog {
+	case "stdout", "-":
+		w = os.Stdout
+	default:
+		f, err := openLogFile(cfg, cfg.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	switch strings.ToLower(cfg.AccessLogFormat) {
+	case "", "combined":
+		return &accessLogger{out: log.New(w, "", 0)}, nil
+	case "json":
+		return &accessLogger{out: log.New(w, "", 0), json: true}, nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", cfg.AccessLogFormat)
+}
+
+// setAccessLogUser records who a request authenticated as, for the access
+// log. Shared-access requests are logged as the member, not the owner.
+func setAccessLogUser(r *http.Request, email string) {
+	if user, ok := r.Context().Value(accessLogContextKey).(*accessLogUser); ok {
+		user.email = email
+	}
+}
+
+// setImpersonatedAccessLogUser records a request an admin made as email,
+// logged as admin:email.
+func setImpersonatedAccessLogUser(r *http.Request, email string) {
+	if user, ok := r.Context().Value(accessLogContextKey).(*accessLogUser); ok {
+		user.email = "admin:" + email
+		user.impersonated = true
+	}
+}
+
+// withAccessLogUser gives r somewhere to record its user, reusing the one an
+// outer middleware already attached.
+func withAccessLogUser(r *http.Request) (*http.Request, *accessLogUser) {
+	if user, ok := r.Context().Value(accessLogContextKey).(*accessLogUser); ok {
+		return r, user
+	}
+	user := &accessLogUser{}
+	return r.WithContext(context.WithValue(r.Context(), accessLogContextKey, user)), user
+}
+
+func (a *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, user := withAccessLogUser(r)
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		record := accessLogRecord{
+			Time:       start,
+			RemoteAddr: host,
+			User:       user.email,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Proto:      r.Proto,
+			Status:     rec.status,
+			Size:       rec.size,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		}
+		a.write(record)
+	})
+}
+
+func (a *accessLogger) write(record accessLogRecord) {
+	if a.json {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+		a.out.Print(string(data))
+		return
+	}
+
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	size := "-"
+	if record.Size > 0 {
+		size = fmt.Sprint(record.Size)
+	}
+	a.out.Printf("%s - %s [%s] %q %d %s %q %q",
+		record.RemoteAddr,
+		dash(record.User),
+		record.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		record.Method+" "+record.URI+" "+record.Proto,
+		record.Status,
+		size,
+		dash(record.Referer),
+		dash(record.UserAgent),
+	)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GET /account tells a client who its token signs in as, for `kiwi whoami`:
+// the account and its tier, what kind of token it is and when it stops
+// working, the device named by X-Kiwi-Device, and how much of the tier's
+// storage is used.
+type Account struct {
+	Email          string         `json:"email"`
+	Username       string         `json:"username,omitempty"`
+	Tenant         string         `json:"tenant,omitempty"`
+	Tier           string         `json:"tier"`
+	CreatedAt      time.Time      `json:"created_at"`
+	TrialExpiresAt *time.Time     `json:"trial_expires_at,omitempty"`
+	Token          AccountToken   `json:"token"`
+	Device         *Device        `json:"device,omitempty"`
+	Storage        AccountStorage `json:"storage"`
+}
+
+type AccountToken struct {
+	// Kind is "api", "session" or "impersonation"
+	Kind string `json:"kind"`
+	// Scope is "full", or an impersonation token's "read" or "sync"
+	Scope string `json:"scope"`
+	// ExpiresAt is unset for API tokens, which last until replaced
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type AccountStorage struct {
+	UsedBytes int64 `json:"used_bytes"`
+	// LimitBytes is the tier's storage limit; zero means none
+	LimitBytes int64 `json:"limit_bytes,omitempty"`
+}
+
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The admin token isn't an account
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := loadUser(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read account", http.StatusInternalServerError)
+		return
+	}
+
+	cfg := currentConfig()
+	tier := userTier(cfg, user)
+	account := Account{
+		Email:          user.Email,
+		Username:       user.Username,
+		Tenant:         user.Tenant,
+		Tier:           tier,
+		CreatedAt:      user.CreatedAt,
+		TrialExpiresAt: user.TrialExpiresAt,
+		Token:          requestToken(r),
+		Storage: AccountStorage{
+			UsedBytes:  userStorageBytes(user.Email),
+			LimitBytes: int64(cfg.Tiers[tier].StorageMB) << 20,
+		},
+	}
+	if id := r.Header.Get("X-Kiwi-Device"); id != "" {
+		if devices, err := loadDevices(user.Email); err == nil {
+			account.Device = devices[id]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
+
+// handleAccountToken replaces the account's API token, cutting off every
+// machine still holding the old one, and returns the new one.
+func handleAccountToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Support staff standing in for a user can't lock them out
+	if requestToken(r).Kind == "impersonation" {
+		http.Error(w, "Forbidden - impersonation tokens can't replace the account's token", http.StatusForbidden)
+		return
+	}
+	token, ok := rotateAccountToken(w, r, userEmail)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"email": userEmail, "token": token})
+}
+
+// rotateAccountToken replaces the account's API token and returns the new
+// one. It writes the error response itself when it fails.
+func rotateAccountToken(w http.ResponseWriter, r *http.Request, email string) (string, bool) {
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return "", false
+	}
+	user, ok := updateUser(w, email, func(user *User) {
+		user.Token = token
+	})
+	if !ok {
+		return "", false
+	}
+	audit(r, AuditEvent{Actor: user.Email, Action: "token.rotate", Target: user.Email})
+	notify(user, notifyTokenRevoked, "Your kiwi API token was replaced",
+		"Your kiwi API token was replaced "+requestOrigin(r)+", so the old one no longer works.\n\nIf this wasn't you, change your password.\n")
+	return token, true
+}
+
+// requestToken describes the token authMiddleware accepted for r.
+func requestToken(r *http.Request) AccountToken {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case strings.HasPrefix(token, impersonationTokenPrefix):
+		if session, err := loadImpersonation(hashShareToken(token)); err == nil {
+			return AccountToken{Kind: "impersonation", Scope: session.Scope, ExpiresAt: &session.ExpiresAt}
+		}
+	case strings.HasPrefix(token, webSessionTokenPrefix):
+		if session, err := loadWebSession(hashShareToken(token)); err == nil {
+			return AccountToken{Kind: "session", Scope: "full", ExpiresAt: &session.ExpiresAt}
+		}
+	}
+	return AccountToken{Kind: "api", Scope: "full"}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// orgOwnershipError is returned when deleting an account would leave an
+// org with members but no owner.
+type orgOwnershipError struct {
+	orgs []string
+}
+
+func (e *orgOwnershipError) Error() string {
+	return "the account is the last owner of " + strings.Join(e.orgs, ", ") + "; make someone else an owner first"
+}
+
+// deleteAccount removes an account and everything that refers to it: its
+// data, username, share links, file set sharing both ways, org memberships,
+// and any browser sessions or impersonation tokens. Orgs the account is
+// the only member of are deleted with it.
+func deleteAccount(email string) error {
+	unlock := lockUserData(email + "\x00user")
+	defer unlock()
+
+	user, err := loadUser(email)
+	if err != nil {
+		return err
+	}
+
+	orgIDs, err := loadUserOrgIDs(email)
+	if err != nil {
+		return err
+	}
+	var blocked []string
+	for _, id := range orgIDs {
+		org, err := loadOrg(id)
+		if err != nil {
+			continue
+		}
+		if org.Members[email] == orgRoleOwner && countOrgRole(org, orgRoleOwner) == 1 && len(org.Members) > 1 {
+			blocked = append(blocked, fmt.Sprintf("%q (%s)", org.Name, org.ID))
+		}
+	}
+	if len(blocked) > 0 {
+		return &orgOwnershipError{orgs: blocked}
+	}
+
+	// Sign the account out first so nothing writes to it while it goes
+	if err := os.Remove(getUserPath(email)); err != nil {
+		return err
+	}
+	accountIndex.remove(email)
+	syncHub.closeUser(email)
+	revokeWebSessions(email)
+	usage.forget(email)
+
+	for _, id := range orgIDs {
+		leaveOrgForDeletion(id, email)
+	}
+	if user.Username != "" {
+		unlockNames := lockUserData("\x00usernames")
+		if owner, err := lookupUsername(user.Username); err == nil && owner == email {
+			os.Remove(getUsernamePath(user.Username))
+		}
+		unlockNames()
+	}
+
+	// Sets this account shared with others, and sets shared with it
+	if fileSets, err := loadFileSets(email); err == nil {
+		for name, set := range fileSets {
+			for member := range set.Members {
+				updateSharedWith(member, email, name, "")
+			}
+		}
+	}
+	if shared, err := loadSharedWith(email); err == nil {
+		for _, entry := range shared {
+			removeFileSetMember(entry.Owner, entry.Name, email)
+		}
+	}
+
+	removeMatching(sharesDir, func(id string) bool {
+		share, err := loadShare(id)
+		return err == nil && share.Email == email
+	})
+	removeMatching(impersonationDir, func(id string) bool {
+		session, err := loadImpersonation(id)
+		return err == nil && session.Email == email
+	})
+	removeMatching(passwordResetsDir, func(id string) bool {
+		reset, err := loadPasswordReset(id)
+		return err == nil && reset.Email == email
+	})
+
+	return os.RemoveAll(getUserDataDir(email))
+}
+
+// leaveOrgForDeletion drops a deleted account from an org, deleting the org
+// when nobody is left.
+func leaveOrgForDeletion(id, email string) {
+	unlock := lockOrg(id)
+	defer unlock()
+	org, err := loadOrg(id)
+	if err != nil {
+		return
+	}
+	delete(org.Members, email)
+	if len(org.Members) == 0 {
+		os.Remove(getOrgPath(id))
+		return
+	}
+	saveOrg(org)
+}
+
+func removeFileSetMember(owner, name, member string) {
+	unlock := lockUserData(owner + "\x00filesets")
+	defer unlock()
+	fileSets, err := loadFileSets(owner)
+	if err != nil || fileSets[name] == nil {
+		return
+	}
+	delete(fileSets[name].Members, member)
+	saveFileSets(owner, fileSets)
+}
+
+// removeMatching deletes the records in a directory of <id>.json files that
+// match.
+func removeMatching(dir string, match func(id string) bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if ok && match(id) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
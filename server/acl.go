@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// File sets let an owner share part of their sync data with other accounts.
+// A member addresses the owner's data by sending X-Kiwi-Owner; authMiddleware
+// then acts as the owner but attaches an ACL that the sync handlers use to
+// hide and protect everything outside the member's file sets. Routes have to
+// opt in with allowSharedAccess, so handlers that don't enforce ACLs can't be
+// reached with borrowed access.
+const (
+	aclRead  = "read"
+	aclWrite = "write"
+
+	maxFileSetPaths   = 1000
+	maxFileSetMembers = 100
+)
+
+var fileSetNameRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type FileSet struct {
+	Name string `json:"name"`
+	// Paths are exact file paths, or prefixes when they end in "/".
+	Paths   []string          `json:"paths"`
+	Members map[string]string `json:"members"`
+}
+
+// SharedFileSet is a member's view of a file set shared with them.
+type SharedFileSet struct {
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	Mode  string `json:"mode"`
+}
+
+type aclGrant struct {
+	paths []string
+	write bool
+}
+
+// ACL limits a member's access to an owner's sync data.
+type ACL struct {
+	Owner  string
+	Member string
+	grants []aclGrant
+}
+
+type contextKey int
+
+const (
+	aclContextKey contextKey = iota
+	sharedAccessContextKey
+	accessLogContextKey
+)
+
+func matchesFileSet(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ACL) CanRead(path string) bool {
+	for _, grant := range acl.grants {
+		if matchesFileSet(grant.paths, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ACL) CanWrite(path string) bool {
+	for _, grant := range acl.grants {
+		if grant.write && matchesFileSet(grant.paths, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestACL returns the ACL of a shared-access request, or nil when the
+// caller owns the data.
+func requestACL(r *http.Request) *ACL {
+	acl, _ := r.Context().Value(aclContextKey).(*ACL)
+	return acl
+}
+
+// allowSharedAccess marks a route as enforcing ACLs. It must wrap
+// authMiddleware.
+func allowSharedAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sharedAccessContextKey, true)))
+	}
+}
+
+// resolveSharedAccess turns a member's request for the owner named in
+// X-Kiwi-Owner into a request acting as the owner, restricted by an ACL.
+func resolveSharedAccess(w http.ResponseWriter, r *http.Request, member string) (*http.Request, bool) {
+	owner := r.Header.Get("X-Kiwi-Owner")
+	if owner == "" || owner == member {
+		return r, true
+	}
+	if allowed, _ := r.Context().Value(sharedAccessContextKey).(bool); !allowed {
+		http.Error(w, "This endpoint is not available for shared file sets", http.StatusForbidden)
+		return nil, false
+	}
+
+	fileSets, err := loadFileSets(owner)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	acl := &ACL{Owner: owner, Member: member}
+	for _, fileSet := range fileSets {
+		if mode, ok := fileSet.Members[member]; ok {
+			acl.grants = append(acl.grants, aclGrant{paths: fileSet.Paths, write: mode == aclWrite})
+		}
+	}
+	// Don't reveal whether the owner exists to accounts they share nothing with
+	if len(acl.grants) == 0 {
+		http.Error(w, "Forbidden - nothing is shared with you by this owner", http.StatusForbidden)
+		return nil, false
+	}
+
+	r.Header.Set("X-User-Email", owner)
+	return r.WithContext(context.WithValue(r.Context(), aclContextKey, acl)), true
+}
+
+// filterSyncData returns the part of syncData the ACL can read. Packages
+// aren't part of file sets.
+func filterSyncData(acl *ACL, syncData *SyncData) *SyncData {
+	filtered := &SyncData{Files: make(map[string]string), Packages: make([]Package, 0)}
+	for path, content := range syncData.Files {
+		if acl.CanRead(path) {
+			filtered.Files[path] = content
+		}
+	}
+	return filtered
+}
+
+// applySharedWrite builds the owner's next sync data from a member's view:
+// files the member can write are replaced by the member's version, and
+// everything else is kept as is.
+func applySharedWrite(acl *ACL, current, view *SyncData) (*SyncData, error) {
+	next := &SyncData{
+		Files:    make(map[string]string, len(current.Files)),
+		Packages: current.Packages,
+		Vectors:  view.Vectors,
+	}
+	for path, content := range current.Files {
+		if !acl.CanWrite(path) {
+			next.Files[path] = content
+		}
+	}
+	for path, content := range view.Files {
+		if !acl.CanWrite(path) {
+			if current.Files[path] == content && acl.CanRead(path) {
+				next.Files[path] = content
+				continue
+			}
+			return nil, fmt.Errorf("no write access to %s", path)
+		}
+		next.Files[path] = content
+	}
+	return next, nil
+}
+
+func getFileSetsPath(email string) string {
+	return filepath.Join(getUserDataDir(email), "filesets.json")
+}
+
+func getSharedWithPath(email string) string {
+	return filepath.Join(getUserDataDir(email), "shared_with_me.json")
+}
+
+func loadFileSets(email string) (map[string]*FileSet, error) {
+	fileSets := make(map[string]*FileSet)
+	data, err := os.ReadFile(getFileSetsPath(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fileSets, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fileSets); err != nil {
+		return nil, err
+	}
+	return fileSets, nil
+}
+
+func saveFileSets(email string, fileSets map[string]*FileSet) error {
+	if err := os.MkdirAll(getUserDataDir(email), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fileSets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getFileSetsPath(email), data, 0644)
+}
+
+func loadSharedWith(email string) ([]SharedFileSet, error) {
+	shared := make([]SharedFileSet, 0)
+	data, err := os.ReadFile(getSharedWithPath(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return shared, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &shared); err != nil {
+		return nil, err
+	}
+	return shared, nil
+}
+
+// updateSharedWith keeps a member's index of file sets shared with them in
+// step with the owner's file sets. An empty mode removes the entry.
+func updateSharedWith(member, owner, name, mode string) error {
+	unlock := lockUserData(member + "\x00shared")
+	defer unlock()
+
+	shared, err := loadSharedWith(member)
+	if err != nil {
+		return err
+	}
+	kept := make([]SharedFileSet, 0, len(shared)+1)
+	for _, entry := range shared {
+		if entry.Owner != owner || entry.Name != name {
+			kept = append(kept, entry)
+		}
+	}
+	if mode != "" {
+		kept = append(kept, SharedFileSet{Owner: owner, Name: name, Mode: mode})
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].Owner != kept[j].Owner {
+			return kept[i].Owner < kept[j].Owner
+		}
+		return kept[i].Name < kept[j].Name
+	})
+
+	if err := os.MkdirAll(getUserDataDir(member), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getSharedWithPath(member), data, 0644)
+}
+
+func validateFileSet(owner string, fileSet *FileSet) error {
+	if len(fileSet.Paths) == 0 || len(fileSet.Paths) > maxFileSetPaths {
+		return fmt.Errorf("a file set needs between 1 and %d paths", maxFileSetPaths)
+	}
+	for _, path := range fileSet.Paths {
+		if path == "" || path == "/" {
+			return errors.New("paths must not be empty or the root")
+		}
+	}
+	if len(fileSet.Members) > maxFileSetMembers {
+		return fmt.Errorf("a file set can have at most %d members", maxFileSetMembers)
+	}
+	tenant := userTenant(owner)
+	for email, mode := range fileSet.Members {
+		if mode != aclRead && mode != aclWrite {
+			return fmt.Errorf("mode for %s must be %q or %q", email, aclRead, aclWrite)
+		}
+		if email == owner {
+			return errors.New("you can't share a file set with yourself")
+		}
+		if !inTenant(tenant, email) {
+			return fmt.Errorf("unknown account %s", email)
+		}
+	}
+	return nil
+}
+
+// handleFileSets lists the caller's own file sets.
+func handleFileSets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fileSets, err := loadFileSets(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read file sets", http.StatusInternalServerError)
+		return
+	}
+	list := make([]*FileSet, 0, len(fileSets))
+	for _, fileSet := range fileSets {
+		list = append(list, fileSet)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func handleFileSet(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.PathValue("name")
+	if !fileSetNameRegex.MatchString(name) {
+		http.Error(w, "Invalid file set name", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockUserData(userEmail + "\x00filesets")
+	defer unlock()
+
+	fileSets, err := loadFileSets(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read file sets", http.StatusInternalServerError)
+		return
+	}
+	previous := fileSets[name]
+
+	switch r.Method {
+	case http.MethodGet:
+		if previous == nil {
+			http.Error(w, "File set not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(previous)
+		return
+
+	case http.MethodPut:
+		var fileSet FileSet
+		if err := json.NewDecoder(r.Body).Decode(&fileSet); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		fileSet.Name = name
+		if fileSet.Members == nil {
+			fileSet.Members = make(map[string]string)
+		}
+		if err := validateFileSet(userEmail, &fileSet); err != nil {
+			http.Error(w, "Invalid file set: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fileSets[name] = &fileSet
+
+	case http.MethodDelete:
+		if previous == nil {
+			http.Error(w, "File set not found", http.StatusNotFound)
+			return
+		}
+		delete(fileSets, name)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := saveFileSets(userEmail, fileSets); err != nil {
+		http.Error(w, "Failed to save file set", http.StatusInternalServerError)
+		return
+	}
+
+	// The owner's file sets are authoritative; the members' indexes only
+	// drive GET /shared, so a failed update isn't fatal
+	if previous != nil {
+		for member := range previous.Members {
+			if fileSets[name] == nil || fileSets[name].Members[member] == "" {
+				updateSharedWith(member, userEmail, name, "")
+			}
+		}
+	}
+	if fileSet := fileSets[name]; fileSet != nil {
+		for member, mode := range fileSet.Members {
+			updateSharedWith(member, userEmail, name, mode)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fileSet)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSharedWithMe lists file sets other accounts share with the caller.
+func handleSharedWithMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	shared, err := loadSharedWith(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read shared file sets", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shared)
+}
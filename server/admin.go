@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAdminUserLimit = 50
+	maxAdminUserLimit     = 200
+)
+
+// AdminStats summarizes usage for capacity planning. A user counts as active
+// when they pushed or any of their devices was seen within the window.
+type AdminStats struct {
+	Users          int              `json:"users"`
+	ActiveUsers7d  int              `json:"active_users_7d"`
+	ActiveUsers30d int              `json:"active_users_30d"`
+	StorageBytes   int64            `json:"storage_bytes"`
+	Snapshots      int              `json:"snapshots"`
+	SyncRequests   SyncRequestRates `json:"sync_requests"`
+	GeneratedAt    time.Time        `json:"generated_at"`
+}
+
+// SyncRequestRates counts requests to /sync routes on this instance since it
+// started, over trailing windows.
+type SyncRequestRates struct {
+	LastMinute uint64 `json:"last_minute"`
+	LastHour   uint64 `json:"last_hour"`
+	LastDay    uint64 `json:"last_day"`
+}
+
+// AdminUser is an account as listed for admins. LastSyncAt is the latest
+// push, or pull by one of its registered devices.
+type AdminUser struct {
+	Email         string           `json:"email"`
+	Username      string           `json:"username,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	LastSyncAt    *time.Time       `json:"last_sync_at,omitempty"`
+	Devices       int              `json:"devices"`
+	StorageBytes  int64            `json:"storage_bytes"`
+	Suspension    *Suspension      `json:"suspension,omitempty"`
+	TermsAccepted *TermsAcceptance `json:"terms_accepted,omitempty"`
+	Tenant        string           `json:"tenant,omitempty"`
+	Tier          string           `json:"tier"`
+}
+
+type AdminUserListResponse struct {
+	Users      []AdminUser `json:"users"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// lastActivity returns the latest push or device activity for a user.
+func lastActivity(email string) time.Time {
+	var last time.Time
+	if state, err := loadSyncState(email); err == nil && state.UpdatedAt.After(last) {
+		last = state.UpdatedAt
+	}
+	if devices, err := loadDevices(email); err == nil {
+		for _, device := range devices {
+			if device.LastSeenAt != nil && device.LastSeenAt.After(last) {
+				last = *device.LastSeenAt
+			}
+		}
+	}
+	return last
+}
+
+func countSnapshots(email string) int {
+	entries, err := os.ReadDir(getSnapshotsDir(email))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			n++
+		}
+	}
+	return n
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	users, err := listAdminUsers(r)
+	if err != nil {
+		http.Error(w, "Failed to read users", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	stats := AdminStats{GeneratedAt: now.UTC()}
+	for _, user := range users {
+		stats.Users++
+		last := lastActivity(user.Email)
+		if now.Sub(last) <= 7*24*time.Hour {
+			stats.ActiveUsers7d++
+		}
+		if now.Sub(last) <= 30*24*time.Hour {
+			stats.ActiveUsers30d++
+		}
+		stats.Snapshots += countSnapshots(user.Email)
+	}
+	// Server-wide counters would leak other tenants' activity to a tenant
+	// admin, who gets the tenant's storage and no request rates instead
+	if tenant, scoped := adminTenant(r); scoped {
+		stats.StorageBytes = tenantUsageTotals()[tenant].bytes
+	} else {
+		stats.StorageBytes, _ = metrics.storageUsage()
+		stats.SyncRequests.LastMinute, stats.SyncRequests.LastHour, stats.SyncRequests.LastDay = metrics.syncRequestCounts()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func lastSync(email string, devices map[string]*Device) *time.Time {
+	var last time.Time
+	if state, err := loadSyncState(email); err == nil {
+		last = state.UpdatedAt
+	}
+	for _, device := range devices {
+		for _, t := range []*time.Time{device.LastPushAt, device.LastPullAt} {
+			if t != nil && t.After(last) {
+				last = *t
+			}
+		}
+	}
+	if last.IsZero() {
+		return nil
+	}
+	return &last
+}
+
+func newAdminUser(user User) AdminUser {
+	devices, _ := loadDevices(user.Email)
+	return AdminUser{
+		Email:         user.Email,
+		Username:      user.Username,
+		CreatedAt:     user.CreatedAt,
+		LastSyncAt:    lastSync(user.Email, devices),
+		Devices:       len(devices),
+		StorageBytes:  userStorageBytes(user.Email),
+		Suspension:    user.Suspension,
+		TermsAccepted: user.TermsAccepted,
+		Tenant:        user.Tenant,
+		Tier:          userTier(currentConfig(), &user),
+	}
+}
+
+// handleAdminUsers pages through accounts ordered by email. q matches part
+// of the email or username, ignoring case.
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultAdminUserLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAdminUserLimit)
+	}
+	// The cursor is the last email of the previous page, opaque to clients
+	var after string
+	if v := query.Get("cursor"); v != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		after = string(decoded)
+	}
+	q := strings.ToLower(strings.TrimSpace(query.Get("q")))
+
+	users, err := listAdminUsers(r)
+	if err != nil {
+		http.Error(w, "Failed to read users", http.StatusInternalServerError)
+		return
+	}
+	matched := users[:0]
+	for _, user := range users {
+		if user.Email <= after {
+			continue
+		}
+		if q != "" && !strings.Contains(strings.ToLower(user.Email), q) && !strings.Contains(strings.ToLower(user.Username), q) {
+			continue
+		}
+		matched = append(matched, user)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Email < matched[j].Email
+	})
+
+	resp := AdminUserListResponse{Users: make([]AdminUser, 0, min(len(matched), limit))}
+	for _, user := range matched {
+		if len(resp.Users) == limit {
+			resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(resp.Users[limit-1].Email))
+			break
+		}
+		resp.Users = append(resp.Users, newAdminUser(user))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+const maxSuspensionReasonLen = 500
+
+type SuspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+// writeSuspended rejects a request from a suspended account, passing the
+// admin's reason on so the user knows why.
+func writeSuspended(w http.ResponseWriter, suspension *Suspension) {
+	msg := "Forbidden - account suspended"
+	if suspension.Reason != "" {
+		msg += ": " + suspension.Reason
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
+
+// handleSuspendUser blocks logins and all authenticated requests for an
+// account, keeping its data and token so reactivating restores access as it
+// was. Suspending again updates the reason.
+func handleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req SuspendRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.Reason) > maxSuspensionReasonLen {
+		http.Error(w, "Reason too long", http.StatusBadRequest)
+		return
+	}
+
+	if !adminTarget(w, r, r.PathValue("email")) {
+		return
+	}
+	user, ok := updateUser(w, r.PathValue("email"), func(user *User) {
+		user.Suspension = &Suspension{Reason: req.Reason, SuspendedAt: time.Now().UTC()}
+	})
+	if !ok {
+		return
+	}
+	syncHub.closeUser(user.Email)
+	log.Printf("Suspended %s", user.Email)
+	audit(r, AuditEvent{Actor: adminActor(r), Action: "user.suspend", Target: user.Email, Reason: req.Reason})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAdminUser(*user))
+}
+
+func handleReactivateUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminTarget(w, r, r.PathValue("email")) {
+		return
+	}
+	user, ok := updateUser(w, r.PathValue("email"), func(user *User) {
+		user.Suspension = nil
+	})
+	if !ok {
+		return
+	}
+	log.Printf("Reactivated %s", user.Email)
+	audit(r, AuditEvent{Actor: adminActor(r), Action: "user.reactivate", Target: user.Email})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAdminUser(*user))
+}
+
+// handleDeleteUser deletes an account and its data for good. It refuses,
+// with 409, while the account is the last owner of an org with other members.
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.PathValue("email")
+	if !adminTarget(w, r, email) {
+		return
+	}
+	var ownership *orgOwnershipError
+	if err := deleteAccount(email); err != nil {
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "User not found", http.StatusNotFound)
+		case errors.As(err, &ownership):
+			http.Error(w, "Can't delete "+email+": "+err.Error(), http.StatusConflict)
+		default:
+			log.Printf("Failed to delete %s: %v", email, err)
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Printf("Deleted %s", email)
+	audit(r, AuditEvent{Actor: adminActor(r), Action: "user.delete", Target: email})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateUser applies update to a stored account, writing the error response
+// itself when it can't.
+func updateUser(w http.ResponseWriter, email string, update func(*User)) (*User, bool) {
+	unlock := lockUserData(email + "\x00user")
+	defer unlock()
+
+	user, err := loadUser(email)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	update(user)
+	if err := saveUser(user); err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
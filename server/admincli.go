@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"kiwi/pkg/client"
+)
+
+// The admin subcommands drive a running server through its admin API with
+// the admin token from KIWI_AUTH_TOKEN. The server address comes from
+// --server or KIWI_SERVER_URL, falling back to what the config says this
+// machine listens on.
+const (
+	serverURLEnv       = "KIWI_SERVER_URL"
+	adminTimeout       = 30 * time.Second
+	backupPollInterval = time.Second
+)
+
+const adminUsage = `Usage: %s [--config path] admin <command> [flags]
+
+Commands:
+  users list [--query q] [--limit n] [--json]   list accounts
+  users suspend [--reason text] <email>         block an account
+  users reactivate <email>                      lift a suspension
+  users delete [--yes] <email>                  delete an account and its data
+  stats [--json]                                show instance-wide usage
+  backup [--timeout d]                          run the backup job and wait for it
+
+Flags for every command:
+  --server url   server to talk to (default $KIWI_SERVER_URL, then the config)
+`
+
+func runAdmin(configPath string, args []string) int {
+	usage := func() int {
+		fmt.Fprintf(os.Stderr, adminUsage, os.Args[0])
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	command := args[0]
+	if command == "users" {
+		if len(args) < 2 {
+			return usage()
+		}
+		command, args = "users "+args[1], args[1:]
+	}
+	switch command {
+	case "users list", "users suspend", "users reactivate", "users delete", "stats", "backup":
+	default:
+		return usage()
+	}
+
+	fs := flag.NewFlagSet("admin "+command, flag.ContinueOnError)
+	server := fs.String("server", os.Getenv(serverURLEnv), "server URL")
+	asJSON := fs.Bool("json", false, "print JSON")
+	query := fs.String("query", "", "only accounts whose email or username contains this")
+	limit := fs.Int("limit", 0, "stop after this many accounts")
+	reason := fs.String("reason", "", "reason shown to the user")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	timeout := fs.Duration("timeout", 30*time.Minute, "how long to wait for the backup")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	c, err := newAdminClient(configPath, *server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	switch command {
+	case "users list":
+		err = adminListUsers(c, *query, *limit, *asJSON)
+	case "users suspend", "users reactivate", "users delete":
+		if fs.NArg() != 1 {
+			return usage()
+		}
+		email := fs.Arg(0)
+		err = withAdminTimeout(func(ctx context.Context) error {
+			switch command {
+			case "users suspend":
+				if _, err := c.SuspendUser(ctx, email, *reason); err != nil {
+					return err
+				}
+				fmt.Printf("Suspended %s\n", email)
+			case "users reactivate":
+				if _, err := c.ReactivateUser(ctx, email); err != nil {
+					return err
+				}
+				fmt.Printf("Reactivated %s\n", email)
+			default:
+				if !*yes && !confirm(fmt.Sprintf("Delete %s and all of its data? This can't be undone.", email)) {
+					return errors.New("cancelled")
+				}
+				if err := c.DeleteUser(ctx, email); err != nil {
+					return err
+				}
+				fmt.Printf("Deleted %s\n", email)
+			}
+			return nil
+		})
+	case "stats":
+		err = adminStats(c, *asJSON)
+	case "backup":
+		err = adminBackup(c, *timeout)
+	}
+	if err != nil {
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) {
+			err = errors.New(apiErr.Message)
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// newAdminClient builds an API client for server, or for the address the
+// configuration listens on when server is empty.
+func newAdminClient(configPath, server string) (*client.Client, error) {
+	token := os.Getenv(authTokenEnv)
+	if token == "" {
+		return nil, fmt.Errorf("%s isn't set", authTokenEnv)
+	}
+	if server != "" {
+		return client.New(server, token), nil
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.Socket != "":
+		c := client.New("http://kiwi", token)
+		c.HTTPClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cfg.Socket)
+			},
+		}
+		return c, nil
+	case cfg.ACMEHost != "":
+		return client.New("https://"+cfg.ACMEHost, token), nil
+	case cfg.TLSCertFile != "":
+		return client.New("https://localhost:"+cfg.Port, token), nil
+	default:
+		return client.New("http://localhost:"+cfg.Port, token), nil
+	}
+}
+
+func withAdminTimeout(f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+	return f(ctx)
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func adminListUsers(c *client.Client, query string, limit int, asJSON bool) error {
+	var users []client.AdminUser
+	cursor := ""
+	for {
+		err := withAdminTimeout(func(ctx context.Context) error {
+			page, err := c.Users(ctx, query, cursor, 200)
+			if err != nil {
+				return err
+			}
+			users = append(users, page.Users...)
+			cursor = page.NextCursor
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if cursor == "" || (limit > 0 && len(users) >= limit) {
+			break
+		}
+	}
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+
+	if asJSON {
+		if users == nil {
+			users = []client.AdminUser{}
+		}
+		return printJSON(users)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tCREATED\tLAST SYNC\tDEVICES\tSTORAGE\tSTATUS")
+	for _, u := range users {
+		lastSync := "never"
+		if u.LastSyncAt != nil {
+			lastSync = u.LastSyncAt.Local().Format(time.DateTime)
+		}
+		status := "active"
+		if u.Suspension != nil {
+			status = "suspended"
+			if u.Suspension.Reason != "" {
+				status += ": " + u.Suspension.Reason
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", u.Email, u.CreatedAt.Local().Format(time.DateOnly),
+			lastSync, u.Devices, formatBytes(u.StorageBytes), status)
+	}
+	return tw.Flush()
+}
+
+func adminStats(c *client.Client, asJSON bool) error {
+	return withAdminTimeout(func(ctx context.Context) error {
+		stats, err := c.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(stats)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "Users\t%d\n", stats.Users)
+		fmt.Fprintf(tw, "Active in 7 days\t%d\n", stats.ActiveUsers7d)
+		fmt.Fprintf(tw, "Active in 30 days\t%d\n", stats.ActiveUsers30d)
+		fmt.Fprintf(tw, "Storage\t%s\n", formatBytes(stats.StorageBytes))
+		fmt.Fprintf(tw, "Snapshots\t%d\n", stats.Snapshots)
+		fmt.Fprintf(tw, "Sync requests\t%d last minute, %d last hour, %d last day\n",
+			stats.SyncRequests.LastMinute, stats.SyncRequests.LastHour, stats.SyncRequests.LastDay)
+		return tw.Flush()
+	})
+}
+
+// adminBackup triggers the backup job and waits for a run that started
+// after the trigger to finish.
+func adminBackup(c *client.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	started := time.Now()
+	if err := c.RunJob(ctx, "backup"); err != nil {
+		return err
+	}
+	fmt.Println("Backup started")
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.New("timed out waiting for the backup; it keeps running on the server")
+		case <-time.After(backupPollInterval):
+		}
+		jobs, err := c.Jobs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if job.Name != "backup" || job.Running || len(job.Runs) == 0 {
+				continue
+			}
+			// Allow for clock skew between here and the server
+			run := job.Runs[0]
+			if run.StartedAt.Before(started.Add(-time.Minute)) {
+				continue
+			}
+			if run.Error != "" {
+				return errors.New("backup failed: " + run.Error)
+			}
+			fmt.Printf("Backup finished in %s: %s\n", time.Duration(run.DurationMs)*time.Millisecond, run.Summary)
+			return nil
+		}
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// An announcement is a one-line notice from the operator, such as planned
+// maintenance, that clients show their users. There is at most one. Every
+// API response carries its ID in the Kiwi-Announcement header while it's
+// showing, so a client can tell a new announcement from one it has already
+// displayed without polling, and fetch the text from GET /announcements.
+const (
+	announcementHeader     = "Kiwi-Announcement"
+	maxAnnouncementMessage = 500
+)
+
+var announcementLevels = map[string]bool{"info": true, "warning": true}
+
+type Announcement struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	// Level is "info" or "warning"; clients may highlight warnings
+	Level     string     `json:"level"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type AnnouncementRequest struct {
+	Message   string     `json:"message"`
+	Level     string     `json:"level,omitempty"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// currentAnnouncement mirrors the file so the header costs nothing per
+// request.
+var currentAnnouncement atomic.Pointer[Announcement]
+
+func getAnnouncementPath() string {
+	return filepath.Join(currentConfig().StorageRoot, "announcement.json")
+}
+
+// loadAnnouncement reads the saved announcement at startup.
+func loadAnnouncement() {
+	data, err := os.ReadFile(getAnnouncementPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read announcement: %v", err)
+		}
+		return
+	}
+	var announcement Announcement
+	if err := json.Unmarshal(data, &announcement); err != nil {
+		log.Printf("Failed to read announcement: %v", err)
+		return
+	}
+	currentAnnouncement.Store(&announcement)
+}
+
+// activeAnnouncement returns the announcement if it's inside its window.
+func activeAnnouncement() *Announcement {
+	announcement := currentAnnouncement.Load()
+	if announcement == nil {
+		return nil
+	}
+	now := time.Now()
+	if announcement.StartsAt != nil && now.Before(*announcement.StartsAt) {
+		return nil
+	}
+	if announcement.ExpiresAt != nil && expired(*announcement.ExpiresAt) {
+		return nil
+	}
+	return announcement
+}
+
+// withAnnouncement adds the Kiwi-Announcement header to every response.
+func withAnnouncement(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if announcement := activeAnnouncement(); announcement != nil {
+			w.Header().Set(announcementHeader, announcement.ID)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAnnouncements lists what clients should show right now. It needs no
+// token, so the CLI can check before it signs in.
+func handleAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	announcements := []*Announcement{}
+	if announcement := activeAnnouncement(); announcement != nil {
+		announcements = append(announcements, announcement)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(announcements)
+}
+
+// handleAdminAnnouncement shows (GET), sets (PUT) or clears (DELETE) the
+// announcement. GET returns it even outside its window.
+func handleAdminAnnouncement(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		announcement := currentAnnouncement.Load()
+		if announcement == nil {
+			http.Error(w, "No announcement", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(announcement)
+	case http.MethodPut:
+		setAnnouncement(w, r)
+	case http.MethodDelete:
+		if err := os.Remove(getAnnouncementPath()); err != nil && !os.IsNotExist(err) {
+			http.Error(w, "Failed to clear announcement", http.StatusInternalServerError)
+			return
+		}
+		currentAnnouncement.Store(nil)
+		audit(r, AuditEvent{Actor: "admin", Action: "announcement.clear"})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func setAnnouncement(w http.ResponseWriter, r *http.Request) {
+	var req AnnouncementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Level == "" {
+		req.Level = "info"
+	}
+	switch {
+	case req.Message == "":
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	case len(req.Message) > maxAnnouncementMessage:
+		http.Error(w, "Message too long", http.StatusBadRequest)
+		return
+	case !announcementLevels[req.Level]:
+		http.Error(w, "Level must be info or warning", http.StatusBadRequest)
+		return
+	case req.StartsAt != nil && req.ExpiresAt != nil && !req.ExpiresAt.After(*req.StartsAt):
+		http.Error(w, "expires_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+
+	id, err := generateID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	announcement := &Announcement{
+		ID:        id,
+		Message:   req.Message,
+		Level:     req.Level,
+		StartsAt:  req.StartsAt,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := json.MarshalIndent(announcement, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(getAnnouncementPath(), data, 0644)
+	}
+	if err != nil {
+		http.Error(w, "Failed to save announcement", http.StatusInternalServerError)
+		return
+	}
+	currentAnnouncement.Store(announcement)
+	audit(r, AuditEvent{Actor: "admin", Action: "announcement.set", Target: announcement.ID, Detail: announcement.Message})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(announcement)
+}
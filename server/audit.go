@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The audit log records privileged actions taken on users' accounts, one
+// JSON object per line in audit.jsonl under the storage root. It's never
+// rotated by the server; it's small and meant to be kept.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+func getAuditLogPath() string {
+	return filepath.Join(currentConfig().StorageRoot, "audit.jsonl")
+}
+
+// audit appends an event, filling in the time and, given a request, the
+// client address. Failures are logged; they don't fail the action.
+func audit(r *http.Request, event AuditEvent) {
+	event.Time = time.Now().UTC()
+	if r != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		event.RemoteAddr = host
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(getAuditLogPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write audit event %s for %s: %v", event.Action, event.Target, err)
+	}
+}
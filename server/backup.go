@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are gzipped tarballs of the storage directories, written to
+// backup.dir by the backup job. Files are copied one at a time without
+// stopping writes; each file is consistent because writes replace files
+// atomically, but a backup taken mid-push can mix revisions of one account.
+const backupPrefix = "kiwi-backup-"
+
+func runBackup(ctx context.Context) (string, error) {
+	cfg := currentConfig()
+	if cfg.BackupDir == "" {
+		return "", fmt.Errorf("backup.dir isn't set")
+	}
+	if err := os.MkdirAll(cfg.BackupDir, 0700); err != nil {
+		return "", err
+	}
+
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	path := filepath.Join(cfg.BackupDir, name)
+	tmp, err := os.CreateTemp(cfg.BackupDir, ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := writeBackup(ctx, tmp, cfg.StorageRoot)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	removed := pruneBackups(cfg.BackupDir, cfg.BackupKeep)
+	return fmt.Sprintf("wrote %s (%d bytes), removed %d old backups", name, size, removed), nil
+}
+
+func writeBackup(ctx context.Context, w io.Writer, root string) (int64, error) {
+	counter := &countingWriter{w: w}
+	gz := gzip.NewWriter(counter)
+	tw := tar.NewWriter(gz)
+
+	for _, dir := range []string{usersDir, dataDir, sharesDir, usernamesDir, orgsDir} {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Entries can vanish while we walk
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Skip anything that isn't a plain file, and half-written files
+			// from writeFileAtomic
+			if !d.IsDir() && (!d.Type().IsRegular() || strings.Contains(d.Name(), ".tmp-")) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if d.IsDir() {
+				header.Name += "/"
+				return tw.WriteHeader(header)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			defer f.Close()
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err = io.CopyN(tw, f, header.Size)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// pruneBackups keeps the newest keep backups. The timestamped names sort in
+// creation order.
+func pruneBackups(dir string, keep int) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), backupPrefix) && strings.HasSuffix(entry.Name(), ".tar.gz") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	removed := 0
+	for len(names) > keep {
+		if os.Remove(filepath.Join(dir, names[0])) == nil {
+			removed++
+		}
+		names = names[1:]
+	}
+	return removed
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Clients decide whether a share link, upload or transaction is still usable
+// from its expires_at and their own clock, and laptops often wake up with
+// clocks minutes off. Expiry is therefore enforced with a grace period of
+// maxClockSkew. Sync ordering never depends on wall clocks: it uses server
+// revisions and version vectors.
+const maxClockSkew = 5 * time.Minute
+
+type TimeResponse struct {
+	Time         time.Time `json:"time"`
+	MaxClockSkew int64     `json:"max_clock_skew"`
+}
+
+// expired reports whether expiresAt has passed even allowing for a client
+// clock that runs up to maxClockSkew slow.
+func expired(expiresAt time.Time) bool {
+	return time.Now().After(expiresAt.Add(maxClockSkew))
+}
+
+// handleTime returns the server clock so clients can estimate their offset
+// and correct timestamps before comparing them with the server's.
+func handleTime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TimeResponse{
+		Time:         time.Now().UTC(),
+		MaxClockSkew: int64(maxClockSkew / time.Second),
+	})
+}
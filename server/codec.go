@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sync endpoints speak JSON internally. codecMiddleware lets clients send
+// and receive MessagePack or CBOR instead by transcoding at the edge, so the
+// binary formats follow the same field names and semantics as the JSON API.
+const (
+	mediaJSON    = "application/json"
+	mediaMsgpack = "application/msgpack"
+	mediaCBOR    = "application/cbor"
+
+	maxCodecBodySize = 64 << 20
+	maxCodecDepth    = 256
+)
+
+var errCodecInvalid = errors.New("invalid encoding")
+
+// codecFor maps a media type to the binary format it names, or "" for JSON
+// and anything unrecognised.
+func codecFor(mediaType string) string {
+	switch strings.ToLower(mediaType) {
+	case mediaMsgpack, "application/x-msgpack", "application/vnd.msgpack":
+		return mediaMsgpack
+	case mediaCBOR:
+		return mediaCBOR
+	}
+	return ""
+}
+
+// negotiateCodec picks the response format from the Accept header. JSON wins
+// ties, and an explicit q=0 rules a format out.
+func negotiateCodec(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		codec := codecFor(mediaType)
+		if q <= 0 {
+			continue
+		}
+		if codec == "" && (mediaType == mediaJSON || mediaType == "*/*" || mediaType == "application/*") {
+			if q >= bestQ {
+				best, bestQ = "", q
+			}
+			continue
+		}
+		if codec != "" && q > bestQ {
+			best, bestQ = codec, q
+		}
+	}
+	return best
+}
+
+// codecResponseWriter buffers a handler's response so a JSON body can be
+// re-encoded once it's complete.
+type codecResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (c *codecResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *codecResponseWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.buf.Write(b)
+}
+
+func codecMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if codec := codecFor(mediaType); codec != "" {
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxCodecBodySize+1))
+			if err != nil {
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+			if len(data) > maxCodecBodySize {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			body, err := transcodeToJSON(codec, data)
+			if err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Set("Content-Type", mediaJSON)
+		}
+
+		w.Header().Add("Vary", "Accept")
+		codec := negotiateCodec(r.Header.Get("Accept"))
+		if codec == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &codecResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		body := cw.buf.Bytes()
+		if strings.HasPrefix(w.Header().Get("Content-Type"), mediaJSON) && len(body) > 0 {
+			if encoded, err := transcodeFromJSON(codec, body); err == nil {
+				body = encoded
+				w.Header().Set("Content-Type", codec)
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(cw.status)
+		w.Write(body)
+	}
+}
+
+func transcodeToJSON(codec string, data []byte) ([]byte, error) {
+	d := &binaryDecoder{data: data}
+	var v interface{}
+	var err error
+	if codec == mediaCBOR {
+		v, err = d.cbor(0)
+	} else {
+		v, err = d.msgpack(0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) || v == cborBreak {
+		return nil, errCodecInvalid
+	}
+	return json.Marshal(v)
+}
+
+func transcodeFromJSON(codec string, data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if codec == mediaCBOR {
+		encodeCBOR(&buf, v)
+	} else {
+		encodeMsgpack(&buf, v)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeMsgpack writes a value decoded from JSON. Map keys are sorted so the
+// output is deterministic.
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			encodeMsgpackInt(buf, n)
+			return
+		}
+		f, _ := v.Float64()
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, f)
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		encodeMsgpackLen(buf, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			encodeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		encodeMsgpackLen(buf, len(v), 0x80, 0xde)
+		for _, key := range sortedKeys(v) {
+			encodeMsgpack(buf, key)
+			encodeMsgpack(buf, v[key])
+		}
+	}
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		buf.WriteByte(byte(n))
+	case n >= -32 && n < 0:
+		buf.WriteByte(byte(n))
+	case n >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// encodeMsgpackLen writes an array or map header; array16 and map16 follow
+// their 32-bit forms by one byte.
+func encodeMsgpackLen(buf *bytes.Buffer, n int, fix, len16 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(len16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(len16 + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeCBOR(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			if n >= 0 {
+				encodeCBORHead(buf, 0, uint64(n))
+			} else {
+				encodeCBORHead(buf, 1, uint64(-(n + 1)))
+			}
+			return
+		}
+		f, _ := v.Float64()
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, f)
+	case string:
+		encodeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		encodeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			encodeCBOR(buf, item)
+		}
+	case map[string]interface{}:
+		encodeCBORHead(buf, 5, uint64(len(v)))
+		for _, key := range sortedKeys(v) {
+			encodeCBOR(buf, key)
+			encodeCBOR(buf, v[key])
+		}
+	}
+}
+
+func encodeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{major | 24, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// binaryDecoder reads MessagePack or CBOR into the values encoding/json
+// produces. Byte strings decode as strings, since file contents travel as
+// strings in the JSON API.
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *binaryDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCodecInvalid
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *binaryDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// count checks a collection length against the bytes left, each element
+// taking at least one byte, before anything is allocated for it.
+func (d *binaryDecoder) count(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errCodecInvalid
+	}
+	return int(n), nil
+}
+
+func (d *binaryDecoder) msgpack(depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecInvalid
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.msgpackMap(uint64(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.msgpackArray(uint64(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.msgpackString(uint64(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[c]
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackString(n)
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return float64(n), nil
+		}
+		return int64(n), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackMap(n, depth)
+	}
+	// Extension types have no JSON equivalent
+	return nil, errCodecInvalid
+}
+
+func (d *binaryDecoder) msgpackString(n uint64) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *binaryDecoder) msgpackArray(n uint64, depth int) (interface{}, error) {
+	count, err := d.count(n)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]interface{}, count)
+	for i := range items {
+		if items[i], err = d.msgpack(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (d *binaryDecoder) msgpackMap(n uint64, depth int) (interface{}, error) {
+	count, err := d.count(n)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, count)
+	for i := 0; i < count; i++ {
+		key, err := d.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, errCodecInvalid
+		}
+		if m[k], err = d.msgpack(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// cborBreak marks the end of an indefinite-length CBOR item.
+var cborBreak = &struct{}{}
+
+func (d *binaryDecoder) cbor(depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecInvalid
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			n, err := d.uint(2)
+			return float16ToFloat64(uint16(n)), err
+		case 26:
+			n, err := d.uint(4)
+			return float64(math.Float32frombits(uint32(n))), err
+		case 27:
+			n, err := d.uint(8)
+			return math.Float64frombits(n), err
+		case 31:
+			return cborBreak, nil
+		}
+		return nil, errCodecInvalid
+	}
+
+	indefinite := info == 31
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		if n, err = d.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	case indefinite && major >= 2 && major <= 5:
+	default:
+		return nil, errCodecInvalid
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return float64(n), nil
+		}
+		return int64(n), nil
+	case 1:
+		if n > math.MaxInt64 {
+			return -float64(n) - 1, nil
+		}
+		return -int64(n) - 1, nil
+	case 2, 3:
+		if !indefinite {
+			s, err := d.next(n)
+			return string(s), err
+		}
+		// Indefinite strings are a series of definite chunks
+		var sb strings.Builder
+		for {
+			chunk, err := d.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if chunk == cborBreak {
+				return sb.String(), nil
+			}
+			s, ok := chunk.(string)
+			if !ok {
+				return nil, errCodecInvalid
+			}
+			sb.WriteString(s)
+		}
+	case 4:
+		items := make([]interface{}, 0)
+		if !indefinite {
+			count, err := d.count(n)
+			if err != nil {
+				return nil, err
+			}
+			items = make([]interface{}, 0, count)
+		}
+		for i := uint64(0); indefinite || i < n; i++ {
+			item, err := d.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if item == cborBreak {
+				if !indefinite {
+					return nil, errCodecInvalid
+				}
+				break
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		m := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < n; i++ {
+			key, err := d.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if key == cborBreak && indefinite {
+				break
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, errCodecInvalid
+			}
+			value, err := d.cbor(depth + 1)
+			if err != nil || value == cborBreak {
+				return nil, errCodecInvalid
+			}
+			m[k] = value
+		}
+		return m, nil
+	case 6:
+		// Tags only annotate the item that follows
+		item, err := d.cbor(depth + 1)
+		if err == nil && item == cborBreak {
+			return nil, errCodecInvalid
+		}
+		return item, err
+	}
+	return nil, errCodecInvalid
+}
+
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
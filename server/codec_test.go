@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranscodeRoundTrip(t *testing.T) {
+	docs := []string{
+		`null`,
+		`true`,
+		`0`,
+		`-1`,
+		`-33`,
+		`127`,
+		`128`,
+		`9223372036854775807`,
+		`-9223372036854775808`,
+		`1.5`,
+		`""`,
+		`"` + strings.Repeat("a", 31) + `"`,
+		`"` + strings.Repeat("b", 300) + `"`,
+		`"` + strings.Repeat("c", 70000) + `"`,
+		`[]`,
+		`[1,"two",null,[false]]`,
+		`{}`,
+		`{"files":{".bashrc":"export PATH"},"packages":["git","jq"],"revision":42}`,
+	}
+	for _, codec := range []string{mediaMsgpack, mediaCBOR} {
+		for _, doc := range docs {
+			encoded, err := transcodeFromJSON(codec, []byte(doc))
+			if err != nil {
+				t.Fatalf("%s: encode %.40s: %v", codec, doc, err)
+			}
+			decoded, err := transcodeToJSON(codec, encoded)
+			if err != nil {
+				t.Fatalf("%s: decode %.40s: %v", codec, doc, err)
+			}
+			if !jsonEqual(t, decoded, []byte(doc)) {
+				t.Errorf("%s: round trip of %.40s gave %.40s", codec, doc, decoded)
+			}
+		}
+	}
+}
+
+func TestTranscodeLargeCollections(t *testing.T) {
+	items := make([]interface{}, 70000)
+	m := make(map[string]interface{}, 20)
+	for i := range items {
+		items[i] = i
+	}
+	for i := 0; i < 20; i++ {
+		m[strings.Repeat("k", i+1)] = i
+	}
+	doc, _ := json.Marshal(map[string]interface{}{"items": items, "m": m})
+	for _, codec := range []string{mediaMsgpack, mediaCBOR} {
+		encoded, err := transcodeFromJSON(codec, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := transcodeToJSON(codec, encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if !jsonEqual(t, decoded, doc) {
+			t.Errorf("%s: large collections didn't round trip", codec)
+		}
+	}
+}
+
+func TestTranscodeToJSONDecodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec string
+		in    []byte
+		want  string
+	}{
+		{"msgpack negative fixint", mediaMsgpack, []byte{0xff}, `-1`},
+		{"msgpack int8", mediaMsgpack, []byte{0xd0, 0x80}, `-128`},
+		{"msgpack int16", mediaMsgpack, []byte{0xd1, 0xff, 0x00}, `-256`},
+		{"msgpack uint64 over int64", mediaMsgpack, []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `18446744073709552000`},
+		{"msgpack float32", mediaMsgpack, []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, `1.5`},
+		{"msgpack bin as string", mediaMsgpack, []byte{0xc4, 0x02, 'h', 'i'}, `"hi"`},
+		{"msgpack map16", mediaMsgpack, []byte{0xde, 0x00, 0x01, 0xa1, 'a', 0x01}, `{"a":1}`},
+		{"cbor negative", mediaCBOR, []byte{0x38, 0x63}, `-100`},
+		{"cbor float16", mediaCBOR, []byte{0xf9, 0x3e, 0x00}, `1.5`},
+		{"cbor byte string", mediaCBOR, []byte{0x42, 'h', 'i'}, `"hi"`},
+		{"cbor indefinite string", mediaCBOR, []byte{0x7f, 0x61, 'h', 0x61, 'i', 0xff}, `"hi"`},
+		{"cbor indefinite array", mediaCBOR, []byte{0x9f, 0x01, 0x02, 0xff}, `[1,2]`},
+		{"cbor indefinite map", mediaCBOR, []byte{0xbf, 0x61, 'a', 0x01, 0xff}, `{"a":1}`},
+		{"cbor tagged", mediaCBOR, []byte{0xc1, 0x1a, 0x00, 0x00, 0x00, 0x01}, `1`},
+		{"cbor undefined", mediaCBOR, []byte{0xf7}, `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transcodeToJSON(tt.codec, tt.in)
+			if err != nil {
+				t.Fatalf("transcodeToJSON: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("transcodeToJSON = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranscodeToJSONRejects(t *testing.T) {
+	deep := func(b byte) []byte { return append(bytes.Repeat([]byte{b}, maxCodecDepth+2), 0x00) }
+	tests := []struct {
+		name  string
+		codec string
+		in    []byte
+	}{
+		{"msgpack empty", mediaMsgpack, nil},
+		{"msgpack truncated str", mediaMsgpack, []byte{0xa5, 'a', 'b'}},
+		{"msgpack truncated str32 length", mediaMsgpack, []byte{0xdb, 0x00, 0x00}},
+		{"msgpack huge str32", mediaMsgpack, []byte{0xdb, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack huge array32", mediaMsgpack, []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"msgpack huge map32", mediaMsgpack, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{"msgpack truncated array", mediaMsgpack, []byte{0x93, 0x01, 0x02}},
+		{"msgpack truncated float64", mediaMsgpack, []byte{0xcb, 0x00, 0x00}},
+		{"msgpack non-string key", mediaMsgpack, []byte{0x81, 0x01, 0x01}},
+		{"msgpack ext", mediaMsgpack, []byte{0xd4, 0x01, 0x00}},
+		{"msgpack unused 0xc1", mediaMsgpack, []byte{0xc1}},
+		{"msgpack trailing bytes", mediaMsgpack, []byte{0x01, 0x02}},
+		{"msgpack too deep", mediaMsgpack, deep(0x91)},
+		{"cbor empty", mediaCBOR, nil},
+		{"cbor truncated uint", mediaCBOR, []byte{0x1b, 0x00, 0x00}},
+		{"cbor huge string", mediaCBOR, []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor huge array", mediaCBOR, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor huge map", mediaCBOR, []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor reserved info", mediaCBOR, []byte{0x1c}},
+		{"cbor indefinite int", mediaCBOR, []byte{0x1f}},
+		{"cbor simple value", mediaCBOR, []byte{0xf0}},
+		{"cbor unterminated array", mediaCBOR, []byte{0x9f, 0x01}},
+		{"cbor break in definite array", mediaCBOR, []byte{0x82, 0x01, 0xff}},
+		{"cbor break as map value", mediaCBOR, []byte{0xbf, 0x61, 'a', 0xff}},
+		{"cbor bare break", mediaCBOR, []byte{0xff}},
+		{"cbor tagged break", mediaCBOR, []byte{0x9f, 0xc1, 0xff}},
+		{"cbor non-string chunk", mediaCBOR, []byte{0x7f, 0x01, 0xff}},
+		{"cbor non-string key", mediaCBOR, []byte{0xa1, 0x01, 0x01}},
+		{"cbor trailing bytes", mediaCBOR, []byte{0x01, 0x01}},
+		{"cbor too deep", mediaCBOR, deep(0x81)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transcodeToJSON(tt.codec, tt.in)
+			if err == nil {
+				t.Errorf("transcodeToJSON = %s, want error", got)
+			} else if !errors.Is(err, errCodecInvalid) {
+				t.Errorf("transcodeToJSON error = %v, want errCodecInvalid", err)
+			}
+		})
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"application/json", ""},
+		{"application/msgpack", mediaMsgpack},
+		{"application/x-msgpack", mediaMsgpack},
+		{"application/cbor", mediaCBOR},
+		{"application/json, application/cbor", ""},
+		{"application/json;q=0.5, application/cbor", mediaCBOR},
+		{"application/cbor;q=0, application/msgpack;q=0.1", mediaMsgpack},
+		{"*/*", ""},
+		{"text/html", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateCodec(tt.header); got != tt.want {
+			t.Errorf("negotiateCodec(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCodecMiddleware(t *testing.T) {
+	handler := codecMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", mediaJSON)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(body)
+	})
+
+	in, _ := transcodeFromJSON(mediaMsgpack, []byte(`{"path":".vimrc"}`))
+	req := httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(in))
+	req.Header.Set("Content-Type", mediaMsgpack)
+	req.Header.Set("Accept", mediaCBOR)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != mediaCBOR {
+		t.Fatalf("Content-Type = %q, want %q", ct, mediaCBOR)
+	}
+	out, err := transcodeToJSON(mediaCBOR, rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"path":".vimrc"}` {
+		t.Errorf("response = %s", out)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader([]byte{0xc1}))
+	req.Header.Set("Content-Type", mediaMsgpack)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestFloat16(t *testing.T) {
+	tests := []struct {
+		h    uint16
+		want float64
+	}{
+		{0x0000, 0},
+		{0x3c00, 1},
+		{0xc000, -2},
+		{0x7bff, 65504},
+		{0x0001, 5.960464477539063e-08},
+	}
+	for _, tt := range tests {
+		if got := float16ToFloat64(tt.h); got != tt.want {
+			t.Errorf("float16ToFloat64(%#04x) = %v, want %v", tt.h, got, tt.want)
+		}
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("invalid JSON %.40s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("invalid JSON %.40s: %v", b, err)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/time/rate"
+)
+
+// The server reads an optional TOML file, /etc/kiwi/server.toml unless
+// --config names another, and then lets environment variables override
+// individual settings. Settings are string, integer, float or boolean values
+// in [tables]; arrays and dates aren't used.
+//
+// The admin token stays in KIWI_AUTH_TOKEN only.
+//
+// SIGHUP reloads the file. Rate limits, tiers, abuse thresholds, retention,
+// IP lists, maintenance mode and job schedules apply immediately; the listener, TLS, storage and
+// log settings need a restart.
+const defaultConfigPath = "/etc/kiwi/server.toml"
+
+type Config struct {
+	Port   string
+	Socket string
+
+	TLSCertFile   string
+	TLSKeyFile    string
+	ACMEHost      string
+	ACMEEmail     string
+	ACMEDirectory string
+
+	StorageBackend string
+	StorageRoot    string
+
+	RateLimit float64
+	RateBurst int
+
+	SnapshotRetention int
+	IdempotencyTTL    time.Duration
+
+	TimeoutAuth     time.Duration
+	TimeoutDefault  time.Duration
+	TimeoutSync     time.Duration
+	TimeoutTransfer time.Duration
+
+	// Job intervals; zero disables the job
+	JobJitter              time.Duration
+	SnapshotGCInterval     time.Duration
+	SessionCleanupInterval time.Duration
+	MetricsRollupInterval  time.Duration
+	BackupInterval         time.Duration
+	MeteringInterval       time.Duration
+	BackupDir              string
+	BackupKeep             int
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	LogFile        string
+	LogMaxSizeMB   int
+	LogRotateEvery time.Duration
+	LogMaxBackups  int
+	LogMaxAge      time.Duration
+
+	AccessLog       string
+	AccessLogFormat string
+
+	SentryDSN    string
+	ErrorWebhook string
+
+	MeteringWebhook string
+	MeteringSecret  string
+	MeteringFile    string
+
+	TermsVersion string
+	TermsURL     string
+
+	InviteOnly bool
+
+	TrialEnabled bool
+	TrialDays    int
+	TrialMaxMB   int
+
+	// Tiers holds the limits of each account tier; see tiers.go
+	Tiers       map[string]TierLimits
+	DefaultTier string
+
+	// Abuse thresholds count events per address; see abuse.go
+	AbuseEnabled       bool
+	AbuseRegistrations int
+	AbuseAuthFailures  int
+	AbuseOversized     int
+	AbuseMaxRequestMB  int
+	AbuseBlockFor      time.Duration
+
+	Maintenance bool
+	Dashboard   bool
+	Tenants     bool
+	AllowIPs    []netip.Prefix
+	DenyIPs     []netip.Prefix
+}
+
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// currentConfig returns the running configuration. Callers must treat it as
+// read-only; a reload swaps in a new value.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:              "8080",
+		StorageBackend:    "filesystem",
+		StorageRoot:       "/opt/kiwi",
+		RateLimit:         1,
+		RateBurst:         10,
+		SnapshotRetention: 100,
+		IdempotencyTTL:    24 * time.Hour,
+
+		TimeoutAuth:     5 * time.Second,
+		TimeoutDefault:  15 * time.Second,
+		TimeoutSync:     time.Minute,
+		TimeoutTransfer: 10 * time.Minute,
+
+		JobJitter:              5 * time.Minute,
+		SnapshotGCInterval:     24 * time.Hour,
+		SessionCleanupInterval: time.Hour,
+		MetricsRollupInterval:  time.Hour,
+		BackupInterval:         24 * time.Hour,
+		MeteringInterval:       time.Hour,
+		BackupKeep:             7,
+
+		LogMaxSizeMB:  100,
+		LogMaxBackups: 7,
+
+		TrialDays:  7,
+		TrialMaxMB: 10,
+
+		Tiers:       defaultTiers(),
+		DefaultTier: tierUnlimited,
+
+		AbuseEnabled:       true,
+		AbuseRegistrations: 10,
+		AbuseAuthFailures:  30,
+		AbuseOversized:     5,
+		AbuseMaxRequestMB:  128,
+		AbuseBlockFor:      time.Hour,
+
+		SMTPPort:      587,
+		Dashboard:     true,
+		ACMEDirectory: acme.LetsEncryptURL,
+	}
+}
+
+type configField struct {
+	key string
+	env string
+	set func(c *Config, v string) error
+}
+
+func setString(dst func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		*dst(c) = v
+		return nil
+	}
+}
+
+// setIPList parses a comma-separated list of addresses and CIDR prefixes.
+func setIPList(dst func(c *Config) *[]netip.Prefix) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		var prefixes []netip.Prefix
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if addr, err := netip.ParseAddr(item); err == nil {
+				prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return fmt.Errorf("invalid address or prefix %q", item)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		*dst(c) = prefixes
+		return nil
+	}
+}
+
+func setPositiveDuration(dst func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("expected a positive duration such as \"30s\", got %q", v)
+		}
+		*dst(c) = d
+		return nil
+	}
+}
+
+// setInterval parses a job interval, where "off" or "0" disables the job.
+func setInterval(dst func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		if v == "off" || v == "0" {
+			*dst(c) = 0
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return fmt.Errorf("expected \"off\" or a duration of at least a minute, got %q", v)
+		}
+		*dst(c) = d
+		return nil
+	}
+}
+
+func setPositiveInt(dst func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("expected a positive integer, got %q", v)
+		}
+		*dst(c) = n
+		return nil
+	}
+}
+
+var configFields = []configField{
+	{"server.port", "PORT", setString(func(c *Config) *string { return &c.Port })},
+	{"server.socket", "KIWI_SOCKET", setString(func(c *Config) *string { return &c.Socket })},
+	{"tls.cert_file", "KIWI_TLS_CERT_FILE", setString(func(c *Config) *string { return &c.TLSCertFile })},
+	{"tls.key_file", "KIWI_TLS_KEY_FILE", setString(func(c *Config) *string { return &c.TLSKeyFile })},
+	{"tls.acme_host", "KIWI_ACME_HOST", setString(func(c *Config) *string { return &c.ACMEHost })},
+	{"tls.acme_email", "KIWI_ACME_EMAIL", setString(func(c *Config) *string { return &c.ACMEEmail })},
+	{"tls.acme_directory", "KIWI_ACME_DIRECTORY", setString(func(c *Config) *string { return &c.ACMEDirectory })},
+	{"storage.backend", "KIWI_STORAGE_BACKEND", func(c *Config, v string) error {
+		if v != "filesystem" {
+			return fmt.Errorf("unsupported backend %q", v)
+		}
+		c.StorageBackend = v
+		return nil
+	}},
+	{"storage.root", "KIWI_STORAGE_ROOT", func(c *Config, v string) error {
+		if !filepath.IsAbs(v) {
+			return fmt.Errorf("must be an absolute path, got %q", v)
+		}
+		c.StorageRoot = filepath.Clean(v)
+		return nil
+	}},
+	{"rate_limit.requests_per_second", "KIWI_RATE_LIMIT", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return fmt.Errorf("expected a positive number, got %q", v)
+		}
+		c.RateLimit = f
+		return nil
+	}},
+	{"rate_limit.burst", "KIWI_RATE_BURST", setPositiveInt(func(c *Config) *int { return &c.RateBurst })},
+	{"retention.snapshots", "KIWI_SNAPSHOT_RETENTION", setPositiveInt(func(c *Config) *int { return &c.SnapshotRetention })},
+	{"retention.idempotency_ttl", "KIWI_IDEMPOTENCY_TTL", setPositiveDuration(func(c *Config) *time.Duration { return &c.IdempotencyTTL })},
+	{"timeouts.auth", "KIWI_TIMEOUT_AUTH", setPositiveDuration(func(c *Config) *time.Duration { return &c.TimeoutAuth })},
+	{"timeouts.default", "KIWI_TIMEOUT_DEFAULT", setPositiveDuration(func(c *Config) *time.Duration { return &c.TimeoutDefault })},
+	{"timeouts.sync", "KIWI_TIMEOUT_SYNC", setPositiveDuration(func(c *Config) *time.Duration { return &c.TimeoutSync })},
+	{"timeouts.transfer", "KIWI_TIMEOUT_TRANSFER", setPositiveDuration(func(c *Config) *time.Duration { return &c.TimeoutTransfer })},
+	{"jobs.jitter", "KIWI_JOB_JITTER", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("expected a duration such as \"5m\", got %q", v)
+		}
+		c.JobJitter = d
+		return nil
+	}},
+	{"jobs.snapshot_gc", "KIWI_JOB_SNAPSHOT_GC", setInterval(func(c *Config) *time.Duration { return &c.SnapshotGCInterval })},
+	{"jobs.session_cleanup", "KIWI_JOB_SESSION_CLEANUP", setInterval(func(c *Config) *time.Duration { return &c.SessionCleanupInterval })},
+	{"jobs.metrics_rollup", "KIWI_JOB_METRICS_ROLLUP", setInterval(func(c *Config) *time.Duration { return &c.MetricsRollupInterval })},
+	{"jobs.backup", "KIWI_JOB_BACKUP", setInterval(func(c *Config) *time.Duration { return &c.BackupInterval })},
+	{"jobs.metering", "KIWI_JOB_METERING", setInterval(func(c *Config) *time.Duration { return &c.MeteringInterval })},
+	{"backup.dir", "KIWI_BACKUP_DIR", setString(func(c *Config) *string { return &c.BackupDir })},
+	{"backup.keep", "KIWI_BACKUP_KEEP", setPositiveInt(func(c *Config) *int { return &c.BackupKeep })},
+	{"smtp.host", "KIWI_SMTP_HOST", setString(func(c *Config) *string { return &c.SMTPHost })},
+	{"smtp.port", "KIWI_SMTP_PORT", setPositiveInt(func(c *Config) *int { return &c.SMTPPort })},
+	{"smtp.username", "KIWI_SMTP_USERNAME", setString(func(c *Config) *string { return &c.SMTPUsername })},
+	{"smtp.password", "KIWI_SMTP_PASSWORD", setString(func(c *Config) *string { return &c.SMTPPassword })},
+	{"smtp.from", "KIWI_SMTP_FROM", setString(func(c *Config) *string { return &c.SMTPFrom })},
+	{"log.file", "KIWI_LOG_FILE", setString(func(c *Config) *string { return &c.LogFile })},
+	{"log.max_size_mb", "KIWI_LOG_MAX_SIZE_MB", setPositiveInt(func(c *Config) *int { return &c.LogMaxSizeMB })},
+	{"log.rotate_every", "KIWI_LOG_ROTATE_EVERY", setInterval(func(c *Config) *time.Duration { return &c.LogRotateEvery })},
+	{"log.max_backups", "KIWI_LOG_MAX_BACKUPS", setPositiveInt(func(c *Config) *int { return &c.LogMaxBackups })},
+	{"log.max_age", "KIWI_LOG_MAX_AGE", setInterval(func(c *Config) *time.Duration { return &c.LogMaxAge })},
+	{"log.access", accessLogEnv, setString(func(c *Config) *string { return &c.AccessLog })},
+	{"log.access_format", accessLogFormatEnv, setString(func(c *Config) *string { return &c.AccessLogFormat })},
+	{"errors.sentry_dsn", sentryDSNEnv, setString(func(c *Config) *string { return &c.SentryDSN })},
+	{"errors.webhook", errorWebhookEnv, setString(func(c *Config) *string { return &c.ErrorWebhook })},
+	{"metering.webhook", "KIWI_METERING_WEBHOOK", setString(func(c *Config) *string { return &c.MeteringWebhook })},
+	{"metering.secret", "KIWI_METERING_SECRET", setString(func(c *Config) *string { return &c.MeteringSecret })},
+	{"metering.file", "KIWI_METERING_FILE", setString(func(c *Config) *string { return &c.MeteringFile })},
+	{"terms.version", "KIWI_TERMS_VERSION", setString(func(c *Config) *string { return &c.TermsVersion })},
+	{"terms.url", "KIWI_TERMS_URL", setString(func(c *Config) *string { return &c.TermsURL })},
+	{"registration.invite_only", "KIWI_INVITE_ONLY", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		c.InviteOnly = b
+		return nil
+	}},
+	{"trial.enabled", "KIWI_TRIAL", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		c.TrialEnabled = b
+		return nil
+	}},
+	{"trial.days", "KIWI_TRIAL_DAYS", setPositiveInt(func(c *Config) *int { return &c.TrialDays })},
+	{"trial.max_mb", "KIWI_TRIAL_MAX_MB", setPositiveInt(func(c *Config) *int { return &c.TrialMaxMB })},
+	{"abuse.enabled", "KIWI_ABUSE", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		c.AbuseEnabled = b
+		return nil
+	}},
+	{"abuse.registrations_per_hour", "KIWI_ABUSE_REGISTRATIONS", setPositiveInt(func(c *Config) *int { return &c.AbuseRegistrations })},
+	{"abuse.auth_failures_per_10m", "KIWI_ABUSE_AUTH_FAILURES", setPositiveInt(func(c *Config) *int { return &c.AbuseAuthFailures })},
+	{"abuse.oversized_requests_per_hour", "KIWI_ABUSE_OVERSIZED", setPositiveInt(func(c *Config) *int { return &c.AbuseOversized })},
+	{"abuse.max_request_mb", "KIWI_ABUSE_MAX_REQUEST_MB", setPositiveInt(func(c *Config) *int { return &c.AbuseMaxRequestMB })},
+	{"abuse.block_for", "KIWI_ABUSE_BLOCK_FOR", setPositiveDuration(func(c *Config) *time.Duration { return &c.AbuseBlockFor })},
+	{"server.maintenance", "KIWI_MAINTENANCE", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		c.Maintenance = b
+		return nil
+	}},
+	{"server.dashboard", "KIWI_DASHBOARD", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		c.Dashboard = b
+		return nil
+	}},
+	{"tenants.enabled", "KIWI_TENANTS", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", v)
+		}
+		c.Tenants = b
+		return nil
+	}},
+	{"access.allow", "KIWI_ALLOW_IPS", setIPList(func(c *Config) *[]netip.Prefix { return &c.AllowIPs })},
+	{"access.deny", "KIWI_DENY_IPS", setIPList(func(c *Config) *[]netip.Prefix { return &c.DenyIPs })},
+}
+
+// loadConfig builds the configuration from defaults, the config file and the
+// environment, in increasing precedence. A missing file is only an error
+// when it was named explicitly.
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+
+	values, err := parseTOMLFile(path)
+	if err != nil && !(errors.Is(err, fs.ErrNotExist) && !explicit) {
+		return nil, err
+	}
+	known := make(map[string]bool, len(configFields))
+	for _, field := range configFields {
+		known[field.key] = true
+		if v, ok := values[field.key]; ok {
+			if err := field.set(c, v); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, field.key, err)
+			}
+		}
+	}
+	for key := range values {
+		if !known[key] {
+			return nil, fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+	}
+
+	for _, field := range configFields {
+		if v := os.Getenv(field.env); v != "" {
+			if err := field.set(c, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", field.env, err)
+			}
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return nil, errors.New("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLSCertFile != "" && c.ACMEHost != "" {
+		return nil, errors.New("set either tls.cert_file or tls.acme_host, not both")
+	}
+	return c, nil
+}
+
+// applyConfig installs cfg as the running configuration at startup.
+func applyConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+	dataDir = filepath.Join(cfg.StorageRoot, "data")
+	usersDir = filepath.Join(cfg.StorageRoot, "users")
+	sharesDir = filepath.Join(cfg.StorageRoot, "shares")
+	usernamesDir = filepath.Join(cfg.StorageRoot, "usernames")
+	impersonationDir = filepath.Join(cfg.StorageRoot, "impersonation")
+	passwordResetsDir = filepath.Join(cfg.StorageRoot, "password_resets")
+	orgsDir = filepath.Join(cfg.StorageRoot, "orgs")
+	orgInvitesDir = filepath.Join(cfg.StorageRoot, "org_invites")
+	webSessionsDir = filepath.Join(cfg.StorageRoot, "web_sessions")
+	tenantsDir = filepath.Join(cfg.StorageRoot, "tenants")
+	inviteCodesDir = filepath.Join(cfg.StorageRoot, "invite_codes")
+	limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.RateBurst)
+}
+
+// reloadConfig re-reads the configuration and applies the settings that can
+// change while serving. Requests in flight keep the config they started with.
+func reloadConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	old := currentConfig()
+	if cfg.Port != old.Port || cfg.Socket != old.Socket || cfg.TLSCertFile != old.TLSCertFile || cfg.TLSKeyFile != old.TLSKeyFile ||
+		cfg.ACMEHost != old.ACMEHost || cfg.ACMEEmail != old.ACMEEmail || cfg.ACMEDirectory != old.ACMEDirectory ||
+		cfg.StorageBackend != old.StorageBackend || cfg.StorageRoot != old.StorageRoot ||
+		cfg.LogFile != old.LogFile || cfg.LogMaxSizeMB != old.LogMaxSizeMB || cfg.LogRotateEvery != old.LogRotateEvery ||
+		cfg.LogMaxBackups != old.LogMaxBackups || cfg.LogMaxAge != old.LogMaxAge ||
+		cfg.AccessLog != old.AccessLog || cfg.AccessLogFormat != old.AccessLogFormat ||
+		cfg.SentryDSN != old.SentryDSN || cfg.ErrorWebhook != old.ErrorWebhook {
+		log.Println("Config reload: listener, TLS, storage, log and error reporting changes take effect on restart")
+	}
+	cfg.Port, cfg.Socket = old.Port, old.Socket
+	cfg.TLSCertFile, cfg.TLSKeyFile = old.TLSCertFile, old.TLSKeyFile
+	cfg.ACMEHost, cfg.ACMEEmail, cfg.ACMEDirectory = old.ACMEHost, old.ACMEEmail, old.ACMEDirectory
+	cfg.StorageBackend, cfg.StorageRoot = old.StorageBackend, old.StorageRoot
+	cfg.LogFile, cfg.LogMaxSizeMB, cfg.LogRotateEvery = old.LogFile, old.LogMaxSizeMB, old.LogRotateEvery
+	cfg.LogMaxBackups, cfg.LogMaxAge = old.LogMaxBackups, old.LogMaxAge
+	cfg.AccessLog, cfg.AccessLogFormat = old.AccessLog, old.AccessLogFormat
+	cfg.SentryDSN, cfg.ErrorWebhook = old.SentryDSN, old.ErrorWebhook
+
+	activeConfig.Store(cfg)
+	limiter.SetLimit(rate.Limit(cfg.RateLimit))
+	limiter.SetBurst(cfg.RateBurst)
+	return nil
+}
+
+// gateMiddleware applies the IP lists and maintenance mode to API requests.
+// Health probes, metrics and profiling stay reachable.
+func gateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		if len(cfg.AllowIPs) > 0 || len(cfg.DenyIPs) > 0 {
+			addr, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil || !ipAllowed(cfg, addr.Addr().Unmap()) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if cfg.Maintenance {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Server is down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipAllowed reports whether addr may use the API: it must not match the deny
+// list and, when there's an allow list, must match it.
+func ipAllowed(cfg *Config, addr netip.Addr) bool {
+	for _, prefix := range cfg.DenyIPs {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(cfg.AllowIPs) == 0 {
+		return true
+	}
+	for _, prefix := range cfg.AllowIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTOMLFile reads key/value pairs into a map keyed by "table.key", with
+// every value in its string form so the same setters serve the file and the
+// environment.
+func parseTOMLFile(path string) (map[string]string, error) {
+	var doc map[string]interface{}
+	if _, err := toml.DecodeFile(path, &doc); err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("%s:%d: %s", path, perr.Position.Line, perr.Message)
+		}
+		return nil, err
+	}
+	values := make(map[string]string)
+	if err := flattenTOML(values, "", doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func flattenTOML(values map[string]string, prefix string, table map[string]interface{}) error {
+	for k, v := range table {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := flattenTOML(values, key, v); err != nil {
+				return err
+			}
+		case string:
+			values[key] = v
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		case int64:
+			values[key] = strconv.FormatInt(v, 10)
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("%s: only strings, numbers and booleans are supported", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTOML(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseTOMLFile(t *testing.T) {
+	path := writeTOML(t, `
+# top-level comment
+top = "level"
+
+[server]
+port = 9090   # PORT
+  maintenance = true
+
+[tiers.free] # nested table
+storage_mb = 1_024
+ratio = -2.5
+literal = 'C:\path' # comment
+`)
+	values, err := parseTOMLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"top":                   "level",
+		"server.port":           "9090",
+		"server.maintenance":    "true",
+		"tiers.free.storage_mb": "1024",
+		"tiers.free.ratio":      "-2.5",
+		"tiers.free.literal":    `C:\path`,
+	}
+	if len(values) != len(want) {
+		t.Errorf("got %d values, want %d: %v", len(values), len(want), values)
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s = %q, want %q", k, values[k], v)
+		}
+	}
+}
+
+func TestParseTOMLFileRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    string
+	}{
+		{"bad table name", "[server.]\nport = 1\n", ":1:"},
+		{"text after table", "[server] port = 1\n", ":1:"},
+		{"no equals", "[server]\nport 8080\n", ":2:"},
+		{"bad value", "[server]\nport = eighty\n", ":2:"},
+		{"duplicate", "[server]\nport = 1\nport = 2\n", ":3:"},
+		{"array", "[access]\nallow = [\"10.0.0.0/8\"]\n", "access.allow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOMLFile(writeTOML(t, tt.content))
+			if err == nil {
+				t.Fatal("parseTOMLFile succeeded, want error")
+			}
+			if !strings.Contains(err.Error(), tt.line) {
+				t.Errorf("error %q doesn't name line %s", err, tt.line)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	cfg, err := loadConfig("server.example.toml")
+	if err != nil {
+		t.Fatalf("server.example.toml doesn't load: %v", err)
+	}
+	if cfg.Port != "8080" || cfg.TimeoutSync != time.Minute {
+		t.Errorf("unexpected values: port %q, sync timeout %v", cfg.Port, cfg.TimeoutSync)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("KIWI_RATE_BURST", "")
+	cfg, err := loadConfig(writeTOML(t, "[rate_limit]\nburst = 20\n[timeouts]\nsync = \"2m\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateBurst != 20 || cfg.TimeoutSync != 2*time.Minute {
+		t.Errorf("burst %d, sync timeout %v", cfg.RateBurst, cfg.TimeoutSync)
+	}
+
+	t.Setenv("KIWI_RATE_BURST", "30")
+	cfg, err = loadConfig(writeTOML(t, "[rate_limit]\nburst = 20\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateBurst != 30 {
+		t.Errorf("environment didn't override the file: burst %d", cfg.RateBurst)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown setting", "[server]\ncolour = \"green\"\n"},
+		{"invalid value", "[timeouts]\nsync = \"-1s\"\n"},
+		{"short interval", "[jobs]\nbackup = \"10s\"\n"},
+		{"bad address", "[access]\nallow = \"10.0.0.300\"\n"},
+		{"half of tls", "[tls]\ncert_file = \"cert.pem\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadConfig(writeTOML(t, tt.content)); err == nil {
+				t.Error("loadConfig succeeded, want error")
+			}
+		})
+	}
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("a missing file named explicitly should be an error")
+	}
+}
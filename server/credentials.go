@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An admin credential reset locks an account out until its owner picks a
+// new password: the API token is rotated, the password is cleared so a
+// leaked one stops working, and a one-time reset link is emailed to the
+// user, or returned to the admin when no mail server is configured.
+const passwordResetTTL = 24 * time.Hour
+
+type PasswordReset struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ResetCredentialsRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ResetCredentialsResponse struct {
+	Email     string    `json:"email"`
+	EmailSent bool      `json:"email_sent"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ResetURL is only returned when the email couldn't be sent, for the
+	// admin to pass on some other way
+	ResetURL string `json:"reset_url,omitempty"`
+}
+
+type PasswordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func getPasswordResetPath(id string) string {
+	return filepath.Join(passwordResetsDir, id+".json")
+}
+
+func loadPasswordReset(id string) (*PasswordReset, error) {
+	data, err := os.ReadFile(getPasswordResetPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var reset PasswordReset
+	if err := json.Unmarshal(data, &reset); err != nil {
+		return nil, err
+	}
+	if expired(reset.ExpiresAt) {
+		os.Remove(getPasswordResetPath(id))
+		return nil, os.ErrNotExist
+	}
+	return &reset, nil
+}
+
+func handleResetCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ResetCredentialsRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !adminTarget(w, r, r.PathValue("email")) {
+		return
+	}
+
+	// Neither the rotated API token nor the reset token is handed to anyone
+	// but the user
+	apiToken, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	resetToken, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user, ok := updateUser(w, r.PathValue("email"), func(user *User) {
+		user.Token = apiToken
+		user.Password = ""
+	})
+	if !ok {
+		return
+	}
+	syncHub.closeUser(user.Email)
+	revokeWebSessions(user.Email)
+
+	now := time.Now().UTC()
+	reset := &PasswordReset{
+		ID:        hashShareToken(resetToken),
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	}
+	data, err := json.MarshalIndent(reset, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(passwordResetsDir, 0700); err == nil {
+			err = writeFileAtomic(getPasswordResetPath(reset.ID), data, 0600)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Credentials were revoked, but the reset link couldn't be saved", http.StatusInternalServerError)
+		return
+	}
+
+	resetURL := requestBaseURL(r) + "/reset-password?token=" + url.QueryEscape(resetToken)
+	resp := ResetCredentialsResponse{Email: user.Email, ExpiresAt: reset.ExpiresAt}
+	err = sendMail(user.Email, "Reset your kiwi password",
+		"An administrator has signed out all of your kiwi sessions and reset your password.\n\n"+
+			"Choose a new password within 24 hours here:\n\n"+resetURL+"\n\n"+
+			"Then sign in again with `kiwi login` on each of your devices.\n")
+	switch {
+	case err == nil:
+		resp.EmailSent = true
+	case errors.Is(err, errMailNotConfigured):
+		resp.ResetURL = resetURL
+	default:
+		log.Printf("Failed to send the password reset email to %s: %v", user.Email, err)
+		resp.ResetURL = resetURL
+	}
+	audit(r, AuditEvent{Actor: adminActor(r), Action: "user.reset_credentials", Target: user.Email, Reason: strings.TrimSpace(req.Reason)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+var passwordResetPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reset your kiwi password</title></head>
+<body>
+{{if .Done}}<p>Your password has been changed. Sign in again with <code>kiwi login</code>.</p>
+{{else}}<h1>Reset your kiwi password</h1>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<label>New password <input type="password" name="password" minlength="8" required></label>
+<button type="submit">Change password</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type passwordResetPageData struct {
+	Token string
+	Error string
+	Done  bool
+}
+
+// handlePasswordReset serves the page behind a reset link and sets the new
+// password. JSON requests get the user with a fresh token back, like login.
+func handlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	fail := func(msg string, status int) {
+		if isJSON {
+			http.Error(w, msg, status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		passwordResetPage.Execute(w, passwordResetPageData{Token: r.FormValue("token"), Error: msg})
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		passwordResetPage.Execute(w, passwordResetPageData{Token: r.URL.Query().Get("token")})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PasswordResetRequest
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Token, req.Password = r.PostFormValue("token"), r.PostFormValue("password")
+	}
+	if len(req.Password) < 8 {
+		fail("Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	id := hashShareToken(req.Token)
+	reset, err := loadPasswordReset(id)
+	if req.Token == "" || err != nil {
+		fail("This reset link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		fail("Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token, err := generateToken()
+	if err != nil {
+		fail("Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user, ok := updateUser(w, reset.Email, func(user *User) {
+		user.Password = string(hashed)
+		user.Token = token
+	})
+	if !ok {
+		return
+	}
+	os.Remove(getPasswordResetPath(id))
+	audit(r, AuditEvent{Actor: user.Email, Action: "user.password_reset", Target: user.Email})
+	notify(user, notifyPasswordChange, "Your kiwi password was changed",
+		"The password for your kiwi account was changed "+requestOrigin(r)+", and your API token was replaced.\n\nIf this wasn't you, contact your server's administrator.\n")
+
+	if isJSON {
+		user.Password = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	passwordResetPage.Execute(w, passwordResetPageData{Done: true})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Delta transfer follows rsync: the server publishes per-block checksums of
+// its copy of a file, and the client sends back only the bytes that don't
+// match a block, referring to the rest by index.
+const (
+	defaultBlockSize = 2048
+	minBlockSize     = 64
+	maxBlockSize     = 64 << 10
+)
+
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type SignatureResponse struct {
+	Path      string           `json:"path"`
+	Hash      string           `json:"hash"`
+	Size      int              `json:"size"`
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// DeltaOp either copies a block of the server's copy or inserts literal data.
+type DeltaOp struct {
+	Block *int   `json:"block,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type DeltaRequest struct {
+	Path      string    `json:"path"`
+	BaseHash  string    `json:"base_hash"`
+	BlockSize int       `json:"block_size"`
+	Ops       []DeltaOp `json:"ops"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+type DeltaResponse struct {
+	Status   string `json:"status"`
+	Revision int64  `json:"revision"`
+	Hash     string `json:"hash"`
+	Size     int    `json:"size"`
+}
+
+// weakChecksum is rsync's rolling checksum; clients compute the same sum
+// over a sliding window to find matching blocks.
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+func strongChecksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+func fileSignature(content []byte, blockSize int) []BlockSignature {
+	blocks := make([]BlockSignature, 0, (len(content)+blockSize-1)/blockSize)
+	for start := 0; start < len(content); start += blockSize {
+		end := min(start+blockSize, len(content))
+		blocks = append(blocks, BlockSignature{
+			Weak:   weakChecksum(content[start:end]),
+			Strong: strongChecksum(content[start:end]),
+		})
+	}
+	return blocks
+}
+
+func applyDelta(base []byte, blockSize int, ops []DeltaOp) ([]byte, error) {
+	var out []byte
+	for i, op := range ops {
+		if op.Block != nil {
+			// Check the index before multiplying, so a huge one can't wrap
+			// around to a valid offset.
+			if *op.Block < 0 || *op.Block >= (len(base)+blockSize-1)/blockSize {
+				return nil, fmt.Errorf("operation %d refers to unknown block %d", i, *op.Block)
+			}
+			start := *op.Block * blockSize
+			out = append(out, base[start:min(start+blockSize, len(base))]...)
+		} else {
+			out = append(out, op.Data...)
+		}
+		if len(out) > maxUploadSize {
+			return nil, fmt.Errorf("result exceeds maximum size")
+		}
+	}
+	return out, nil
+}
+
+func handleSyncSignature(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "Missing path parameter", http.StatusBadRequest)
+		return
+	}
+	blockSize := defaultBlockSize
+	if v := r.URL.Query().Get("block_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minBlockSize || n > maxBlockSize {
+			http.Error(w, fmt.Sprintf("block_size must be between %d and %d", minBlockSize, maxBlockSize), http.StatusBadRequest)
+			return
+		}
+		blockSize = n
+	}
+
+	syncData, err := loadSyncData(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	content, ok := syncData.Files[path]
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SignatureResponse{
+		Path:      path,
+		Hash:      hashContent(content),
+		Size:      len(content),
+		BlockSize: blockSize,
+		Blocks:    fileSignature([]byte(content), blockSize),
+	})
+}
+
+func handleSyncDelta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	base, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+
+	var req DeltaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" || req.BaseHash == "" {
+		http.Error(w, "Path and base_hash are required", http.StatusBadRequest)
+		return
+	}
+	path, err := normalizeFilePath(req.Path)
+	if err != nil {
+		http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Path = path
+	if req.BlockSize < minBlockSize || req.BlockSize > maxBlockSize {
+		http.Error(w, fmt.Sprintf("block_size must be between %d and %d", minBlockSize, maxBlockSize), http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockUserData(userEmail)
+	defer unlock()
+
+	syncData, err := loadSyncData(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	current, ok := syncData.Files[req.Path]
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// Block references only make sense against the copy the signature was
+	// computed from
+	if hashContent(current) != req.BaseHash {
+		http.Error(w, "File changed since the signature was taken", http.StatusPreconditionFailed)
+		return
+	}
+
+	content, err := applyDelta([]byte(current), req.BlockSize, req.Ops)
+	if err != nil {
+		http.Error(w, "Invalid delta: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	hash := hashContent(string(content))
+	if req.Hash != "" && req.Hash != hash {
+		http.Error(w, "Reconstructed file does not match hash", http.StatusUnprocessableEntity)
+		return
+	}
+
+	syncData.Files[req.Path] = string(content)
+	state, conflict, err := commitSyncData(r.Context(), userEmail, syncData, base)
+	if err != nil {
+		writeCommitError(w, err)
+		return
+	}
+	if conflict != nil {
+		writeConflict(w, state, conflict)
+		return
+	}
+
+	setRevisionHeaders(w, state)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeltaResponse{
+		Status:   "ok",
+		Revision: state.Revision,
+		Hash:     hash,
+		Size:     len(content),
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func block(n int) *int { return &n }
+
+func TestApplyDelta(t *testing.T) {
+	base := bytes.Repeat([]byte("0123456789abcdef"), 9) // 144 bytes, 3 blocks of 64
+	tests := []struct {
+		name    string
+		ops     []DeltaOp
+		want    []byte
+		wantErr bool
+	}{
+		{"copy all", []DeltaOp{{Block: block(0)}, {Block: block(1)}, {Block: block(2)}}, base, false},
+		{"short last block", []DeltaOp{{Block: block(2)}}, base[128:], false},
+		{"literal", []DeltaOp{{Data: []byte("hi")}, {Block: block(1)}}, append([]byte("hi"), base[64:128]...), false},
+		{"negative block", []DeltaOp{{Block: block(-1)}}, nil, true},
+		{"past end", []DeltaOp{{Block: block(3)}}, nil, true},
+		{"overflows to negative", []DeltaOp{{Block: block(1 << 57)}}, nil, true},
+		{"wraps to zero", []DeltaOp{{Block: block(1 << 58)}}, nil, true},
+		{"max int", []DeltaOp{{Block: block(int(^uint(0) >> 1))}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyDelta(base, 64, tt.ops)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("applyDelta = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyDelta: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("applyDelta = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaEmptyBase(t *testing.T) {
+	if _, err := applyDelta(nil, 64, []DeltaOp{{Block: block(0)}}); err == nil {
+		t.Error("block 0 of an empty base should be unknown")
+	}
+}
+
+func TestFileSignatureRoundTrip(t *testing.T) {
+	base := bytes.Repeat([]byte("x"), 200)
+	sigs := fileSignature(base, 64)
+	if len(sigs) != 4 {
+		t.Fatalf("got %d blocks, want 4", len(sigs))
+	}
+	var ops []DeltaOp
+	for i := range sigs {
+		ops = append(ops, DeltaOp{Block: block(i)})
+	}
+	got, err := applyDelta(base, 64, ops)
+	if err != nil || !bytes.Equal(got, base) {
+		t.Errorf("applyDelta = %q, %v; want the base back", got, err)
+	}
+}
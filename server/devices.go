@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const maxDeviceFieldLen = 128
+
+type Device struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	OS           string     `json:"os"`
+	Hostname     string     `json:"hostname"`
+	RegisteredAt time.Time  `json:"registered_at"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	LastPushAt   *time.Time `json:"last_push_at,omitempty"`
+	LastPullAt   *time.Time `json:"last_pull_at,omitempty"`
+	// RevokedAt is set once the device is cut off: requests naming it are
+	// refused, and it can't register again until it's removed
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type RegisterDeviceRequest struct {
+	Name     string `json:"name"`
+	OS       string `json:"os"`
+	Hostname string `json:"hostname"`
+}
+
+type RenameDeviceRequest struct {
+	Name string `json:"name"`
+}
+
+// RevokedDevice is answered to a revoke, with the account token that
+// replaced the one the device held.
+type RevokedDevice struct {
+	*Device
+	Token string `json:"token"`
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+func getDevicesPath(email string) string {
+	return filepath.Join(getUserDataDir(email), "devices.json")
+}
+
+func loadDevices(email string) (map[string]*Device, error) {
+	devices := make(map[string]*Device)
+	data, err := os.ReadFile(getDevicesPath(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return devices, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func saveDevices(email string, devices map[string]*Device) error {
+	if err := os.MkdirAll(getUserDataDir(email), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getDevicesPath(email), data, 0644)
+}
+
+func lockDevices(email string) func() {
+	return lockUserData(email + "\x00devices")
+}
+
+// recordDeviceActivity stamps a device's last push or pull time.
+func recordDeviceActivity(email, id string, push bool) error {
+	unlock := lockDevices(email)
+	defer unlock()
+
+	devices, err := loadDevices(email)
+	if err != nil {
+		return err
+	}
+	device, ok := devices[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	device.LastSeenAt = &now
+	if push {
+		device.LastPushAt = &now
+	} else {
+		device.LastPullAt = &now
+	}
+	return saveDevices(email, devices)
+}
+
+// deviceActivityMiddleware tracks per-device sync times for requests that
+// identify their device with the X-Kiwi-Device header.
+func deviceActivityMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.Header.Get("X-Kiwi-Device")
+		userEmail := r.Header.Get("X-User-Email")
+		// Members of a shared file set register devices on their own account
+		if deviceID == "" || userEmail == "" || requestACL(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		devices, err := loadDevices(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read devices", http.StatusInternalServerError)
+			return
+		}
+		device, ok := devices[deviceID]
+		if !ok {
+			http.Error(w, "Unknown device - register it with /devices/register", http.StatusBadRequest)
+			return
+		}
+		if device.RevokedAt != nil {
+			http.Error(w, "Forbidden - this device was revoked", http.StatusForbidden)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status >= 400 {
+			return
+		}
+		// Activity tracking is best effort; the sync itself already succeeded
+		push := r.Method != http.MethodGet && r.Method != http.MethodHead
+		recordDeviceActivity(userEmail, deviceID, push)
+	}
+}
+
+func handleDeviceRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Hostname == "" {
+		http.Error(w, "Device name and hostname are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > maxDeviceFieldLen || len(req.OS) > maxDeviceFieldLen || len(req.Hostname) > maxDeviceFieldLen {
+		http.Error(w, "Device fields must be at most 128 characters", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockDevices(userEmail)
+	defer unlock()
+
+	devices, err := loadDevices(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read devices", http.StatusInternalServerError)
+		return
+	}
+
+	// Re-registering the same machine returns the existing device
+	for _, device := range devices {
+		if device.Name == req.Name && device.Hostname == req.Hostname {
+			if device.RevokedAt != nil {
+				http.Error(w, "Forbidden - this device was revoked; remove it with DELETE /devices/"+device.ID+" to register it again", http.StatusForbidden)
+				return
+			}
+			device.OS = req.OS
+			if err := saveDevices(userEmail, devices); err != nil {
+				http.Error(w, "Failed to save device", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(device)
+			return
+		}
+	}
+
+	id, err := generateID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	device := &Device{
+		ID:           id,
+		Name:         req.Name,
+		OS:           req.OS,
+		Hostname:     req.Hostname,
+		RegisteredAt: time.Now().UTC(),
+	}
+	devices[id] = device
+	if err := saveDevices(userEmail, devices); err != nil {
+		http.Error(w, "Failed to save device", http.StatusInternalServerError)
+		return
+	}
+	if user, err := loadUser(userEmail); err == nil {
+		notify(user, notifyNewDevice, "New device on your kiwi account",
+			fmt.Sprintf("%s (%s) was registered with your kiwi account %s.\n\nIf this wasn't you, change your password and remove the device.\n", device.Name, device.Hostname, requestOrigin(r)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	devices, err := loadDevices(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read devices", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		list = append(list, device)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].RegisteredAt.Before(list[j].RegisteredAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleDevice renames (PATCH) or forgets (DELETE) a registered device.
+// Forgetting doesn't touch the token, so a device that syncs again just shows
+// up unregistered until it re-registers; revoke it to cut it off.
+func handleDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RenameDeviceRequest
+	if r.Method == http.MethodPatch {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" || len(req.Name) > maxDeviceFieldLen {
+			http.Error(w, "Device name is required and must be at most 128 characters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	device, ok := updateDevice(w, r, func(devices map[string]*Device, device *Device) {
+		if r.Method == http.MethodDelete {
+			delete(devices, device.ID)
+			return
+		}
+		device.Name = req.Name
+	})
+	if !ok {
+		return
+	}
+	if device == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// handleDeviceRevoke cuts a device off. It's kept, marked revoked, so
+// requests naming it are refused and it can't quietly register again. A
+// device doesn't have to name itself, so the account token it holds is
+// replaced too, and the new one is answered for the caller to keep.
+func handleDeviceRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requestToken(r).Kind == "impersonation" {
+		http.Error(w, "Forbidden - impersonation tokens can't replace the account's token", http.StatusForbidden)
+		return
+	}
+	device, ok := updateDevice(w, r, func(devices map[string]*Device, device *Device) {
+		if device.RevokedAt == nil {
+			now := time.Now().UTC()
+			device.RevokedAt = &now
+		}
+	})
+	if !ok {
+		return
+	}
+	token, ok := rotateAccountToken(w, r, r.Header.Get("X-User-Email"))
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevokedDevice{Device: device, Token: token})
+}
+
+// updateDevice applies change to the device named in the path and saves the
+// caller's devices. It returns the changed device, or nil if change removed
+// it, and writes the error response itself when it fails.
+func updateDevice(w http.ResponseWriter, r *http.Request, change func(devices map[string]*Device, device *Device)) (*Device, bool) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	unlock := lockDevices(userEmail)
+	defer unlock()
+	devices, err := loadDevices(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read devices", http.StatusInternalServerError)
+		return nil, false
+	}
+	device, ok := devices[r.PathValue("id")]
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, false
+	}
+	change(devices, device)
+	if err := saveDevices(userEmail, devices); err != nil {
+		http.Error(w, "Failed to save devices", http.StatusInternalServerError)
+		return nil, false
+	}
+	if _, ok := devices[device.ID]; !ok {
+		return nil, true
+	}
+	return device, true
+}
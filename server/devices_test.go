@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeviceRevokeReplacesToken(t *testing.T) {
+	useTempStorage(t)
+	if err := saveUser(&User{Email: "alice@example.com", Token: "stolen"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDevices("alice@example.com", map[string]*Device{"laptop": {ID: "laptop", Name: "laptop", Hostname: "laptop"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/devices/laptop/revoke", nil)
+	r.Header.Set("X-User-Email", "alice@example.com")
+	r.SetPathValue("id", "laptop")
+	rec := httptest.NewRecorder()
+	handleDeviceRevoke(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var revoked struct {
+		RevokedAt *string `json:"revoked_at"`
+		Token     string  `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&revoked); err != nil {
+		t.Fatal(err)
+	}
+	if revoked.RevokedAt == nil || revoked.Token == "" || revoked.Token == "stolen" {
+		t.Errorf("unexpected response %+v", revoked)
+	}
+
+	user, err := loadUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Token != revoked.Token {
+		t.Errorf("token on the account = %q, want the one answered", user.Token)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The doctor subcommand checks that the server can start and do its job
+// with the current configuration, without starting it. It only reads and
+// probes; directories that don't exist yet are reported, not created.
+const (
+	doctorTimeout      = 5 * time.Second
+	doctorCertWarning  = 14 * 24 * time.Hour
+	doctorLowDiskBytes = 1 << 30
+)
+
+type doctor struct {
+	failures int
+	warnings int
+}
+
+func (d *doctor) ok(check, format string, args ...interface{}) {
+	fmt.Printf("ok    %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(check, format string, args ...interface{}) {
+	d.warnings++
+	fmt.Printf("warn  %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(check, format string, args ...interface{}) {
+	d.failures++
+	fmt.Printf("FAIL  %-12s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// runDoctor prints one line per check and returns the process exit code.
+func runDoctor(configPath string) int {
+	d := &doctor{}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		d.fail("config", "%v", err)
+		fmt.Println("\nFix the configuration and run doctor again.")
+		return 1
+	}
+	source := configPath
+	if source == "" {
+		source = defaultConfigPath
+		if _, err := os.Stat(source); err != nil {
+			source = "defaults and environment"
+		}
+	}
+	d.ok("config", "loaded from %s", source)
+	applyConfig(cfg)
+
+	d.checkAdminToken()
+	d.checkStorage(cfg)
+	d.checkListener(cfg)
+	d.checkTLS(cfg)
+	d.checkSMTP(cfg)
+	d.checkWritableFile("log", cfg.LogFile)
+	if cfg.AccessLog != "stdout" && cfg.AccessLog != "-" {
+		d.checkWritableFile("access_log", cfg.AccessLog)
+	}
+	if cfg.BackupDir != "" {
+		d.checkDir("backup", cfg.BackupDir)
+	}
+	if cfg.SentryDSN != "" || cfg.ErrorWebhook != "" {
+		if _, err := newErrorReporter(cfg.SentryDSN, cfg.ErrorWebhook); err != nil {
+			d.fail("errors", "%v", err)
+		} else {
+			d.ok("errors", "error reporting configured")
+		}
+	}
+	if cfg.MeteringWebhook != "" {
+		if _, err := meterPublishers(cfg); err != nil {
+			d.fail("metering", "%v", err)
+		} else {
+			d.ok("metering", "webhook configured")
+		}
+	}
+	d.checkWritableFile("metering_file", cfg.MeteringFile)
+	switch {
+	case cfg.TermsVersion != "" && cfg.TermsURL == "":
+		d.warn("terms", "terms.url isn't set; users are asked to accept version %s without a link to it", cfg.TermsVersion)
+	case cfg.TermsVersion == "" && cfg.TermsURL != "":
+		d.warn("terms", "terms.url is set but terms.version isn't, so acceptance isn't required")
+	case cfg.TermsVersion != "":
+		d.ok("terms", "accepting version "+cfg.TermsVersion+" is required to sync")
+	}
+
+	fmt.Printf("\n%d failed, %d warnings\n", d.failures, d.warnings)
+	if d.failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (d *doctor) checkAdminToken() {
+	token := os.Getenv(authTokenEnv)
+	switch {
+	case token == "":
+		d.fail("admin_token", "%s isn't set; the server won't start", authTokenEnv)
+	case len(token) < 32:
+		d.warn("admin_token", "%s is only %d characters; use at least 32", authTokenEnv, len(token))
+	default:
+		d.ok("admin_token", "set")
+	}
+}
+
+func (d *doctor) checkStorage(cfg *Config) {
+	if cfg.StorageBackend != "filesystem" {
+		d.fail("storage", "unsupported backend %q", cfg.StorageBackend)
+		return
+	}
+	for _, dir := range []string{dataDir, usersDir, sharesDir, usernamesDir} {
+		d.checkDir("storage", dir)
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cfg.StorageRoot, &fs); err != nil {
+		return
+	}
+	free := fs.Bavail * uint64(fs.Bsize)
+	if free < doctorLowDiskBytes {
+		d.warn("disk", "only %d MiB free under %s", free>>20, cfg.StorageRoot)
+	} else {
+		d.ok("disk", "%d GiB free under %s", free>>30, cfg.StorageRoot)
+	}
+}
+
+// checkDir reports whether dir is writable, or can be created if missing.
+func (d *doctor) checkDir(check, dir string) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(dir)
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if err := checkDirWritable(parent); err != nil {
+			d.fail(check, "%s doesn't exist and can't be created: %v", dir, err)
+			return
+		}
+		d.warn(check, "%s doesn't exist yet; it will be created", dir)
+		return
+	}
+	if err != nil {
+		d.fail(check, "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		d.fail(check, "%s isn't a directory", dir)
+		return
+	}
+	if err := checkDirWritable(dir); err != nil {
+		d.fail(check, "%s isn't writable: %v", dir, err)
+		return
+	}
+	d.ok(check, "%s is writable", dir)
+}
+
+func (d *doctor) checkWritableFile(check, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		d.checkDir(check, filepath.Dir(path))
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		d.fail(check, "%s isn't writable: %v", path, err)
+		return
+	}
+	f.Close()
+	d.ok(check, "%s is writable", path)
+}
+
+func (d *doctor) checkListener(cfg *Config) {
+	if cfg.Socket != "" {
+		d.checkDir("listen", filepath.Dir(cfg.Socket))
+		return
+	}
+	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		d.warn("listen", "port %s isn't free (is the server already running?): %v", cfg.Port, err)
+		return
+	}
+	ln.Close()
+	d.ok("listen", "port %s is free", cfg.Port)
+}
+
+func (d *doctor) checkTLS(cfg *Config) {
+	switch {
+	case cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			d.fail("tls", "can't load certificate: %v", err)
+			return
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			d.ok("tls", "certificate and key match")
+			return
+		}
+		switch left := time.Until(leaf.NotAfter); {
+		case left <= 0:
+			d.fail("tls", "certificate expired on %s", leaf.NotAfter.Format(time.DateOnly))
+		case left < doctorCertWarning:
+			d.warn("tls", "certificate expires on %s", leaf.NotAfter.Format(time.DateOnly))
+		default:
+			d.ok("tls", "certificate for %v valid until %s", leaf.DNSNames, leaf.NotAfter.Format(time.DateOnly))
+		}
+
+	case cfg.ACMEHost != "":
+		d.checkDir("tls", filepath.Join(cfg.StorageRoot, "acme"))
+		if _, err := net.LookupHost(cfg.ACMEHost); err != nil {
+			d.fail("tls", "%s doesn't resolve: %v", cfg.ACMEHost, err)
+			return
+		}
+		if cfg.Port != "443" && cfg.Socket == "" {
+			d.warn("tls", "ACME validation reaches %s on port 443, but the server listens on %s", cfg.ACMEHost, cfg.Port)
+			return
+		}
+		d.ok("tls", "ACME certificates for %s", cfg.ACMEHost)
+
+	default:
+		d.warn("tls", "serving plain HTTP; put a TLS-terminating proxy in front")
+	}
+}
+
+// checkSMTP connects to the mail server and, when credentials are set,
+// authenticates, without sending anything.
+func (d *doctor) checkSMTP(cfg *Config) {
+	if cfg.SMTPHost == "" {
+		d.warn("smtp", "no SMTP host; emails won't be sent")
+		return
+	}
+	if cfg.SMTPFrom == "" {
+		d.warn("smtp", "smtp.from isn't set")
+	}
+
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+	conn, err := net.DialTimeout("tcp", addr, doctorTimeout)
+	if err != nil {
+		d.fail("smtp", "can't reach %s: %v", addr, err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(doctorTimeout))
+	client, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		d.fail("smtp", "%s: %v", addr, err)
+		return
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: cfg.SMTPHost}); err != nil {
+			d.fail("smtp", "STARTTLS with %s failed: %v", addr, err)
+			return
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)); err != nil {
+			d.fail("smtp", "authentication with %s failed: %v", addr, err)
+			return
+		}
+	}
+	client.Quit()
+	d.ok("smtp", "connected to %s", addr)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var blobHashRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// serveFileContent writes a synced file as a raw download. http.ServeContent
+// takes care of Range, If-Range and conditional requests, so interrupted
+// downloads can resume with standard tooling.
+func serveFileContent(w http.ResponseWriter, r *http.Request, name, content string, modTime time.Time) {
+	w.Header().Set("ETag", `"`+hashContent(content)+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, filepath.Base(name), modTime, strings.NewReader(content))
+}
+
+// servePublicFileContent serves a synced file to anyone, from the same origin
+// as the dashboard. Its type never comes from the name or contents, so an
+// uploaded .html or .svg can't run script there: text is served as plain
+// text in a sandbox, and anything else only as an attachment.
+func servePublicFileContent(w http.ResponseWriter, r *http.Request, name, content string, modTime time.Time) {
+	disposition := "inline"
+	if utf8.ValidString(content) && !strings.ContainsRune(content, 0) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filepath.Base(name)}))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	serveFileContent(w, r, name, content, modTime)
+}
+
+func handleSyncFile(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := r.PathValue("path")
+	acl := requestACL(r)
+	// A {path...} wildcard has to end the pattern, so POST .../share is
+	// routed here
+	if shared, ok := strings.CutSuffix(path, "/share"); ok && r.Method == http.MethodPost {
+		if acl != nil {
+			http.Error(w, "Only the owner can create share links", http.StatusForbidden)
+			return
+		}
+		if userEmail == "" {
+			http.Error(w, "Share links belong to a user account", http.StatusBadRequest)
+			return
+		}
+		handleShareCreate(w, r, userEmail, shared)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if acl != nil && !acl.CanRead(path) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	syncData, err := loadSyncData(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	content, ok := syncData.Files[path]
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	state, err := loadSyncState(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+
+	serveFileContent(w, r, path, content, state.Files[path].UpdatedAt)
+}
+
+// handleSyncBlob serves file contents by hash from the snapshot object store,
+// which also covers earlier versions still referenced by a snapshot.
+func handleSyncBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	hash := r.PathValue("hash")
+	if !blobHashRegex.MatchString(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(getObjectsDir(userEmail), hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Blob not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read blob", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read blob", http.StatusInternalServerError)
+		return
+	}
+
+	// Blobs are content-addressed, so they never change
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServePublicFileContent(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		contentType string
+		disposition string
+	}{
+		{"index.html", "<html><script>alert(1)</script></html>", "text/plain; charset=utf-8", "inline"},
+		{"logo.svg", `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, "text/plain; charset=utf-8", "inline"},
+		{".bashrc", "export PATH=$HOME/bin:$PATH\n", "text/plain; charset=utf-8", "inline"},
+		{"page.html", "<html>\x00</html>", "application/octet-stream", "attachment"},
+		{"blob", "\xff\xfe\x00", "application/octet-stream", "attachment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			servePublicFileContent(rec, httptest.NewRequest(http.MethodGet, "/s/token", nil), tt.name, tt.content, time.Now())
+			h := rec.Header()
+			if got := h.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := h.Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition+";") {
+				t.Errorf("Content-Disposition = %q, want %s", got, tt.disposition)
+			}
+			if got := h.Get("Content-Security-Policy"); got != "sandbox" {
+				t.Errorf("Content-Security-Policy = %q, want sandbox", got)
+			}
+			if rec.Body.String() != tt.content {
+				t.Errorf("body = %q, want %q", rec.Body, tt.content)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Panics and 5xx responses can be reported to Sentry (KIWI_SENTRY_DSN) or
+// posted as JSON to any webhook (KIWI_ERROR_WEBHOOK). Reports carry the
+// request line, user and client but never request or response payloads.
+// 503s are left out: the server sends them on purpose during maintenance
+// and shutdown.
+const (
+	sentryDSNEnv       = "KIWI_SENTRY_DSN"
+	errorWebhookEnv    = "KIWI_ERROR_WEBHOOK"
+	errorQueueSize     = 100
+	errorMessageLimit  = 512
+	errorReportTimeout = 10 * time.Second
+)
+
+type ErrorReport struct {
+	Time       time.Time `json:"time"`
+	Server     string    `json:"server"`
+	Message    string    `json:"message"`
+	Panic      bool      `json:"panic"`
+	Stack      string    `json:"stack,omitempty"`
+	Status     int       `json:"status"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+type errorReporter struct {
+	endpoint   string
+	sentryAuth string // empty for a plain webhook
+	hostname   string
+	client     *http.Client
+	queue      chan ErrorReport
+}
+
+func newErrorReporter(dsn, webhook string) (*errorReporter, error) {
+	if dsn != "" && webhook != "" {
+		return nil, errors.New("set either a Sentry DSN or an error webhook, not both")
+	}
+	e := &errorReporter{
+		endpoint: webhook,
+		client:   &http.Client{Timeout: errorReportTimeout},
+		queue:    make(chan ErrorReport, errorQueueSize),
+	}
+	e.hostname, _ = os.Hostname()
+	if dsn != "" {
+		endpoint, auth, err := parseSentryDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		e.endpoint, e.sentryAuth = endpoint, auth
+	} else if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid error webhook URL %q", webhook)
+	}
+	go e.run()
+	return e, nil
+}
+
+// parseSentryDSN turns https://KEY@HOST/PROJECT into the project's store
+// endpoint and X-Sentry-Auth header.
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" {
+		return "", "", errors.New("invalid Sentry DSN")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return "", "", errors.New("invalid Sentry DSN: missing project ID")
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project)
+	auth := "Sentry sentry_version=7, sentry_client=kiwi-server/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return endpoint, auth, nil
+}
+
+// errorRecorder keeps the start of 5xx response bodies, which hold the
+// error message passed to http.Error.
+type errorRecorder struct {
+	statusRecorder
+	message []byte
+}
+
+func (rec *errorRecorder) Write(b []byte) (int, error) {
+	if rec.status >= 500 && len(rec.message) < errorMessageLimit {
+		rec.message = append(rec.message, b[:min(len(b), errorMessageLimit-len(rec.message))]...)
+	}
+	return rec.statusRecorder.Write(b)
+}
+
+func (e *errorReporter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, user := withAccessLogUser(r)
+		rec := &errorRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := debug.Stack()
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, stack)
+			report := e.newReport(r, user, http.StatusInternalServerError, fmt.Sprint(v))
+			report.Panic, report.Stack = true, string(stack)
+			e.enqueue(report)
+			if rec.status == 0 {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= 500 && rec.status != http.StatusServiceUnavailable {
+			message := strings.TrimSpace(string(rec.message))
+			if message == "" {
+				message = http.StatusText(rec.status)
+			}
+			e.enqueue(e.newReport(r, user, rec.status, message))
+		}
+	})
+}
+
+func (e *errorReporter) newReport(r *http.Request, user *accessLogUser, status int, message string) ErrorReport {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return ErrorReport{
+		Time:       time.Now().UTC(),
+		Server:     e.hostname,
+		Message:    message,
+		Status:     status,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		User:       user.email,
+		RemoteAddr: host,
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+// enqueue hands a report to the sender without blocking the request. When
+// the endpoint can't keep up, reports are dropped.
+func (e *errorReporter) enqueue(report ErrorReport) {
+	select {
+	case e.queue <- report:
+	default:
+		log.Println("Error report queue full, dropping report")
+	}
+}
+
+func (e *errorReporter) run() {
+	for report := range e.queue {
+		if err := e.send(report); err != nil {
+			log.Printf("Failed to send error report: %v", err)
+		}
+	}
+}
+
+func (e *errorReporter) send(report ErrorReport) error {
+	var payload interface{} = report
+	if e.sentryAuth != "" {
+		payload = sentryEvent(report)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.sentryAuth != "" {
+		req.Header.Set("X-Sentry-Auth", e.sentryAuth)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func sentryEvent(report ErrorReport) map[string]interface{} {
+	eventID, _ := generateID()
+	event := map[string]interface{}{
+		"event_id":    eventID,
+		"timestamp":   report.Time.Format(time.RFC3339),
+		"platform":    "go",
+		"level":       "error",
+		"logger":      "kiwi",
+		"server_name": report.Server,
+		"message":     map[string]string{"formatted": report.Message},
+		"request": map[string]interface{}{
+			"method":  report.Method,
+			"url":     report.Path,
+			"headers": map[string]string{"User-Agent": report.UserAgent},
+		},
+		"user": map[string]string{"email": report.User, "ip_address": report.RemoteAddr},
+		"tags": map[string]string{"status": strconv.Itoa(report.Status), "panic": strconv.FormatBool(report.Panic)},
+	}
+	if report.Panic {
+		event["level"] = "fatal"
+		event["extra"] = map[string]string{"stack": report.Stack}
+	}
+	return event
+}
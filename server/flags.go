@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Feature flags let the operator roll a new protocol feature, like delta
+// sync, out to some accounts before it becomes the default. A flag is on for
+// an account when it's listed in the flag's overrides, or when the account
+// falls in the flag's rollout percentage. Accounts are bucketed by a hash of
+// the flag name and email, so raising the percentage only adds accounts and
+// each flag picks a different slice. Flags live in flags.json under the
+// storage root; clients read theirs from GET /flags and fall back to their
+// own default for flags the server doesn't define.
+const maxFlagDescription = 500
+
+var flagNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Percent of accounts the flag is on for, from 0 to 100
+	Percent int `json:"percent"`
+	// Overrides turn the flag on (true) or off (false) for single accounts
+	// whatever the percentage
+	Overrides map[string]bool `json:"overrides,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+type FlagRequest struct {
+	Description *string         `json:"description,omitempty"`
+	Percent     *int            `json:"percent,omitempty"`
+	Overrides   map[string]bool `json:"overrides,omitempty"`
+}
+
+// currentFlags mirrors the file so evaluating a flag costs nothing per
+// request. flagsMu serializes updates.
+var (
+	currentFlags atomic.Pointer[map[string]*Flag]
+	flagsMu      sync.Mutex
+)
+
+func getFlagsPath() string {
+	return filepath.Join(currentConfig().StorageRoot, "flags.json")
+}
+
+// loadFlags reads the saved flags at startup.
+func loadFlags() {
+	flags := make(map[string]*Flag)
+	defer currentFlags.Store(&flags)
+	data, err := os.ReadFile(getFlagsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read feature flags: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &flags); err != nil {
+		log.Printf("Failed to read feature flags: %v", err)
+	}
+}
+
+func allFlags() map[string]*Flag {
+	if flags := currentFlags.Load(); flags != nil {
+		return *flags
+	}
+	return nil
+}
+
+// enabledFor reports whether the flag is on for an account.
+func (f *Flag) enabledFor(email string) bool {
+	if on, ok := f.Overrides[email]; ok {
+		return on
+	}
+	return flagBucket(f.Name, email) < f.Percent
+}
+
+// flagBucket places an account in one of 100 buckets for a flag.
+func flagBucket(name, email string) int {
+	hash := sha256.Sum256([]byte(name + "\x00" + email))
+	return int(binary.BigEndian.Uint64(hash[:8]) % 100)
+}
+
+// flagEnabled reports whether a flag is on for an account, for handlers
+// that gate a feature server-side. Undefined flags are off.
+func flagEnabled(name, email string) bool {
+	flag, ok := allFlags()[name]
+	return ok && flag.enabledFor(email)
+}
+
+func sortedFlags() []*Flag {
+	flags := allFlags()
+	list := make([]*Flag, 0, len(flags))
+	for _, flag := range flags {
+		list = append(list, flag)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// handleFlags returns every defined flag and whether it's on for the caller.
+func handleFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userEmail := r.Header.Get("X-User-Email")
+	resp := make(map[string]bool)
+	for name, flag := range allFlags() {
+		resp[name] = flag.enabledFor(userEmail)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdminFlags lists the flags with their rollout settings.
+func handleAdminFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sortedFlags())
+}
+
+// handleAdminFlag shows (GET), creates or updates (PUT) or deletes (DELETE)
+// a flag. PUT changes only the fields it sets; overrides, when set, replace
+// the flag's overrides.
+func handleAdminFlag(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !flagNameRegex.MatchString(name) {
+		http.Error(w, "Invalid flag name", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		flag, ok := allFlags()[name]
+		if !ok {
+			http.Error(w, "Flag not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flag)
+	case http.MethodPut:
+		setFlag(w, r, name)
+	case http.MethodDelete:
+		flagsMu.Lock()
+		defer flagsMu.Unlock()
+		flags := allFlags()
+		if _, ok := flags[name]; !ok {
+			http.Error(w, "Flag not found", http.StatusNotFound)
+			return
+		}
+		updated := make(map[string]*Flag, len(flags))
+		for n, flag := range flags {
+			if n != name {
+				updated[n] = flag
+			}
+		}
+		if err := saveFlags(updated); err != nil {
+			http.Error(w, "Failed to save flags", http.StatusInternalServerError)
+			return
+		}
+		audit(r, AuditEvent{Actor: "admin", Action: "flag.delete", Target: name})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func setFlag(w http.ResponseWriter, r *http.Request, name string) {
+	var req FlagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Description != nil {
+		trimmed := strings.TrimSpace(*req.Description)
+		req.Description = &trimmed
+	}
+	switch {
+	case req.Description != nil && len(*req.Description) > maxFlagDescription:
+		http.Error(w, "Description too long", http.StatusBadRequest)
+		return
+	case req.Percent != nil && (*req.Percent < 0 || *req.Percent > 100):
+		http.Error(w, "Percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	for email := range req.Overrides {
+		if !emailRegex.MatchString(email) {
+			http.Error(w, "Invalid override email "+email, http.StatusBadRequest)
+			return
+		}
+	}
+
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	flags := allFlags()
+	flag := &Flag{Name: name}
+	if existing, ok := flags[name]; ok {
+		copied := *existing
+		flag = &copied
+	}
+	if req.Description != nil {
+		flag.Description = *req.Description
+	}
+	if req.Percent != nil {
+		flag.Percent = *req.Percent
+	}
+	if req.Overrides != nil {
+		flag.Overrides = req.Overrides
+	}
+	flag.UpdatedAt = time.Now().UTC()
+
+	updated := make(map[string]*Flag, len(flags)+1)
+	for n, f := range flags {
+		updated[n] = f
+	}
+	updated[name] = flag
+	if err := saveFlags(updated); err != nil {
+		http.Error(w, "Failed to save flags", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Set feature flag %s to %d%%", name, flag.Percent)
+	audit(r, AuditEvent{Actor: "admin", Action: "flag.set", Target: name, Detail: strconv.Itoa(flag.Percent) + "%"})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flag)
+}
+
+// saveFlags writes flags and makes them current. The caller holds flagsMu.
+func saveFlags(flags map[string]*Flag) error {
+	data, err := json.MarshalIndent(flags, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(getFlagsPath(), data, 0644); err != nil {
+		return err
+	}
+	currentFlags.Store(&flags)
+	return nil
+}
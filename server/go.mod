@@ -6,4 +6,15 @@ require golang.org/x/crypto v0.36.0
 
 require golang.org/x/time v0.11.0
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require github.com/joho/godotenv v1.5.1
+
+require github.com/klauspost/compress v1.18.0
+
+require github.com/BurntSushi/toml v1.6.0
+
+require github.com/coder/websocket v1.8.14
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+)
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// /livez only says the process is serving. /readyz also runs
+// readinessChecks, so orchestrators stop routing to an instance that can't
+// store data; storage backends add their reachability checks there.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+var readinessChecks = []readinessCheck{
+	{"data_dir", func() error { return checkDirWritable(dataDir) }},
+	{"users_dir", func() error { return checkDirWritable(usersDir) }},
+	{"shares_dir", func() error { return checkDirWritable(sharesDir) }},
+	{"usernames_dir", func() error { return checkDirWritable(usernamesDir) }},
+}
+
+// draining is set once shutdown starts, taking the instance out of rotation
+// while in-flight requests finish.
+var draining atomic.Bool
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthDetails is the admin view behind /healthz/details, meant for
+// monitoring to alert on trends such as shrinking disk space.
+type HealthDetails struct {
+	Status           string            `json:"status"`
+	Checks           map[string]string `json:"checks"`
+	StorageLatencyMs float64           `json:"storage_latency_ms"`
+	DiskFreeBytes    uint64            `json:"disk_free_bytes"`
+	DiskTotalBytes   uint64            `json:"disk_total_bytes"`
+	Users            int               `json:"users"`
+	OpenSessions     int               `json:"open_sessions"`
+	Uptime           string            `json:"uptime"`
+	GC               GCStatus          `json:"gc"`
+}
+
+type GCStatus struct {
+	NumGC          uint32     `json:"num_gc"`
+	LastGC         *time.Time `json:"last_gc,omitempty"`
+	LastPauseMs    float64    `json:"last_pause_ms"`
+	PauseTotalMs   float64    `json:"pause_total_ms"`
+	HeapAllocBytes uint64     `json:"heap_alloc_bytes"`
+	HeapSysBytes   uint64     `json:"heap_sys_bytes"`
+	Goroutines     int        `json:"goroutines"`
+}
+
+var startedAt = time.Now()
+
+func checkDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(name)
+	return err
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthResponse{Status: "OK"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, HealthResponse{Status: "shutting down"})
+		return
+	}
+
+	resp := HealthResponse{Status: "OK", Checks: make(map[string]string, len(readinessChecks))}
+	status := http.StatusOK
+	for _, c := range readinessChecks {
+		if err := c.check(); err != nil {
+			resp.Checks[c.name] = err.Error()
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		resp.Checks[c.name] = "ok"
+	}
+	writeHealth(w, status, resp)
+}
+
+func gcStatus() GCStatus {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	status := GCStatus{
+		NumGC:          ms.NumGC,
+		PauseTotalMs:   float64(ms.PauseTotalNs) / 1e6,
+		HeapAllocBytes: ms.HeapAlloc,
+		HeapSysBytes:   ms.HeapSys,
+		Goroutines:     runtime.NumGoroutine(),
+	}
+	if ms.NumGC > 0 {
+		last := time.Unix(0, int64(ms.LastGC)).UTC()
+		status.LastGC = &last
+		status.LastPauseMs = float64(ms.PauseNs[(ms.NumGC+255)%256]) / 1e6
+	}
+	return status
+}
+
+// handleHealthDetails runs the readiness checks and adds the numbers worth
+// graphing. Storage latency is the time to write and remove a file in the
+// data directory.
+func handleHealthDetails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := HealthDetails{Status: "OK", Checks: make(map[string]string, len(readinessChecks)+1)}
+	status := http.StatusOK
+	fail := func(name string, err error) {
+		resp.Checks[name] = err.Error()
+		resp.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	if draining.Load() {
+		resp.Status = "shutting down"
+		status = http.StatusServiceUnavailable
+	}
+	for _, c := range readinessChecks {
+		start := time.Now()
+		if err := c.check(); err != nil {
+			fail(c.name, err)
+			continue
+		}
+		if c.name == "data_dir" {
+			resp.StorageLatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		}
+		resp.Checks[c.name] = "ok"
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dataDir, &fs); err != nil {
+		fail("disk_space", err)
+	} else {
+		resp.DiskFreeBytes = fs.Bavail * uint64(fs.Bsize)
+		resp.DiskTotalBytes = fs.Blocks * uint64(fs.Bsize)
+		resp.Checks["disk_space"] = "ok"
+	}
+
+	_, resp.Users = metrics.storageUsage()
+	resp.OpenSessions = syncHub.connections()
+	resp.Uptime = time.Since(startedAt).Round(time.Second).String()
+	resp.GC = gcStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
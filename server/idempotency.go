@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const maxIdempotencyKeyLen = 255
+
+// Response headers worth replaying; everything else is regenerated by the
+// middleware chain on every request.
+var idempotentHeaders = []string{"Content-Type", "ETag", "X-Kiwi-Revision"}
+
+type idempotencyRecord struct {
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status"`
+	Header      map[string]string `json:"header"`
+	Body        []byte            `json:"body"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+var inflightIdempotencyKeys sync.Map
+
+func getIdempotencyPath(email, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(getUserDataDir(email), "idempotency", base64.URLEncoding.EncodeToString(hash[:])+".json")
+}
+
+func loadIdempotencyRecord(path string) (*idempotencyRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record idempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	if time.Since(record.CreatedAt) > currentConfig().IdempotencyTTL {
+		os.Remove(path)
+		return nil, os.ErrNotExist
+	}
+	return &record, nil
+}
+
+func saveIdempotencyRecord(path string, record *idempotencyRecord) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// idempotencyMiddleware replays the stored response when a write is retried
+// with the same Idempotency-Key, so a retry after a network timeout doesn't
+// commit (and notify devices) twice. Server errors aren't stored, leaving the
+// client free to retry them.
+func idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+
+		userEmail := r.Header.Get("X-User-Email")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		inflightKey := userEmail + "\x00" + key
+		if _, busy := inflightIdempotencyKeys.LoadOrStore(inflightKey, struct{}{}); busy {
+			http.Error(w, "A request with this Idempotency-Key is already in progress", http.StatusConflict)
+			return
+		}
+		defer inflightIdempotencyKeys.Delete(inflightKey)
+
+		path := getIdempotencyPath(userEmail, key)
+		if record, err := loadIdempotencyRecord(path); err == nil {
+			if record.Fingerprint != fingerprint {
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			for name, value := range record.Header {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 || rec.status >= 500 {
+			return
+		}
+
+		record := &idempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			Header:      make(map[string]string),
+			Body:        rec.body.Bytes(),
+			CreatedAt:   time.Now(),
+		}
+		for _, name := range idempotentHeaders {
+			if value := w.Header().Get(name); value != "" {
+				record.Header[name] = value
+			}
+		}
+		saveIdempotencyRecord(path, record)
+	}
+}
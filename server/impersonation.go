@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Impersonation lets an admin act as a user with a short-lived token, to
+// reproduce sync problems without the user's credentials. Tokens are scoped:
+// "read" only allows GET and HEAD, "sync" also allows writes to /sync
+// routes. Account settings can't be changed either way. Issuing, revoking
+// and every request made with a token go to the audit log. As with share
+// links, only a hash of the token is stored, and it doubles as the ID.
+const (
+	impersonationTokenPrefix  = "kiwi_imp_"
+	defaultImpersonationTTL   = 15 * time.Minute
+	maxImpersonationTTL       = time.Hour
+	maxImpersonationReasonLen = 500
+)
+
+type ImpersonationSession struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Scope     string    `json:"scope"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ImpersonateRequest struct {
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+	// Scope is "read" (the default) or "sync"
+	Scope string `json:"scope"`
+	// ExpiresIn is the token lifetime in seconds; zero means 15 minutes
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type ImpersonateResponse struct {
+	ImpersonationSession
+	Token string `json:"token"`
+}
+
+func getImpersonationPath(id string) string {
+	return filepath.Join(impersonationDir, id+".json")
+}
+
+func loadImpersonation(id string) (*ImpersonationSession, error) {
+	data, err := os.ReadFile(getImpersonationPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var session ImpersonationSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if expired(session.ExpiresAt) {
+		os.Remove(getImpersonationPath(id))
+		return nil, os.ErrNotExist
+	}
+	return &session, nil
+}
+
+func handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ImpersonateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Reason) > maxImpersonationReasonLen {
+		http.Error(w, "Reason too long", http.StatusBadRequest)
+		return
+	}
+	switch req.Scope {
+	case "":
+		req.Scope = "read"
+	case "read", "sync":
+	default:
+		http.Error(w, `Invalid scope - must be "read" or "sync"`, http.StatusBadRequest)
+		return
+	}
+	ttl := defaultImpersonationTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+		if req.ExpiresIn < 0 || ttl > maxImpersonationTTL {
+			http.Error(w, "expires_in must be between 1 second and one hour", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := loadUser(req.Email); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token = impersonationTokenPrefix + token
+	now := time.Now().UTC()
+	session := &ImpersonationSession{
+		ID:        hashShareToken(token),
+		Email:     req.Email,
+		Scope:     req.Scope,
+		Reason:    req.Reason,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(impersonationDir, 0700); err == nil {
+			err = writeFileAtomic(getImpersonationPath(session.ID), data, 0600)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to save impersonation token", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Actor: "admin", Action: "impersonation.start", Target: req.Email, Reason: req.Reason, Detail: "scope " + req.Scope + ", id " + session.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ImpersonateResponse{ImpersonationSession: *session, Token: token})
+}
+
+func handleRevokeImpersonation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	if !shareIDRegex.MatchString(id) {
+		http.Error(w, "Impersonation token not found", http.StatusNotFound)
+		return
+	}
+	session, err := loadImpersonation(id)
+	if err != nil {
+		http.Error(w, "Impersonation token not found", http.StatusNotFound)
+		return
+	}
+	if err := os.Remove(getImpersonationPath(id)); err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to revoke impersonation token", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Actor: "admin", Action: "impersonation.revoke", Target: session.Email, Detail: "id " + id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// impersonationAllows reports whether a token's scope covers the request.
+func impersonationAllows(scope string, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	return scope == "sync" && (r.Pattern == "/sync" || strings.HasPrefix(r.Pattern, "/sync/"))
+}
+
+// serveImpersonated authenticates a request made with an impersonation
+// token as the target user, and audits it once it has been served.
+func serveImpersonated(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	session, err := loadImpersonation(hashShareToken(token))
+	if err != nil {
+		metrics.authFailed("invalid_token")
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+		return
+	}
+	setImpersonatedAccessLogUser(r, session.Email)
+
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		audit(r, AuditEvent{Actor: "admin", Action: "impersonation.request", Target: session.Email, Method: r.Method, Path: r.URL.Path, Status: rec.status})
+	}()
+
+	if !impersonationAllows(session.Scope, r) {
+		http.Error(rec, "Forbidden - impersonation token has "+session.Scope+" scope", http.StatusForbidden)
+		return
+	}
+	r.Header.Set("X-User-Email", session.Email)
+	shared, ok := resolveSharedAccess(rec, r, session.Email)
+	if !ok {
+		return
+	}
+	next.ServeHTTP(rec, shared)
+}
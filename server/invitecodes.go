@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In invite-only mode (registration.invite_only) /register needs an invite
+// code, each good for one account. Admins mint codes in batches; the codes
+// are only shown then, and like org invites only a hash is stored, which
+// doubles as the code's ID. Codes are short enough to type, grouped as
+// XXXX-XXXX-XXXX, and matched ignoring case and dashes.
+const (
+	maxInviteCodeBatch = 1000
+	maxInviteCodeNote  = 200
+	inviteCodeLength   = 12
+)
+
+type InviteCode struct {
+	ID         string     `json:"id"`
+	Batch      string     `json:"batch"`
+	Note       string     `json:"note,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RedeemedBy string     `json:"redeemed_by,omitempty"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+}
+
+type InviteCodeBatchRequest struct {
+	Count     int        `json:"count"`
+	Note      string     `json:"note,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// InviteCodeBatch is a freshly minted batch. Codes are in the same order as
+// Invites and can't be retrieved again.
+type InviteCodeBatch struct {
+	Batch   string        `json:"batch"`
+	Codes   []string      `json:"codes"`
+	Invites []*InviteCode `json:"invites"`
+}
+
+type InviteCodeListResponse struct {
+	Codes    []*InviteCode `json:"codes"`
+	Total    int           `json:"total"`
+	Redeemed int           `json:"redeemed"`
+}
+
+func getInviteCodePath(id string) string {
+	return filepath.Join(inviteCodesDir, id+".json")
+}
+
+// normalizeInviteCode strips what people add when typing a code in.
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+func generateInviteCode() (string, error) {
+	b := make([]byte, inviteCodeLength*5/8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12], nil
+}
+
+func loadInviteCode(id string) (*InviteCode, error) {
+	if !shareIDRegex.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(getInviteCodePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var invite InviteCode
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func saveInviteCode(invite *InviteCode) error {
+	data, err := json.MarshalIndent(invite, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(inviteCodesDir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(getInviteCodePath(invite.ID), data, 0600)
+}
+
+// claimInviteCode checks a code presented to /register and holds it until
+// the returned release is called, so two registrations can't both redeem
+// it. It writes the error response itself when the code can't be used.
+func claimInviteCode(w http.ResponseWriter, code string) (*InviteCode, func(), bool) {
+	id := hashShareToken(normalizeInviteCode(code))
+	unlock := lockUserData("\x00invite-code\x00" + id)
+	invite, err := loadInviteCode(id)
+	switch {
+	case code == "":
+		http.Error(w, "Forbidden - registration is invite-only; an invite code is required", http.StatusForbidden)
+	case err != nil && !os.IsNotExist(err):
+		http.Error(w, "Failed to read invite code", http.StatusInternalServerError)
+	case err != nil || invite.RedeemedAt != nil || (invite.ExpiresAt != nil && expired(*invite.ExpiresAt)):
+		http.Error(w, "Forbidden - invalid or already used invite code", http.StatusForbidden)
+	default:
+		return invite, unlock, true
+	}
+	unlock()
+	return nil, nil, false
+}
+
+// redeemInviteCode marks a claimed code as used by email.
+func redeemInviteCode(invite *InviteCode, email string) {
+	now := time.Now().UTC()
+	invite.RedeemedBy, invite.RedeemedAt = email, &now
+	if err := saveInviteCode(invite); err != nil {
+		log.Printf("Failed to mark invite code %s redeemed by %s: %v", invite.ID, email, err)
+	}
+}
+
+// listInviteCodes returns every code, or a batch's, newest first.
+func listInviteCodes(batch string) ([]*InviteCode, error) {
+	entries, err := os.ReadDir(inviteCodesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var codes []*InviteCode
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		invite, err := loadInviteCode(id)
+		if err != nil || (batch != "" && invite.Batch != batch) {
+			continue
+		}
+		codes = append(codes, invite)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if !codes[i].CreatedAt.Equal(codes[j].CreatedAt) {
+			return codes[i].CreatedAt.After(codes[j].CreatedAt)
+		}
+		return codes[i].ID < codes[j].ID
+	})
+	return codes, nil
+}
+
+// handleInviteCodes lists codes with their redemption status (GET, with an
+// optional batch) or mints a batch (POST).
+func handleInviteCodes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		codes, err := listInviteCodes(r.URL.Query().Get("batch"))
+		if err != nil {
+			http.Error(w, "Failed to read invite codes", http.StatusInternalServerError)
+			return
+		}
+		resp := InviteCodeListResponse{Codes: make([]*InviteCode, 0, len(codes)), Total: len(codes)}
+		for _, invite := range codes {
+			if invite.RedeemedAt != nil {
+				resp.Redeemed++
+			}
+			resp.Codes = append(resp.Codes, invite)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodPost:
+		mintInviteCodes(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func mintInviteCodes(w http.ResponseWriter, r *http.Request) {
+	var req InviteCodeBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	switch {
+	case req.Count < 1 || req.Count > maxInviteCodeBatch:
+		http.Error(w, "Count must be between 1 and "+strconv.Itoa(maxInviteCodeBatch), http.StatusBadRequest)
+		return
+	case len(req.Note) > maxInviteCodeNote:
+		http.Error(w, "Note too long", http.StatusBadRequest)
+		return
+	case req.ExpiresAt != nil && expired(*req.ExpiresAt):
+		http.Error(w, "expires_at is in the past", http.StatusBadRequest)
+		return
+	}
+
+	batch, err := generateID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	resp := InviteCodeBatch{Batch: batch, Codes: make([]string, 0, req.Count), Invites: make([]*InviteCode, 0, req.Count)}
+	for range req.Count {
+		code, err := generateInviteCode()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		invite := &InviteCode{
+			ID:        hashShareToken(normalizeInviteCode(code)),
+			Batch:     batch,
+			Note:      req.Note,
+			CreatedAt: now,
+			ExpiresAt: req.ExpiresAt,
+		}
+		if err := saveInviteCode(invite); err != nil {
+			http.Error(w, "Failed to save invite codes", http.StatusInternalServerError)
+			return
+		}
+		resp.Codes = append(resp.Codes, code)
+		resp.Invites = append(resp.Invites, invite)
+	}
+	log.Printf("Minted %d invite codes in batch %s", req.Count, batch)
+	audit(r, AuditEvent{Actor: "admin", Action: "invite_codes.mint", Target: batch, Detail: strconv.Itoa(req.Count) + " codes"})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleInviteCode revokes a code that hasn't been redeemed.
+func handleInviteCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	unlock := lockUserData("\x00invite-code\x00" + id)
+	defer unlock()
+	invite, err := loadInviteCode(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Invite code not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read invite code", http.StatusInternalServerError)
+		}
+		return
+	}
+	if invite.RedeemedAt != nil {
+		http.Error(w, "Invite code was already redeemed by "+invite.RedeemedBy, http.StatusConflict)
+		return
+	}
+	if err := os.Remove(getInviteCodePath(id)); err != nil {
+		http.Error(w, "Failed to revoke invite code", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Actor: "admin", Action: "invite_codes.revoke", Target: id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Org invites let owners and maintainers bring in people by email. The
+// invite is bound to that address: the emailed link joins the account with
+// that email, and the code it carries can be redeemed from the CLI by the
+// same account. Like reset links, only a hash of the code is stored, and it
+// doubles as the invite's ID.
+const (
+	orgInviteTTL  = 7 * 24 * time.Hour
+	maxOrgInvites = 100
+)
+
+type OrgInvite struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type OrgInviteResponse struct {
+	OrgInvite
+	EmailSent bool `json:"email_sent"`
+	// Code and URL are handed to the inviter too, for when the email doesn't
+	// arrive. They only work for the invited address.
+	Code string `json:"code"`
+	URL  string `json:"url"`
+}
+
+type AcceptInviteRequest struct {
+	Code string `json:"code"`
+}
+
+func getOrgInvitePath(id string) string {
+	return filepath.Join(orgInvitesDir, id+".json")
+}
+
+func loadOrgInvite(id string) (*OrgInvite, error) {
+	if !shareIDRegex.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(getOrgInvitePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var invite OrgInvite
+	if err := json.Unmarshal(data, &invite); err != nil {
+		return nil, err
+	}
+	if expired(invite.ExpiresAt) {
+		os.Remove(getOrgInvitePath(id))
+		return nil, os.ErrNotExist
+	}
+	return &invite, nil
+}
+
+// loadOrgInvites returns an org's pending invites, oldest first.
+func loadOrgInvites(orgID string) ([]*OrgInvite, error) {
+	entries, err := os.ReadDir(orgInvitesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var invites []*OrgInvite
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		invite, err := loadOrgInvite(id)
+		if err != nil || invite.OrgID != orgID {
+			continue
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].CreatedAt.Before(invites[j].CreatedAt)
+	})
+	return invites, nil
+}
+
+// handleOrgInvites lists and creates invites. Both need the role to manage
+// members, and an invite can only be for a role the inviter could assign.
+func handleOrgInvites(w http.ResponseWriter, r *http.Request) {
+	unlock := lockOrg(r.PathValue("id"))
+	defer unlock()
+	org, role, ok := orgRequest(w, r)
+	if !ok {
+		return
+	}
+	if !orgRoleAtLeast(role, orgRoleMaintainer) {
+		http.Error(w, "Forbidden - only owners and maintainers can manage invites", http.StatusForbidden)
+		return
+	}
+	invites, err := loadOrgInvites(org.ID)
+	if err != nil {
+		http.Error(w, "Failed to read invites", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if invites == nil {
+			invites = []*OrgInvite{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invites)
+
+	case http.MethodPost:
+		var req OrgMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		createOrgInvite(w, r, org, role, invites, req)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createOrgInvite invites req.Email to org with req.Role and emails them the
+// link. Callers hold the org's lock and have checked that role can manage
+// members; invites are the org's pending ones.
+func createOrgInvite(w http.ResponseWriter, r *http.Request, org *Org, role string, invites []*OrgInvite, req OrgMemberRequest) {
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" || strings.ContainsAny(req.Email, "\r\n") || !strings.Contains(req.Email, "@") {
+		http.Error(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = orgRoleMember
+	}
+	if _, ok := orgRoleRank[req.Role]; !ok {
+		http.Error(w, fmt.Sprintf("Role must be %q, %q, %q or %q", orgRoleOwner, orgRoleMaintainer, orgRoleMember, orgRoleViewer), http.StatusBadRequest)
+		return
+	}
+	if !canManageOrgRole(role, req.Role) {
+		http.Error(w, "Forbidden - maintainers can only invite members and viewers", http.StatusForbidden)
+		return
+	}
+	if _, ok := org.Members[req.Email]; ok {
+		http.Error(w, req.Email+" is already a member", http.StatusConflict)
+		return
+	}
+	if len(invites) >= maxOrgInvites {
+		http.Error(w, fmt.Sprintf("Orgs can have at most %d pending invites", maxOrgInvites), http.StatusBadRequest)
+		return
+	}
+	if len(org.Members)+len(invites) >= maxOrgMembers {
+		http.Error(w, fmt.Sprintf("Orgs can have at most %d members", maxOrgMembers), http.StatusBadRequest)
+		return
+	}
+
+	code, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	invite := &OrgInvite{
+		ID:        hashShareToken(code),
+		OrgID:     org.ID,
+		OrgName:   org.Name,
+		Email:     req.Email,
+		Role:      req.Role,
+		InvitedBy: r.Header.Get("X-User-Email"),
+		CreatedAt: now,
+		ExpiresAt: now.Add(orgInviteTTL),
+	}
+	data, err := json.MarshalIndent(invite, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(orgInvitesDir, 0700); err == nil {
+			err = writeFileAtomic(getOrgInvitePath(invite.ID), data, 0600)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to save invite", http.StatusInternalServerError)
+		return
+	}
+
+	resp := OrgInviteResponse{
+		OrgInvite: *invite,
+		Code:      code,
+		URL:       requestBaseURL(r) + "/invite?code=" + url.QueryEscape(code),
+	}
+	err = sendMail(invite.Email, "You're invited to "+org.Name+" on kiwi",
+		invite.InvitedBy+" invited you to join "+org.Name+" on kiwi as a "+invite.Role+".\n\n"+
+			"Accept within 7 days here:\n\n"+resp.URL+"\n\n"+
+			"or redeem this invite code while signed in:\n\n    "+code+"\n\n"+
+			"If you don't have an account yet, create one with this email address first.\n")
+	switch {
+	case err == nil:
+		resp.EmailSent = true
+	case errors.Is(err, errMailNotConfigured):
+	default:
+		log.Printf("Failed to send the invite to %s for org %s: %v", invite.Email, org.ID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleOrgInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	unlock := lockOrg(r.PathValue("id"))
+	defer unlock()
+	org, role, ok := orgRequest(w, r)
+	if !ok {
+		return
+	}
+	invite, err := loadOrgInvite(r.PathValue("invite"))
+	if err != nil || invite.OrgID != org.ID {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if !canManageOrgRole(role, invite.Role) {
+		http.Error(w, "Forbidden - you can't revoke this invite", http.StatusForbidden)
+		return
+	}
+	if err := os.Remove(getOrgInvitePath(invite.ID)); err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptOrgInvite adds the invited account to the org and uses up the
+// invite. Someone who's already a member keeps their current role.
+func acceptOrgInvite(invite *OrgInvite) (*Org, string, int, error) {
+	unlock := lockOrg(invite.OrgID)
+	defer unlock()
+
+	org, err := loadOrg(invite.OrgID)
+	if err != nil {
+		os.Remove(getOrgInvitePath(invite.ID))
+		return nil, "", http.StatusNotFound, errors.New("This org no longer exists")
+	}
+	if !inTenant(org.Tenant, invite.Email) {
+		return nil, "", http.StatusForbidden, errors.New("This invite is for an org on another tenant")
+	}
+	role, member := org.Members[invite.Email]
+	if !member {
+		if len(org.Members) >= maxOrgMembers {
+			return nil, "", http.StatusConflict, fmt.Errorf("%s is full", org.Name)
+		}
+		role = invite.Role
+		org.Members[invite.Email] = role
+		if err := saveOrg(org); err != nil {
+			return nil, "", http.StatusInternalServerError, errors.New("Failed to save org")
+		}
+	}
+	if err := setUserOrg(invite.Email, org.ID, true); err != nil {
+		return nil, "", http.StatusInternalServerError, errors.New("Failed to save org")
+	}
+	os.Remove(getOrgInvitePath(invite.ID))
+	return org, role, http.StatusOK, nil
+}
+
+// handleAcceptInvite redeems an invite code for the signed in account,
+// which must be the one it was sent to.
+func handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req AcceptInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	invite, err := loadOrgInvite(hashShareToken(strings.TrimSpace(req.Code)))
+	if req.Code == "" || err != nil || invite.Email != r.Header.Get("X-User-Email") {
+		http.Error(w, "This invite is invalid or has expired", http.StatusNotFound)
+		return
+	}
+	org, role, status, err := acceptOrgInvite(invite)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org.view(role))
+}
+
+var orgInvitePage = template.Must(template.New("invite").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Join {{.OrgName}} on kiwi</title></head>
+<body>
+{{if .Done}}<p>You've joined {{.OrgName}}. Its shared files arrive on your next <code>kiwi pull</code>.</p>
+{{else if .Error}}<p><strong>{{.Error}}</strong></p>
+{{else}}<h1>Join {{.OrgName}} on kiwi</h1>
+<p>{{.InvitedBy}} invited {{.Email}} to join as a {{.Role}}.</p>
+<form method="post">
+<input type="hidden" name="code" value="{{.Code}}">
+<button type="submit">Accept invite</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type orgInvitePageData struct {
+	OrgName   string
+	InvitedBy string
+	Email     string
+	Role      string
+	Code      string
+	Error     string
+	Done      bool
+}
+
+// handleInvitePage serves the page behind an emailed invite link. Having
+// the link is taken as proof of owning the address, as with reset links,
+// so accepting doesn't need a session.
+func handleInvitePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	code := r.FormValue("code")
+	invite, err := loadOrgInvite(hashShareToken(code))
+	if code == "" || err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		orgInvitePage.Execute(w, orgInvitePageData{OrgName: "an org", Error: "This invite is invalid or has expired"})
+		return
+	}
+	data := orgInvitePageData{
+		OrgName:   invite.OrgName,
+		InvitedBy: invite.InvitedBy,
+		Email:     invite.Email,
+		Role:      invite.Role,
+		Code:      code,
+	}
+	if r.Method == http.MethodGet {
+		orgInvitePage.Execute(w, data)
+		return
+	}
+
+	if _, err := loadUser(invite.Email); err != nil {
+		data.Error = "Create a kiwi account for " + invite.Email + " first, then open this link again"
+		w.WriteHeader(http.StatusConflict)
+		orgInvitePage.Execute(w, data)
+		return
+	}
+	if _, _, status, err := acceptOrgInvite(invite); err != nil {
+		data.Error = err.Error()
+		w.WriteHeader(status)
+		orgInvitePage.Execute(w, data)
+		return
+	}
+	data.Done = true
+	orgInvitePage.Execute(w, data)
+}
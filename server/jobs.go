@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recurring maintenance runs on an in-process scheduler. Each job has an
+// interval in the [jobs] config table; runs are spread by a random jitter so
+// instances started together don't hit storage at the same moment. Intervals
+// are re-read every jobRecheck, so a SIGHUP applies without a restart.
+const (
+	jobRecheck     = time.Minute
+	jobHistorySize = 20
+)
+
+type job struct {
+	name     string
+	interval func(c *Config) time.Duration
+	// run returns a short summary of what it did
+	run func(ctx context.Context) (string, error)
+}
+
+var jobs = []job{
+	{"snapshot_gc", func(c *Config) time.Duration { return c.SnapshotGCInterval }, runSnapshotGC},
+	{"session_cleanup", func(c *Config) time.Duration { return c.SessionCleanupInterval }, runSessionCleanup},
+	{"metrics_rollup", func(c *Config) time.Duration { return c.MetricsRollupInterval }, runMetricsRollup},
+	{"backup", func(c *Config) time.Duration {
+		if c.BackupDir == "" {
+			return 0
+		}
+		return c.BackupInterval
+	}, runBackup},
+	{"metering", func(c *Config) time.Duration {
+		if c.MeteringWebhook == "" && c.MeteringFile == "" {
+			return 0
+		}
+		return c.MeteringInterval
+	}, runMetering},
+}
+
+type JobRun struct {
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Summary    string    `json:"summary,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type JobStatus struct {
+	Name     string     `json:"name"`
+	Interval string     `json:"interval"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	Runs     []JobRun   `json:"runs"`
+}
+
+type jobState struct {
+	job
+	trigger chan struct{}
+	running bool
+	next    time.Time
+	runs    []JobRun // newest first
+}
+
+type jobScheduler struct {
+	mu    sync.Mutex
+	state map[string]*jobState
+}
+
+var scheduler = &jobScheduler{state: make(map[string]*jobState)}
+
+// start launches a goroutine per job that runs until ctx is done.
+func (s *jobScheduler) start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range jobs {
+		st := &jobState{job: j, trigger: make(chan struct{}, 1), runs: make([]JobRun, 0)}
+		s.state[j.name] = st
+		go s.loop(ctx, st)
+	}
+}
+
+func (s *jobScheduler) loop(ctx context.Context, st *jobState) {
+	var interval time.Duration
+	var next time.Time
+	for {
+		cfg := currentConfig()
+		if current := st.interval(cfg); current != interval || (interval > 0 && next.IsZero()) {
+			interval = current
+			next = time.Time{}
+			if interval > 0 {
+				next = time.Now().Add(interval + jitter(cfg.JobJitter))
+			}
+			s.mu.Lock()
+			st.next = next
+			s.mu.Unlock()
+		}
+
+		wait := jobRecheck
+		if interval > 0 && time.Until(next) < wait {
+			wait = max(time.Until(next), 0)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-st.trigger:
+			s.run(ctx, st, "manual")
+		case <-time.After(wait):
+			if interval > 0 && !time.Now().Before(next) {
+				s.run(ctx, st, "schedule")
+				next = time.Time{}
+			}
+		}
+	}
+}
+
+func jitter(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit)
+}
+
+func (s *jobScheduler) run(ctx context.Context, st *jobState, trigger string) {
+	s.mu.Lock()
+	st.running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	summary, err := st.run(ctx)
+	record := JobRun{Trigger: trigger, StartedAt: start.UTC(), DurationMs: time.Since(start).Milliseconds(), Summary: summary}
+	if err != nil {
+		record.Error = err.Error()
+		log.Printf("Job %s failed: %v", st.name, err)
+	}
+
+	s.mu.Lock()
+	st.running = false
+	st.runs = append([]JobRun{record}, st.runs...)
+	if len(st.runs) > jobHistorySize {
+		st.runs = st.runs[:jobHistorySize]
+	}
+	s.mu.Unlock()
+}
+
+// trigger asks a job to run now. It reports whether the job exists and
+// whether it was already running or queued, in which case nothing changes.
+func (s *jobScheduler) trigger(name string) (found, busy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.state[name]
+	if !ok {
+		return false, false
+	}
+	if st.running {
+		return true, true
+	}
+	select {
+	case st.trigger <- struct{}{}:
+		return true, false
+	default:
+		return true, true
+	}
+}
+
+func (s *jobScheduler) status() []JobStatus {
+	cfg := currentConfig()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		st := s.state[j.name]
+		status := JobStatus{Name: j.name, Interval: "off", Runs: make([]JobRun, 0)}
+		if interval := j.interval(cfg); interval > 0 {
+			status.Interval = interval.String()
+		}
+		if st != nil {
+			status.Running = st.running
+			status.Runs = append(status.Runs, st.runs...)
+			if !st.next.IsZero() {
+				next := st.next.UTC()
+				status.NextRun = &next
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// runSnapshotGC trims every user's snapshots to the retention setting.
+// Commits only prune every retention-th revision, and lowering the setting
+// doesn't touch existing snapshots, so this catches up.
+func runSnapshotGC(ctx context.Context) (string, error) {
+	users, err := listUsers()
+	if err != nil {
+		return "", err
+	}
+	keep := int64(currentConfig().SnapshotRetention)
+	pruned := 0
+	purged := purgeExpiredTrials(ctx, users)
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		unlock := lockUserData(user.Email)
+		state, err := loadSyncState(user.Email)
+		if err == nil && state.Revision > keep {
+			before := countSnapshots(user.Email)
+			err = pruneSnapshots(user.Email, state.Revision-keep)
+			pruned += before - countSnapshots(user.Email)
+		}
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Snapshot GC failed for a user: %v", err)
+		}
+	}
+	return fmt.Sprintf("pruned %d snapshots across %d users, purged %d expired trial accounts", pruned, len(users), purged), nil
+}
+
+// runSessionCleanup deletes expired transactions, uploads, idempotency
+// records, shares, impersonation tokens and password reset links. Their loaders already drop expired entries on access,
+// so this only sweeps what nobody asked for again.
+func runSessionCleanup(ctx context.Context) (string, error) {
+	users, err := listUsers()
+	if err != nil {
+		return "", err
+	}
+	removed := 0
+	sweep := func(dir, suffix string, load func(name string) error) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), suffix)
+			if !ok || entry.IsDir() {
+				continue
+			}
+			if err := load(name); os.IsNotExist(err) {
+				removed++
+			}
+		}
+	}
+
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		email := user.Email
+		sweep(filepath.Join(getUserDataDir(email), "transactions"), ".json", func(id string) error {
+			defer lockTransaction(email, id)()
+			_, err := loadTransaction(email, id)
+			return err
+		})
+		sweep(getUploadsDir(email), ".json", func(id string) error {
+			_, err := loadUpload(email, id)
+			return err
+		})
+		sweep(filepath.Join(getUserDataDir(email), "idempotency"), ".json", func(name string) error {
+			_, err := loadIdempotencyRecord(filepath.Join(getUserDataDir(email), "idempotency", name+".json"))
+			return err
+		})
+	}
+	sweep(sharesDir, ".json", func(id string) error {
+		_, err := loadShare(id)
+		return err
+	})
+	sweep(impersonationDir, ".json", func(id string) error {
+		_, err := loadImpersonation(id)
+		return err
+	})
+	sweep(passwordResetsDir, ".json", func(id string) error {
+		_, err := loadPasswordReset(id)
+		return err
+	})
+	sweep(orgInvitesDir, ".json", func(id string) error {
+		_, err := loadOrgInvite(id)
+		return err
+	})
+	sweep(webSessionsDir, ".json", func(id string) error {
+		_, err := loadWebSession(id)
+		return err
+	})
+	abuse.prune()
+	pruneAccountLimiters()
+	return fmt.Sprintf("removed %d expired entries", removed), nil
+}
+
+// MetricsRollup is one line of the rollup log, recording usage at the time
+// of the run.
+type MetricsRollup struct {
+	Time             time.Time `json:"time"`
+	Users            int       `json:"users"`
+	StorageBytes     int64     `json:"storage_bytes"`
+	SyncRequestsHour uint64    `json:"sync_requests_hour"`
+}
+
+// runMetricsRollup appends current usage to a monthly JSON lines file under
+// the storage root, keeping history that outlives the in-memory metrics, and
+// saves the per-user usage counters.
+func runMetricsRollup(ctx context.Context) (string, error) {
+	now := time.Now().UTC()
+	storageBytes, users := metrics.storageUsage()
+	_, hour, _ := metrics.syncRequestCounts()
+	line, err := json.Marshal(MetricsRollup{Time: now, Users: users, StorageBytes: storageBytes, SyncRequestsHour: hour})
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(currentConfig().StorageRoot, "rollups")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, now.Format("2006-01")+".jsonl")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	flushed, err := usage.flush()
+	if err != nil {
+		return "", err
+	}
+	warned, err := checkQuotaWarnings(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("appended to %s, flushed usage for %d users, sent %d quota warnings", path, flushed, warned), nil
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduler.status())
+}
+
+func handleJobRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	found, busy := scheduler.trigger(r.PathValue("name"))
+	if !found {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if busy {
+		http.Error(w, "Job is already running", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// systemd passes activated sockets starting at this descriptor.
+const listenFDsStart = 3
+
+// listen opens the server's listener. A socket handed over by a restarting
+// parent or by systemd wins, then server.socket, then the TCP port.
+func listen(cfg *Config) (net.Listener, error) {
+	ln, err := inheritedListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	ln, err = systemdListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	if cfg.Socket != "" {
+		return listenUnix(cfg.Socket)
+	}
+	return net.Listen("tcp", ":"+cfg.Port)
+}
+
+// systemdListener returns the first socket passed via the LISTEN_FDS
+// protocol, or nil if the process wasn't socket-activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("LISTEN_FDS is set but passes no sockets")
+	}
+	// Don't leak the variables to anything we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(listenFDsStart)
+	f := os.NewFile(listenFDsStart, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket: %w", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a unix domain socket, replacing a stale socket file
+// left by an earlier run. The socket is group-accessible so a reverse proxy
+// in the same group can connect.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an append-only log file that rolls over when it grows
+// past maxSize or gets older than maxAge. Rolled files are renamed with a
+// timestamp suffix next to the original, and the oldest are deleted once
+// there are more than keep of them or they're older than retain.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	every   time.Duration
+	keep    int
+	retain  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+const rotatedSuffixFormat = "20060102T150405"
+
+// openLogFile opens path with the rotation settings from the [log] table.
+func openLogFile(cfg *Config, path string) (*rotatingFile, error) {
+	return openRotatingFile(path, int64(cfg.LogMaxSizeMB)<<20, cfg.LogRotateEvery, cfg.LogMaxBackups, cfg.LogMaxAge)
+}
+
+func openRotatingFile(path string, maxSize int64, every time.Duration, keep int, retain time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, every: every, keep: keep, retain: retain}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	// A file left by an earlier run is as old as its last write, which is
+	// close enough for time-based rotation
+	r.opened = time.Now()
+	if r.size > 0 {
+		r.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize || r.every > 0 && time.Since(r.opened) >= r.every) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "log rotation failed for %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	rotated := r.path + "." + time.Now().UTC().Format(rotatedSuffixFormat)
+	if _, err := os.Stat(rotated); err == nil {
+		rotated += fmt.Sprintf(".%d", time.Now().UnixNano())
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		// Nothing was lost; writes go on to the renamed file
+		return err
+	}
+	old.Close()
+	r.prune()
+	return nil
+}
+
+// prune removes rolled files beyond the retention limits.
+func (r *rotatingFile) prune() {
+	dir, base := filepath.Dir(r.path), filepath.Base(r.path)+"."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), base) && !entry.IsDir() {
+			rotated = append(rotated, entry.Name())
+		}
+	}
+	// The timestamp suffix sorts oldest first
+	sort.Strings(rotated)
+	for i, name := range rotated {
+		path := filepath.Join(dir, name)
+		tooMany := r.keep > 0 && len(rotated)-i > r.keep
+		tooOld := false
+		if info, err := os.Stat(path); err == nil && r.retain > 0 {
+			tooOld = time.Since(info.ModTime()) > r.retain
+		}
+		if tooMany || tooOld {
+			os.Remove(path)
+		}
+	}
+}
@@ -1,35 +1,73 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	_ "embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/time/rate"
 )
 
 type User struct {
 	Email     string    `json:"email"`
-	Password  string    `json:"-"`
+	Username  string    `json:"username,omitempty"`
+	Password  string    `json:"password,omitempty"`
 	Token     string    `json:"token,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
+	// Suspension is set while an admin has blocked the account
+	Suspension *Suspension `json:"suspension,omitempty"`
+	// TermsAccepted is the last terms of service version the user accepted
+	TermsAccepted *TermsAcceptance `json:"terms_accepted,omitempty"`
+	// Tenant is the tenant the account registered in; "" is the default
+	Tenant string `json:"tenant,omitempty"`
+	// TrialExpiresAt is set on trial accounts, which are deleted after it
+	TrialExpiresAt *time.Time `json:"trial_expires_at,omitempty"`
+	// Tier is the account's tier; "" is tiers.default
+	Tier string `json:"tier,omitempty"`
+	// Notifications holds the security emails turned on or off; missing
+	// kinds are on
+	Notifications map[string]bool `json:"notifications,omitempty"`
+	// QuotaWarnedAt is set while the account has been warned its storage is
+	// nearly full
+	QuotaWarnedAt *time.Time `json:"quota_warned_at,omitempty"`
+}
+
+type Suspension struct {
+	Reason      string    `json:"reason,omitempty"`
+	SuspendedAt time.Time `json:"suspended_at"`
 }
 
 type SyncData struct {
 	Files    map[string]string `json:"files"`
 	Packages []Package         `json:"packages"`
+	// Vectors optionally carries the version vector of each pushed file.
+	// It's never stored as part of the sync data.
+	Vectors map[string]VersionVector `json:"vectors,omitempty"`
 }
 
 type Package struct {
@@ -38,6 +76,59 @@ type Package struct {
 	Installed bool    `json:"installed"`
 }
 
+type FileInfo struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type FileListResponse struct {
+	Files      []FileInfo `json:"files"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+type ManifestEntry struct {
+	Hash   string        `json:"hash"`
+	Size   int           `json:"size"`
+	MTime  time.Time     `json:"mtime"`
+	Vector VersionVector `json:"vector,omitempty"`
+}
+
+type ManifestResponse struct {
+	Revision         int64                    `json:"revision"`
+	PackagesRevision int64                    `json:"packages_revision"`
+	Files            map[string]ManifestEntry `json:"files"`
+}
+
+type ChangesResponse struct {
+	Changes []ChangeEvent `json:"changes"`
+	Cursor  string        `json:"cursor"`
+	HasMore bool          `json:"has_more"`
+}
+
+type BatchOperation struct {
+	Op      string   `json:"op"`
+	Path    string   `json:"path,omitempty"`
+	Content *string  `json:"content,omitempty"`
+	Package *Package `json:"package,omitempty"`
+	Name    string   `json:"name,omitempty"`
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchResponse struct {
+	Status   string `json:"status"`
+	Revision int64  `json:"revision"`
+	Applied  int    `json:"applied"`
+}
+
+type PackagesRequest struct {
+	Add    []Package `json:"add"`
+	Remove []string  `json:"remove"`
+}
+
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -46,14 +137,44 @@ type LoginRequest struct {
 type RegisterRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// InviteCode is required when registration is invite-only
+	InviteCode string `json:"invite_code,omitempty"`
 }
 
 const (
+	defaultFileListLimit = 100
+	maxFileListLimit     = 1000
+	defaultChangesLimit  = 500
+	maxChangesLimit      = 5000
+	maxBatchOperations   = 1000
+)
+
+const authTokenEnv = "KIWI_AUTH_TOKEN"
+
+// Storage directories live under storage.root; see applyConfig.
+var (
 	dataDir      = "/opt/kiwi/data"
 	usersDir     = "/opt/kiwi/users"
-	authTokenEnv = "KIWI_AUTH_TOKEN"
+	sharesDir    = "/opt/kiwi/shares"
+	usernamesDir = "/opt/kiwi/usernames"
+	// impersonationDir holds admin impersonation tokens; see impersonation.go
+	impersonationDir = "/opt/kiwi/impersonation"
+	// passwordResetsDir holds pending reset links; see credentials.go
+	passwordResetsDir = "/opt/kiwi/password_resets"
+	orgsDir           = "/opt/kiwi/orgs"
+	// orgInvitesDir holds pending org invites; see invites.go
+	orgInvitesDir = "/opt/kiwi/org_invites"
+	// webSessionsDir holds dashboard sign-ins; see sessions.go
+	webSessionsDir = "/opt/kiwi/web_sessions"
+	// tenantsDir holds tenant definitions; see tenants.go
+	tenantsDir = "/opt/kiwi/tenants"
+	// inviteCodesDir holds registration invite codes; see invitecodes.go
+	inviteCodesDir = "/opt/kiwi/invite_codes"
 )
 
+//go:embed openapi.json
+var openAPISpec []byte
+
 var (
 	limiter    = rate.NewLimiter(rate.Every(time.Second), 10)
 	emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
@@ -67,16 +188,52 @@ func generateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-func getUserPath(email string) string {
+// generateID returns a random 128-bit identifier for server-side records.
+func generateID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// userHash is the name an account's user file and data directory are
+// stored under.
+func userHash(email string) string {
 	hash := sha256.Sum256([]byte(email))
-	userHash := base64.URLEncoding.EncodeToString(hash[:])
-	return filepath.Join(usersDir, userHash+".json")
+	return base64.URLEncoding.EncodeToString(hash[:])
+}
+
+func getUserPath(email string) string {
+	return filepath.Join(usersDir, userHash(email)+".json")
 }
 
 func getUserDataDir(email string) string {
-	hash := sha256.Sum256([]byte(email))
-	userHash := base64.URLEncoding.EncodeToString(hash[:])
-	return filepath.Join(dataDir, userHash)
+	return filepath.Join(dataDir, userHash(email))
+}
+
+// listUsers reads every account, skipping files that can't be parsed.
+func listUsers() ([]User, error) {
+	entries, err := os.ReadDir(usersDir)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(usersDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil || user.Email == "" {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
 }
 
 func loadUser(email string) (*User, error) {
@@ -96,13 +253,132 @@ func saveUser(user *User) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(getUserPath(user.Email), data, 0600)
+	if err := os.WriteFile(getUserPath(user.Email), data, 0600); err != nil {
+		return err
+	}
+	accountIndex.put(user)
+	return nil
+}
+
+func loadSyncData(email string) (*SyncData, error) {
+	syncData := &SyncData{
+		Files:    make(map[string]string),
+		Packages: make([]Package, 0),
+	}
+	data, err := os.ReadFile(filepath.Join(getUserDataDir(email), "sync_data.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return syncData, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, syncData); err != nil {
+		return nil, err
+	}
+	if syncData.Files == nil {
+		syncData.Files = make(map[string]string)
+	}
+	if syncData.Packages == nil {
+		syncData.Packages = make([]Package, 0)
+	}
+	return syncData, nil
+}
+
+func saveSyncData(email string, syncData *SyncData) error {
+	userDataDir := getUserDataDir(email)
+	if err := os.MkdirAll(userDataDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(syncData, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(userDataDir, "sync_data.json"), data, 0644)
+}
+
+func hashContent(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+// upsertPackage adds pkg, updating an already tracked package in place.
+func upsertPackage(packages []Package, pkg Package) []Package {
+	for i := range packages {
+		if packages[i].Name == pkg.Name {
+			updated := append([]Package(nil), packages...)
+			updated[i] = pkg
+			return updated
+		}
+	}
+	return append(append(make([]Package, 0, len(packages)+1), packages...), pkg)
+}
+
+func removePackage(packages []Package, name string) []Package {
+	kept := make([]Package, 0, len(packages))
+	for _, pkg := range packages {
+		if pkg.Name != name {
+			kept = append(kept, pkg)
+		}
+	}
+	return kept
+}
+
+// writeFileAtomic replaces path in one step so readers never observe a
+// partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// mergePatch applies an RFC 7386 JSON Merge Patch to target: objects are
+// merged recursively, null removes a member and any other value replaces it.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
 }
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Only this middleware decides who the caller is
+		r.Header.Del("X-User-Role")
+		r.Header.Del("X-Admin-Tenant")
+
 		auth := r.Header.Get("Authorization")
 		if auth == "" {
+			metrics.authFailed("missing_token")
 			http.Error(w, "Unauthorized - No token provided", http.StatusUnauthorized)
 			return
 		}
@@ -114,11 +390,25 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		// First check if it's an admin token
 		if auth == os.Getenv(authTokenEnv) {
+			setAccessLogUser(r, "admin")
 			r.Header.Set("X-User-Role", "admin")
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if strings.HasPrefix(auth, impersonationTokenPrefix) {
+			serveImpersonated(w, r, auth, next)
+			return
+		}
+		if strings.HasPrefix(auth, webSessionTokenPrefix) {
+			serveWebSession(w, r, auth, next)
+			return
+		}
+		if strings.HasPrefix(auth, tenantAdminTokenPrefix) {
+			serveTenantAdmin(w, r, auth, next)
+			return
+		}
+
 		// Try to find user by token
 		files, err := os.ReadDir(usersDir)
 		if err != nil {
@@ -145,19 +435,47 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			}
 		}
 
-		if foundUser == nil {
+		if foundUser == nil || !inRequestTenant(r, foundUser) {
+			metrics.authFailed("invalid_token")
 			http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
 			return
 		}
 
+		setAccessLogUser(r, foundUser.Email)
+		if foundUser.Suspension != nil {
+			metrics.authFailed("suspended")
+			writeSuspended(w, foundUser.Suspension)
+			return
+		}
+		if trialRestricted(w, r, foundUser) || termsPending(w, r, foundUser) || tenantOverQuota(w, r, foundUser) || tierRestricted(w, r, foundUser) {
+			return
+		}
 		r.Header.Set("X-User-Email", foundUser.Email)
+		r, ok := resolveSharedAccess(w, r, foundUser.Email)
+		if !ok {
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 }
 
+// rateLimitMiddleware throttles requests and reports the limiter's state on
+// every response, so clients can pace themselves before hitting a 429.
+// X-RateLimit-Reset is the number of seconds until the bucket is full again.
 func rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
+		now := time.Now()
+		allowed := limiter.AllowN(now, 1)
+		tokens := math.Max(limiter.TokensAt(now), 0)
+		perSecond := float64(limiter.Limit())
+
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(limiter.Burst()))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil((float64(limiter.Burst())-tokens)/perSecond))))
+		if !allowed {
+			metrics.rateLimitRejected()
+			h.Set("Retry-After", strconv.Itoa(int(math.Max(math.Ceil((1-tokens)/perSecond), 1))))
 			http.Error(w, "Too many requests", http.StatusTooManyRequests)
 			return
 		}
@@ -176,6 +494,115 @@ func secureHeaders(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// compressResponseWriter encodes the response body with the coding that was
+// negotiated from Accept-Encoding.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	enc io.Writer
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	c.Header().Del("Content-Length")
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	return c.enc.Write(b)
+}
+
+// negotiateEncoding picks the response coding from the Accept-Encoding
+// header: whichever of zstd and gzip has the higher q-value, zstd on a tie,
+// or "" when neither is acceptable. An explicit q=0 opts a coding out even
+// if * would allow it.
+func negotiateEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "zstd" && coding != "gzip" && coding != "*" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				weight = v
+			}
+		}
+		q[coding] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"zstd", "gzip"} {
+		weight, ok := q[coding]
+		if !ok {
+			weight = q["*"]
+		}
+		if weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
+
+// compressionMiddleware decodes gzip and zstd request bodies and encodes the
+// response with whichever of the two the client prefers. Decoded bodies are
+// capped at maxUploadSize whatever the abuse settings, so a small compressed
+// body can't expand without limit in the handlers behind it.
+func compressionMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+		case "gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			r.Body = http.MaxBytesReader(w, gz, maxUploadSize)
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		case "zstd":
+			zr, err := zstd.NewReader(r.Body, zstd.WithDecoderMaxMemory(maxUploadSize))
+			if err != nil {
+				http.Error(w, "Invalid zstd request body", http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r.Body = http.MaxBytesReader(w, io.NopCloser(zr), maxUploadSize)
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			w.Header().Set("Accept-Encoding", "zstd, gzip")
+			http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		switch negotiateEncoding(r.Header.Get("Accept-Encoding")) {
+		case "zstd":
+			zw, err := zstd.NewWriter(w)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			defer zw.Close()
+			w.Header().Set("Content-Encoding", "zstd")
+			next.ServeHTTP(&compressResponseWriter{ResponseWriter: w, enc: zw}, r)
+		case "gzip":
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			next.ServeHTTP(&compressResponseWriter{ResponseWriter: w, enc: gz}, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
 func validateEmail(email string) bool {
 	return emailRegex.MatchString(email)
 }
@@ -198,11 +625,29 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tenant, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unknown tenant", http.StatusBadRequest)
+		return
+	}
+
 	// Check if user exists
 	if _, err := loadUser(req.Email); err == nil {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
+	if tenantFull(tenant) {
+		http.Error(w, "Forbidden - this tenant has reached its account limit", http.StatusForbidden)
+		return
+	}
+	var invite *InviteCode
+	if currentConfig().InviteOnly {
+		var release func()
+		if invite, release, ok = claimInviteCode(w, req.InviteCode); !ok {
+			return
+		}
+		defer release()
+	}
 
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
@@ -224,6 +669,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		Password:  string(hashedPassword),
 		Token:     token,
 		CreatedAt: time.Now(),
+		Tenant:    tenant,
 	}
 
 	// Save user
@@ -232,6 +678,10 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if invite != nil {
+		redeemInviteCode(invite, user.Email)
+	}
+
 	// Create user data directory
 	userDataDir := getUserDataDir(req.Email)
 	if err := os.MkdirAll(userDataDir, 0755); err != nil {
@@ -257,15 +707,22 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, err := loadUser(req.Email)
-	if err != nil {
+	if err != nil || !inRequestTenant(r, user) {
+		metrics.authFailed("invalid_credentials")
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		metrics.authFailed("invalid_credentials")
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if user.Suspension != nil {
+		metrics.authFailed("suspended")
+		writeSuspended(w, user.Suspension)
+		return
+	}
 
 	// Generate new token
 	token, err := generateToken()
@@ -279,6 +736,8 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to update user", http.StatusInternalServerError)
 		return
 	}
+	notify(user, notifyTokenRevoked, "Your kiwi API token was replaced",
+		"Signing in to kiwi "+requestOrigin(r)+" replaced your API token, so the old one no longer works.\n\nIf this wasn't you, change your password.\n")
 
 	// Return user data (without password)
 	user.Password = ""
@@ -295,8 +754,45 @@ func handleSync(w http.ResponseWriter, r *http.Request) {
 	userDataDir := getUserDataDir(userEmail)
 	syncFilePath := filepath.Join(userDataDir, "sync_data.json")
 
+	acl := requestACL(r)
+
 	switch r.Method {
 	case http.MethodGet:
+		state, err := loadSyncState(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+		setRevisionHeaders(w, state)
+
+		if acl != nil {
+			syncData, err := loadSyncData(userEmail)
+			if err != nil {
+				http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(filterSyncData(acl, syncData))
+			return
+		}
+
+		orgData, orgTag, err := orgSyncData(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read org sets", http.StatusInternalServerError)
+			return
+		}
+		if orgTag != "" {
+			syncData, err := loadSyncData(userEmail)
+			if err != nil {
+				http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Kiwi-Org-Revision", orgTag)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(mergeOrgData(syncData, orgData))
+			return
+		}
+
 		data, err := os.ReadFile(syncFilePath)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -313,44 +809,572 @@ func handleSync(w http.ResponseWriter, r *http.Request) {
 		w.Write(data)
 
 	case http.MethodPost:
+		base, err := parseIfMatch(r)
+		if err != nil {
+			http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+
 		var syncData SyncData
 		if err := json.NewDecoder(r.Body).Decode(&syncData); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		if syncData.Files, err = normalizePathKeys(syncData.Files); err != nil {
+			http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if syncData.Vectors, err = normalizePathKeys(syncData.Vectors); err != nil {
+			http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if syncData.Files == nil {
+			syncData.Files = make(map[string]string)
+		}
+		if syncData.Packages == nil {
+			syncData.Packages = make([]Package, 0)
+		}
+
+		unlock := lockUserData(userEmail)
+		defer unlock()
 
-		if err := os.MkdirAll(userDataDir, 0755); err != nil {
-			http.Error(w, "Failed to create user directory", http.StatusInternalServerError)
+		next := &syncData
+		if acl != nil {
+			current, err := loadSyncData(userEmail)
+			if err != nil {
+				http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+				return
+			}
+			if next, err = applySharedWrite(acl, current, &syncData); err != nil {
+				http.Error(w, "Forbidden - "+err.Error(), http.StatusForbidden)
+				return
+			}
+		} else if !stripOrgPush(w, userEmail, nil, next) {
 			return
 		}
 
-		data, err := json.MarshalIndent(syncData, "", "  ")
+		state, conflict, err := commitSyncData(r.Context(), userEmail, next, base)
 		if err != nil {
-			http.Error(w, "Failed to marshal sync data", http.StatusInternalServerError)
+			writeCommitError(w, err)
 			return
 		}
-
-		if err := os.WriteFile(syncFilePath, data, 0644); err != nil {
-			http.Error(w, "Failed to save sync data", http.StatusInternalServerError)
+		if conflict != nil {
+			writeConflict(w, state, conflict)
 			return
 		}
 
+		setRevisionHeaders(w, state)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status": "ok"}`))
 
+	case http.MethodPatch:
+		contentType := r.Header.Get("Content-Type")
+		if contentType != "" && !strings.HasPrefix(contentType, "application/merge-patch+json") && !strings.HasPrefix(contentType, "application/json") {
+			http.Error(w, "Unsupported media type - expected application/merge-patch+json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		base, err := parseIfMatch(r)
+		if err != nil {
+			http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+
+		var patch map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// Only the paths the patch names are checked, so files stored
+		// before validation existed can still be patched around
+		if files, ok := patch["files"].(map[string]interface{}); ok {
+			if patch["files"], err = normalizePathKeys(files); err != nil {
+				http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		unlock := lockUserData(userEmail)
+		defer unlock()
+
+		current, err := loadSyncData(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+
+		// Apply the patch to the same document shape clients see on GET
+		view := current
+		if acl != nil {
+			view = filterSyncData(acl, current)
+		}
+		raw, err := json.Marshal(view)
+		if err != nil {
+			http.Error(w, "Failed to marshal sync data", http.StatusInternalServerError)
+			return
+		}
+		var doc interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+
+		raw, err = json.Marshal(mergePatch(doc, patch))
+		if err != nil {
+			http.Error(w, "Failed to apply patch", http.StatusInternalServerError)
+			return
+		}
+		patched := &SyncData{}
+		if err := json.Unmarshal(raw, patched); err != nil {
+			http.Error(w, "Patch produces an invalid sync document", http.StatusBadRequest)
+			return
+		}
+		if patched.Files == nil {
+			patched.Files = make(map[string]string)
+		}
+		if patched.Packages == nil {
+			patched.Packages = make([]Package, 0)
+		}
+		next := patched
+		if acl != nil {
+			if next, err = applySharedWrite(acl, current, patched); err != nil {
+				http.Error(w, "Forbidden - "+err.Error(), http.StatusForbidden)
+				return
+			}
+		} else if !stripOrgPush(w, userEmail, current, next) {
+			return
+		}
+
+		state, conflict, err := commitSyncData(r.Context(), userEmail, next, base)
+		if err != nil {
+			writeCommitError(w, err)
+			return
+		}
+		if conflict != nil {
+			writeConflict(w, state, conflict)
+			return
+		}
+
+		setRevisionHeaders(w, state)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(patched)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSyncPackages(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		syncData, err := loadSyncData(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(syncData.Packages)
+
+	case http.MethodPost:
+		base, err := parseIfMatch(r)
+		if err != nil {
+			http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+
+		var req PackagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for _, pkg := range req.Add {
+			if pkg.Name == "" {
+				http.Error(w, "Package name is required", http.StatusBadRequest)
+				return
+			}
+		}
+
+		unlock := lockUserData(userEmail)
+		defer unlock()
+
+		syncData, err := loadSyncData(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+
+		// Removals are applied first so a package can be replaced in one request
+		packages := syncData.Packages
+		for _, name := range req.Remove {
+			packages = removePackage(packages, name)
+		}
+		for _, pkg := range req.Add {
+			packages = upsertPackage(packages, pkg)
+		}
+
+		syncData.Packages = packages
+		state, conflict, err := commitSyncData(r.Context(), userEmail, syncData, base)
+		if err != nil {
+			writeCommitError(w, err)
+			return
+		}
+		if conflict != nil {
+			writeConflict(w, state, conflict)
+			return
+		}
+
+		setRevisionHeaders(w, state)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(syncData.Packages)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSyncFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultFileListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxFileListLimit)
+	}
+
+	// The cursor is the last path of the previous page, opaque to clients
+	var after string
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		after = string(decoded)
+	}
+
+	syncData, err := loadSyncData(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	if acl := requestACL(r); acl != nil {
+		syncData = filterSyncData(acl, syncData)
+	}
+
+	paths := make([]string, 0, len(syncData.Files))
+	for path := range syncData.Files {
+		if path > after {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	resp := FileListResponse{Files: make([]FileInfo, 0, min(len(paths), limit))}
+	for _, path := range paths {
+		if len(resp.Files) == limit {
+			resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(resp.Files[limit-1].Path))
+			break
+		}
+		content := syncData.Files[path]
+		resp.Files = append(resp.Files, FileInfo{
+			Path: path,
+			Size: len(content),
+			Hash: hashContent(content),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleSyncManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	state, err := loadSyncState(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	setRevisionHeaders(w, state)
+
+	// Clients polling for drift can skip the body entirely when nothing changed
+	if match := r.Header.Get("If-None-Match"); match != "" && match == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	resp := ManifestResponse{
+		Revision:         state.Revision,
+		PackagesRevision: state.PackagesRevision,
+		Files:            make(map[string]ManifestEntry, len(state.Files)),
+	}
+	acl := requestACL(r)
+	for path, fs := range state.Files {
+		if fs.Deleted || acl != nil && !acl.CanRead(path) {
+			continue
+		}
+		resp.Files[path] = ManifestEntry{Hash: fs.Hash, Size: fs.Size, MTime: fs.UpdatedAt, Vector: fs.Vector}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleSyncChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultChangesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxChangesLimit)
+	}
+
+	since, err := decodeChangeCursor(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	state, err := loadSyncState(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	setRevisionHeaders(w, state)
+
+	changes := changesSince(state, since)
+	if acl := requestACL(r); acl != nil {
+		visible := changes[:0]
+		for _, change := range changes {
+			if change.Path != "" && acl.CanRead(change.Path) {
+				visible = append(visible, change)
+			}
+		}
+		changes = visible
+	}
+	resp := ChangesResponse{Changes: changes, Cursor: encodeChangeCursor(changeCursor{Revision: state.Revision})}
+	if resp.Changes == nil {
+		resp.Changes = make([]ChangeEvent, 0)
+	}
+	if len(changes) > limit {
+		last := changes[limit-1]
+		resp.Changes = changes[:limit]
+		resp.Cursor = encodeChangeCursor(changeCursor{Revision: last.Revision, Path: last.Path})
+		resp.HasMore = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// applyBatchOperation applies op to syncData in place, returning a
+// client-facing error if the operation is invalid.
+func applyBatchOperation(syncData *SyncData, op BatchOperation) error {
+	if op.Op == "put_file" || op.Op == "delete_file" {
+		path, err := normalizeFilePath(op.Path)
+		if err != nil && op.Path != "" {
+			return err
+		}
+		op.Path = path
+	}
+	switch op.Op {
+	case "put_file":
+		if op.Path == "" || op.Content == nil {
+			return fmt.Errorf("put_file requires path and content")
+		}
+		syncData.Files[op.Path] = *op.Content
+	case "delete_file":
+		if op.Path == "" {
+			return fmt.Errorf("delete_file requires path")
+		}
+		if _, ok := syncData.Files[op.Path]; !ok {
+			return fmt.Errorf("file not found: %s", op.Path)
+		}
+		delete(syncData.Files, op.Path)
+	case "add_package":
+		if op.Package == nil || op.Package.Name == "" {
+			return fmt.Errorf("add_package requires a package with a name")
+		}
+		syncData.Packages = upsertPackage(syncData.Packages, *op.Package)
+	case "remove_package":
+		if op.Name == "" {
+			return fmt.Errorf("remove_package requires name")
+		}
+		remaining := removePackage(syncData.Packages, op.Name)
+		if len(remaining) == len(syncData.Packages) {
+			return fmt.Errorf("package not found: %s", op.Name)
+		}
+		syncData.Packages = remaining
 	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	return nil
+}
+
+func handleSyncBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	base, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
+	if len(req.Operations) == 0 {
+		http.Error(w, "No operations provided", http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		http.Error(w, fmt.Sprintf("Too many operations (max %d)", maxBatchOperations), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	unlock := lockUserData(userEmail)
+	defer unlock()
+
+	syncData, err := loadSyncData(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+
+	// Operations apply to an in-memory copy; nothing is written unless all succeed
+	for i, op := range req.Operations {
+		if err := applyBatchOperation(syncData, op); err != nil {
+			http.Error(w, fmt.Sprintf("Operation %d failed: %v", i, err), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	state, conflict, err := commitSyncData(r.Context(), userEmail, syncData, base)
+	if err != nil {
+		writeCommitError(w, err)
+		return
+	}
+	if conflict != nil {
+		writeConflict(w, state, conflict)
+		return
+	}
+
+	setRevisionHeaders(w, state)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchResponse{
+		Status:   "ok",
+		Revision: state.Revision,
+		Applied:  len(req.Operations),
+	})
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to the config file (default "+defaultConfigPath+")")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--config path] [doctor | admin ...]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  doctor\tcheck the configuration and environment without starting the server")
+		fmt.Fprintln(flag.CommandLine.Output(), "  admin\tmanage users and run backups on a running server (see admin --help)")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// Load .env file
 	if err := godotenv.Load(); err != nil {
 		log.Println("Warning: .env file not found")
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "doctor":
+		os.Exit(runDoctor(*configPath))
+	case "admin":
+		os.Exit(runAdmin(*configPath, flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	applyConfig(cfg)
+
+	if cfg.LogFile != "" {
+		logFile, err := openLogFile(cfg, cfg.LogFile)
+		if err != nil {
+			log.Fatal("Failed to open log file: ", err)
+		}
+		log.SetOutput(logFile)
+	}
+
+	// Reload the settings that can change at runtime on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(*configPath); err != nil {
+				log.Printf("Config reload failed, keeping the current config: %v", err)
+				continue
+			}
+			log.Println("Config reloaded")
+		}
+	}()
+
 	// Ensure directories exist with proper permissions
-	for _, dir := range []string{dataDir, usersDir} {
+	for _, dir := range []string{dataDir, usersDir, sharesDir, usernamesDir} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Fatal("Failed to create directory:", err)
 		}
@@ -360,37 +1384,169 @@ func main() {
 		}
 	}
 
+	loadAnnouncement()
+	loadReleases()
+	loadFlags()
+	if err := loadTenants(); err != nil {
+		log.Fatal("Failed to read tenants: ", err)
+	}
+
 	// Check if admin token is set
 	if os.Getenv("KIWI_AUTH_TOKEN") == "" {
 		log.Fatal("KIWI_AUTH_TOKEN environment variable must be set")
 	}
 
+	// Apply middleware chain. API routes are mounted below under each
+	// version prefix.
+	api := http.NewServeMux()
+	api.HandleFunc("/versions", secureHeaders(handleAPIVersions))
+	api.HandleFunc("/time", secureHeaders(rateLimitMiddleware(handleTime)))
+	api.HandleFunc("/announcements", secureHeaders(rateLimitMiddleware(handleAnnouncements)))
+	api.HandleFunc("/releases/{channel}", secureHeaders(rateLimitMiddleware(handleRelease)))
+	api.HandleFunc("/register", secureHeaders(rateLimitMiddleware(handleRegister)))
+	api.HandleFunc("/login", secureHeaders(rateLimitMiddleware(handleLogin)))
+	api.HandleFunc("/trial", secureHeaders(rateLimitMiddleware(handleTrial)))
+	api.HandleFunc("/reset-password", secureHeaders(rateLimitMiddleware(handlePasswordReset)))
+	api.HandleFunc("/invite", secureHeaders(rateLimitMiddleware(handleInvitePage)))
+	api.HandleFunc("/sync", secureHeaders(rateLimitMiddleware(allowSharedAccess(authMiddleware(compressionMiddleware(codecMiddleware(idempotencyMiddleware(deviceActivityMiddleware(handleSync)))))))))
+	api.HandleFunc("/sync/files", secureHeaders(rateLimitMiddleware(allowSharedAccess(authMiddleware(compressionMiddleware(codecMiddleware(deviceActivityMiddleware(handleSyncFiles))))))))
+	api.HandleFunc("/sync/files/{path...}", secureHeaders(rateLimitMiddleware(allowSharedAccess(authMiddleware(deviceActivityMiddleware(handleSyncFile))))))
+	api.HandleFunc("/sync/blobs/{hash}", secureHeaders(rateLimitMiddleware(authMiddleware(deviceActivityMiddleware(handleSyncBlob)))))
+	api.HandleFunc("/sync/ws", secureHeaders(rateLimitMiddleware(authMiddleware(handleSyncWS))))
+	api.HandleFunc("/sync/changes", secureHeaders(rateLimitMiddleware(allowSharedAccess(authMiddleware(compressionMiddleware(codecMiddleware(deviceActivityMiddleware(handleSyncChanges))))))))
+	api.HandleFunc("/sync/manifest", secureHeaders(rateLimitMiddleware(allowSharedAccess(authMiddleware(compressionMiddleware(codecMiddleware(deviceActivityMiddleware(handleSyncManifest))))))))
+	api.HandleFunc("/sync/batch", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(idempotencyMiddleware(deviceActivityMiddleware(handleSyncBatch))))))))
+	api.HandleFunc("/sync/plan", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(handleSyncPlan))))))
+	api.HandleFunc("/sync/merge", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(handleSyncMerge))))))
+	api.HandleFunc("/sync/snapshots/{revision}", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(handleSyncSnapshot))))))
+	api.HandleFunc("/sync/signature", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(deviceActivityMiddleware(handleSyncSignature)))))))
+	api.HandleFunc("/sync/delta", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(idempotencyMiddleware(deviceActivityMiddleware(handleSyncDelta))))))))
+	api.HandleFunc("/sync/transactions", secureHeaders(rateLimitMiddleware(authMiddleware(handleTransactions))))
+	api.HandleFunc("/sync/transactions/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(handleTransaction))))
+	api.HandleFunc("/sync/transactions/{id}/files/{path...}", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(handleTransactionFile)))))
+	api.HandleFunc("/sync/transactions/{id}/packages", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(handleTransactionPackages)))))
+	api.HandleFunc("/sync/transactions/{id}/commit", secureHeaders(rateLimitMiddleware(authMiddleware(idempotencyMiddleware(deviceActivityMiddleware(handleTransactionCommit))))))
+	api.HandleFunc("/sync/packages", secureHeaders(rateLimitMiddleware(authMiddleware(compressionMiddleware(codecMiddleware(idempotencyMiddleware(deviceActivityMiddleware(handleSyncPackages))))))))
+	api.HandleFunc("/devices", secureHeaders(rateLimitMiddleware(authMiddleware(handleDevices))))
+	api.HandleFunc("/devices/register", secureHeaders(rateLimitMiddleware(authMiddleware(handleDeviceRegister))))
+	api.HandleFunc("/devices/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(handleDevice))))
+	api.HandleFunc("/devices/{id}/revoke", secureHeaders(rateLimitMiddleware(authMiddleware(handleDeviceRevoke))))
+	api.HandleFunc("/sessions", secureHeaders(rateLimitMiddleware(handleSessions)))
+	api.HandleFunc("/sessions/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(handleSession))))
+	api.HandleFunc("/shares", secureHeaders(rateLimitMiddleware(authMiddleware(handleShares))))
+	api.HandleFunc("/shares/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(handleShare))))
+	api.HandleFunc("/s/{token}", secureHeaders(rateLimitMiddleware(handleSharedFile)))
+	api.HandleFunc("/profile", secureHeaders(rateLimitMiddleware(authMiddleware(handleProfile))))
+	api.HandleFunc("/flags", secureHeaders(rateLimitMiddleware(authMiddleware(handleFlags))))
+	api.HandleFunc("/terms", secureHeaders(rateLimitMiddleware(authMiddleware(handleTerms))))
+	api.HandleFunc("/account", secureHeaders(rateLimitMiddleware(authMiddleware(handleAccount))))
+	api.HandleFunc("/account/token", secureHeaders(rateLimitMiddleware(authMiddleware(handleAccountToken))))
+	api.HandleFunc("/account/usage", secureHeaders(rateLimitMiddleware(authMiddleware(handleAccountUsage))))
+	api.HandleFunc("/account/notifications", secureHeaders(rateLimitMiddleware(authMiddleware(handleNotifications))))
+	api.HandleFunc("/u/{username}", secureHeaders(rateLimitMiddleware(handlePublicProfile)))
+	api.HandleFunc("/u/{username}/{path...}", secureHeaders(rateLimitMiddleware(handlePublicProfile)))
+	api.HandleFunc("/filesets", secureHeaders(rateLimitMiddleware(authMiddleware(handleFileSets))))
+	api.HandleFunc("/filesets/{name}", secureHeaders(rateLimitMiddleware(authMiddleware(handleFileSet))))
+	api.HandleFunc("/shared", secureHeaders(rateLimitMiddleware(authMiddleware(handleSharedWithMe))))
+	api.HandleFunc("/orgs", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrgs))))
+	api.HandleFunc("/orgs/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrg))))
+	api.HandleFunc("/orgs/{id}/members", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrgMembers))))
+	api.HandleFunc("/orgs/{id}/members/{email}", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrgMember))))
+	api.HandleFunc("/orgs/{id}/sets/{name}", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrgSet))))
+	api.HandleFunc("/orgs/{id}/invites", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrgInvites))))
+	api.HandleFunc("/orgs/{id}/invites/{invite}", secureHeaders(rateLimitMiddleware(authMiddleware(handleOrgInvite))))
+	api.HandleFunc("/invites/accept", secureHeaders(rateLimitMiddleware(authMiddleware(handleAcceptInvite))))
+	api.HandleFunc("/uploads", secureHeaders(rateLimitMiddleware(authMiddleware(handleUploads))))
+	api.HandleFunc("/uploads/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(handleUpload))))
+	api.HandleFunc("/admin/stats", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleAdminStats)))))
+	api.HandleFunc("/admin/users", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleAdminUsers)))))
+	api.HandleFunc("/admin/users/search", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleAdminUserSearch)))))
+	api.HandleFunc("/admin/users/{email}", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleDeleteUser)))))
+	api.HandleFunc("/admin/users/{email}/suspend", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleSuspendUser)))))
+	api.HandleFunc("/admin/users/{email}/reactivate", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleReactivateUser)))))
+	api.HandleFunc("/admin/users/{email}/tier", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleUserTier)))))
+	api.HandleFunc("/admin/users/{email}/reset-credentials", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleResetCredentials)))))
+	api.HandleFunc("/admin/impersonate", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleImpersonate)))))
+	api.HandleFunc("/admin/impersonate/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleRevokeImpersonation)))))
+	api.HandleFunc("/admin/usage", secureHeaders(rateLimitMiddleware(authMiddleware(requireAdmin(handleAdminUsage)))))
+	api.HandleFunc("/admin/announcement", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleAdminAnnouncement)))))
+	api.HandleFunc("/admin/releases/{channel}", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleAdminRelease)))))
+	api.HandleFunc("/admin/flags", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleAdminFlags)))))
+	api.HandleFunc("/admin/flags/{name}", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleAdminFlag)))))
+	api.HandleFunc("/admin/tenants", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleTenants)))))
+	api.HandleFunc("/admin/tenants/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleTenant)))))
+	api.HandleFunc("/admin/tenants/{id}/token", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleTenantToken)))))
+	api.HandleFunc("/admin/abuse", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleAdminAbuse)))))
+	api.HandleFunc("/admin/abuse/{ip...}", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleAdminAbuseBlock)))))
+	api.HandleFunc("/admin/invite-codes", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleInviteCodes)))))
+	api.HandleFunc("/admin/invite-codes/{id}", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleInviteCode)))))
+	api.HandleFunc("/admin/jobs", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleJobs)))))
+	api.HandleFunc("/admin/jobs/{name}/run", secureHeaders(rateLimitMiddleware(authMiddleware(requireServerAdmin(handleJobRun)))))
+
 	// Create a new ServeMux for better route handling
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", handleLivez)
+	mux.HandleFunc("/livez", handleLivez)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/healthz/details", secureHeaders(authMiddleware(requireServerAdmin(handleHealthDetails))))
+
+	mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+		w.Write(openAPISpec)
 	})
 
-	// Apply middleware chain
-	mux.HandleFunc("/register", secureHeaders(rateLimitMiddleware(handleRegister)))
-	mux.HandleFunc("/login", secureHeaders(rateLimitMiddleware(handleLogin)))
-	mux.HandleFunc("/sync", secureHeaders(rateLimitMiddleware(authMiddleware(handleSync))))
+	mux.HandleFunc("/metrics", secureHeaders(authMiddleware(requireServerAdmin(handleMetrics))))
+	mux.Handle("/ui/", gateMiddleware(secureHeaders(dashboardHandler().ServeHTTP)))
+	mux.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	registerPprof(mux)
+	mux.Handle("/v1/", http.StripPrefix("/v1", withAPIVersion(1, withAnnouncement(instrument(gateMiddleware(abuseMiddleware(timeoutMiddleware(api))))))))
+	mux.Handle("/", withAPIVersion(legacyAPIVersion, withAnnouncement(instrument(gateMiddleware(abuseMiddleware(timeoutMiddleware(api)))))))
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	var handler http.Handler = mux
+	if cfg.SentryDSN != "" || cfg.ErrorWebhook != "" {
+		reporter, err := newErrorReporter(cfg.SentryDSN, cfg.ErrorWebhook)
+		if err != nil {
+			log.Fatal("Failed to set up error reporting:", err)
+		}
+		handler = reporter.middleware(handler)
+	}
+	if cfg.AccessLog != "" {
+		accessLog, err := newAccessLogger(cfg)
+		if err != nil {
+			log.Fatal("Failed to open access log:", err)
+		}
+		handler = accessLog.middleware(handler)
 	}
 
 	server := &http.Server{
-		Addr:         ":" + port,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Handler: handler,
+		// API routes replace these with their own budgets
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
 	}
 
+	// Hijacked WebSocket connections aren't tracked by Shutdown
+	server.RegisterOnShutdown(syncHub.closeAll)
+
+	if cfg.ACMEHost != "" {
+		// autocert answers TLS-ALPN-01 challenges on the HTTPS listener,
+		// renews ahead of expiry and backs off after failed issuance.
+		certs := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEHost),
+			Cache:      autocert.DirCache(filepath.Join(cfg.StorageRoot, "acme")),
+			Email:      cfg.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: cfg.ACMEDirectory},
+		}
+		server.TLSConfig = certs.TLSConfig()
+	}
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	scheduler.start(jobsCtx)
+
 	// Graceful shutdown setup
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
@@ -399,6 +1555,8 @@ func main() {
 	go func() {
 		<-quit
 		log.Println("Server is shutting down...")
+		draining.Store(true)
+		stopJobs()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
@@ -410,11 +1568,50 @@ func main() {
 		close(done)
 	}()
 
-	log.Printf("Starting server on port %s", port)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	ln, err := listen(cfg)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+
+	// Hand the listener to a new binary on SIGUSR2, then drain like SIGTERM
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			log.Println("Restarting...")
+			if err := restart(ln); err != nil {
+				log.Printf("Restart failed, still serving: %v", err)
+				continue
+			}
+			log.Println("New process is serving")
+			quit <- syscall.SIGTERM
+			return
+		}
+	}()
+
+	log.Printf("Starting server on %s %s", ln.Addr().Network(), ln.Addr())
+	notifyParentReady()
+	switch {
+	case cfg.TLSCertFile != "":
+		err = server.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+	case server.TLSConfig != nil:
+		err = server.ServeTLS(ln, "", "")
+	default:
+		err = server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 
 	<-done
+	if _, err := usage.flush(); err != nil {
+		log.Printf("Failed to save usage counters: %v", err)
+	}
+	// Activity since the last metering run would be lost otherwise
+	meterCtx, cancel := context.WithTimeout(context.Background(), meterTimeout)
+	if _, err := runMetering(meterCtx); err != nil {
+		log.Printf("Failed to publish usage events: %v", err)
+	}
+	cancel()
 	log.Println("Server stopped")
 }
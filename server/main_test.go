@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"zstd", "zstd"},
+		{"gzip, zstd", "zstd"},
+		{"gzip;q=1, zstd;q=0.5", "gzip"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "gzip"},
+		{"*;q=0", ""},
+		{"br, deflate", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionMiddlewareRoundTrip(t *testing.T) {
+	echo := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	payload := bytes.Repeat([]byte("export PATH=$HOME/bin:$PATH\n"), 100)
+
+	for _, coding := range []string{"gzip", "zstd"} {
+		t.Run(coding, func(t *testing.T) {
+			var body bytes.Buffer
+			var enc io.WriteCloser
+			if coding == "gzip" {
+				enc = gzip.NewWriter(&body)
+			} else {
+				enc, _ = zstd.NewWriter(&body)
+			}
+			enc.Write(payload)
+			enc.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/sync", &body)
+			req.Header.Set("Content-Encoding", coding)
+			req.Header.Set("Accept-Encoding", coding)
+			rec := httptest.NewRecorder()
+			echo(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != coding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, coding)
+			}
+			var dec io.Reader
+			if coding == "gzip" {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dec = gz
+			} else {
+				zr, err := zstd.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zr.Close()
+				dec = zr
+			}
+			got, err := io.ReadAll(dec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("round trip returned %d bytes, want %d", len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestCompressionMiddlewareRejectsUnknownEncoding(t *testing.T) {
+	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	req := httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader([]byte("x")))
+	req.Header.Set("Content-Encoding", "br")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status = %d, want 415", rec.Code)
+	}
+}
+
+func TestCompressionMiddlewareCapsDecodedBody(t *testing.T) {
+	var readErr error
+	handler := compressionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.Copy(io.Discard, r.Body)
+	})
+
+	for _, coding := range []string{"gzip", "zstd"} {
+		t.Run(coding, func(t *testing.T) {
+			var body bytes.Buffer
+			var enc io.WriteCloser
+			if coding == "gzip" {
+				enc, _ = gzip.NewWriterLevel(&body, gzip.BestSpeed)
+			} else {
+				enc, _ = zstd.NewWriter(&body, zstd.WithEncoderLevel(zstd.SpeedFastest))
+			}
+			zeros := make([]byte, 1<<20)
+			for i := 0; i <= maxUploadSize>>20; i++ {
+				enc.Write(zeros)
+			}
+			enc.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/sync", &body)
+			req.Header.Set("Content-Encoding", coding)
+			handler(httptest.NewRecorder(), req)
+			var tooLarge *http.MaxBytesError
+			if !errors.As(readErr, &tooLarge) {
+				t.Errorf("reading a body past maxUploadSize: %v, want *http.MaxBytesError", readErr)
+			}
+		})
+	}
+}
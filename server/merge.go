@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Files whose line-by-line comparison would need more cells than this are
+// reported as conflicting instead of merged.
+const maxMergeCells = 4 << 20
+
+type MergeRequest struct {
+	Base     int64             `json:"base"`
+	Files    map[string]string `json:"files"`
+	Packages []Package         `json:"packages"`
+}
+
+// MergeConflict flags a file that couldn't be merged cleanly. For "content"
+// conflicts the merged file holds conflict markers; for "delete_modify" it
+// holds the side that kept the file.
+type MergeConflict struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type MergeResponse struct {
+	BaseRevision     int64             `json:"base_revision"`
+	Revision         int64             `json:"revision"`
+	Files            map[string]string `json:"files"`
+	Packages         []Package         `json:"packages"`
+	Conflicts        []MergeConflict   `json:"conflicts"`
+	PackageConflicts []string          `json:"package_conflicts"`
+}
+
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.SplitAfter(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// lcsMatches maps each line of a to the index of its partner in b along a
+// longest common subsequence, or -1 if it has none.
+func lcsMatches(a, b []string) []int {
+	n, m := len(a), len(b)
+	lengths := make([][]int, n+1)
+	for i := range lengths {
+		lengths[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	matches := make([]int, n)
+	for i := range matches {
+		matches[i] = -1
+	}
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[i] == b[j]:
+			matches[i] = j
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+// merge3 merges ours and theirs line by line against their common ancestor.
+// Hunks changed on only one side are taken from that side; hunks changed
+// differently on both sides are written out between conflict markers.
+func merge3(base, ours, theirs string) (string, bool) {
+	// Restore the trailing newline dropped by splitLines if either side has it
+	withNewline := strings.HasSuffix(ours, "\n") || strings.HasSuffix(theirs, "\n")
+	b, o, t := splitLines(base), splitLines(ours), splitLines(theirs)
+	if len(b)*len(o) > maxMergeCells || len(b)*len(t) > maxMergeCells {
+		return ours, false
+	}
+	for _, lines := range [][]string{b, o, t} {
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			lines[len(lines)-1] += "\n"
+		}
+	}
+	matchOurs, matchTheirs := lcsMatches(b, o), lcsMatches(b, t)
+
+	var out strings.Builder
+	clean := true
+	i, j, k := 0, 0, 0
+	for i < len(b) || j < len(o) || k < len(t) {
+		// Lines unchanged on both sides
+		n := 0
+		for i+n < len(b) && matchOurs[i+n] == j+n && matchTheirs[i+n] == k+n {
+			out.WriteString(b[i+n])
+			n++
+		}
+		if n > 0 {
+			i, j, k = i+n, j+n, k+n
+			continue
+		}
+
+		// Otherwise the hunk runs up to the next base line both sides kept
+		l, jo, kt := i, len(o), len(t)
+		for ; l < len(b); l++ {
+			if matchOurs[l] >= 0 && matchTheirs[l] >= 0 {
+				jo, kt = matchOurs[l], matchTheirs[l]
+				break
+			}
+		}
+		baseHunk := strings.Join(b[i:l], "")
+		oursHunk := strings.Join(o[j:jo], "")
+		theirsHunk := strings.Join(t[k:kt], "")
+		switch {
+		case oursHunk == baseHunk || oursHunk == theirsHunk:
+			out.WriteString(theirsHunk)
+		case theirsHunk == baseHunk:
+			out.WriteString(oursHunk)
+		default:
+			clean = false
+			out.WriteString("<<<<<<< yours\n")
+			out.WriteString(oursHunk)
+			out.WriteString("=======\n")
+			out.WriteString(theirsHunk)
+			out.WriteString(">>>>>>> theirs\n")
+		}
+		i, j, k = l, jo, kt
+	}
+
+	merged := out.String()
+	if clean && !withNewline {
+		merged = strings.TrimSuffix(merged, "\n")
+	}
+	return merged, clean
+}
+
+// mergeFile three-way merges a single file. A nil pointer means the file
+// doesn't exist on that side.
+func mergeFile(base, ours, theirs *string) (*string, string) {
+	equal := func(a, b *string) bool {
+		return a == nil && b == nil || a != nil && b != nil && *a == *b
+	}
+	switch {
+	case equal(ours, theirs), equal(base, theirs):
+		return ours, ""
+	case equal(base, ours):
+		return theirs, ""
+	case ours == nil:
+		return theirs, "delete_modify"
+	case theirs == nil:
+		return ours, "delete_modify"
+	}
+
+	var baseContent string
+	if base != nil {
+		baseContent = *base
+	}
+	merged, clean := merge3(baseContent, *ours, *theirs)
+	if !clean {
+		return &merged, "content"
+	}
+	return &merged, ""
+}
+
+func mergeFiles(base, ours, theirs map[string]string) (map[string]string, []MergeConflict) {
+	lookup := func(files map[string]string, path string) *string {
+		if content, ok := files[path]; ok {
+			return &content
+		}
+		return nil
+	}
+
+	paths := make(map[string]bool)
+	for _, files := range []map[string]string{base, ours, theirs} {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+
+	merged := make(map[string]string)
+	conflicts := make([]MergeConflict, 0)
+	for path := range paths {
+		result, reason := mergeFile(lookup(base, path), lookup(ours, path), lookup(theirs, path))
+		if result != nil {
+			merged[path] = *result
+		}
+		if reason != "" {
+			conflicts = append(conflicts, MergeConflict{Path: path, Reason: reason})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return merged, conflicts
+}
+
+// mergePackages merges package lists by name, keeping the client's entry
+// when both sides changed the same package differently.
+func mergePackages(base, ours, theirs []Package) ([]Package, []string) {
+	index := func(packages []Package) map[string]Package {
+		byName := make(map[string]Package, len(packages))
+		for _, pkg := range packages {
+			byName[pkg.Name] = pkg
+		}
+		return byName
+	}
+	baseByName, oursByName, theirsByName := index(base), index(ours), index(theirs)
+	same := func(a Package, aok bool, b Package, bok bool) bool {
+		return aok == bok && (!aok || packagesEqual([]Package{a}, []Package{b}))
+	}
+
+	// Keep the client's ordering, followed by packages only the server has
+	merged := make([]Package, 0, len(ours))
+	conflicts := make([]string, 0)
+	names := make([]string, 0, len(ours)+len(theirs))
+	seen := make(map[string]bool)
+	for _, packages := range [][]Package{ours, theirs, base} {
+		for _, pkg := range packages {
+			if !seen[pkg.Name] {
+				seen[pkg.Name] = true
+				names = append(names, pkg.Name)
+			}
+		}
+	}
+	for _, name := range names {
+		b, bok := baseByName[name]
+		o, ook := oursByName[name]
+		t, tok := theirsByName[name]
+
+		result, ok := o, ook
+		switch {
+		case same(o, ook, t, tok), same(b, bok, t, tok):
+		case same(b, bok, o, ook):
+			result, ok = t, tok
+		default:
+			conflicts = append(conflicts, name)
+			if !ook {
+				result, ok = t, tok
+			}
+		}
+		if ok {
+			merged = append(merged, result)
+		}
+	}
+	return merged, conflicts
+}
+
+func handleSyncMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req MergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	files, err := normalizePathKeys(req.Files)
+	if err != nil {
+		http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Files = files
+	if req.Files == nil {
+		req.Files = make(map[string]string)
+	}
+	if req.Packages == nil {
+		req.Packages = make([]Package, 0)
+	}
+
+	unlock := lockUserData(userEmail)
+	state, err := loadSyncState(userEmail)
+	if err != nil {
+		unlock()
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	current, err := loadSyncData(userEmail)
+	if err != nil {
+		unlock()
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	base, err := loadSnapshotData(userEmail, req.Base, state)
+	unlock()
+	if err != nil {
+		if errors.Is(err, errSnapshotNotFound) {
+			http.Error(w, "Unknown base snapshot - it may have been pruned", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	files, conflicts := mergeFiles(base.Files, req.Files, current.Files)
+	packages, packageConflicts := mergePackages(base.Packages, req.Packages, current.Packages)
+
+	// Nothing is committed; the client pushes the result with If-Match set
+	// to the returned revision.
+	setRevisionHeaders(w, state)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MergeResponse{
+		BaseRevision:     req.Base,
+		Revision:         state.Revision,
+		Files:            files,
+		Packages:         packages,
+		Conflicts:        conflicts,
+		PackageConflicts: packageConflicts,
+	})
+}
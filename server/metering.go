@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Metering publishes a usage event per account on every run of the metering
+// job, for hosted operators to bill from. Events go to a webhook as batched
+// JSON POSTs, signed with HMAC-SHA256 when a secret is set, and/or are
+// appended as JSON lines to a file that a queue forwarder can tail. Activity
+// counts are what happened since the previous event; storage and devices are
+// snapshots. Events that fail to go out are sent again on the next run with
+// the same IDs, so consumers should deduplicate on ID.
+const (
+	meterBatchSize       = 500
+	maxMeterRetry        = 10000
+	meterTimeout         = 30 * time.Second
+	meterSignatureHeader = "X-Kiwi-Signature"
+)
+
+type MeterEvent struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Account      string    `json:"account"`
+	Tenant       string    `json:"tenant,omitempty"`
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	StorageBytes int64     `json:"storage_bytes"`
+	Devices      int       `json:"devices"`
+	UsageTotals
+}
+
+type MeterBatch struct {
+	Server string       `json:"server"`
+	Sent   time.Time    `json:"sent"`
+	Events []MeterEvent `json:"events"`
+}
+
+// meterPublisher delivers one batch of events to a sink.
+type meterPublisher interface {
+	publish(ctx context.Context, batch *MeterBatch) error
+}
+
+type webhookMeterPublisher struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (p *webhookMeterPublisher) publish(ctx context.Context, batch *MeterBatch) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.secret))
+		mac.Write(body)
+		req.Header.Set(meterSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("metering webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// fileMeterPublisher appends one event per line, so the file can also be a
+// named pipe read by a queue producer.
+type fileMeterPublisher struct {
+	path string
+}
+
+func (p *fileMeterPublisher) publish(ctx context.Context, batch *MeterBatch) error {
+	var buf bytes.Buffer
+	for _, event := range batch.Events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// meterPublishers returns the sinks set up in cfg. They're built per run so
+// a reload takes effect on the next one.
+func meterPublishers(cfg *Config) ([]meterPublisher, error) {
+	var publishers []meterPublisher
+	if cfg.MeteringWebhook != "" {
+		u, err := url.Parse(cfg.MeteringWebhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid metering webhook URL %q", cfg.MeteringWebhook)
+		}
+		publishers = append(publishers, &webhookMeterPublisher{
+			url:    cfg.MeteringWebhook,
+			secret: cfg.MeteringSecret,
+			client: &http.Client{Timeout: meterTimeout},
+		})
+	}
+	if cfg.MeteringFile != "" {
+		publishers = append(publishers, &fileMeterPublisher{path: cfg.MeteringFile})
+	}
+	return publishers, nil
+}
+
+// meterState tracks activity since the last run, and events waiting to be
+// sent again.
+type meterState struct {
+	mu      sync.Mutex
+	since   time.Time
+	pending map[string]*UsageTotals
+	retry   []MeterEvent
+}
+
+var metering = &meterState{since: time.Now().UTC(), pending: make(map[string]*UsageTotals)}
+
+func (m *meterState) record(email string, push bool, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	totals := m.pending[email]
+	if totals == nil {
+		totals = &UsageTotals{}
+		m.pending[email] = totals
+	}
+	totals.SyncRequests++
+	if push {
+		totals.Pushes++
+	}
+	totals.BytesIn += in
+	totals.BytesOut += out
+}
+
+// take hands over the counters and undelivered events, starting a new period.
+func (m *meterState) take(now time.Time) (map[string]*UsageTotals, []MeterEvent, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending, retry, since := m.pending, m.retry, m.since
+	m.pending, m.retry, m.since = make(map[string]*UsageTotals), nil, now
+	return pending, retry, since
+}
+
+// requeue keeps events for the next run, dropping the oldest past
+// maxMeterRetry.
+func (m *meterState) requeue(events []MeterEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retry = append(events, m.retry...)
+	if dropped := len(m.retry) - maxMeterRetry; dropped > 0 {
+		log.Printf("Metering: dropping %d undelivered events", dropped)
+		m.retry = m.retry[dropped:]
+	}
+}
+
+func runMetering(ctx context.Context) (string, error) {
+	publishers, err := meterPublishers(currentConfig())
+	if err != nil || len(publishers) == 0 {
+		return "", err
+	}
+	users, err := listUsers()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	pending, events, since := metering.take(now)
+	retried := len(events)
+	for _, user := range users {
+		event := MeterEvent{
+			Type:         "usage",
+			Account:      user.Email,
+			Tenant:       user.Tenant,
+			PeriodStart:  since,
+			PeriodEnd:    now,
+			StorageBytes: userStorageBytes(user.Email),
+		}
+		// One event per account and period
+		sum := sha256.Sum256([]byte(user.Email + "\x00" + now.Format(time.RFC3339Nano)))
+		event.ID = hex.EncodeToString(sum[:16])
+		if devices, err := loadDevices(user.Email); err == nil {
+			event.Devices = len(devices)
+		}
+		if totals := pending[user.Email]; totals != nil {
+			event.UsageTotals = *totals
+		}
+		events = append(events, event)
+	}
+
+	hostname, _ := os.Hostname()
+	var failed []MeterEvent
+	var errs []error
+	for start := 0; start < len(events); start += meterBatchSize {
+		batch := &MeterBatch{Server: hostname, Sent: now, Events: events[start:min(start+meterBatchSize, len(events))]}
+		for _, p := range publishers {
+			if err := p.publish(ctx, batch); err != nil {
+				errs = append(errs, err)
+				failed = append(failed, batch.Events...)
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		metering.requeue(failed)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return "", fmt.Errorf("published %d of %d events: %w", len(events)-len(failed), len(events), err)
+	}
+	return fmt.Sprintf("published %d events, %d of them retried", len(events), retried), nil
+}
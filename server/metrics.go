@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are kept in memory and rendered in the Prometheus text format on
+// GET /metrics, which needs the admin token. Storage usage is measured by
+// walking the data directory, so it's cached between scrapes.
+const storageScanInterval = time.Minute
+
+var (
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	payloadBuckets  = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, upper := range buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// minuteCounter counts events per minute over the last day.
+type minuteCounter struct {
+	counts [24 * 60]uint64
+	minute int64 // minute of the newest bucket, in Unix minutes
+}
+
+func (c *minuteCounter) advance(now time.Time) {
+	minute := now.Unix() / 60
+	for m := c.minute + 1; m <= minute && m <= c.minute+int64(len(c.counts)); m++ {
+		c.counts[m%int64(len(c.counts))] = 0
+	}
+	if minute > c.minute {
+		c.minute = minute
+	}
+}
+
+func (c *minuteCounter) add(now time.Time) {
+	c.advance(now)
+	c.counts[c.minute%int64(len(c.counts))]++
+}
+
+// sum returns the count over the last n minutes, including the current one.
+func (c *minuteCounter) sum(now time.Time, n int) uint64 {
+	c.advance(now)
+	var total uint64
+	for i := 0; i < n && i < len(c.counts); i++ {
+		total += c.counts[(c.minute-int64(i))%int64(len(c.counts))]
+	}
+	return total
+}
+
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+type metricsRegistry struct {
+	mu           sync.Mutex
+	requests     map[requestKey]uint64
+	durations    map[string]*histogram
+	payloads     map[string]*histogram
+	authFailures map[string]uint64
+	rateLimited  uint64
+	syncRequests minuteCounter
+
+	storageMu        sync.Mutex
+	storageBytes     int64
+	storageUsers     int
+	storageScannedAt time.Time
+}
+
+var metrics = &metricsRegistry{
+	requests:     make(map[requestKey]uint64),
+	durations:    make(map[string]*histogram),
+	payloads:     make(map[string]*histogram),
+	authFailures: make(map[string]uint64),
+}
+
+func (m *metricsRegistry) observeRequest(route, method string, code int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, method, code}]++
+	h := m.durations[route]
+	if h == nil {
+		h = &histogram{}
+		m.durations[route] = h
+	}
+	h.observe(durationBuckets, elapsed.Seconds())
+	if strings.HasPrefix(route, "/sync") {
+		m.syncRequests.add(time.Now())
+	}
+}
+
+// syncRequestCounts returns sync requests seen in the last minute, hour and
+// day.
+func (m *metricsRegistry) syncRequestCounts() (minute, hour, day uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	return m.syncRequests.sum(now, 1), m.syncRequests.sum(now, 60), m.syncRequests.sum(now, 24*60)
+}
+
+func (m *metricsRegistry) observePayload(direction string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.payloads[direction]
+	if h == nil {
+		h = &histogram{}
+		m.payloads[direction] = h
+	}
+	h.observe(payloadBuckets, float64(size))
+}
+
+// authFailed counts a rejected credential; reason is a short label such as
+// "invalid_token".
+func (m *metricsRegistry) authFailed(reason string) {
+	m.mu.Lock()
+	m.authFailures[reason]++
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) rateLimitRejected() {
+	m.mu.Lock()
+	m.rateLimited++
+	m.mu.Unlock()
+}
+
+// storageUsage returns the bytes stored under dataDir and the number of
+// accounts, rescanning at most once per storageScanInterval.
+func (m *metricsRegistry) storageUsage() (int64, int) {
+	m.storageMu.Lock()
+	defer m.storageMu.Unlock()
+	if time.Since(m.storageScannedAt) < storageScanInterval {
+		return m.storageBytes, m.storageUsers
+	}
+
+	var total int64
+	filepath.WalkDir(dataDir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	users := 0
+	if entries, err := os.ReadDir(usersDir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+				users++
+			}
+		}
+	}
+
+	m.storageBytes, m.storageUsers, m.storageScannedAt = total, users, time.Now()
+	return total, users
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// instrument records per-route request counts and latencies. It wraps the
+// API mux, which sets r.Pattern to the matched route once it dispatches.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, user := withAccessLogUser(r)
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metrics.observeRequest(route, r.Method, rec.status, time.Since(start))
+		if strings.HasPrefix(route, "/sync") && route != "/sync/ws" {
+			metrics.observePayload("in", body.n)
+			metrics.observePayload("out", int64(rec.size))
+			if user.email != "" && user.email != "admin" && !user.impersonated {
+				usage.record(user.email, r.Method != http.MethodGet, body.n, int64(rec.size))
+				metering.record(user.email, r.Method != http.MethodGet, body.n, int64(rec.size))
+			}
+		}
+	})
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHistogram(w io.Writer, name, labels string, buckets []float64, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, upper := range buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func sortedHistogramKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	storageBytes, users := metrics.storageUsage()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP kiwi_http_requests_total HTTP requests by route, method and status code.")
+	fmt.Fprintln(w, "# TYPE kiwi_http_requests_total counter")
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for key := range metrics.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "kiwi_http_requests_total{route=\"%s\",method=\"%s\",code=\"%d\"} %d\n",
+			escapeLabel(key.route), escapeLabel(key.method), key.code, metrics.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP kiwi_http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(w, "# TYPE kiwi_http_request_duration_seconds histogram")
+	for _, route := range sortedHistogramKeys(metrics.durations) {
+		writeHistogram(w, "kiwi_http_request_duration_seconds", fmt.Sprintf("route=\"%s\"", escapeLabel(route)), durationBuckets, metrics.durations[route])
+	}
+
+	fmt.Fprintln(w, "# HELP kiwi_sync_payload_bytes Body sizes of sync requests and responses.")
+	fmt.Fprintln(w, "# TYPE kiwi_sync_payload_bytes histogram")
+	for _, direction := range sortedHistogramKeys(metrics.payloads) {
+		writeHistogram(w, "kiwi_sync_payload_bytes", fmt.Sprintf("direction=\"%s\"", direction), payloadBuckets, metrics.payloads[direction])
+	}
+
+	fmt.Fprintln(w, "# HELP kiwi_auth_failures_total Rejected credentials by reason.")
+	fmt.Fprintln(w, "# TYPE kiwi_auth_failures_total counter")
+	reasons := make([]string, 0, len(metrics.authFailures))
+	for reason := range metrics.authFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "kiwi_auth_failures_total{reason=\"%s\"} %d\n", reason, metrics.authFailures[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP kiwi_rate_limited_total Requests rejected by the rate limiter.")
+	fmt.Fprintln(w, "# TYPE kiwi_rate_limited_total counter")
+	fmt.Fprintf(w, "kiwi_rate_limited_total %d\n", metrics.rateLimited)
+
+	fmt.Fprintln(w, "# HELP kiwi_storage_bytes Bytes stored under the data directory.")
+	fmt.Fprintln(w, "# TYPE kiwi_storage_bytes gauge")
+	fmt.Fprintf(w, "kiwi_storage_bytes %d\n", storageBytes)
+
+	fmt.Fprintln(w, "# HELP kiwi_users Registered accounts.")
+	fmt.Fprintln(w, "# TYPE kiwi_users gauge")
+	fmt.Fprintf(w, "kiwi_users %d\n", users)
+}
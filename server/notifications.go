@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Security notifications email the account owner about a new device or
+// browser sign-in, a password change, their API token being replaced, and
+// storage nearing its limit. Each kind can be turned off per account at
+// /account/notifications; all are on by default. They're sent in the
+// background through the [smtp] server and skipped when none is set, and
+// never for trial accounts, which have no address.
+const (
+	notifyNewDevice      = "new_device"
+	notifyPasswordChange = "password_change"
+	notifyTokenRevoked   = "token_revoked"
+	notifyQuotaWarning   = "quota_warning"
+)
+
+var notificationKinds = []string{notifyNewDevice, notifyPasswordChange, notifyTokenRevoked, notifyQuotaWarning}
+
+// quotaWarningPercent is how full an account's storage must be for a quota
+// warning. Another is sent once it has dropped below and crossed it again.
+const quotaWarningPercent = 90
+
+// notificationsEnabled returns whether each kind is on for an account.
+func notificationsEnabled(user *User) map[string]bool {
+	enabled := make(map[string]bool, len(notificationKinds))
+	for _, kind := range notificationKinds {
+		on, set := user.Notifications[kind]
+		enabled[kind] = on || !set
+	}
+	return enabled
+}
+
+// notify emails an account about a security event unless it has turned that
+// kind off.
+func notify(user *User, kind, subject, body string) {
+	if isTrialAccount(user) || !notificationsEnabled(user)[kind] {
+		return
+	}
+	email := user.Email
+	body += "\nYou can turn these emails off in your account's notification settings.\n"
+	go func() {
+		if err := sendMail(email, subject, body); err != nil && !errors.Is(err, errMailNotConfigured) {
+			log.Printf("Failed to send %s notification to %s: %v", kind, email, err)
+		}
+	}()
+}
+
+// requestOrigin describes where a request came from for notification text.
+func requestOrigin(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	origin := "from " + host
+	if agent := r.UserAgent(); agent != "" {
+		origin += " (" + agent + ")"
+	}
+	return origin + " at " + time.Now().UTC().Format(time.RFC1123)
+}
+
+// handleNotifications shows (GET) or changes (PATCH) which notifications
+// the caller gets. PATCH takes a map of kinds to turn on or off and leaves
+// the rest as they are.
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err := loadUser(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read user", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notificationsEnabled(user))
+	case http.MethodPatch:
+		var req map[string]bool
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for kind := range req {
+			if !containsString(notificationKinds, kind) {
+				http.Error(w, "Unknown notification "+kind+"; expected one of "+strings.Join(notificationKinds, ", "), http.StatusBadRequest)
+				return
+			}
+		}
+		user, ok := updateUser(w, userEmail, func(user *User) {
+			if user.Notifications == nil {
+				user.Notifications = make(map[string]bool)
+			}
+			for kind, on := range req {
+				user.Notifications[kind] = on
+			}
+		})
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notificationsEnabled(user))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuotaWarnings emails accounts whose storage has crossed
+// quotaWarningPercent of their limit since the last run, remembering who
+// was warned. It runs with the metrics rollup.
+func checkQuotaWarnings(ctx context.Context) (int, error) {
+	cfg := currentConfig()
+	users, err := listUsers()
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+	warned := 0
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return warned, ctx.Err()
+		}
+		if isTrialAccount(&user) {
+			continue
+		}
+		limit := int64(cfg.Tiers[userTier(cfg, &user)].StorageMB) << 20
+		if limit == 0 && user.QuotaWarnedAt == nil {
+			continue
+		}
+		used := userStorageBytes(user.Email)
+		over := limit > 0 && used*100 >= limit*quotaWarningPercent
+		if over == (user.QuotaWarnedAt != nil) {
+			continue
+		}
+
+		unlock := lockUserData(user.Email + "\x00user")
+		current, err := loadUser(user.Email)
+		if err == nil {
+			if over {
+				now := time.Now().UTC()
+				current.QuotaWarnedAt = &now
+			} else {
+				current.QuotaWarnedAt = nil
+			}
+			err = saveUser(current)
+		}
+		unlock()
+		if err != nil || !over {
+			continue
+		}
+		warned++
+		notify(current, notifyQuotaWarning, "Your kiwi storage is almost full",
+			fmt.Sprintf("Your kiwi account is using %.1f MB of its %d MB of storage.\n\n", float64(used)/(1<<20), limit>>20)+
+				"Once it's full, pushes will be refused until you remove files or move to a bigger plan.\n")
+	}
+	return warned, nil
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orgs give a team centrally managed sets of files and packages. Every
+// member's pull through GET /sync gets the sets of all their orgs merged
+// under their personal data: personal files and packages win, and between
+// orgs the one with the lowest ID wins. Pushing org-provided entries back
+// unchanged doesn't copy them into personal data, so later edits to a set
+// still reach members; changing one locally makes it a personal override.
+//
+// Roles, from most to least privileged:
+//   - owner: everything, including deleting the org and managing owners
+//   - maintainer: edits sets and manages members below maintainer
+//   - member: gets the org's sets on pull
+//   - viewer: can read the org and its sets, but they aren't merged into
+//     the viewer's own data
+const (
+	orgRoleOwner      = "owner"
+	orgRoleMaintainer = "maintainer"
+	orgRoleMember     = "member"
+	orgRoleViewer     = "viewer"
+
+	maxOrgNameLen  = 64
+	maxOrgMembers  = 500
+	maxOrgSets     = 50
+	maxOrgSetFiles = 1000
+)
+
+type Org struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Members maps each member's email to their role
+	Members map[string]string  `json:"members"`
+	Sets    map[string]*OrgSet `json:"sets"`
+	// Tenant is the creator's tenant; only its accounts can join
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// OrgSet is one shared bundle of files and packages. Revision goes up on
+// every change so members can tell when it moved.
+type OrgSet struct {
+	Name      string            `json:"name"`
+	Files     map[string]string `json:"files"`
+	Packages  []Package         `json:"packages"`
+	Revision  int64             `json:"revision"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	UpdatedBy string            `json:"updated_by"`
+}
+
+type OrgSetSummary struct {
+	Name      string    `json:"name"`
+	Files     int       `json:"files"`
+	Packages  int       `json:"packages"`
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OrgView is an org as members see it, with sets summarized.
+type OrgView struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Role      string            `json:"role"`
+	CreatedAt time.Time         `json:"created_at"`
+	Members   map[string]string `json:"members"`
+	Sets      []OrgSetSummary   `json:"sets"`
+}
+
+type CreateOrgRequest struct {
+	Name string `json:"name"`
+}
+
+type OrgMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type OrgSetRequest struct {
+	Files    map[string]string `json:"files"`
+	Packages []Package         `json:"packages"`
+}
+
+var orgRoleRank = map[string]int{
+	orgRoleViewer:     1,
+	orgRoleMember:     2,
+	orgRoleMaintainer: 3,
+	orgRoleOwner:      4,
+}
+
+// orgRoleAtLeast reports whether role is min or more privileged.
+func orgRoleAtLeast(role, min string) bool {
+	return orgRoleRank[role] >= orgRoleRank[min]
+}
+
+// canManageOrgRole reports whether a member with role can grant or take
+// away target. Owners manage everyone; maintainers only manage roles below
+// their own.
+func canManageOrgRole(role, target string) bool {
+	if role == orgRoleOwner {
+		return true
+	}
+	return orgRoleAtLeast(role, orgRoleMaintainer) && orgRoleRank[target] < orgRoleRank[role]
+}
+
+func getOrgPath(id string) string {
+	return filepath.Join(orgsDir, id+".json")
+}
+
+func getUserOrgsPath(email string) string {
+	return filepath.Join(getUserDataDir(email), "orgs.json")
+}
+
+// lockOrg serializes changes to an org. Membership indexes are locked
+// separately, always after the org.
+func lockOrg(id string) func() {
+	return lockUserData("\x00org:" + id)
+}
+
+func loadOrg(id string) (*Org, error) {
+	if !idRegex.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(getOrgPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var org Org
+	if err := json.Unmarshal(data, &org); err != nil {
+		return nil, err
+	}
+	if org.Members == nil {
+		org.Members = make(map[string]string)
+	}
+	if org.Sets == nil {
+		org.Sets = make(map[string]*OrgSet)
+	}
+	return &org, nil
+}
+
+func saveOrg(org *Org) error {
+	if err := os.MkdirAll(orgsDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(org, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getOrgPath(org.ID), data, 0644)
+}
+
+// loadUserOrgIDs returns the orgs a user belongs to, sorted by ID.
+func loadUserOrgIDs(email string) ([]string, error) {
+	data, err := os.ReadFile(getUserOrgsPath(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// setUserOrg adds or removes an org from a user's membership index.
+func setUserOrg(email, id string, member bool) error {
+	unlock := lockUserData(email + "\x00orgs")
+	defer unlock()
+
+	ids, err := loadUserOrgIDs(email)
+	if err != nil {
+		return err
+	}
+	i, found := slices.BinarySearch(ids, id)
+	switch {
+	case member && !found:
+		ids = slices.Insert(ids, i, id)
+	case !member && found:
+		ids = slices.Delete(ids, i, i+1)
+	default:
+		return nil
+	}
+	if err := os.MkdirAll(getUserDataDir(email), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getUserOrgsPath(email), data, 0644)
+}
+
+func (org *Org) view(role string) OrgView {
+	v := OrgView{
+		ID:        org.ID,
+		Name:      org.Name,
+		Role:      role,
+		CreatedAt: org.CreatedAt,
+		Members:   org.Members,
+		Sets:      make([]OrgSetSummary, 0, len(org.Sets)),
+	}
+	for _, set := range org.Sets {
+		v.Sets = append(v.Sets, OrgSetSummary{
+			Name:      set.Name,
+			Files:     len(set.Files),
+			Packages:  len(set.Packages),
+			Revision:  set.Revision,
+			UpdatedAt: set.UpdatedAt,
+		})
+	}
+	sort.Slice(v.Sets, func(i, j int) bool {
+		return v.Sets[i].Name < v.Sets[j].Name
+	})
+	return v
+}
+
+// orgSyncData collects what a user's orgs provide, along with a tag that
+// changes whenever any of those sets does.
+func orgSyncData(email string) (*SyncData, string, error) {
+	data := &SyncData{Files: make(map[string]string), Packages: make([]Package, 0)}
+	ids, err := loadUserOrgIDs(email)
+	if err != nil || len(ids) == 0 {
+		return data, "", err
+	}
+
+	tag := sha256.New()
+	for _, id := range ids {
+		org, err := loadOrg(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, "", err
+		}
+		// Viewers can look at sets but don't consume them
+		if !orgRoleAtLeast(org.Members[email], orgRoleMember) {
+			continue
+		}
+		names := make([]string, 0, len(org.Sets))
+		for name := range org.Sets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			set := org.Sets[name]
+			fmt.Fprintf(tag, "%s/%s/%d\n", id, name, set.Revision)
+			for path, content := range set.Files {
+				if _, ok := data.Files[path]; !ok {
+					data.Files[path] = content
+				}
+			}
+			for _, pkg := range set.Packages {
+				if !slices.ContainsFunc(data.Packages, func(p Package) bool { return p.Name == pkg.Name }) {
+					data.Packages = append(data.Packages, pkg)
+				}
+			}
+		}
+	}
+	if len(data.Files) == 0 && len(data.Packages) == 0 {
+		return data, "", nil
+	}
+	return data, hex.EncodeToString(tag.Sum(nil))[:16], nil
+}
+
+// mergeOrgData layers personal data over what orgs provide.
+func mergeOrgData(personal, org *SyncData) *SyncData {
+	merged := &SyncData{
+		Files:    make(map[string]string, len(personal.Files)+len(org.Files)),
+		Packages: slices.Clone(personal.Packages),
+	}
+	for path, content := range org.Files {
+		merged.Files[path] = content
+	}
+	for path, content := range personal.Files {
+		merged.Files[path] = content
+	}
+	for _, pkg := range org.Packages {
+		if !slices.ContainsFunc(merged.Packages, func(p Package) bool { return p.Name == pkg.Name }) {
+			merged.Packages = append(merged.Packages, pkg)
+		}
+	}
+	return merged
+}
+
+// stripOrgData drops entries from a push that merely echo what orgs
+// provide, unless they're already stored as personal overrides.
+func stripOrgData(current, next, org *SyncData) {
+	for path, content := range next.Files {
+		if orgContent, ok := org.Files[path]; ok && orgContent == content {
+			if _, personal := current.Files[path]; !personal {
+				delete(next.Files, path)
+				delete(next.Vectors, path)
+			}
+		}
+	}
+	next.Packages = slices.DeleteFunc(next.Packages, func(pkg Package) bool {
+		if slices.ContainsFunc(current.Packages, func(p Package) bool { return p.Name == pkg.Name }) {
+			return false
+		}
+		return slices.ContainsFunc(org.Packages, func(p Package) bool {
+			return p.Name == pkg.Name && packagesEqual([]Package{p}, []Package{pkg})
+		})
+	})
+}
+
+// stripOrgPush applies stripOrgData to a push. current is loaded when the
+// caller doesn't have it yet.
+func stripOrgPush(w http.ResponseWriter, email string, current, next *SyncData) bool {
+	orgData, orgTag, err := orgSyncData(email)
+	if err != nil {
+		http.Error(w, "Failed to read org sets", http.StatusInternalServerError)
+		return false
+	}
+	if orgTag == "" {
+		return true
+	}
+	if current == nil {
+		if current, err = loadSyncData(email); err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return false
+		}
+	}
+	stripOrgData(current, next, orgData)
+	return true
+}
+
+// orgRequest loads the org named in the path for a member, writing the
+// error response itself when the caller isn't one.
+func orgRequest(w http.ResponseWriter, r *http.Request) (*Org, string, bool) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, "", false
+	}
+	org, err := loadOrg(r.PathValue("id"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Org not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read org", http.StatusInternalServerError)
+		}
+		return nil, "", false
+	}
+	role, ok := org.Members[userEmail]
+	if !ok {
+		// Don't reveal that the org exists
+		http.Error(w, "Org not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	return org, role, true
+}
+
+func handleOrgs(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ids, err := loadUserOrgIDs(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read orgs", http.StatusInternalServerError)
+			return
+		}
+		views := make([]OrgView, 0, len(ids))
+		for _, id := range ids {
+			org, err := loadOrg(id)
+			if err != nil {
+				continue
+			}
+			if role, ok := org.Members[userEmail]; ok {
+				views = append(views, org.view(role))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+
+	case http.MethodPost:
+		var req CreateOrgRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > maxOrgNameLen {
+			http.Error(w, fmt.Sprintf("Org name must be 1 to %d characters", maxOrgNameLen), http.StatusBadRequest)
+			return
+		}
+		id, err := generateID()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		org := &Org{
+			ID:        id,
+			Name:      req.Name,
+			CreatedAt: time.Now().UTC(),
+			Members:   map[string]string{userEmail: orgRoleOwner},
+			Sets:      make(map[string]*OrgSet),
+			Tenant:    userTenant(userEmail),
+		}
+		if err := saveOrg(org); err != nil {
+			http.Error(w, "Failed to save org", http.StatusInternalServerError)
+			return
+		}
+		if err := setUserOrg(userEmail, id, true); err != nil {
+			http.Error(w, "Failed to save org", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(org.view(orgRoleOwner))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleOrg(w http.ResponseWriter, r *http.Request) {
+	unlock := lockOrg(r.PathValue("id"))
+	defer unlock()
+	org, role, ok := orgRequest(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(org.view(role))
+
+	case http.MethodDelete:
+		if role != orgRoleOwner {
+			http.Error(w, "Forbidden - only owners can delete an org", http.StatusForbidden)
+			return
+		}
+		if err := os.Remove(getOrgPath(org.ID)); err != nil {
+			http.Error(w, "Failed to delete org", http.StatusInternalServerError)
+			return
+		}
+		// Members' indexes skip orgs that are gone, so this is only tidying
+		for email := range org.Members {
+			setUserOrg(email, org.ID, false)
+		}
+		if invites, err := loadOrgInvites(org.ID); err == nil {
+			for _, invite := range invites {
+				os.Remove(getOrgInvitePath(invite.ID))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleOrgMembers changes a member's role. Someone who isn't a member yet
+// is sent an invite instead, since nobody is added to an org, and gets its
+// sets on pull, without accepting.
+func handleOrgMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	unlock := lockOrg(r.PathValue("id"))
+	defer unlock()
+	org, role, ok := orgRequest(w, r)
+	if !ok {
+		return
+	}
+	if !orgRoleAtLeast(role, orgRoleMaintainer) {
+		http.Error(w, "Forbidden - only owners and maintainers can manage members", http.StatusForbidden)
+		return
+	}
+
+	var req OrgMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	current, exists := org.Members[req.Email]
+	if !exists {
+		invites, err := loadOrgInvites(org.ID)
+		if err != nil {
+			http.Error(w, "Failed to read invites", http.StatusInternalServerError)
+			return
+		}
+		createOrgInvite(w, r, org, role, invites, req)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = orgRoleMember
+	}
+	if _, ok := orgRoleRank[req.Role]; !ok {
+		http.Error(w, fmt.Sprintf("Role must be %q, %q, %q or %q", orgRoleOwner, orgRoleMaintainer, orgRoleMember, orgRoleViewer), http.StatusBadRequest)
+		return
+	}
+	if !canManageOrgRole(role, req.Role) || !canManageOrgRole(role, current) {
+		http.Error(w, "Forbidden - maintainers can only manage members and viewers", http.StatusForbidden)
+		return
+	}
+	if current == orgRoleOwner && req.Role != orgRoleOwner && countOrgRole(org, orgRoleOwner) == 1 {
+		http.Error(w, "Can't demote the last owner", http.StatusConflict)
+		return
+	}
+
+	org.Members[req.Email] = req.Role
+	if err := saveOrg(org); err != nil {
+		http.Error(w, "Failed to save org", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org.view(role))
+}
+
+// handleOrgMember removes a member. Anyone can leave, and owners and
+// maintainers can remove the roles they manage, as long as an owner is left.
+func handleOrgMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	unlock := lockOrg(r.PathValue("id"))
+	defer unlock()
+	org, role, ok := orgRequest(w, r)
+	if !ok {
+		return
+	}
+	email := r.PathValue("email")
+	memberRole, ok := org.Members[email]
+	if !ok {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if email != r.Header.Get("X-User-Email") && !canManageOrgRole(role, memberRole) {
+		http.Error(w, "Forbidden - you can't remove this member", http.StatusForbidden)
+		return
+	}
+	if memberRole == orgRoleOwner && countOrgRole(org, orgRoleOwner) == 1 {
+		http.Error(w, "Can't remove the last owner - delete the org instead", http.StatusConflict)
+		return
+	}
+
+	delete(org.Members, email)
+	if err := saveOrg(org); err != nil {
+		http.Error(w, "Failed to save org", http.StatusInternalServerError)
+		return
+	}
+	if err := setUserOrg(email, org.ID, false); err != nil {
+		http.Error(w, "Failed to save org", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func countOrgRole(org *Org, role string) int {
+	n := 0
+	for _, r := range org.Members {
+		if r == role {
+			n++
+		}
+	}
+	return n
+}
+
+func handleOrgSet(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !fileSetNameRegex.MatchString(name) {
+		http.Error(w, "Invalid set name", http.StatusBadRequest)
+		return
+	}
+	unlock := lockOrg(r.PathValue("id"))
+	defer unlock()
+	org, role, ok := orgRequest(w, r)
+	if !ok {
+		return
+	}
+	set := org.Sets[name]
+
+	switch r.Method {
+	case http.MethodGet:
+		if set == nil {
+			http.Error(w, "Set not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+		return
+
+	case http.MethodPut:
+		if !orgRoleAtLeast(role, orgRoleMaintainer) {
+			http.Error(w, "Forbidden - only owners and maintainers can edit sets", http.StatusForbidden)
+			return
+		}
+		var req OrgSetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		files, err := normalizePathKeys(req.Files)
+		if err != nil {
+			http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(files) > maxOrgSetFiles {
+			http.Error(w, fmt.Sprintf("Sets can have at most %d files", maxOrgSetFiles), http.StatusBadRequest)
+			return
+		}
+		for _, pkg := range req.Packages {
+			if pkg.Name == "" {
+				http.Error(w, "Package name is required", http.StatusBadRequest)
+				return
+			}
+		}
+		if set == nil && len(org.Sets) >= maxOrgSets {
+			http.Error(w, fmt.Sprintf("Orgs can have at most %d sets", maxOrgSets), http.StatusBadRequest)
+			return
+		}
+		if files == nil {
+			files = make(map[string]string)
+		}
+		if req.Packages == nil {
+			req.Packages = make([]Package, 0)
+		}
+
+		next := &OrgSet{
+			Name:      name,
+			Files:     files,
+			Packages:  req.Packages,
+			Revision:  1,
+			UpdatedAt: time.Now().UTC(),
+			UpdatedBy: r.Header.Get("X-User-Email"),
+		}
+		if set != nil {
+			next.Revision = set.Revision + 1
+		}
+		org.Sets[name] = next
+		set = next
+
+	case http.MethodDelete:
+		if !orgRoleAtLeast(role, orgRoleMaintainer) {
+			http.Error(w, "Forbidden - only owners and maintainers can edit sets", http.StatusForbidden)
+			return
+		}
+		if set == nil {
+			http.Error(w, "Set not found", http.StatusNotFound)
+			return
+		}
+		delete(org.Sets, name)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := saveOrg(org); err != nil {
+		http.Error(w, "Failed to save org", http.StatusInternalServerError)
+		return
+	}
+	// Let members' devices know to pull
+	event := SyncEvent{Type: "org", UpdatedAt: time.Now().UTC()}
+	if set != nil && r.Method == http.MethodPut {
+		for path := range set.Files {
+			event.Files = append(event.Files, path)
+		}
+		sort.Strings(event.Files)
+		event.Packages = len(set.Packages) > 0
+	}
+	for email := range org.Members {
+		syncHub.publish(email, event)
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// useTempStorage points the server's storage at a fresh directory for the
+// length of a test.
+func useTempStorage(t *testing.T) {
+	t.Helper()
+	old := currentConfig()
+	cfg := *old
+	cfg.StorageRoot = t.TempDir()
+	applyConfig(&cfg)
+	t.Cleanup(func() { applyConfig(old) })
+	for _, dir := range []string{dataDir, usersDir, sharesDir, usernamesDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func orgTestRequest(method, email, orgID string, body interface{}) *http.Request {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest(method, "/orgs/"+orgID+"/members", bytes.NewReader(data))
+	r.Header.Set("X-User-Email", email)
+	r.SetPathValue("id", orgID)
+	return r
+}
+
+func TestOrgMembersInvitesNewMembers(t *testing.T) {
+	useTempStorage(t)
+	id, err := generateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := &Org{
+		ID:      id,
+		Name:    "Team",
+		Members: map[string]string{"owner@example.com": orgRoleOwner, "member@example.com": orgRoleMember},
+		Sets:    map[string]*OrgSet{},
+	}
+	if err := saveOrg(org); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleOrgMembers(rec, orgTestRequest(http.MethodPost, "owner@example.com", org.ID, OrgMemberRequest{Email: "victim@example.com"}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	var invite OrgInviteResponse
+	if err := json.NewDecoder(rec.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+	if invite.Email != "victim@example.com" || invite.Code == "" {
+		t.Errorf("unexpected invite %+v", invite)
+	}
+
+	saved, err := loadOrg(org.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved.Members["victim@example.com"]; ok {
+		t.Error("the invitee became a member without accepting")
+	}
+	if ids, _ := loadUserOrgIDs("victim@example.com"); len(ids) != 0 {
+		t.Errorf("the invitee's org index lists %v", ids)
+	}
+
+	// Existing members still have their role changed in place
+	rec = httptest.NewRecorder()
+	handleOrgMembers(rec, orgTestRequest(http.MethodPost, "owner@example.com", org.ID, OrgMemberRequest{Email: "member@example.com", Role: orgRoleViewer}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("role change: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if saved, _ := loadOrg(org.ID); saved.Members["member@example.com"] != orgRoleViewer {
+		t.Errorf("role = %q, want viewer", saved.Members["member@example.com"])
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// normalizeFilePath validates a file path from a client and returns its
+// canonical form. Paths are relative to the user's home directory and use
+// forward slashes, so a restoring client can't be steered outside it.
+func normalizeFilePath(path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", fmt.Errorf("path %q contains a null byte", path)
+	}
+	p := strings.ReplaceAll(path, `\`, "/")
+	if strings.HasPrefix(p, "/") || (len(p) >= 2 && p[1] == ':' && isASCIILetter(p[0])) {
+		return "", fmt.Errorf("path %q must be relative", path)
+	}
+
+	segments := make([]string, 0, strings.Count(p, "/")+1)
+	for _, segment := range strings.Split(p, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("path %q must not contain ..", path)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("path %q is empty", path)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// normalizePathKeys rekeys a map by canonical file path, rejecting invalid
+// paths and distinct paths that normalize to the same file.
+func normalizePathKeys[V any](m map[string]V) (map[string]V, error) {
+	if m == nil {
+		return nil, nil
+	}
+	normalized := make(map[string]V, len(m))
+	for path, v := range m {
+		p, err := normalizeFilePath(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := normalized[p]; ok {
+			return nil, fmt.Errorf("duplicate path %q", p)
+		}
+		normalized[p] = v
+	}
+	return normalized, nil
+}
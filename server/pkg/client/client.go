@@ -0,0 +1,1499 @@
+// Package client is a Go client for the kiwi sync API described by the
+// server's /openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type User struct {
+	Email     string    `json:"email"`
+	Username  string    `json:"username,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// TrialExpiresAt is set on trial accounts
+	TrialExpiresAt *time.Time `json:"trial_expires_at,omitempty"`
+}
+
+type Package struct {
+	Name      string  `json:"name"`
+	Version   *string `json:"version,omitempty"`
+	Installed bool    `json:"installed"`
+}
+
+// VersionVector counts the edits each device has made to a file. Increment
+// the entry for your DeviceID when changing a file locally.
+type VersionVector map[string]int64
+
+type SyncData struct {
+	Files    map[string]string `json:"files"`
+	Packages []Package         `json:"packages"`
+	// Vectors optionally orders pushed files against other devices' writes:
+	// a version older than the server's is ignored, and a concurrent one is
+	// reported as a ConflictError.
+	Vectors map[string]VersionVector `json:"vectors,omitempty"`
+}
+
+type FileInfo struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type FileListResponse struct {
+	Files      []FileInfo `json:"files"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+type ManifestEntry struct {
+	Hash   string        `json:"hash"`
+	Size   int           `json:"size"`
+	MTime  time.Time     `json:"mtime"`
+	Vector VersionVector `json:"vector,omitempty"`
+}
+
+type ManifestResponse struct {
+	Revision         int64                    `json:"revision"`
+	PackagesRevision int64                    `json:"packages_revision"`
+	Files            map[string]ManifestEntry `json:"files"`
+}
+
+type ChangeEvent struct {
+	Revision  int64         `json:"revision"`
+	Type      string        `json:"type"`
+	Path      string        `json:"path,omitempty"`
+	Hash      string        `json:"hash,omitempty"`
+	Size      int           `json:"size,omitempty"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Vector    VersionVector `json:"vector,omitempty"`
+}
+
+type ChangesResponse struct {
+	Changes []ChangeEvent `json:"changes"`
+	Cursor  string        `json:"cursor"`
+	HasMore bool          `json:"has_more"`
+}
+
+type BatchOperation struct {
+	Op      string   `json:"op"`
+	Path    string   `json:"path,omitempty"`
+	Content *string  `json:"content,omitempty"`
+	Package *Package `json:"package,omitempty"`
+	Name    string   `json:"name,omitempty"`
+}
+
+type BatchResponse struct {
+	Status   string `json:"status"`
+	Revision int64  `json:"revision"`
+	Applied  int    `json:"applied"`
+}
+
+type MergeConflict struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type MergeResponse struct {
+	BaseRevision     int64             `json:"base_revision"`
+	Revision         int64             `json:"revision"`
+	Files            map[string]string `json:"files"`
+	Packages         []Package         `json:"packages"`
+	Conflicts        []MergeConflict   `json:"conflicts"`
+	PackageConflicts []string          `json:"package_conflicts"`
+}
+
+// Plan describes what pushing a snapshot would change. Conflict is set when
+// the push would be rejected.
+type Plan struct {
+	Revision        int64          `json:"revision"`
+	Created         []string       `json:"created"`
+	Modified        []string       `json:"modified"`
+	Deleted         []string       `json:"deleted"`
+	Unchanged       int            `json:"unchanged"`
+	PackagesChanged bool           `json:"packages_changed"`
+	Conflict        *ConflictError `json:"conflict,omitempty"`
+}
+
+type Transaction struct {
+	ID           string    `json:"id"`
+	BaseRevision int64     `json:"base_revision"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Updated      []string  `json:"updated"`
+	Deleted      []string  `json:"deleted"`
+	Packages     bool      `json:"packages"`
+}
+
+type Share struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Path      string     `json:"path"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// URL is only set on the response to ShareFile.
+	URL string `json:"url,omitempty"`
+}
+
+type Profile struct {
+	Username    string   `json:"username"`
+	PublicFiles []string `json:"public_files"`
+}
+
+// FileSet shares Paths (exact, or prefixes ending in "/") with Members,
+// mapping each member's email to "read" or "write".
+type FileSet struct {
+	Name    string            `json:"name"`
+	Paths   []string          `json:"paths"`
+	Members map[string]string `json:"members"`
+}
+
+// Org is an org as its members see it; Role is the caller's.
+type Org struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Role      string            `json:"role"`
+	CreatedAt time.Time         `json:"created_at"`
+	Members   map[string]string `json:"members"`
+	Sets      []OrgSetSummary   `json:"sets"`
+}
+
+type OrgSetSummary struct {
+	Name      string    `json:"name"`
+	Files     int       `json:"files"`
+	Packages  int       `json:"packages"`
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type OrgSet struct {
+	Name      string            `json:"name"`
+	Files     map[string]string `json:"files"`
+	Packages  []Package         `json:"packages"`
+	Revision  int64             `json:"revision,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at,omitempty"`
+	UpdatedBy string            `json:"updated_by,omitempty"`
+}
+
+// OrgInvite is a pending invite to an org. Code and URL are only set on
+// the response to creating one.
+type OrgInvite struct {
+	ID        string    `json:"id"`
+	OrgID     string    `json:"org_id"`
+	OrgName   string    `json:"org_name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	EmailSent bool      `json:"email_sent,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	URL       string    `json:"url,omitempty"`
+}
+
+type SharedFileSet struct {
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	Mode  string `json:"mode"`
+}
+
+type Device struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	OS           string     `json:"os"`
+	Hostname     string     `json:"hostname"`
+	RegisteredAt time.Time  `json:"registered_at"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	LastPushAt   *time.Time `json:"last_push_at,omitempty"`
+	LastPullAt   *time.Time `json:"last_pull_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RevokedDevice is a revoked device and the account token that replaced the
+// one it held.
+type RevokedDevice struct {
+	Device
+	Token string `json:"token"`
+}
+
+type AdminStats struct {
+	Users          int              `json:"users"`
+	ActiveUsers7d  int              `json:"active_users_7d"`
+	ActiveUsers30d int              `json:"active_users_30d"`
+	StorageBytes   int64            `json:"storage_bytes"`
+	Snapshots      int              `json:"snapshots"`
+	SyncRequests   SyncRequestRates `json:"sync_requests"`
+	GeneratedAt    time.Time        `json:"generated_at"`
+}
+
+type SyncRequestRates struct {
+	LastMinute uint64 `json:"last_minute"`
+	LastHour   uint64 `json:"last_hour"`
+	LastDay    uint64 `json:"last_day"`
+}
+
+type AdminUser struct {
+	Email         string           `json:"email"`
+	Username      string           `json:"username,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	LastSyncAt    *time.Time       `json:"last_sync_at,omitempty"`
+	Devices       int              `json:"devices"`
+	StorageBytes  int64            `json:"storage_bytes"`
+	Suspension    *Suspension      `json:"suspension,omitempty"`
+	TermsAccepted *TermsAcceptance `json:"terms_accepted,omitempty"`
+	Tenant        string           `json:"tenant,omitempty"`
+	// Tier is "free", "pro" or "unlimited"
+	Tier string `json:"tier"`
+}
+
+type Suspension struct {
+	Reason      string    `json:"reason,omitempty"`
+	SuspendedAt time.Time `json:"suspended_at"`
+}
+
+type TermsAcceptance struct {
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// TermsStatus says which terms of service the server requires, if any, and
+// whether this account has accepted them. A sync refused for unaccepted
+// terms fails with a 403 APIError.
+type TermsStatus struct {
+	Version  string           `json:"version,omitempty"`
+	URL      string           `json:"url,omitempty"`
+	Accepted bool             `json:"accepted"`
+	Last     *TermsAcceptance `json:"last_accepted,omitempty"`
+}
+
+// Tenant is one partition of a multi-tenant server. AdminToken is only set
+// in the response that created it.
+type Tenant struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Domains         []string  `json:"domains"`
+	MaxUsers        int       `json:"max_users,omitempty"`
+	MaxStorageBytes int64     `json:"max_storage_bytes,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	Users           int       `json:"users"`
+	StorageBytes    int64     `json:"storage_bytes"`
+	AdminToken      string    `json:"admin_token,omitempty"`
+}
+
+// TenantRequest creates or updates a tenant; nil fields are left as they
+// are.
+type TenantRequest struct {
+	ID              string    `json:"id,omitempty"`
+	Name            *string   `json:"name,omitempty"`
+	Domains         *[]string `json:"domains,omitempty"`
+	MaxUsers        *int      `json:"max_users,omitempty"`
+	MaxStorageBytes *int64    `json:"max_storage_bytes,omitempty"`
+}
+
+type AdminUserListResponse struct {
+	Users      []AdminUser `json:"users"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// AdminUserMatch is an account found by SearchUsers. UserHash names its
+// user file and data directory on the server.
+type AdminUserMatch struct {
+	AdminUser
+	UserHash string `json:"user_hash"`
+}
+
+type AdminUserSearchResponse struct {
+	Users []AdminUserMatch `json:"users"`
+}
+
+// CredentialReset reports how the reset link reached the user. ResetURL is
+// only set when it wasn't emailed.
+type CredentialReset struct {
+	Email     string    `json:"email"`
+	EmailSent bool      `json:"email_sent"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ResetURL  string    `json:"reset_url,omitempty"`
+}
+
+type ImpersonateRequest struct {
+	Email     string `json:"email"`
+	Reason    string `json:"reason"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresIn int64  `json:"expires_in,omitempty"`
+}
+
+// Impersonation is an admin token that authenticates as another user. Token
+// is only set when it's issued.
+type Impersonation struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Scope     string    `json:"scope"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     string    `json:"token,omitempty"`
+}
+
+type UsageDay struct {
+	Date         string `json:"date"`
+	SyncRequests int64  `json:"sync_requests"`
+	Pushes       int64  `json:"pushes"`
+	BytesIn      int64  `json:"bytes_in"`
+	BytesOut     int64  `json:"bytes_out"`
+	StorageBytes int64  `json:"storage_bytes,omitempty"`
+}
+
+type UsageTotals struct {
+	SyncRequests int64 `json:"sync_requests"`
+	Pushes       int64 `json:"pushes"`
+	BytesIn      int64 `json:"bytes_in"`
+	BytesOut     int64 `json:"bytes_out"`
+}
+
+type UsageResponse struct {
+	Email        string      `json:"email"`
+	StorageBytes int64       `json:"storage_bytes"`
+	Totals       UsageTotals `json:"totals"`
+	Days         []UsageDay  `json:"days"`
+}
+
+type Account struct {
+	Email          string         `json:"email"`
+	Username       string         `json:"username,omitempty"`
+	Tenant         string         `json:"tenant,omitempty"`
+	Tier           string         `json:"tier"`
+	CreatedAt      time.Time      `json:"created_at"`
+	TrialExpiresAt *time.Time     `json:"trial_expires_at,omitempty"`
+	Token          AccountToken   `json:"token"`
+	Device         *Device        `json:"device,omitempty"`
+	Storage        AccountStorage `json:"storage"`
+}
+
+type AccountToken struct {
+	Kind      string     `json:"kind"`
+	Scope     string     `json:"scope"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type AccountStorage struct {
+	UsedBytes  int64 `json:"used_bytes"`
+	LimitBytes int64 `json:"limit_bytes,omitempty"`
+}
+
+type UserUsage struct {
+	Email string `json:"email"`
+	UsageTotals
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+type AdminUsageResponse struct {
+	Days  int         `json:"days"`
+	Users []UserUsage `json:"users"`
+}
+
+// InviteCode is a registration invite code. The code itself is only
+// returned when minted, in InviteCodeBatch.
+type InviteCode struct {
+	ID         string     `json:"id"`
+	Batch      string     `json:"batch"`
+	Note       string     `json:"note,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RedeemedBy string     `json:"redeemed_by,omitempty"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+}
+
+type InviteCodeBatchRequest struct {
+	Count     int        `json:"count"`
+	Note      string     `json:"note,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type InviteCodeBatch struct {
+	Batch   string       `json:"batch"`
+	Codes   []string     `json:"codes"`
+	Invites []InviteCode `json:"invites"`
+}
+
+type InviteCodeList struct {
+	Codes    []InviteCode `json:"codes"`
+	Total    int          `json:"total"`
+	Redeemed int          `json:"redeemed"`
+}
+
+// AbuseBlock is a client address the server has temporarily blocked.
+// Reason is "registration", "auth_failure" or "oversized_request".
+type AbuseBlock struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	Events    int       `json:"events"`
+	BlockedAt time.Time `json:"blocked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Rejected  int       `json:"rejected"`
+}
+
+type AbuseBlockList struct {
+	Blocks []AbuseBlock `json:"blocks"`
+}
+
+type JobStatus struct {
+	Name     string     `json:"name"`
+	Interval string     `json:"interval"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	Runs     []JobRun   `json:"runs"`
+}
+
+type JobRun struct {
+	Trigger    string    `json:"trigger"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Summary    string    `json:"summary,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type FileVersion struct {
+	Hash      string        `json:"hash,omitempty"`
+	Size      int           `json:"size"`
+	UpdatedAt *time.Time    `json:"updated_at,omitempty"`
+	Revision  int64         `json:"revision,omitempty"`
+	Deleted   bool          `json:"deleted,omitempty"`
+	Vector    VersionVector `json:"vector,omitempty"`
+}
+
+type FileConflict struct {
+	Path string `json:"path"`
+	// Base is the file at the base revision, for a three-way merge; nil
+	// when the server no longer has that revision
+	Base   *FileVersion `json:"base,omitempty"`
+	Theirs FileVersion  `json:"theirs"`
+	Yours  FileVersion  `json:"yours"`
+}
+
+// ConflictError is returned when a write based on a stale revision would
+// overwrite newer server changes.
+type ConflictError struct {
+	BaseRevision     int64          `json:"base_revision"`
+	CurrentRevision  int64          `json:"current_revision"`
+	Files            []FileConflict `json:"files"`
+	PackagesConflict bool           `json:"packages_conflict,omitempty"`
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("kiwi: sync conflict: %d file(s) changed since revision %d", len(e.Files), e.BaseRevision)
+}
+
+// APIError is returned for any other non-2xx response.
+type APIError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked us to wait before retrying,
+	// set when it's throttling requests.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("kiwi: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	err := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+// WriteOptions control conditional and idempotent writes.
+type WriteOptions struct {
+	// BaseRevision enables conflict detection when non-nil.
+	BaseRevision *int64
+	// IdempotencyKey makes retries of the same write safe.
+	IdempotencyKey string
+}
+
+// APIVersion is the server API version this package speaks. Requests go to
+// the matching /v{N} prefix.
+const (
+	APIVersion = 1
+	apiPrefix  = "/v1"
+)
+
+type Announcement struct {
+	ID        string     `json:"id"`
+	Message   string     `json:"message"`
+	Level     string     `json:"level"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Flag is a feature flag as the admin sees it. Overrides turn it on or off
+// for single accounts whatever Percent says.
+type Flag struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Percent     int             `json:"percent"`
+	Overrides   map[string]bool `json:"overrides,omitempty"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// FlagRequest creates or updates a flag; nil fields are left as they are
+// and Overrides, when set, replaces the flag's overrides.
+type FlagRequest struct {
+	Description *string         `json:"description,omitempty"`
+	Percent     *int            `json:"percent,omitempty"`
+	Overrides   map[string]bool `json:"overrides,omitempty"`
+}
+
+type AnnouncementRequest struct {
+	Message   string     `json:"message"`
+	Level     string     `json:"level,omitempty"`
+	StartsAt  *time.Time `json:"starts_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type APIVersions struct {
+	Current   int   `json:"current"`
+	Supported []int `json:"supported"`
+}
+
+type Client struct {
+	BaseURL string
+	Token   string
+	// DeviceID, when set, is sent with every request so the server can
+	// track this device's last push and pull.
+	DeviceID string
+	// Owner, when set to another account's email, makes sync reads and
+	// writes act on the file sets that account shares with you.
+	Owner string
+	// Tenant, when set, names the tenant to use on a multi-tenant server
+	// whose tenants aren't told apart by domain.
+	Tenant string
+	// OnAnnouncement, when set, is called with the ID from the
+	// Kiwi-Announcement header of every response that carries one. Fetch
+	// the text with Announcements when the ID is new.
+	OnAnnouncement func(id string)
+	HTTPClient     *http.Client
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Negotiate checks that the server still serves APIVersion, so an outdated
+// build can ask to be upgraded instead of failing on individual requests.
+func (c *Client) Negotiate(ctx context.Context) (*APIVersions, error) {
+	var versions APIVersions
+	if _, err := c.do(ctx, http.MethodGet, "/versions", nil, nil, &versions); err != nil {
+		return nil, err
+	}
+	for _, v := range versions.Supported {
+		if v == APIVersion {
+			return &versions, nil
+		}
+	}
+	return &versions, fmt.Errorf("kiwi: server no longer supports API v%d (supports %v); upgrade the client", APIVersion, versions.Supported)
+}
+
+// ClockOffset estimates how far the server clock is ahead of the local one,
+// assuming the request and response took equally long.
+func (c *Client) ClockOffset(ctx context.Context) (time.Duration, error) {
+	var resp struct {
+		Time time.Time `json:"time"`
+	}
+	start := time.Now()
+	if _, err := c.do(ctx, http.MethodGet, "/time", nil, nil, &resp); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	return resp.Time.Sub(start.Add(rtt / 2)), nil
+}
+
+func (c *Client) Register(ctx context.Context, email, password string) (*User, error) {
+	var user User
+	_, err := c.do(ctx, http.MethodPost, "/register", map[string]string{"email": email, "password": password}, nil, &user)
+	return &user, err
+}
+
+// RegisterWithInviteCode creates an account on an invite-only server.
+func (c *Client) RegisterWithInviteCode(ctx context.Context, email, password, code string) (*User, error) {
+	var user User
+	body := map[string]string{"email": email, "password": password, "invite_code": code}
+	_, err := c.do(ctx, http.MethodPost, "/register", body, nil, &user)
+	return &user, err
+}
+
+// StartTrial creates a trial account and stores its token on the client.
+func (c *Client) StartTrial(ctx context.Context) (*User, error) {
+	var user User
+	if _, err := c.do(ctx, http.MethodPost, "/trial", nil, nil, &user); err != nil {
+		return nil, err
+	}
+	c.Token = user.Token
+	return &user, nil
+}
+
+// Login authenticates and stores the returned token on the client.
+func (c *Client) Login(ctx context.Context, email, password string) (*User, error) {
+	var user User
+	if _, err := c.do(ctx, http.MethodPost, "/login", map[string]string{"email": email, "password": password}, nil, &user); err != nil {
+		return nil, err
+	}
+	c.Token = user.Token
+	return &user, nil
+}
+
+// GetSync returns the full snapshot and its revision.
+func (c *Client) GetSync(ctx context.Context) (*SyncData, int64, error) {
+	var data SyncData
+	header, err := c.do(ctx, http.MethodGet, "/sync", nil, nil, &data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &data, revisionFrom(header), nil
+}
+
+// PushSync replaces the full snapshot and returns the new revision.
+func (c *Client) PushSync(ctx context.Context, data *SyncData, opts *WriteOptions) (int64, error) {
+	header, err := c.do(ctx, http.MethodPost, "/sync", data, opts, nil)
+	if err != nil {
+		return 0, err
+	}
+	return revisionFrom(header), nil
+}
+
+// Plan reports what PushSync would change for data without applying it.
+func (c *Client) Plan(ctx context.Context, data *SyncData, opts *WriteOptions) (*Plan, error) {
+	var plan Plan
+	_, err := c.do(ctx, http.MethodPost, "/sync/plan", data, opts, &plan)
+	return &plan, err
+}
+
+// PatchSync applies a JSON Merge Patch; a nil value in Files deletes a file.
+func (c *Client) PatchSync(ctx context.Context, patch map[string]interface{}, opts *WriteOptions) (*SyncData, int64, error) {
+	var data SyncData
+	header, err := c.do(ctx, http.MethodPatch, "/sync", patch, opts, &data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &data, revisionFrom(header), nil
+}
+
+func (c *Client) ListFiles(ctx context.Context, cursor string, limit int) (*FileListResponse, error) {
+	q := url.Values{}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var resp FileListResponse
+	_, err := c.do(ctx, http.MethodGet, "/sync/files?"+q.Encode(), nil, nil, &resp)
+	return &resp, err
+}
+
+func (c *Client) Manifest(ctx context.Context) (*ManifestResponse, error) {
+	var resp ManifestResponse
+	_, err := c.do(ctx, http.MethodGet, "/sync/manifest", nil, nil, &resp)
+	return &resp, err
+}
+
+// Changes lists changes after since; pass the returned cursor to continue.
+func (c *Client) Changes(ctx context.Context, since string, limit int) (*ChangesResponse, error) {
+	q := url.Values{}
+	if since != "" {
+		q.Set("since", since)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var resp ChangesResponse
+	_, err := c.do(ctx, http.MethodGet, "/sync/changes?"+q.Encode(), nil, nil, &resp)
+	return &resp, err
+}
+
+func (c *Client) Packages(ctx context.Context) ([]Package, error) {
+	var packages []Package
+	_, err := c.do(ctx, http.MethodGet, "/sync/packages", nil, nil, &packages)
+	return packages, err
+}
+
+func (c *Client) UpdatePackages(ctx context.Context, add []Package, remove []string, opts *WriteOptions) ([]Package, error) {
+	var packages []Package
+	body := map[string]interface{}{"add": add, "remove": remove}
+	_, err := c.do(ctx, http.MethodPost, "/sync/packages", body, opts, &packages)
+	return packages, err
+}
+
+// Batch applies operations atomically: either all of them or none.
+func (c *Client) Batch(ctx context.Context, ops []BatchOperation, opts *WriteOptions) (*BatchResponse, error) {
+	var resp BatchResponse
+	_, err := c.do(ctx, http.MethodPost, "/sync/batch", map[string]interface{}{"operations": ops}, opts, &resp)
+	return &resp, err
+}
+
+// BeginTransaction starts staging changes that are applied together by
+// CommitTransaction. BaseRevision defaults to the current revision.
+func (c *Client) BeginTransaction(ctx context.Context, opts *WriteOptions) (*Transaction, error) {
+	var txn Transaction
+	_, err := c.do(ctx, http.MethodPost, "/sync/transactions", nil, opts, &txn)
+	return &txn, err
+}
+
+// StageFile stages a file's new contents; nil content stages a deletion.
+func (c *Client) StageFile(ctx context.Context, id, path string, content *string) error {
+	if content == nil {
+		_, err := c.do(ctx, http.MethodDelete, "/sync/transactions/"+id+"/files/"+escapePath(path), nil, nil, nil)
+		return err
+	}
+	_, err := c.do(ctx, http.MethodPut, "/sync/transactions/"+id+"/files/"+escapePath(path), rawBody(*content), nil, nil)
+	return err
+}
+
+func (c *Client) StagePackages(ctx context.Context, id string, packages []Package) error {
+	_, err := c.do(ctx, http.MethodPut, "/sync/transactions/"+id+"/packages", packages, nil, nil)
+	return err
+}
+
+func (c *Client) CommitTransaction(ctx context.Context, id string, opts *WriteOptions) (*BatchResponse, error) {
+	var resp BatchResponse
+	_, err := c.do(ctx, http.MethodPost, "/sync/transactions/"+id+"/commit", nil, opts, &resp)
+	return &resp, err
+}
+
+func (c *Client) AbortTransaction(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/sync/transactions/"+id, nil, nil, nil)
+	return err
+}
+
+// DownloadFile streams a file's raw contents starting at offset, which lets
+// an interrupted download resume. The caller must close the reader.
+func (c *Client) DownloadFile(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+apiPrefix+"/sync/files/"+escapePath(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return nil, newAPIError(resp, data)
+	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.New("kiwi: server ignored the range request")
+	}
+	return resp.Body, nil
+}
+
+// ShareFile creates a read-only link to path. A zero ttl never expires.
+func (c *Client) ShareFile(ctx context.Context, path string, ttl time.Duration) (*Share, error) {
+	var share Share
+	body := map[string]int64{"expires_in": int64(ttl / time.Second)}
+	_, err := c.do(ctx, http.MethodPost, "/sync/files/"+escapePath(path)+"/share", body, nil, &share)
+	return &share, err
+}
+
+func (c *Client) Shares(ctx context.Context) ([]Share, error) {
+	var shares []Share
+	_, err := c.do(ctx, http.MethodGet, "/shares", nil, nil, &shares)
+	return shares, err
+}
+
+func (c *Client) RevokeShare(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/shares/"+id, nil, nil, nil)
+	return err
+}
+
+func (c *Client) Profile(ctx context.Context) (*Profile, error) {
+	var profile Profile
+	_, err := c.do(ctx, http.MethodGet, "/profile", nil, nil, &profile)
+	return &profile, err
+}
+
+// SetProfile claims a username and replaces the list of files published
+// under /u/{username}.
+func (c *Client) SetProfile(ctx context.Context, profile *Profile) (*Profile, error) {
+	var resp Profile
+	_, err := c.do(ctx, http.MethodPut, "/profile", profile, nil, &resp)
+	return &resp, err
+}
+
+// DeleteProfile unpublishes every public file and releases the username.
+func (c *Client) DeleteProfile(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodDelete, "/profile", nil, nil, nil)
+	return err
+}
+
+func (c *Client) FileSets(ctx context.Context) ([]FileSet, error) {
+	var fileSets []FileSet
+	_, err := c.do(ctx, http.MethodGet, "/filesets", nil, nil, &fileSets)
+	return fileSets, err
+}
+
+// PutFileSet creates or replaces a file set and its members.
+func (c *Client) PutFileSet(ctx context.Context, fileSet *FileSet) (*FileSet, error) {
+	var resp FileSet
+	_, err := c.do(ctx, http.MethodPut, "/filesets/"+url.PathEscape(fileSet.Name), fileSet, nil, &resp)
+	return &resp, err
+}
+
+func (c *Client) DeleteFileSet(ctx context.Context, name string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/filesets/"+url.PathEscape(name), nil, nil, nil)
+	return err
+}
+
+func (c *Client) Orgs(ctx context.Context) ([]Org, error) {
+	var orgs []Org
+	_, err := c.do(ctx, http.MethodGet, "/orgs", nil, nil, &orgs)
+	return orgs, err
+}
+
+// CreateOrg creates an org owned by the caller.
+func (c *Client) CreateOrg(ctx context.Context, name string) (*Org, error) {
+	var org Org
+	_, err := c.do(ctx, http.MethodPost, "/orgs", map[string]string{"name": name}, nil, &org)
+	return &org, err
+}
+
+func (c *Client) GetOrg(ctx context.Context, id string) (*Org, error) {
+	var org Org
+	_, err := c.do(ctx, http.MethodGet, "/orgs/"+url.PathEscape(id), nil, nil, &org)
+	return &org, err
+}
+
+func (c *Client) DeleteOrg(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/orgs/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+// SetOrgMember changes a member's role: "owner", "maintainer", "member" or
+// "viewer". Someone who isn't a member yet is invited instead, and only the
+// invite is returned.
+func (c *Client) SetOrgMember(ctx context.Context, id, email, role string) (*Org, *OrgInvite, error) {
+	var raw json.RawMessage
+	body := map[string]string{"email": email, "role": role}
+	if _, err := c.do(ctx, http.MethodPost, "/orgs/"+url.PathEscape(id)+"/members", body, nil, &raw); err != nil {
+		return nil, nil, err
+	}
+	var invite OrgInvite
+	if err := json.Unmarshal(raw, &invite); err != nil {
+		return nil, nil, err
+	}
+	if invite.OrgID != "" {
+		return nil, &invite, nil
+	}
+	var org Org
+	if err := json.Unmarshal(raw, &org); err != nil {
+		return nil, nil, err
+	}
+	return &org, nil, nil
+}
+
+func (c *Client) RemoveOrgMember(ctx context.Context, id, email string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/orgs/"+url.PathEscape(id)+"/members/"+url.PathEscape(email), nil, nil, nil)
+	return err
+}
+
+func (c *Client) OrgSet(ctx context.Context, id, name string) (*OrgSet, error) {
+	var set OrgSet
+	_, err := c.do(ctx, http.MethodGet, "/orgs/"+url.PathEscape(id)+"/sets/"+url.PathEscape(name), nil, nil, &set)
+	return &set, err
+}
+
+// PutOrgSet creates or replaces a shared set with set's files and packages.
+func (c *Client) PutOrgSet(ctx context.Context, id string, set *OrgSet) (*OrgSet, error) {
+	var resp OrgSet
+	body := map[string]interface{}{"files": set.Files, "packages": set.Packages}
+	_, err := c.do(ctx, http.MethodPut, "/orgs/"+url.PathEscape(id)+"/sets/"+url.PathEscape(set.Name), body, nil, &resp)
+	return &resp, err
+}
+
+func (c *Client) DeleteOrgSet(ctx context.Context, id, name string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/orgs/"+url.PathEscape(id)+"/sets/"+url.PathEscape(name), nil, nil, nil)
+	return err
+}
+
+// OrgInvites lists an org's pending invites.
+func (c *Client) OrgInvites(ctx context.Context, id string) ([]OrgInvite, error) {
+	var invites []OrgInvite
+	_, err := c.do(ctx, http.MethodGet, "/orgs/"+url.PathEscape(id)+"/invites", nil, nil, &invites)
+	return invites, err
+}
+
+// InviteToOrg emails an invite to join an org with role. The returned
+// invite carries the code and link in case the email doesn't arrive.
+func (c *Client) InviteToOrg(ctx context.Context, id, email, role string) (*OrgInvite, error) {
+	var invite OrgInvite
+	body := map[string]string{"email": email, "role": role}
+	_, err := c.do(ctx, http.MethodPost, "/orgs/"+url.PathEscape(id)+"/invites", body, nil, &invite)
+	return &invite, err
+}
+
+func (c *Client) RevokeOrgInvite(ctx context.Context, id, inviteID string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/orgs/"+url.PathEscape(id)+"/invites/"+url.PathEscape(inviteID), nil, nil, nil)
+	return err
+}
+
+// AcceptOrgInvite joins the org an invite code was sent for. It has to be
+// redeemed by the invited account.
+func (c *Client) AcceptOrgInvite(ctx context.Context, code string) (*Org, error) {
+	var org Org
+	_, err := c.do(ctx, http.MethodPost, "/invites/accept", map[string]string{"code": code}, nil, &org)
+	return &org, err
+}
+
+// SharedWithMe lists file sets other accounts share with you.
+func (c *Client) SharedWithMe(ctx context.Context) ([]SharedFileSet, error) {
+	var shared []SharedFileSet
+	_, err := c.do(ctx, http.MethodGet, "/shared", nil, nil, &shared)
+	return shared, err
+}
+
+// Merge three-way merges data, derived from revision base, with the server's
+// current state. The result isn't saved; push it with BaseRevision set to
+// the returned Revision.
+func (c *Client) Merge(ctx context.Context, base int64, data *SyncData) (*MergeResponse, error) {
+	var resp MergeResponse
+	body := map[string]interface{}{"base": base, "files": data.Files, "packages": data.Packages}
+	_, err := c.do(ctx, http.MethodPost, "/sync/merge", body, nil, &resp)
+	return &resp, err
+}
+
+// Snapshot returns the sync data as of a past revision.
+func (c *Client) Snapshot(ctx context.Context, revision int64) (*SyncData, error) {
+	var data SyncData
+	if _, err := c.do(ctx, http.MethodGet, "/sync/snapshots/"+strconv.FormatInt(revision, 10), nil, nil, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// RegisterDevice registers this machine and sets DeviceID on the client.
+func (c *Client) RegisterDevice(ctx context.Context, name, os, hostname string) (*Device, error) {
+	var device Device
+	body := map[string]string{"name": name, "os": os, "hostname": hostname}
+	if _, err := c.do(ctx, http.MethodPost, "/devices/register", body, nil, &device); err != nil {
+		return nil, err
+	}
+	c.DeviceID = device.ID
+	return &device, nil
+}
+
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	var devices []Device
+	_, err := c.do(ctx, http.MethodGet, "/devices", nil, nil, &devices)
+	return devices, err
+}
+
+// RemoveDevice forgets a registered device.
+func (c *Client) RemoveDevice(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/devices/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+func (c *Client) RenameDevice(ctx context.Context, id, name string) (*Device, error) {
+	var device Device
+	if _, err := c.do(ctx, http.MethodPatch, "/devices/"+url.PathEscape(id), map[string]string{"name": name}, nil, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// RevokeDevice cuts a device off and replaces the account's token, storing
+// the new one on the client. Every other machine holding the old one has to
+// log in again.
+func (c *Client) RevokeDevice(ctx context.Context, id string) (*RevokedDevice, error) {
+	var revoked RevokedDevice
+	if _, err := c.do(ctx, http.MethodPost, "/devices/"+url.PathEscape(id)+"/revoke", nil, nil, &revoked); err != nil {
+		return nil, err
+	}
+	c.Token = revoked.Token
+	return &revoked, nil
+}
+
+// Stats returns instance-wide usage figures. It needs the admin token.
+func (c *Client) Stats(ctx context.Context) (*AdminStats, error) {
+	var stats AdminStats
+	if _, err := c.do(ctx, http.MethodGet, "/admin/stats", nil, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Users lists accounts matching q a page at a time; pass the returned
+// cursor to continue. It needs the admin token.
+func (c *Client) Users(ctx context.Context, q, cursor string, limit int) (*AdminUserListResponse, error) {
+	v := url.Values{}
+	if q != "" {
+		v.Set("q", q)
+	}
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	var resp AdminUserListResponse
+	if _, err := c.do(ctx, http.MethodGet, "/admin/users?"+v.Encode(), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SearchUsers finds accounts whose email is email, ignoring case, or whose
+// email or username contains q. At least one must be set. It needs the admin
+// token.
+func (c *Client) SearchUsers(ctx context.Context, email, q string, limit int) (*AdminUserSearchResponse, error) {
+	v := url.Values{}
+	if email != "" {
+		v.Set("email", email)
+	}
+	if q != "" {
+		v.Set("q", q)
+	}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	var resp AdminUserSearchResponse
+	if _, err := c.do(ctx, http.MethodGet, "/admin/users/search?"+v.Encode(), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SuspendUser blocks an account until ReactivateUser is called. The reason
+// is shown to the user. It needs the admin token.
+func (c *Client) SuspendUser(ctx context.Context, email, reason string) (*AdminUser, error) {
+	var user AdminUser
+	body := map[string]string{"reason": reason}
+	if _, err := c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(email)+"/suspend", body, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (c *Client) ReactivateUser(ctx context.Context, email string) (*AdminUser, error) {
+	var user AdminUser
+	if _, err := c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(email)+"/reactivate", nil, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetUserTier moves an account to another tier, or back to the server's
+// default one when tier is "". It needs the admin token.
+func (c *Client) SetUserTier(ctx context.Context, email, tier string) (*AdminUser, error) {
+	var user AdminUser
+	body := map[string]string{"tier": tier}
+	if _, err := c.do(ctx, http.MethodPut, "/admin/users/"+url.PathEscape(email)+"/tier", body, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// DeleteUser deletes an account and all of its data. It fails with 409
+// while the account is the last owner of an org with other members. It
+// needs the admin token.
+func (c *Client) DeleteUser(ctx context.Context, email string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/users/"+url.PathEscape(email), nil, nil, nil)
+	return err
+}
+
+// ResetCredentials revokes an account's token and password and sends the
+// user a link to choose a new password. It needs the admin token.
+func (c *Client) ResetCredentials(ctx context.Context, email, reason string) (*CredentialReset, error) {
+	var reset CredentialReset
+	body := map[string]string{"reason": reason}
+	if _, err := c.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(email)+"/reset-credentials", body, nil, &reset); err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// Impersonate issues a short-lived token for acting as req.Email; use it as
+// another client's Token. It needs the admin token.
+func (c *Client) Impersonate(ctx context.Context, req ImpersonateRequest) (*Impersonation, error) {
+	var imp Impersonation
+	if _, err := c.do(ctx, http.MethodPost, "/admin/impersonate", req, nil, &imp); err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+func (c *Client) RevokeImpersonation(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/impersonate/"+id, nil, nil, nil)
+	return err
+}
+
+// Account returns who the token signs in as, with the client's device when
+// DeviceID is set.
+func (c *Client) Account(ctx context.Context) (*Account, error) {
+	var account Account
+	if _, err := c.do(ctx, http.MethodGet, "/account", nil, nil, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// RotateToken replaces the account's API token and stores the new one on the
+// client. Every other machine holding the old one has to log in again.
+func (c *Client) RotateToken(ctx context.Context) (*User, error) {
+	var user User
+	if _, err := c.do(ctx, http.MethodPost, "/account/token", nil, nil, &user); err != nil {
+		return nil, err
+	}
+	c.Token = user.Token
+	return &user, nil
+}
+
+// Usage returns the account's usage per day over the last days days; zero
+// uses the server's default window.
+func (c *Client) Usage(ctx context.Context, days int) (*UsageResponse, error) {
+	q := url.Values{}
+	if days > 0 {
+		q.Set("days", strconv.Itoa(days))
+	}
+	var resp UsageResponse
+	if _, err := c.do(ctx, http.MethodGet, "/account/usage?"+q.Encode(), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Notifications reports which security emails the account gets, keyed by
+// kind: new_device, password_change, token_revoked and quota_warning.
+func (c *Client) Notifications(ctx context.Context) (map[string]bool, error) {
+	var prefs map[string]bool
+	if _, err := c.do(ctx, http.MethodGet, "/account/notifications", nil, nil, &prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// UpdateNotifications turns the given security emails on or off, leaving the
+// rest as they are, and returns the new preferences.
+func (c *Client) UpdateNotifications(ctx context.Context, prefs map[string]bool) (map[string]bool, error) {
+	var updated map[string]bool
+	if _, err := c.do(ctx, http.MethodPatch, "/account/notifications", prefs, nil, &updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// AdminUsage ranks accounts by usage over the last days days. It needs the
+// admin token.
+func (c *Client) AdminUsage(ctx context.Context, days int) (*AdminUsageResponse, error) {
+	q := url.Values{}
+	if days > 0 {
+		q.Set("days", strconv.Itoa(days))
+	}
+	var resp AdminUsageResponse
+	if _, err := c.do(ctx, http.MethodGet, "/admin/usage?"+q.Encode(), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Terms reports the server's terms of service and whether they've been
+// accepted.
+func (c *Client) Terms(ctx context.Context) (*TermsStatus, error) {
+	var status TermsStatus
+	if _, err := c.do(ctx, http.MethodGet, "/terms", nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// AcceptTerms accepts the given terms version, which must be the one the
+// server currently requires.
+func (c *Client) AcceptTerms(ctx context.Context, version string) (*TermsStatus, error) {
+	var status TermsStatus
+	body := map[string]string{"version": version}
+	if _, err := c.do(ctx, http.MethodPost, "/terms", body, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Announcements returns the operator's notices to show right now, if any.
+// It works without a token.
+func (c *Client) Announcements(ctx context.Context) ([]Announcement, error) {
+	var announcements []Announcement
+	_, err := c.do(ctx, http.MethodGet, "/announcements", nil, nil, &announcements)
+	return announcements, err
+}
+
+// SetAnnouncement replaces the announcement. It needs the admin token.
+func (c *Client) SetAnnouncement(ctx context.Context, req AnnouncementRequest) (*Announcement, error) {
+	var announcement Announcement
+	if _, err := c.do(ctx, http.MethodPut, "/admin/announcement", req, nil, &announcement); err != nil {
+		return nil, err
+	}
+	return &announcement, nil
+}
+
+// ClearAnnouncement removes the announcement. It needs the admin token.
+func (c *Client) ClearAnnouncement(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/announcement", nil, nil, nil)
+	return err
+}
+
+// Tenants lists the server's tenants. It needs the server admin token.
+func (c *Client) Tenants(ctx context.Context) ([]Tenant, error) {
+	var tenants []Tenant
+	_, err := c.do(ctx, http.MethodGet, "/admin/tenants", nil, nil, &tenants)
+	return tenants, err
+}
+
+// CreateTenant adds a tenant and returns it with its admin token.
+func (c *Client) CreateTenant(ctx context.Context, req TenantRequest) (*Tenant, error) {
+	var tenant Tenant
+	if _, err := c.do(ctx, http.MethodPost, "/admin/tenants", req, nil, &tenant); err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+// UpdateTenant changes a tenant's name, domains or limits.
+func (c *Client) UpdateTenant(ctx context.Context, id string, req TenantRequest) (*Tenant, error) {
+	var tenant Tenant
+	if _, err := c.do(ctx, http.MethodPatch, "/admin/tenants/"+url.PathEscape(id), req, nil, &tenant); err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+// DeleteTenant removes a tenant that has no accounts left.
+func (c *Client) DeleteTenant(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/tenants/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+// RotateTenantToken replaces a tenant's admin token and returns the tenant
+// with the new one.
+func (c *Client) RotateTenantToken(ctx context.Context, id string) (*Tenant, error) {
+	var tenant Tenant
+	if _, err := c.do(ctx, http.MethodPost, "/admin/tenants/"+url.PathEscape(id)+"/token", nil, nil, &tenant); err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+// Flags returns whether each feature flag the server defines is on for this
+// account. Flags missing from the map aren't defined; use the client's own
+// default for them.
+func (c *Client) Flags(ctx context.Context) (map[string]bool, error) {
+	var flags map[string]bool
+	_, err := c.do(ctx, http.MethodGet, "/flags", nil, nil, &flags)
+	return flags, err
+}
+
+// AdminFlags lists the feature flags with their rollout settings. It needs
+// the admin token.
+func (c *Client) AdminFlags(ctx context.Context) ([]Flag, error) {
+	var flags []Flag
+	_, err := c.do(ctx, http.MethodGet, "/admin/flags", nil, nil, &flags)
+	return flags, err
+}
+
+// SetFlag creates or updates a feature flag. It needs the admin token.
+func (c *Client) SetFlag(ctx context.Context, name string, req FlagRequest) (*Flag, error) {
+	var flag Flag
+	if _, err := c.do(ctx, http.MethodPut, "/admin/flags/"+url.PathEscape(name), req, nil, &flag); err != nil {
+		return nil, err
+	}
+	return &flag, nil
+}
+
+// DeleteFlag removes a feature flag. It needs the admin token.
+func (c *Client) DeleteFlag(ctx context.Context, name string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/flags/"+url.PathEscape(name), nil, nil, nil)
+	return err
+}
+
+// MintInviteCodes creates a batch of single-use registration invite codes.
+// It needs the admin token.
+func (c *Client) MintInviteCodes(ctx context.Context, req InviteCodeBatchRequest) (*InviteCodeBatch, error) {
+	var batch InviteCodeBatch
+	if _, err := c.do(ctx, http.MethodPost, "/admin/invite-codes", req, nil, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// InviteCodes lists invite codes and whether they were redeemed, optionally
+// only those of one batch. It needs the admin token.
+func (c *Client) InviteCodes(ctx context.Context, batch string) (*InviteCodeList, error) {
+	path := "/admin/invite-codes"
+	if batch != "" {
+		path += "?batch=" + url.QueryEscape(batch)
+	}
+	var list InviteCodeList
+	if _, err := c.do(ctx, http.MethodGet, path, nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// RevokeInviteCode deletes an unredeemed invite code by ID. It needs the
+// admin token.
+func (c *Client) RevokeInviteCode(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/invite-codes/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+// AbuseBlocks lists the addresses the server has blocked for abuse. It needs
+// the admin token.
+func (c *Client) AbuseBlocks(ctx context.Context) (*AbuseBlockList, error) {
+	var list AbuseBlockList
+	if _, err := c.do(ctx, http.MethodGet, "/admin/abuse", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Unblock lifts the block on an address, or an IPv6 /64 as listed by
+// AbuseBlocks. It needs the admin token.
+func (c *Client) Unblock(ctx context.Context, ip string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/admin/abuse/"+ip, nil, nil, nil)
+	return err
+}
+
+// Jobs lists the server's maintenance jobs and their recent runs. It needs
+// the admin token.
+func (c *Client) Jobs(ctx context.Context) ([]JobStatus, error) {
+	var jobs []JobStatus
+	_, err := c.do(ctx, http.MethodGet, "/admin/jobs", nil, nil, &jobs)
+	return jobs, err
+}
+
+// RunJob queues an immediate run of a maintenance job.
+func (c *Client) RunJob(ctx context.Context, name string) error {
+	_, err := c.do(ctx, http.MethodPost, "/admin/jobs/"+url.PathEscape(name)+"/run", nil, nil, nil)
+	return err
+}
+
+// rawBody is sent as-is instead of being JSON encoded.
+type rawBody string
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func revisionFrom(header http.Header) int64 {
+	rev, _ := strconv.ParseInt(strings.Trim(header.Get("ETag"), `"`), 10, 64)
+	return rev
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, opts *WriteOptions, out interface{}) (http.Header, error) {
+	var reader io.Reader
+	contentType := "application/json"
+	if raw, ok := body.(rawBody); ok {
+		reader = strings.NewReader(string(raw))
+		contentType = "application/octet-stream"
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+apiPrefix+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if method == http.MethodPatch {
+			contentType = "application/merge-patch+json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.DeviceID != "" {
+		req.Header.Set("X-Kiwi-Device", c.DeviceID)
+	}
+	if c.Owner != "" {
+		req.Header.Set("X-Kiwi-Owner", c.Owner)
+	}
+	if c.Tenant != "" {
+		req.Header.Set("X-Kiwi-Tenant", c.Tenant)
+	}
+	if opts != nil {
+		if opts.BaseRevision != nil {
+			req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, *opts.BaseRevision))
+		}
+		if opts.IdempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", opts.IdempotencyKey)
+		}
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if id := resp.Header.Get("Kiwi-Announcement"); id != "" && c.OnAnnouncement != nil {
+		c.OnAnnouncement(id)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusConflict && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var conflict ConflictError
+		if err := json.Unmarshal(data, &conflict); err == nil {
+			return resp.Header, &conflict
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.Header, newAPIError(resp, data)
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp.Header, errors.Join(errors.New("kiwi: invalid response body"), err)
+		}
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type Signature struct {
+	Path      string           `json:"path"`
+	Hash      string           `json:"hash"`
+	Size      int              `json:"size"`
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// DeltaOp either copies a block of the server's copy or inserts literal data.
+type DeltaOp struct {
+	Block *int   `json:"block,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type DeltaResponse struct {
+	Status   string `json:"status"`
+	Revision int64  `json:"revision"`
+	Hash     string `json:"hash"`
+	Size     int    `json:"size"`
+}
+
+// Signature fetches the block checksums of the server's copy of path. A zero
+// blockSize uses the server default.
+func (c *Client) Signature(ctx context.Context, path string, blockSize int) (*Signature, error) {
+	q := url.Values{"path": {path}}
+	if blockSize > 0 {
+		q.Set("block_size", strconv.Itoa(blockSize))
+	}
+	var sig Signature
+	_, err := c.do(ctx, http.MethodGet, "/sync/signature?"+q.Encode(), nil, nil, &sig)
+	return &sig, err
+}
+
+// PushDelta uploads content for path, sending only the blocks that differ
+// from the server's copy.
+func (c *Client) PushDelta(ctx context.Context, path string, content []byte, opts *WriteOptions) (*DeltaResponse, error) {
+	sig, err := c.Signature(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	body := map[string]interface{}{
+		"path":       path,
+		"base_hash":  sig.Hash,
+		"block_size": sig.BlockSize,
+		"ops":        ComputeDelta(sig, content),
+		"hash":       hex.EncodeToString(sum[:]),
+	}
+	var resp DeltaResponse
+	_, err = c.do(ctx, http.MethodPost, "/sync/delta", body, opts, &resp)
+	return &resp, err
+}
+
+// ComputeDelta slides a window over content and emits a block reference
+// wherever the window matches a block of sig, and literal data elsewhere.
+func ComputeDelta(sig *Signature, content []byte) []DeltaOp {
+	blockSize := sig.BlockSize
+	blocks := make(map[uint32][]int)
+	for i, block := range sig.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+	// The last block may be short; it can only match at the end of content
+	lastSize := sig.Size - (len(sig.Blocks)-1)*blockSize
+
+	var ops []DeltaOp
+	literalStart := 0
+	flush := func(end int) {
+		if end > literalStart {
+			ops = append(ops, DeltaOp{Data: content[literalStart:end]})
+		}
+	}
+	match := func(window []byte, weak uint32) (int, bool) {
+		candidates, ok := blocks[weak]
+		if !ok {
+			return 0, false
+		}
+		strong := strongChecksum(window)
+		for _, i := range candidates {
+			size := blockSize
+			if i == len(sig.Blocks)-1 {
+				size = lastSize
+			}
+			if size == len(window) && sig.Blocks[i].Strong == strong {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	pos := 0
+	var a, b uint32
+	rolling := false
+	for pos < len(content) {
+		end := min(pos+blockSize, len(content))
+		window := content[pos:end]
+		if !rolling {
+			a, b = 0, 0
+			for i, c := range window {
+				a += uint32(c)
+				b += uint32(len(window)-i) * uint32(c)
+			}
+			rolling = true
+		}
+		if i, ok := match(window, a&0xffff|b<<16); ok {
+			flush(pos)
+			block := i
+			ops = append(ops, DeltaOp{Block: &block})
+			pos = end
+			literalStart = pos
+			rolling = false
+			continue
+		}
+
+		// Roll the window forward one byte
+		out := uint32(content[pos])
+		a -= out
+		b -= uint32(len(window)) * out
+		if end < len(content) {
+			in := uint32(content[end])
+			a += in
+			b += a
+		}
+		pos++
+	}
+	flush(len(content))
+	return ops
+}
+
+func strongChecksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
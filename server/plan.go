@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// PlanRequest proposes a snapshot exactly as POST /sync would receive it.
+// Thin clients can send a manifest of hashes instead of file contents.
+type PlanRequest struct {
+	Files    map[string]string        `json:"files"`
+	Manifest map[string]ManifestEntry `json:"manifest"`
+	Packages []Package                `json:"packages"`
+	Vectors  map[string]VersionVector `json:"vectors,omitempty"`
+}
+
+type PlanResponse struct {
+	Revision        int64             `json:"revision"`
+	Created         []string          `json:"created"`
+	Modified        []string          `json:"modified"`
+	Deleted         []string          `json:"deleted"`
+	Unchanged       int               `json:"unchanged"`
+	PackagesChanged bool              `json:"packages_changed"`
+	Conflict        *ConflictResponse `json:"conflict,omitempty"`
+}
+
+// handleSyncPlan reports what a push would change without applying it. It
+// runs the same vector settlement and conflict checks as a real commit,
+// honouring If-Match.
+func handleSyncPlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" && r.Header.Get("X-User-Role") != "admin" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	base, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+
+	var req PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Files != nil && req.Manifest != nil {
+		http.Error(w, "Send either files or a manifest, not both", http.StatusBadRequest)
+		return
+	}
+	if req.Files, err = normalizePathKeys(req.Files); err == nil {
+		if req.Manifest, err = normalizePathKeys(req.Manifest); err == nil {
+			req.Vectors, err = normalizePathKeys(req.Vectors)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Manifest != nil && req.Vectors != nil {
+		http.Error(w, "Version vectors require file contents", http.StatusBadRequest)
+		return
+	}
+	if req.Packages == nil {
+		req.Packages = make([]Package, 0)
+	}
+
+	unlock := lockUserData(userEmail)
+	state, err := loadSyncState(userEmail)
+	if err != nil {
+		unlock()
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	current, err := loadSyncData(userEmail)
+	unlock()
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+
+	manifest := req.Manifest
+	settled := make(map[string]bool)
+	var vectorConflicts []FileConflict
+	if manifest == nil {
+		next := &SyncData{Files: req.Files, Packages: req.Packages}
+		if next.Files == nil {
+			next.Files = make(map[string]string)
+		}
+		settled, vectorConflicts = settleVersionVectors(state, current, next, req.Vectors)
+		manifest = manifestOf(next.Files)
+	}
+
+	resp := PlanResponse{
+		Revision:        state.Revision,
+		Created:         make([]string, 0),
+		Modified:        make([]string, 0),
+		Deleted:         make([]string, 0),
+		PackagesChanged: !packagesEqual(current.Packages, req.Packages),
+		Conflict:        checkConflicts(userEmail, state, current, manifest, req.Packages, base, settled, vectorConflicts),
+	}
+	for path, entry := range manifest {
+		fs, ok := state.Files[path]
+		switch {
+		case !ok || fs.Deleted:
+			resp.Created = append(resp.Created, path)
+		case fs.Hash != entry.Hash:
+			resp.Modified = append(resp.Modified, path)
+		default:
+			resp.Unchanged++
+		}
+	}
+	for path, fs := range state.Files {
+		if _, ok := manifest[path]; !ok && !fs.Deleted {
+			resp.Deleted = append(resp.Deleted, path)
+		}
+	}
+	sort.Strings(resp.Created)
+	sort.Strings(resp.Modified)
+	sort.Strings(resp.Deleted)
+
+	setRevisionHeaders(w, state)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// requireAdmin restricts a handler to the admin token. It runs after
+// authMiddleware, which sets X-User-Role.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-User-Role") != "admin" {
+			http.Error(w, "Forbidden - admin token required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// registerPprof mounts the runtime profiler under /debug/pprof/ for the
+// admin. CPU profiles and traces must fit in the server's WriteTimeout, so
+// pass ?seconds= below it.
+func registerPprof(mux *http.ServeMux) {
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return secureHeaders(authMiddleware(requireServerAdmin(h)))
+	}
+	mux.HandleFunc("/debug/pprof/", admin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", admin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", admin(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", admin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", admin(pprof.Trace))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A public profile exposes an allowlist of a user's files under
+// /u/{username}; everything else stays private. Usernames are indexed in
+// usernamesDir so public requests can find the owning account.
+const maxPublicFiles = 1000
+
+var usernameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}$`)
+
+type Profile struct {
+	Username    string   `json:"username"`
+	PublicFiles []string `json:"public_files"`
+}
+
+type PublicProfile struct {
+	Username string     `json:"username"`
+	Files    []FileInfo `json:"files"`
+}
+
+type usernameRecord struct {
+	Email string `json:"email"`
+}
+
+func getUsernamePath(username string) string {
+	return filepath.Join(usernamesDir, username+".json")
+}
+
+func getProfilePath(email string) string {
+	return filepath.Join(getUserDataDir(email), "profile.json")
+}
+
+func lookupUsername(username string) (string, error) {
+	data, err := os.ReadFile(getUsernamePath(username))
+	if err != nil {
+		return "", err
+	}
+	var record usernameRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return "", err
+	}
+	return record.Email, nil
+}
+
+func loadPublicFiles(email string) ([]string, error) {
+	files := make([]string, 0)
+	data, err := os.ReadFile(getProfilePath(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, err
+	}
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	if profile.PublicFiles != nil {
+		files = profile.PublicFiles
+	}
+	return files, nil
+}
+
+func savePublicFiles(email string, files []string) error {
+	if err := os.MkdirAll(getUserDataDir(email), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(Profile{PublicFiles: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getProfilePath(email), data, 0644)
+}
+
+// claimUsername points username at the user's account, releasing their
+// previous username. It writes the error response itself when it fails.
+func claimUsername(w http.ResponseWriter, email, username string) (*User, bool) {
+	unlock := lockUserData("\x00usernames")
+	defer unlock()
+
+	owner, err := lookupUsername(username)
+	if err == nil && owner != email {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return nil, false
+	} else if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	data, err := json.Marshal(usernameRecord{Email: email})
+	if err == nil {
+		err = writeFileAtomic(getUsernamePath(username), data, 0644)
+	}
+	if err != nil {
+		http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+		return nil, false
+	}
+	var previous string
+	user, ok := updateUser(w, email, func(user *User) {
+		previous = user.Username
+		user.Username = username
+	})
+	if !ok {
+		if owner == "" {
+			os.Remove(getUsernamePath(username))
+		}
+		return nil, false
+	}
+	if previous != "" && previous != username {
+		os.Remove(getUsernamePath(previous))
+	}
+	return user, true
+}
+
+// releaseUsername frees the user's username so anyone can claim it.
+func releaseUsername(w http.ResponseWriter, email string) bool {
+	unlock := lockUserData("\x00usernames")
+	defer unlock()
+
+	var previous string
+	if _, ok := updateUser(w, email, func(user *User) {
+		previous = user.Username
+		user.Username = ""
+	}); !ok {
+		return false
+	}
+	if previous != "" {
+		if owner, err := lookupUsername(previous); err == nil && owner == email {
+			os.Remove(getUsernamePath(previous))
+		}
+	}
+	return true
+}
+
+// handleProfile reads and sets the user's username and public files. DELETE
+// unpublishes everything and releases the username.
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var username string
+	switch r.Method {
+	case http.MethodGet:
+		user, err := loadUser(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read user", http.StatusInternalServerError)
+			return
+		}
+		username = user.Username
+
+	case http.MethodPut:
+		var req Profile
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Username = strings.ToLower(req.Username)
+		if !usernameRegex.MatchString(req.Username) {
+			http.Error(w, "Username must be 2-39 lowercase letters, digits or dashes", http.StatusBadRequest)
+			return
+		}
+		if len(req.PublicFiles) > maxPublicFiles {
+			http.Error(w, "Too many public files", http.StatusBadRequest)
+			return
+		}
+
+		user, ok := claimUsername(w, userEmail, req.Username)
+		if !ok {
+			return
+		}
+		username = user.Username
+		publicFiles := make([]string, 0, len(req.PublicFiles))
+		seen := make(map[string]bool)
+		for _, path := range req.PublicFiles {
+			if path != "" && !seen[path] {
+				seen[path] = true
+				publicFiles = append(publicFiles, path)
+			}
+		}
+		sort.Strings(publicFiles)
+		if err := savePublicFiles(userEmail, publicFiles); err != nil {
+			http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		// Unpublish first, so a failure leaves nothing public behind the name
+		if err := os.Remove(getProfilePath(userEmail)); err != nil && !os.IsNotExist(err) {
+			http.Error(w, "Failed to delete profile", http.StatusInternalServerError)
+			return
+		}
+		if releaseUsername(w, userEmail) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	publicFiles, err := loadPublicFiles(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Profile{Username: username, PublicFiles: publicFiles})
+}
+
+// handlePublicProfile lists a user's public files, or serves one of them.
+// Files that aren't both allowlisted and present are indistinguishable from
+// files that don't exist.
+func handlePublicProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PathValue("username")
+	if !usernameRegex.MatchString(username) {
+		http.NotFound(w, r)
+		return
+	}
+	email, err := lookupUsername(username)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// Suspended accounts publish nothing until an admin lifts the suspension
+	if user, err := loadUser(email); err != nil || !inRequestTenant(r, user) || user.Suspension != nil {
+		http.NotFound(w, r)
+		return
+	}
+	publicFiles, err := loadPublicFiles(email)
+	if err != nil {
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	syncData, err := loadSyncData(email)
+	if err != nil {
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+
+	path := r.PathValue("path")
+	if path == "" {
+		profile := PublicProfile{Username: username, Files: make([]FileInfo, 0, len(publicFiles))}
+		for _, path := range publicFiles {
+			if content, ok := syncData.Files[path]; ok {
+				profile.Files = append(profile.Files, FileInfo{Path: path, Size: len(content), Hash: hashContent(content)})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+		return
+	}
+
+	i := sort.SearchStrings(publicFiles, path)
+	content, ok := syncData.Files[path]
+	if i == len(publicFiles) || publicFiles[i] != path || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	state, err := loadSyncState(email)
+	if err != nil {
+		http.Error(w, "Failed to read profile", http.StatusInternalServerError)
+		return
+	}
+	servePublicFileContent(w, r, path, content, state.Files[path].UpdatedAt)
+}
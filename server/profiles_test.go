@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publishTestProfile gives email the username alice and publishes index.html.
+func publishTestProfile(t *testing.T, email string) {
+	t.Helper()
+	if err := writeFileAtomic(getUsernamePath("alice"), []byte(`{"email":"`+email+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUser(&User{Email: email, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePublicFiles(email, []string{"index.html"}); err != nil {
+		t.Fatal(err)
+	}
+	syncData := &SyncData{Files: map[string]string{"index.html": "<script>alert(1)</script>"}, Packages: []Package{}}
+	if err := saveSyncData(email, syncData); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func publicProfileRequest(path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/u/alice/"+path, nil)
+	r.SetPathValue("username", "alice")
+	r.SetPathValue("path", path)
+	rec := httptest.NewRecorder()
+	handlePublicProfile(rec, r)
+	return rec
+}
+
+func TestPublicProfileServesPlainText(t *testing.T) {
+	useTempStorage(t)
+	publishTestProfile(t, "alice@example.com")
+
+	rec := publicProfileRequest("index.html")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", csp)
+	}
+}
+
+func TestPublicProfileHidesSuspendedAccounts(t *testing.T) {
+	useTempStorage(t)
+	publishTestProfile(t, "alice@example.com")
+	user := &User{Email: "alice@example.com", Username: "alice", Suspension: &Suspension{SuspendedAt: time.Now()}}
+	if err := saveUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"", "index.html"} {
+		if rec := publicProfileRequest(path); rec.Code != http.StatusNotFound {
+			t.Errorf("/u/alice/%s: status = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func profileRequest(method, email, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/profile", strings.NewReader(body))
+	r.Header.Set("X-User-Email", email)
+	rec := httptest.NewRecorder()
+	handleProfile(rec, r)
+	return rec
+}
+
+func TestProfileDeleteReleasesUsername(t *testing.T) {
+	useTempStorage(t)
+	publishTestProfile(t, "alice@example.com")
+	if err := saveUser(&User{Email: "bob@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := profileRequest(http.MethodPut, "bob@example.com", `{"username":"alice"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("claiming a taken username: status = %d, want 409", rec.Code)
+	}
+	if rec := profileRequest(http.MethodDelete, "alice@example.com", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /profile: status = %d, want 204: %s", rec.Code, rec.Body)
+	}
+	if rec := publicProfileRequest("index.html"); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted profile still served: status = %d", rec.Code)
+	}
+	if user, err := loadUser("alice@example.com"); err != nil || user.Username != "" {
+		t.Errorf("username not cleared: %+v, %v", user, err)
+	}
+
+	if rec := profileRequest(http.MethodPut, "bob@example.com", `{"username":"alice"}`); rec.Code != http.StatusOK {
+		t.Fatalf("claiming a released username: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if owner, err := lookupUsername("alice"); err != nil || owner != "bob@example.com" {
+		t.Errorf("alice points at %q, %v", owner, err)
+	}
+}
+
+func TestClaimUsernameReleasesPrevious(t *testing.T) {
+	useTempStorage(t)
+	if err := saveUser(&User{Email: "alice@example.com", Token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"first", "second"} {
+		if rec := profileRequest(http.MethodPut, "alice@example.com", `{"username":"`+username+`"}`); rec.Code != http.StatusOK {
+			t.Fatalf("claiming %s: status = %d: %s", username, rec.Code, rec.Body)
+		}
+	}
+
+	user, err := loadUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Token != "token" || user.Username != "second" {
+		t.Errorf("user = %+v, want token kept and username second", user)
+	}
+	if _, err := lookupUsername("first"); !os.IsNotExist(err) {
+		t.Errorf("previous username still claimed: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Releases tell `kiwi self-update` which CLI version is current on each
+// channel and where to download it. The release process publishes them with
+// PUT /admin/releases/{channel}; clients read them from GET
+// /releases/{channel} without a token. The server only relays what it's
+// given: each asset carries an Ed25519 signature by the release key, which
+// the CLI checks against the key built into it before downloading, and the
+// download against the signed SHA-256 before installing it.
+const maxReleaseNotes = 2000
+
+var (
+	releaseChannels    = map[string]bool{"stable": true, "beta": true}
+	releaseSignatureRe = regexp.MustCompile(`^[0-9a-f]{128}$`)
+)
+
+type Release struct {
+	Channel string `json:"channel"`
+	Version string `json:"version"`
+	Notes   string `json:"notes,omitempty"`
+	// Assets maps a target triple, such as aarch64-apple-darwin, to the
+	// binary built for it
+	Assets      map[string]ReleaseAsset `json:"assets"`
+	PublishedAt time.Time               `json:"published_at"`
+}
+
+type ReleaseAsset struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	// Signature is the release key's Ed25519 signature, in hex, of
+	// "kiwi <version> <target> <sha256>"
+	Signature string `json:"signature"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+type ReleaseRequest struct {
+	Version string                  `json:"version"`
+	Notes   string                  `json:"notes,omitempty"`
+	Assets  map[string]ReleaseAsset `json:"assets"`
+}
+
+var (
+	releasesMu sync.RWMutex
+	releases   = map[string]*Release{}
+)
+
+func getReleasesPath() string {
+	return filepath.Join(currentConfig().StorageRoot, "releases.json")
+}
+
+// loadReleases reads the published releases at startup.
+func loadReleases() {
+	data, err := os.ReadFile(getReleasesPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read releases: %v", err)
+		}
+		return
+	}
+	loaded := map[string]*Release{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("Failed to read releases: %v", err)
+		return
+	}
+	releasesMu.Lock()
+	releases = loaded
+	releasesMu.Unlock()
+}
+
+// handleRelease returns the current release on a channel. It needs no
+// token, so the CLI can update before it signs in.
+func handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	channel := r.PathValue("channel")
+	if !releaseChannels[channel] {
+		http.Error(w, "Channel must be stable or beta", http.StatusNotFound)
+		return
+	}
+	releasesMu.RLock()
+	release := releases[channel]
+	releasesMu.RUnlock()
+	if release == nil {
+		http.Error(w, "No release on this channel", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(release)
+}
+
+// handleAdminRelease publishes (PUT) or withdraws (DELETE) the release on a
+// channel.
+func handleAdminRelease(w http.ResponseWriter, r *http.Request) {
+	channel := r.PathValue("channel")
+	if !releaseChannels[channel] {
+		http.Error(w, "Channel must be stable or beta", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		publishRelease(w, r, channel)
+	case http.MethodDelete:
+		releasesMu.Lock()
+		defer releasesMu.Unlock()
+		if releases[channel] == nil {
+			http.Error(w, "No release on this channel", http.StatusNotFound)
+			return
+		}
+		updated := copyReleases()
+		delete(updated, channel)
+		if err := saveReleases(updated); err != nil {
+			http.Error(w, "Failed to save releases", http.StatusInternalServerError)
+			return
+		}
+		releases = updated
+		audit(r, AuditEvent{Actor: "admin", Action: "release.withdraw", Target: channel})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func publishRelease(w http.ResponseWriter, r *http.Request, channel string) {
+	var req ReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Version = strings.TrimPrefix(strings.TrimSpace(req.Version), "v")
+	switch {
+	case req.Version == "":
+		http.Error(w, "Version is required", http.StatusBadRequest)
+		return
+	case len(req.Notes) > maxReleaseNotes:
+		http.Error(w, "Notes too long", http.StatusBadRequest)
+		return
+	case len(req.Assets) == 0:
+		http.Error(w, "At least one asset is required", http.StatusBadRequest)
+		return
+	}
+	for target, asset := range req.Assets {
+		if msg := validateReleaseAsset(target, asset); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	release := &Release{
+		Channel:     channel,
+		Version:     req.Version,
+		Notes:       req.Notes,
+		Assets:      req.Assets,
+		PublishedAt: time.Now().UTC(),
+	}
+	releasesMu.Lock()
+	updated := copyReleases()
+	updated[channel] = release
+	err := saveReleases(updated)
+	if err == nil {
+		releases = updated
+	}
+	releasesMu.Unlock()
+	if err != nil {
+		http.Error(w, "Failed to save releases", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Actor: "admin", Action: "release.publish", Target: channel, Detail: release.Version})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(release)
+}
+
+// validateReleaseAsset returns why an asset can't be published, or "".
+func validateReleaseAsset(target string, asset ReleaseAsset) string {
+	if target == "" || strings.ContainsAny(target, " /") {
+		return "Invalid target: " + target
+	}
+	u, err := url.Parse(asset.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "Asset URL for " + target + " must be https"
+	}
+	if !blobHashRegex.MatchString(asset.SHA256) {
+		return "Asset sha256 for " + target + " must be 64 lowercase hex digits"
+	}
+	if !releaseSignatureRe.MatchString(asset.Signature) {
+		return "Asset signature for " + target + " must be 128 lowercase hex digits"
+	}
+	if asset.Size < 0 {
+		return "Asset size for " + target + " can't be negative"
+	}
+	return ""
+}
+
+// copyReleases copies the release map for a writer to change; callers hold
+// releasesMu.
+func copyReleases() map[string]*Release {
+	updated := make(map[string]*Release, len(releases)+1)
+	for channel, release := range releases {
+		updated[channel] = release
+	}
+	return updated
+}
+
+func saveReleases(updated map[string]*Release) error {
+	data, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getReleasesPath(), data, 0644)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// On SIGUSR2 the server starts a new copy of its binary, hands it the
+// listening socket and, once the new process is serving, shuts down
+// gracefully so in-flight requests finish. The new process gets the listener
+// on fd 3 and a pipe on fd 4 that it writes to when it's ready.
+const (
+	inheritListenerEnv = "KIWI_INHERIT_LISTENER"
+	inheritedReadyFD   = 4
+	restartTimeout     = 30 * time.Second
+)
+
+// inheritedListener returns the listener passed by a restarting parent, or
+// nil if there's none.
+func inheritedListener() (net.Listener, error) {
+	if os.Getenv(inheritListenerEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(inheritListenerEnv)
+
+	f := os.NewFile(listenFDsStart, "inherited-listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	restarted = true
+	return ln, nil
+}
+
+// restarted is set when the listener came from a restarting parent.
+var restarted bool
+
+// notifyParentReady tells a restarting parent, or systemd for a Type=notify
+// unit, that this process is serving.
+func notifyParentReady() {
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	if !restarted {
+		return
+	}
+	f := os.NewFile(inheritedReadyFD, "restart-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// restart starts a new server process on ln and waits until it's ready. On
+// success the caller should shut down; on failure it keeps serving.
+func restart(ln net.Listener) error {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("listener can't be passed to another process")
+	}
+	lf, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), inheritListenerEnv+"=1")
+	cmd.ExtraFiles = []*os.File{lf, readyW}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	// The read fails with EOF if the child exits before it's ready
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(restartTimeout):
+		cmd.Process.Kill()
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Wait()
+		return fmt.Errorf("new process didn't start: %w", err)
+	}
+
+	// The new process serves the same socket file, so don't remove it
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	// Under systemd, make the new process the service's main process so it
+	// isn't stopped along with the cgroup when this one exits
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Printf("Failed to notify systemd of the new main process: %v", err)
+	}
+	return nil
+}
+
+// sdNotify sends a state update to systemd over $NOTIFY_SOCKET. It's a no-op
+// when the server isn't running under systemd or the unit doesn't listen
+// for notifications.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
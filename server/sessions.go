@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Web sessions sign the dashboard in without touching the account's API
+// token: POST /login hands out a new token and so signs out the CLI, which
+// a browser login shouldn't do. A session token is only good for webSessionTTL
+// and can be listed and revoked from any other session. Only a hash of the
+// token is stored, and it doubles as the ID.
+const (
+	webSessionTokenPrefix = "kiwi_web_"
+	webSessionTTL         = 12 * time.Hour
+	maxWebSessions        = 20
+)
+
+type WebSession struct {
+	ID         string    `json:"id"`
+	Email      string    `json:"email"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session making the request when listing
+	Current bool `json:"current,omitempty"`
+}
+
+type WebSessionResponse struct {
+	WebSession
+	Token string `json:"token"`
+}
+
+func getWebSessionPath(id string) string {
+	return filepath.Join(webSessionsDir, id+".json")
+}
+
+func loadWebSession(id string) (*WebSession, error) {
+	if !shareIDRegex.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(getWebSessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var session WebSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if expired(session.ExpiresAt) {
+		os.Remove(getWebSessionPath(id))
+		return nil, os.ErrNotExist
+	}
+	return &session, nil
+}
+
+// loadWebSessions returns a user's sessions, newest first.
+func loadWebSessions(email string) ([]*WebSession, error) {
+	entries, err := os.ReadDir(webSessionsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sessions []*WebSession
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		session, err := loadWebSession(id)
+		if err != nil || session.Email != email {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// revokeWebSessions signs a user out of the dashboard everywhere.
+func revokeWebSessions(email string) {
+	sessions, _ := loadWebSessions(email)
+	for _, session := range sessions {
+		os.Remove(getWebSessionPath(session.ID))
+	}
+}
+
+// handleSessions lists the caller's web sessions (GET, authenticated) or
+// signs in with a password to start one (POST, public).
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(handleListSessions)(w, r)
+	case http.MethodPost:
+		handleCreateSession(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	user, err := loadUser(req.Email)
+	if err != nil || !inRequestTenant(r, user) || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		metrics.authFailed("invalid_credentials")
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if user.Suspension != nil {
+		metrics.authFailed("suspended")
+		writeSuspended(w, user.Suspension)
+		return
+	}
+
+	// Make room by dropping the oldest sessions
+	if sessions, err := loadWebSessions(user.Email); err == nil {
+		for i := maxWebSessions - 1; i < len(sessions); i++ {
+			os.Remove(getWebSessionPath(sessions[i].ID))
+		}
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token = webSessionTokenPrefix + token
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	now := time.Now().UTC()
+	session := &WebSession{
+		ID:         hashShareToken(token),
+		Email:      user.Email,
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: host,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(webSessionTTL),
+	}
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(webSessionsDir, 0700); err == nil {
+			err = writeFileAtomic(getWebSessionPath(session.ID), data, 0600)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
+	notify(user, notifyNewDevice, "New sign-in to your kiwi account",
+		"Someone signed in to your kiwi account in a browser "+requestOrigin(r)+".\n\nIf this wasn't you, change your password and sign out your sessions.\n")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(WebSessionResponse{WebSession: *session, Token: token})
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Sessions belong to a user account", http.StatusBadRequest)
+		return
+	}
+	sessions, err := loadWebSessions(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sessions", http.StatusInternalServerError)
+		return
+	}
+	if sessions == nil {
+		sessions = []*WebSession{}
+	}
+	current := currentWebSessionID(r)
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// handleSession revokes one of the caller's sessions; "current" names the
+// one making the request, for signing out.
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	if id == "current" {
+		id = currentWebSessionID(r)
+	}
+	session, err := loadWebSession(id)
+	if err != nil || session.Email != r.Header.Get("X-User-Email") {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := os.Remove(getWebSessionPath(id)); err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentWebSessionID returns the ID of the session token the request was
+// made with, or "" for other credentials.
+func currentWebSessionID(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, webSessionTokenPrefix) {
+		return ""
+	}
+	return hashShareToken(token)
+}
+
+// serveWebSession authenticates a request made with a session token as its
+// user, like an API token.
+func serveWebSession(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	session, err := loadWebSession(hashShareToken(token))
+	if err != nil {
+		metrics.authFailed("invalid_token")
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+		return
+	}
+	user, err := loadUser(session.Email)
+	if err != nil || !inRequestTenant(r, user) {
+		metrics.authFailed("invalid_token")
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+		return
+	}
+	setAccessLogUser(r, user.Email)
+	if user.Suspension != nil {
+		metrics.authFailed("suspended")
+		writeSuspended(w, user.Suspension)
+		return
+	}
+	if termsPending(w, r, user) || tenantOverQuota(w, r, user) || tierRestricted(w, r, user) {
+		return
+	}
+	r.Header.Set("X-User-Email", user.Email)
+	r, ok := resolveSharedAccess(w, r, user.Email)
+	if !ok {
+		return
+	}
+	next.ServeHTTP(w, r)
+}
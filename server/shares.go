@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Share links serve a single file read-only to anyone holding the token.
+// Only a hash of the token is stored, and the hash doubles as the share ID
+// the owner uses to list and revoke links.
+const maxShareTTL = 365 * 24 * time.Hour
+
+var shareIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type Share struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Path      string     `json:"path"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type CreateShareRequest struct {
+	// ExpiresIn is the link lifetime in seconds; zero means it never expires.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type CreateShareResponse struct {
+	Share
+	URL string `json:"url"`
+}
+
+func hashShareToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func getSharePath(id string) string {
+	return filepath.Join(sharesDir, id+".json")
+}
+
+func loadShare(id string) (*Share, error) {
+	data, err := os.ReadFile(getSharePath(id))
+	if err != nil {
+		return nil, err
+	}
+	var share Share
+	if err := json.Unmarshal(data, &share); err != nil {
+		return nil, err
+	}
+	if share.ExpiresAt != nil && expired(*share.ExpiresAt) {
+		os.Remove(getSharePath(id))
+		return nil, os.ErrNotExist
+	}
+	return &share, nil
+}
+
+func saveShare(share *Share) error {
+	data, err := json.MarshalIndent(share, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getSharePath(share.ID), data, 0600)
+}
+
+// requestBaseURL reconstructs the externally visible origin of the server.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func handleShareCreate(w http.ResponseWriter, r *http.Request, userEmail, path string) {
+	var req CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if req.ExpiresIn < 0 || ttl > maxShareTTL {
+		http.Error(w, "expires_in must be between 0 and one year", http.StatusBadRequest)
+		return
+	}
+
+	syncData, err := loadSyncData(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := syncData.Files[path]; !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	share := &Share{
+		ID:        hashShareToken(token),
+		Email:     userEmail,
+		Path:      path,
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expiresAt := share.CreatedAt.Add(ttl)
+		share.ExpiresAt = &expiresAt
+	}
+	if err := saveShare(share); err != nil {
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateShareResponse{
+		Share: *share,
+		URL:   requestBaseURL(r) + "/s/" + token,
+	})
+}
+
+// handleShares lists the caller's active share links.
+func handleShares(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entries, err := os.ReadDir(sharesDir)
+	if err != nil {
+		http.Error(w, "Failed to read share links", http.StatusInternalServerError)
+		return
+	}
+	shares := make([]*Share, 0)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !shareIDRegex.MatchString(id) {
+			continue
+		}
+		share, err := loadShare(id)
+		if err != nil || share.Email != userEmail {
+			continue
+		}
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].CreatedAt.Before(shares[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shares)
+}
+
+// handleShare revokes a share link by ID.
+func handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.PathValue("id")
+	if !shareIDRegex.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	share, err := loadShare(id)
+	if err != nil || share.Email != userEmail {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err := os.Remove(getSharePath(id)); err != nil {
+		http.Error(w, "Failed to revoke share link", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSharedFile serves a shared file to anyone holding the link. It
+// always serves the file's current contents.
+func handleSharedFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	share, err := loadShare(hashShareToken(r.PathValue("token")))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	syncData, err := loadSyncData(share.Email)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	content, ok := syncData.Files[share.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	state, err := loadSyncState(share.Email)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	servePublicFileContent(w, r, share.Path, content, state.Files[share.Path].UpdatedAt)
+}
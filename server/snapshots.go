@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every committed revision is kept as a snapshot so clients can name it as
+// the common ancestor of a merge. File contents are stored once per hash in
+// the objects directory and shared between snapshots. How many are kept is
+// set by retention.snapshots.
+
+type Snapshot struct {
+	Revision  int64             `json:"revision"`
+	CreatedAt time.Time         `json:"created_at"`
+	Files     map[string]string `json:"files"`
+	Packages  []Package         `json:"packages"`
+}
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+func getSnapshotsDir(email string) string {
+	return filepath.Join(getUserDataDir(email), "snapshots")
+}
+
+func getObjectsDir(email string) string {
+	return filepath.Join(getUserDataDir(email), "objects")
+}
+
+func saveObject(email, hash, content string) error {
+	path := filepath.Join(getObjectsDir(email), hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return writeFileAtomic(path, []byte(content), 0644)
+}
+
+func loadObject(email, hash string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(getObjectsDir(email), hash))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func saveSnapshot(email string, revision int64, syncData *SyncData, createdAt time.Time) error {
+	if err := os.MkdirAll(getSnapshotsDir(email), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(getObjectsDir(email), 0755); err != nil {
+		return err
+	}
+
+	snapshot := Snapshot{
+		Revision:  revision,
+		CreatedAt: createdAt,
+		Files:     make(map[string]string, len(syncData.Files)),
+		Packages:  syncData.Packages,
+	}
+	for path, content := range syncData.Files {
+		hash := hashContent(content)
+		if err := saveObject(email, hash, content); err != nil {
+			return err
+		}
+		snapshot.Files[path] = hash
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	name := strconv.FormatInt(revision, 10) + ".json"
+	if err := writeFileAtomic(filepath.Join(getSnapshotsDir(email), name), data, 0644); err != nil {
+		return err
+	}
+
+	// Prune in bulk rather than on every commit, since collecting unused
+	// objects means reading every remaining snapshot
+	if keep := int64(currentConfig().SnapshotRetention); revision%keep == 0 {
+		return pruneSnapshots(email, revision-keep)
+	}
+	return nil
+}
+
+func readSnapshot(email string, revision int64) (*Snapshot, error) {
+	name := strconv.FormatInt(revision, 10) + ".json"
+	data, err := os.ReadFile(filepath.Join(getSnapshotsDir(email), name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errSnapshotNotFound
+		}
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// loadSnapshotData returns the sync data as of revision. The current revision
+// is always available, including data written before snapshots existed.
+func loadSnapshotData(email string, revision int64, state *SyncState) (*SyncData, error) {
+	if revision == state.Revision {
+		return loadSyncData(email)
+	}
+	snapshot, err := readSnapshot(email, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	syncData := &SyncData{
+		Files:    make(map[string]string, len(snapshot.Files)),
+		Packages: snapshot.Packages,
+	}
+	if syncData.Packages == nil {
+		syncData.Packages = make([]Package, 0)
+	}
+	for path, hash := range snapshot.Files {
+		content, err := loadObject(email, hash)
+		if err != nil {
+			return nil, err
+		}
+		syncData.Files[path] = content
+	}
+	return syncData, nil
+}
+
+// pruneSnapshots drops snapshots at or before revision and the objects no
+// remaining snapshot refers to.
+func pruneSnapshots(email string, revision int64) error {
+	entries, err := os.ReadDir(getSnapshotsDir(email))
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		rev, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if rev <= revision {
+			os.Remove(filepath.Join(getSnapshotsDir(email), entry.Name()))
+			continue
+		}
+		snapshot, err := readSnapshot(email, rev)
+		if err != nil {
+			return err
+		}
+		for _, hash := range snapshot.Files {
+			referenced[hash] = true
+		}
+	}
+
+	objects, err := os.ReadDir(getObjectsDir(email))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if !referenced[object.Name()] {
+			os.Remove(filepath.Join(getObjectsDir(email), object.Name()))
+		}
+	}
+	return nil
+}
+
+// handleSyncSnapshot returns the files and packages as of a past revision,
+// so clients can show what changed between two of them.
+func handleSyncSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	revision, err := strconv.ParseInt(r.PathValue("revision"), 10, 64)
+	if err != nil || revision < 0 {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockUserData(userEmail)
+	state, err := loadSyncState(userEmail)
+	var syncData *SyncData
+	if err == nil {
+		syncData, err = loadSnapshotData(userEmail, revision, state)
+	}
+	unlock()
+	if err != nil {
+		if errors.Is(err, errSnapshotNotFound) {
+			http.Error(w, "Unknown snapshot - it may have been pruned", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Kiwi-Revision", strconv.FormatInt(revision, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(syncData)
+}
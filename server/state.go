@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileState is the server's record of the last change to a synced file.
+// Deleted files are kept as tombstones so stale clients can't resurrect them.
+type FileState struct {
+	Hash      string        `json:"hash,omitempty"`
+	Size      int           `json:"size"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Revision  int64         `json:"revision"`
+	Deleted   bool          `json:"deleted,omitempty"`
+	Vector    VersionVector `json:"vector,omitempty"`
+}
+
+// SyncState tracks the revision history metadata of a user's sync data.
+// Every write that changes something bumps Revision, which clients echo back
+// in If-Match to detect concurrent changes.
+type SyncState struct {
+	Revision          int64                `json:"revision"`
+	PackagesRevision  int64                `json:"packages_revision"`
+	PackagesUpdatedAt time.Time            `json:"packages_updated_at"`
+	UpdatedAt         time.Time            `json:"updated_at"`
+	Files             map[string]FileState `json:"files"`
+}
+
+type FileVersion struct {
+	Hash      string        `json:"hash,omitempty"`
+	Size      int           `json:"size"`
+	UpdatedAt *time.Time    `json:"updated_at,omitempty"`
+	Revision  int64         `json:"revision,omitempty"`
+	Deleted   bool          `json:"deleted,omitempty"`
+	Vector    VersionVector `json:"vector,omitempty"`
+}
+
+type FileConflict struct {
+	Path string `json:"path"`
+	// Base is the file at the base revision, the common ancestor for a
+	// three-way merge; nil once that revision's snapshot has been pruned
+	Base   *FileVersion `json:"base,omitempty"`
+	Theirs FileVersion  `json:"theirs"`
+	Yours  FileVersion  `json:"yours"`
+}
+
+type ConflictResponse struct {
+	Error            string         `json:"error"`
+	BaseRevision     int64          `json:"base_revision"`
+	CurrentRevision  int64          `json:"current_revision"`
+	Files            []FileConflict `json:"files"`
+	PackagesConflict bool           `json:"packages_conflict,omitempty"`
+}
+
+// ChangeEvent describes the latest change to a file (or to the package list)
+// since a cursor. Replaying the same events is idempotent.
+type ChangeEvent struct {
+	Revision  int64         `json:"revision"`
+	Type      string        `json:"type"`
+	Path      string        `json:"path,omitempty"`
+	Hash      string        `json:"hash,omitempty"`
+	Size      int           `json:"size,omitempty"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Vector    VersionVector `json:"vector,omitempty"`
+}
+
+// changeCursor marks how far a client has read the change feed. An empty
+// Path means every change up to and including Revision has been delivered;
+// otherwise only the files of Revision up to Path have.
+type changeCursor struct {
+	Revision int64  `json:"r"`
+	Path     string `json:"p,omitempty"`
+}
+
+var userLocks sync.Map
+
+// lockUserData serializes read-modify-write cycles on a user's sync data.
+// Keys with a \x00 suffix name other per-user state and are only locked
+// within this process.
+func lockUserData(email string) func() {
+	v, _ := userLocks.LoadOrStore(email, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	if strings.Contains(email, "\x00") {
+		return mu.Unlock
+	}
+
+	// During a SIGUSR2 handoff the old and new processes both commit sync
+	// data, so the user's directory is locked on disk as well.
+	f, err := flockFile(filepath.Join(getUserDataDir(email), "sync.lock"))
+	if err != nil {
+		log.Printf("Failed to lock sync data on disk: %v", err)
+		return mu.Unlock
+	}
+	return func() {
+		f.Close()
+		mu.Unlock()
+	}
+}
+
+// flockFile opens path and takes an exclusive flock on it, which is released
+// when the file is closed.
+func flockFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func getSyncStatePath(email string) string {
+	return filepath.Join(getUserDataDir(email), "sync_state.json")
+}
+
+func loadSyncState(email string) (*SyncState, error) {
+	data, err := os.ReadFile(getSyncStatePath(email))
+	if err == nil {
+		var state SyncState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		if state.Files == nil {
+			state.Files = make(map[string]FileState)
+		}
+		return &state, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Data written before state tracking existed starts out at revision 0
+	state := &SyncState{Files: make(map[string]FileState)}
+	syncData, err := loadSyncData(email)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filepath.Join(getUserDataDir(email), "sync_data.json")); err == nil {
+		state.UpdatedAt = info.ModTime().UTC()
+		state.PackagesUpdatedAt = state.UpdatedAt
+	}
+	for path, content := range syncData.Files {
+		state.Files[path] = FileState{
+			Hash:      hashContent(content),
+			Size:      len(content),
+			UpdatedAt: state.UpdatedAt,
+		}
+	}
+	return state, nil
+}
+
+func saveSyncState(email string, state *SyncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getSyncStatePath(email), data, 0644)
+}
+
+func packagesEqual(a, b []Package) bool {
+	aj, errA := json.Marshal(a)
+	bj, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aj, bj)
+}
+
+// parseIfMatch extracts the base revision a client wrote against. A missing
+// header means the client opted out of conflict detection.
+func parseIfMatch(r *http.Request) (*int64, error) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" {
+		return nil, nil
+	}
+	v = strings.TrimPrefix(v, "W/")
+	v = strings.Trim(v, `"`)
+	base, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || base < 0 {
+		return nil, fmt.Errorf("invalid If-Match revision %q", v)
+	}
+	return &base, nil
+}
+
+func setRevisionHeaders(w http.ResponseWriter, state *SyncState) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, state.Revision))
+	w.Header().Set("X-Kiwi-Revision", strconv.FormatInt(state.Revision, 10))
+}
+
+func writeConflict(w http.ResponseWriter, state *SyncState, conflict *ConflictResponse) {
+	setRevisionHeaders(w, state)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(conflict)
+}
+
+// detectConflicts reports the files that changed on the server after base and
+// that next would overwrite with different content. Changes the client never
+// touched are not conflicts, so concurrent edits to different files merge.
+// Files in settled were already checked by their version vectors.
+func detectConflicts(state *SyncState, current *SyncData, next map[string]ManifestEntry, nextPackages []Package, base int64, settled map[string]bool) *ConflictResponse {
+	conflict := &ConflictResponse{
+		Error:           "conflict",
+		BaseRevision:    base,
+		CurrentRevision: state.Revision,
+		Files:           make([]FileConflict, 0),
+	}
+
+	for path, fs := range state.Files {
+		if fs.Revision <= base || settled[path] {
+			continue
+		}
+		entry, ok := next[path]
+		if fs.Deleted && !ok {
+			continue
+		}
+		if !fs.Deleted && ok && entry.Hash == fs.Hash {
+			continue
+		}
+
+		updatedAt := fs.UpdatedAt
+		theirs := FileVersion{
+			Hash:      fs.Hash,
+			Size:      fs.Size,
+			UpdatedAt: &updatedAt,
+			Revision:  fs.Revision,
+			Deleted:   fs.Deleted,
+			Vector:    fs.Vector,
+		}
+		yours := FileVersion{Deleted: !ok}
+		if ok {
+			yours.Hash = entry.Hash
+			yours.Size = entry.Size
+		}
+		conflict.Files = append(conflict.Files, FileConflict{Path: path, Theirs: theirs, Yours: yours})
+	}
+	sort.Slice(conflict.Files, func(i, j int) bool {
+		return conflict.Files[i].Path < conflict.Files[j].Path
+	})
+
+	conflict.PackagesConflict = state.PackagesRevision > base && !packagesEqual(current.Packages, nextPackages)
+
+	return conflict
+}
+
+// checkConflicts decides whether a write of next to email's data may
+// proceed, combining revision-based detection against base with the version
+// vector conflicts settleVersionVectors found. It returns nil when there's
+// no conflict.
+func checkConflicts(email string, state *SyncState, current *SyncData, next map[string]ManifestEntry, nextPackages []Package, base *int64, settled map[string]bool, vectorConflicts []FileConflict) *ConflictResponse {
+	conflict := &ConflictResponse{Error: "conflict", CurrentRevision: state.Revision}
+	if base != nil && *base != state.Revision {
+		conflict = detectConflicts(state, current, next, nextPackages, *base, settled)
+	} else if base != nil {
+		conflict.BaseRevision = *base
+	} else {
+		conflict.BaseRevision = state.Revision
+	}
+	if len(vectorConflicts) > 0 {
+		conflict.Files = append(conflict.Files, vectorConflicts...)
+		sort.Slice(conflict.Files, func(i, j int) bool {
+			return conflict.Files[i].Path < conflict.Files[j].Path
+		})
+	}
+	if len(conflict.Files) == 0 && !conflict.PackagesConflict {
+		return nil
+	}
+	addConflictBases(email, state, conflict)
+	return conflict
+}
+
+// addConflictBases records each conflicting file as it was at the
+// conflict's base revision. A file missing there is reported deleted.
+func addConflictBases(email string, state *SyncState, conflict *ConflictResponse) {
+	var base map[string]string
+	if snapshot, err := readSnapshot(email, conflict.BaseRevision); err == nil {
+		base = snapshot.Files
+	} else if conflict.BaseRevision == state.Revision {
+		// Data written before snapshots existed has no snapshot yet
+		base = make(map[string]string, len(state.Files))
+		for path, fs := range state.Files {
+			if !fs.Deleted {
+				base[path] = fs.Hash
+			}
+		}
+	} else {
+		return
+	}
+
+	for i := range conflict.Files {
+		file := &conflict.Files[i]
+		hash, ok := base[file.Path]
+		version := &FileVersion{Hash: hash, Deleted: !ok}
+		if ok {
+			version.Size = int(fileBytes(filepath.Join(getObjectsDir(email), hash)))
+			if fs := state.Files[file.Path]; fs.Hash == hash {
+				version.Size = fs.Size
+			}
+		}
+		file.Base = version
+	}
+}
+
+// manifestOf describes files by hash and size, the form conflict detection
+// and sync plans compare.
+func manifestOf(files map[string]string) map[string]ManifestEntry {
+	manifest := make(map[string]ManifestEntry, len(files))
+	for path, content := range files {
+		manifest[path] = ManifestEntry{Hash: hashContent(content), Size: len(content)}
+	}
+	return manifest
+}
+
+// writeCommitError answers a request whose commitSyncData failed.
+func writeCommitError(w http.ResponseWriter, err error) {
+	var full *storageFullError
+	if errors.As(err, &full) {
+		http.Error(w, full.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	http.Error(w, "Failed to save sync data", http.StatusInternalServerError)
+}
+
+// commitSyncData is the single write path for sync data. When base is set the
+// write is rejected with a conflict if it would overwrite newer server state.
+// Nothing is written once the request's time budget in ctx has run out.
+// Callers must hold lockUserData for the user.
+func commitSyncData(ctx context.Context, email string, next *SyncData, base *int64) (*SyncState, *ConflictResponse, error) {
+	current, err := loadSyncData(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := loadSyncState(email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Vectors only travel with the request; they're recorded per file below
+	vectors := next.Vectors
+	next.Vectors = nil
+	settled, vectorConflicts := settleVersionVectors(state, current, next, vectors)
+
+	if conflict := checkConflicts(email, state, current, manifestOf(next.Files), next.Packages, base, settled, vectorConflicts); conflict != nil {
+		return state, conflict, nil
+	}
+
+	now := time.Now().UTC()
+	revision := state.Revision + 1
+	changed := false
+	vectorsChanged := false
+	var changedFiles []string
+
+	for path, content := range next.Files {
+		hash := hashContent(content)
+		fs, ok := state.Files[path]
+		vector := nextVector(fs.Vector, vectors[path])
+		if ok && !fs.Deleted && fs.Hash == hash {
+			// Same content under a newer vector still advances the vector
+			if vectors[path] != nil && compareVectors(vector, fs.Vector) != vectorEqual {
+				fs.Vector = vector
+				state.Files[path] = fs
+				vectorsChanged = true
+			}
+			continue
+		}
+		state.Files[path] = FileState{
+			Hash:      hash,
+			Size:      len(content),
+			UpdatedAt: now,
+			Revision:  revision,
+			Vector:    vector,
+		}
+		changedFiles = append(changedFiles, path)
+		changed = true
+	}
+	for path, fs := range state.Files {
+		if _, ok := next.Files[path]; !ok && !fs.Deleted {
+			state.Files[path] = FileState{
+				UpdatedAt: now,
+				Revision:  revision,
+				Deleted:   true,
+				Vector:    nextVector(fs.Vector, vectors[path]),
+			}
+			changedFiles = append(changedFiles, path)
+			changed = true
+		}
+	}
+	packagesChanged := !packagesEqual(current.Packages, next.Packages)
+	if packagesChanged {
+		state.PackagesRevision = revision
+		state.PackagesUpdatedAt = now
+		changed = true
+	}
+
+	if err := checkTierStorage(email, current, next); err != nil {
+		return nil, nil, err
+	}
+	if err := beginCommit(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := saveSyncData(email, next); err != nil {
+		return nil, nil, err
+	}
+	if changed {
+		state.Revision = revision
+		state.UpdatedAt = now
+		if err := saveSyncState(email, state); err != nil {
+			return nil, nil, err
+		}
+		if err := saveSnapshot(email, revision, next, now); err != nil {
+			return nil, nil, err
+		}
+		sort.Strings(changedFiles)
+		syncHub.publish(email, SyncEvent{
+			Type:      "sync",
+			Revision:  revision,
+			UpdatedAt: now,
+			Files:     changedFiles,
+			Packages:  packagesChanged,
+		})
+	} else if vectorsChanged {
+		if err := saveSyncState(email, state); err != nil {
+			return nil, nil, err
+		}
+	}
+	return state, nil, nil
+}
+
+func encodeChangeCursor(c changeCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeChangeCursor(v string) (changeCursor, error) {
+	// Revision 0 holds data written before state tracking existed
+	c := changeCursor{Revision: -1}
+	if v == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// changesSince lists changes after cursor ordered by revision and then path,
+// with the package list sorting after the files of its revision.
+func changesSince(state *SyncState, after changeCursor) []ChangeEvent {
+	var changes []ChangeEvent
+	for path, fs := range state.Files {
+		if fs.Revision < after.Revision ||
+			fs.Revision == after.Revision && (after.Path == "" || path <= after.Path) {
+			continue
+		}
+		event := ChangeEvent{
+			Revision:  fs.Revision,
+			Type:      "file_updated",
+			Path:      path,
+			Hash:      fs.Hash,
+			Size:      fs.Size,
+			UpdatedAt: fs.UpdatedAt,
+			Vector:    fs.Vector,
+		}
+		if fs.Deleted {
+			event.Type = "file_deleted"
+		}
+		changes = append(changes, event)
+	}
+	if state.PackagesRevision > after.Revision ||
+		state.PackagesRevision == after.Revision && after.Path != "" {
+		changes = append(changes, ChangeEvent{
+			Revision:  state.PackagesRevision,
+			Type:      "packages_updated",
+			UpdatedAt: state.PackagesUpdatedAt,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Revision != b.Revision {
+			return a.Revision < b.Revision
+		}
+		if (a.Path == "") != (b.Path == "") {
+			return b.Path == ""
+		}
+		return a.Path < b.Path
+	})
+	return changes
+}
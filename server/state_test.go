@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFlockFileExcludesOtherOpens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user", "sync.lock")
+	f, err := flockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another open file description, as another process would have
+	other, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("second flock = %v, want EWOULDBLOCK", err)
+	}
+
+	f.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("flock after close = %v, want success", err)
+	}
+}
+
+func TestConflictsIncludeBase(t *testing.T) {
+	useTempStorage(t)
+	email := "alice@example.com"
+	commit := func(files map[string]string, base *int64) *ConflictResponse {
+		t.Helper()
+		_, conflict, err := commitSyncData(context.Background(), email, &SyncData{Files: files, Packages: []Package{}}, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conflict
+	}
+	commit(map[string]string{".zshrc": "one"}, nil)
+	base := int64(1)
+	commit(map[string]string{".zshrc": "two", ".vimrc": "theirs"}, &base)
+
+	conflict := commit(map[string]string{".zshrc": "three", ".vimrc": "yours"}, &base)
+	if conflict == nil || len(conflict.Files) != 2 {
+		t.Fatalf("conflict = %+v, want two files", conflict)
+	}
+	for _, file := range conflict.Files {
+		if file.Base == nil {
+			t.Fatalf("%s has no base", file.Path)
+		}
+	}
+	vimrc, zshrc := conflict.Files[0], conflict.Files[1]
+	if !vimrc.Base.Deleted {
+		t.Errorf(".vimrc base = %+v, want deleted since it didn't exist at revision 1", vimrc.Base)
+	}
+	if zshrc.Base.Hash != hashContent("one") || zshrc.Base.Size != 3 {
+		t.Errorf(".zshrc base = %+v, want the revision 1 content", zshrc.Base)
+	}
+}
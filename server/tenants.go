@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tenants partition one server between independent groups. With
+// tenants.enabled on, every request belongs to a tenant: the one whose
+// domains include the request's Host, else the one named by the
+// X-Kiwi-Tenant header, else the default tenant "" that holds accounts
+// from before tenants existed. Accounts belong to the tenant they
+// registered in and can only sign in, share and join orgs there; an email
+// address can be in one tenant only.
+//
+// Each tenant has its own admin token, which works like the server admin
+// token but only sees and manages the tenant's accounts, and optional
+// limits on accounts and storage. Server-wide endpoints (jobs, tenants,
+// announcements, metrics) stay with the server admin token.
+const (
+	tenantHeader           = "X-Kiwi-Tenant"
+	tenantAdminTokenPrefix = "kiwi_tadm_"
+	maxTenantDomains       = 20
+	// tenantStorageTTL is how stale the storage total used for quotas may be
+	tenantStorageTTL = time.Minute
+)
+
+var tenantIDRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type Tenant struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Domains         []string  `json:"domains"`
+	MaxUsers        int       `json:"max_users,omitempty"`
+	MaxStorageBytes int64     `json:"max_storage_bytes,omitempty"`
+	AdminTokenHash  string    `json:"admin_token_hash"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// TenantInfo is a tenant as the server admin sees it. AdminToken is only
+// set when a token was just created.
+type TenantInfo struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Domains         []string  `json:"domains"`
+	MaxUsers        int       `json:"max_users,omitempty"`
+	MaxStorageBytes int64     `json:"max_storage_bytes,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	Users           int       `json:"users"`
+	StorageBytes    int64     `json:"storage_bytes"`
+	AdminToken      string    `json:"admin_token,omitempty"`
+}
+
+type TenantRequest struct {
+	ID              string    `json:"id"`
+	Name            *string   `json:"name"`
+	Domains         *[]string `json:"domains"`
+	MaxUsers        *int      `json:"max_users"`
+	MaxStorageBytes *int64    `json:"max_storage_bytes"`
+}
+
+// tenantIndex is every tenant, looked up by ID, domain and admin token
+// hash. It's rebuilt whenever a tenant changes.
+type tenantIndex struct {
+	byID     map[string]*Tenant
+	byDomain map[string]*Tenant
+	byToken  map[string]*Tenant
+}
+
+var (
+	tenants   atomic.Pointer[tenantIndex]
+	tenantsMu sync.Mutex
+)
+
+func getTenantPath(id string) string {
+	return filepath.Join(tenantsDir, id+".json")
+}
+
+// loadTenants reads the tenants into the index, at startup and after every
+// change.
+func loadTenants() error {
+	index := &tenantIndex{
+		byID:     make(map[string]*Tenant),
+		byDomain: make(map[string]*Tenant),
+		byToken:  make(map[string]*Tenant),
+	}
+	entries, err := os.ReadDir(tenantsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(tenantsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var tenant Tenant
+		if err := json.Unmarshal(data, &tenant); err != nil {
+			log.Printf("Skipping unreadable tenant %s: %v", entry.Name(), err)
+			continue
+		}
+		index.byID[tenant.ID] = &tenant
+		for _, domain := range tenant.Domains {
+			index.byDomain[domain] = &tenant
+		}
+		index.byToken[tenant.AdminTokenHash] = &tenant
+	}
+	tenants.Store(index)
+	return nil
+}
+
+func lookupTenant(id string) *Tenant {
+	index := tenants.Load()
+	if index == nil {
+		return nil
+	}
+	return index.byID[id]
+}
+
+func tenantsEnabled() bool {
+	return currentConfig().Tenants
+}
+
+// requestTenant returns the tenant a request is for. ok is false when the
+// X-Kiwi-Tenant header names a tenant that doesn't exist.
+func requestTenant(r *http.Request) (id string, ok bool) {
+	if !tenantsEnabled() {
+		return "", true
+	}
+	index := tenants.Load()
+	if index == nil {
+		return "", true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if tenant := index.byDomain[strings.ToLower(host)]; tenant != nil {
+		return tenant.ID, true
+	}
+	if id := r.Header.Get(tenantHeader); id != "" {
+		return id, index.byID[id] != nil
+	}
+	return "", true
+}
+
+// inRequestTenant reports whether user may act through this request. It
+// always does while tenants are off.
+func inRequestTenant(r *http.Request, user *User) bool {
+	if !tenantsEnabled() {
+		return true
+	}
+	tenant, ok := requestTenant(r)
+	return ok && user.Tenant == tenant
+}
+
+// inTenant reports whether the account email exists in tenant, for checks
+// before sharing with it.
+func inTenant(tenant, email string) bool {
+	user, err := loadUser(email)
+	if err != nil {
+		return false
+	}
+	return !tenantsEnabled() || user.Tenant == tenant
+}
+
+// userTenant returns the tenant of an account, or "" if it can't be read.
+func userTenant(email string) string {
+	user, err := loadUser(email)
+	if err != nil {
+		return ""
+	}
+	return user.Tenant
+}
+
+// serveTenantAdmin authenticates a tenant admin token as an admin limited
+// to its tenant; see adminTenant.
+func serveTenantAdmin(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	var tenant *Tenant
+	if index := tenants.Load(); index != nil && tenantsEnabled() {
+		tenant = index.byToken[hashShareToken(token)]
+	}
+	if tenant == nil {
+		metrics.authFailed("invalid_token")
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+		return
+	}
+	// The token works on its own tenant's domains and on shared ones
+	if id, ok := requestTenant(r); !ok || id != "" && id != tenant.ID {
+		metrics.authFailed("invalid_token")
+		http.Error(w, "Unauthorized - Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.Pattern, "/admin/") {
+		http.Error(w, "Forbidden - tenant admin tokens only work on /admin endpoints", http.StatusForbidden)
+		return
+	}
+	setAccessLogUser(r, "admin:"+tenant.ID)
+	r.Header.Del("X-User-Email")
+	r.Header.Set("X-User-Role", "admin")
+	r.Header.Set("X-Admin-Tenant", tenant.ID)
+	next.ServeHTTP(w, r)
+}
+
+// adminTenant returns the tenant an admin request is limited to; scoped is
+// false for the server admin token.
+func adminTenant(r *http.Request) (tenant string, scoped bool) {
+	tenant = r.Header.Get("X-Admin-Tenant")
+	return tenant, tenant != ""
+}
+
+// adminActor names the admin making r in audit events.
+func adminActor(r *http.Request) string {
+	if tenant, scoped := adminTenant(r); scoped {
+		return "admin:" + tenant
+	}
+	return "admin"
+}
+
+// adminCanSee reports whether the admin making r manages user.
+func adminCanSee(r *http.Request, user *User) bool {
+	tenant, scoped := adminTenant(r)
+	return !scoped || user.Tenant == tenant
+}
+
+// listAdminUsers returns the accounts the admin making r manages.
+func listAdminUsers(r *http.Request) ([]User, error) {
+	users, err := listUsers()
+	if err != nil {
+		return nil, err
+	}
+	if _, scoped := adminTenant(r); !scoped {
+		return users, nil
+	}
+	visible := users[:0]
+	for _, user := range users {
+		if adminCanSee(r, &user) {
+			visible = append(visible, user)
+		}
+	}
+	return visible, nil
+}
+
+// adminTarget checks that the account an admin request names is one the
+// admin manages, answering 404 for accounts of other tenants as for
+// missing ones.
+func adminTarget(w http.ResponseWriter, r *http.Request, email string) bool {
+	user, err := loadUser(email)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Failed to read user", http.StatusInternalServerError)
+		return false
+	}
+	if err != nil || !adminCanSee(r, user) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// requireServerAdmin is requireAdmin for endpoints that affect the whole
+// server, which tenant admin tokens can't use.
+func requireServerAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if _, scoped := adminTenant(r); scoped {
+			http.Error(w, "Forbidden - server admin token required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantStorage caches each tenant's storage total for quota checks.
+var tenantStorage struct {
+	sync.Mutex
+	totals    map[string]tenantUsage
+	scannedAt time.Time
+}
+
+type tenantUsage struct {
+	users int
+	bytes int64
+}
+
+// tenantUsageTotals returns the account count and storage of every
+// tenant, rescanning at most every tenantStorageTTL.
+func tenantUsageTotals() map[string]tenantUsage {
+	tenantStorage.Lock()
+	defer tenantStorage.Unlock()
+	if tenantStorage.totals != nil && time.Since(tenantStorage.scannedAt) < tenantStorageTTL {
+		return tenantStorage.totals
+	}
+	totals := make(map[string]tenantUsage)
+	users, _ := listUsers()
+	for _, user := range users {
+		usage := totals[user.Tenant]
+		usage.users++
+		usage.bytes += userStorageBytes(user.Email)
+		totals[user.Tenant] = usage
+	}
+	tenantStorage.totals, tenantStorage.scannedAt = totals, time.Now()
+	return totals
+}
+
+// tenantOverQuota refuses uploads from accounts whose tenant has used up
+// its storage, with 507. Reads and deletes still work so users can make
+// room.
+func tenantOverQuota(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if !tenantsEnabled() || user.Tenant == "" {
+		return false
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return false
+	}
+	if r.Pattern != "/sync" && !strings.HasPrefix(r.Pattern, "/sync/") && r.Pattern != "/uploads" && !strings.HasPrefix(r.Pattern, "/uploads/") {
+		return false
+	}
+	tenant := lookupTenant(user.Tenant)
+	if tenant == nil || tenant.MaxStorageBytes <= 0 || tenantUsageTotals()[tenant.ID].bytes < tenant.MaxStorageBytes {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Insufficient storage - %s has used its %d byte quota", tenant.Name, tenant.MaxStorageBytes), http.StatusInsufficientStorage)
+	return true
+}
+
+// tenantFull reports whether a tenant can't take another account.
+func tenantFull(id string) bool {
+	tenant := lookupTenant(id)
+	if tenant == nil || tenant.MaxUsers <= 0 {
+		return false
+	}
+	// Count afresh; a stale count would let a burst of signups through
+	users, err := listUsers()
+	if err != nil {
+		return true
+	}
+	n := 0
+	for _, user := range users {
+		if user.Tenant == id {
+			n++
+		}
+	}
+	return n >= tenant.MaxUsers
+}
+
+func (t *Tenant) info() TenantInfo {
+	usage := tenantUsageTotals()[t.ID]
+	return TenantInfo{
+		ID:              t.ID,
+		Name:            t.Name,
+		Domains:         t.Domains,
+		MaxUsers:        t.MaxUsers,
+		MaxStorageBytes: t.MaxStorageBytes,
+		CreatedAt:       t.CreatedAt,
+		Users:           usage.users,
+		StorageBytes:    usage.bytes,
+	}
+}
+
+func saveTenant(tenant *Tenant) error {
+	data, err := json.MarshalIndent(tenant, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tenantsDir, 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(getTenantPath(tenant.ID), data, 0600); err != nil {
+		return err
+	}
+	return loadTenants()
+}
+
+// newTenantAdminToken sets a fresh admin token on tenant and returns it.
+func newTenantAdminToken(tenant *Tenant) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	token = tenantAdminTokenPrefix + token
+	tenant.AdminTokenHash = hashShareToken(token)
+	return token, nil
+}
+
+// applyTenantRequest validates req and copies it onto tenant.
+func applyTenantRequest(tenant *Tenant, req *TenantRequest) error {
+	if req.Name != nil {
+		tenant.Name = strings.TrimSpace(*req.Name)
+	}
+	if tenant.Name == "" {
+		tenant.Name = tenant.ID
+	}
+	if req.Domains != nil {
+		if len(*req.Domains) > maxTenantDomains {
+			return fmt.Errorf("a tenant can have at most %d domains", maxTenantDomains)
+		}
+		domains := make([]string, 0, len(*req.Domains))
+		index := tenants.Load()
+		for _, domain := range *req.Domains {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain == "" || strings.ContainsAny(domain, ":/ ") {
+				return fmt.Errorf("invalid domain %q", domain)
+			}
+			if other := index.byDomain[domain]; other != nil && other.ID != tenant.ID {
+				return fmt.Errorf("%s already belongs to tenant %s", domain, other.ID)
+			}
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+		tenant.Domains = domains
+	}
+	if req.MaxUsers != nil {
+		if *req.MaxUsers < 0 {
+			return errors.New("max_users can't be negative")
+		}
+		tenant.MaxUsers = *req.MaxUsers
+	}
+	if req.MaxStorageBytes != nil {
+		if *req.MaxStorageBytes < 0 {
+			return errors.New("max_storage_bytes can't be negative")
+		}
+		tenant.MaxStorageBytes = *req.MaxStorageBytes
+	}
+	return nil
+}
+
+// handleTenants lists tenants (GET) or creates one (POST), returning its
+// admin token once.
+func handleTenants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		index := tenants.Load()
+		infos := make([]TenantInfo, 0, len(index.byID))
+		for _, tenant := range index.byID {
+			infos = append(infos, tenant.info())
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].ID < infos[j].ID
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+
+	case http.MethodPost:
+		var req TenantRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !tenantIDRegex.MatchString(req.ID) {
+			http.Error(w, "Tenant IDs are 1-63 lowercase letters, digits and dashes", http.StatusBadRequest)
+			return
+		}
+
+		tenantsMu.Lock()
+		defer tenantsMu.Unlock()
+		if lookupTenant(req.ID) != nil {
+			http.Error(w, "Tenant "+req.ID+" already exists", http.StatusConflict)
+			return
+		}
+		tenant := &Tenant{ID: req.ID, Domains: []string{}, CreatedAt: time.Now().UTC()}
+		if err := applyTenantRequest(tenant, &req); err != nil {
+			http.Error(w, "Invalid tenant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		token, err := newTenantAdminToken(tenant)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := saveTenant(tenant); err != nil {
+			http.Error(w, "Failed to save tenant", http.StatusInternalServerError)
+			return
+		}
+		audit(r, AuditEvent{Actor: "admin", Action: "tenant.create", Target: tenant.ID})
+
+		info := tenant.info()
+		info.AdminToken = token
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTenant shows (GET), updates (PATCH) or deletes (DELETE) a tenant.
+// Only tenants without accounts can be deleted.
+func handleTenant(w http.ResponseWriter, r *http.Request) {
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	tenant := lookupTenant(r.PathValue("id"))
+	if tenant == nil {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	// Work on a copy; the index is shared with concurrent requests
+	updated := *tenant
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenant.info())
+
+	case http.MethodPatch:
+		var req TenantRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := applyTenantRequest(&updated, &req); err != nil {
+			http.Error(w, "Invalid tenant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveTenant(&updated); err != nil {
+			http.Error(w, "Failed to save tenant", http.StatusInternalServerError)
+			return
+		}
+		audit(r, AuditEvent{Actor: "admin", Action: "tenant.update", Target: tenant.ID})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated.info())
+
+	case http.MethodDelete:
+		users, err := listUsers()
+		if err != nil {
+			http.Error(w, "Failed to read users", http.StatusInternalServerError)
+			return
+		}
+		for _, user := range users {
+			if user.Tenant == tenant.ID {
+				http.Error(w, "Tenant "+tenant.ID+" still has accounts; delete them first", http.StatusConflict)
+				return
+			}
+		}
+		if err := os.Remove(getTenantPath(tenant.ID)); err != nil {
+			http.Error(w, "Failed to delete tenant", http.StatusInternalServerError)
+			return
+		}
+		if err := loadTenants(); err != nil {
+			log.Printf("Failed to reload tenants: %v", err)
+		}
+		audit(r, AuditEvent{Actor: "admin", Action: "tenant.delete", Target: tenant.ID})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTenantToken replaces a tenant's admin token, revoking the old one.
+func handleTenantToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	tenant := lookupTenant(r.PathValue("id"))
+	if tenant == nil {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	updated := *tenant
+	token, err := newTenantAdminToken(&updated)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := saveTenant(&updated); err != nil {
+		http.Error(w, "Failed to save tenant", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Actor: "admin", Action: "tenant.rotate_token", Target: tenant.ID})
+
+	info := updated.info()
+	info.AdminToken = token
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
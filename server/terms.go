@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Hosted deployments can require users to accept terms of service. With
+// terms.version set, sync requests from accounts that haven't accepted that
+// exact version get 403 with the version and URL in the Kiwi-Terms-Version
+// and Kiwi-Terms-URL headers, until they POST it to /terms. Bumping the
+// version asks everyone again. Other requests, such as login and reading
+// the terms, keep working so the client can walk the user through it.
+const (
+	termsVersionHeader = "Kiwi-Terms-Version"
+	termsURLHeader     = "Kiwi-Terms-URL"
+)
+
+type TermsAcceptance struct {
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+type TermsStatus struct {
+	// Version is empty when the server doesn't require terms
+	Version  string           `json:"version,omitempty"`
+	URL      string           `json:"url,omitempty"`
+	Accepted bool             `json:"accepted"`
+	Last     *TermsAcceptance `json:"last_accepted,omitempty"`
+}
+
+type AcceptTermsRequest struct {
+	Version string `json:"version"`
+}
+
+// termsPending reports whether user must accept the current terms before
+// the request can go ahead, and answers it if so. Only sync is gated.
+func termsPending(w http.ResponseWriter, r *http.Request, user *User) bool {
+	cfg := currentConfig()
+	if cfg.TermsVersion == "" || (r.Pattern != "/sync" && !strings.HasPrefix(r.Pattern, "/sync/")) {
+		return false
+	}
+	if user.TermsAccepted != nil && user.TermsAccepted.Version == cfg.TermsVersion {
+		return false
+	}
+	w.Header().Set(termsVersionHeader, cfg.TermsVersion)
+	msg := "Forbidden - accept the terms of service (version " + cfg.TermsVersion + ") to sync"
+	if cfg.TermsURL != "" {
+		w.Header().Set(termsURLHeader, cfg.TermsURL)
+		msg += ": " + cfg.TermsURL
+	}
+	http.Error(w, msg, http.StatusForbidden)
+	return true
+}
+
+func newTermsStatus(user *User) TermsStatus {
+	cfg := currentConfig()
+	status := TermsStatus{
+		Version: cfg.TermsVersion,
+		URL:     cfg.TermsURL,
+		Last:    user.TermsAccepted,
+	}
+	status.Accepted = cfg.TermsVersion == "" || (user.TermsAccepted != nil && user.TermsAccepted.Version == cfg.TermsVersion)
+	return status
+}
+
+// handleTerms shows the current terms and whether the caller has accepted
+// them (GET), or accepts them (POST). Accepting names the version so a
+// client can't agree to terms that changed after it showed them.
+func handleTerms(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Terms are accepted by a user account", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err := loadUser(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read user", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newTermsStatus(user))
+	case http.MethodPost:
+		var req AcceptTermsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		version := currentConfig().TermsVersion
+		if version == "" {
+			http.Error(w, "This server has no terms to accept", http.StatusNotFound)
+			return
+		}
+		if req.Version != version {
+			http.Error(w, "The terms have changed; review version "+version, http.StatusConflict)
+			return
+		}
+		user, ok := updateUser(w, userEmail, func(user *User) {
+			if user.TermsAccepted == nil || user.TermsAccepted.Version != version {
+				user.TermsAccepted = &TermsAcceptance{Version: version, AcceptedAt: time.Now().UTC()}
+			}
+		})
+		if !ok {
+			return
+		}
+		audit(r, AuditEvent{Actor: user.Email, Action: "terms.accept", Target: user.Email, Detail: "version " + version})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newTermsStatus(user))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Every account is on a tier, which sets how fast it may make requests and
+// how much it may store. Tiers are configured under [tiers.<name>]; a zero
+// limit means none. Accounts without a tier of their own are on
+// tiers.default. The per-account rate limit applies on top of the
+// server-wide one in [rate_limit], and the storage limit only refuses writes
+// that grow the stored data, so users can still read and delete.
+const (
+	tierFree      = "free"
+	tierPro       = "pro"
+	tierUnlimited = "unlimited"
+)
+
+var tierNames = []string{tierFree, tierPro, tierUnlimited}
+
+type TierLimits struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+	StorageMB         int     `json:"storage_mb,omitempty"`
+}
+
+type TierRequest struct {
+	// Tier is a tier name, or "" to put the account back on the default
+	Tier string `json:"tier"`
+}
+
+func defaultTiers() map[string]TierLimits {
+	return map[string]TierLimits{
+		tierFree:      {RequestsPerSecond: 1, Burst: 10, StorageMB: 100},
+		tierPro:       {RequestsPerSecond: 5, Burst: 50, StorageMB: 5000},
+		tierUnlimited: {},
+	}
+}
+
+func init() {
+	configFields = append(configFields, configField{"tiers.default", "KIWI_TIER_DEFAULT", func(c *Config, v string) error {
+		if _, ok := c.Tiers[v]; !ok {
+			return fmt.Errorf("expected one of %s, got %q", strings.Join(tierNames, ", "), v)
+		}
+		c.DefaultTier = v
+		return nil
+	}})
+	for _, name := range tierNames {
+		env := "KIWI_TIER_" + strings.ToUpper(name)
+		configFields = append(configFields,
+			configField{"tiers." + name + ".requests_per_second", env + "_RATE_LIMIT", setTierLimit(name, func(l *TierLimits, v string) error {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil || f < 0 {
+					return fmt.Errorf("expected a number, 0 for no limit, got %q", v)
+				}
+				l.RequestsPerSecond = f
+				return nil
+			})},
+			configField{"tiers." + name + ".burst", env + "_BURST", setTierLimit(name, func(l *TierLimits, v string) error {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					return fmt.Errorf("expected a whole number, got %q", v)
+				}
+				l.Burst = n
+				return nil
+			})},
+			configField{"tiers." + name + ".storage_mb", env + "_STORAGE_MB", setTierLimit(name, func(l *TierLimits, v string) error {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					return fmt.Errorf("expected a whole number, 0 for no limit, got %q", v)
+				}
+				l.StorageMB = n
+				return nil
+			})},
+		)
+	}
+}
+
+func setTierLimit(name string, set func(l *TierLimits, v string) error) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		limits := c.Tiers[name]
+		if err := set(&limits, v); err != nil {
+			return err
+		}
+		c.Tiers[name] = limits
+		return nil
+	}
+}
+
+// userTier returns the tier an account is on.
+func userTier(cfg *Config, user *User) string {
+	if _, ok := cfg.Tiers[user.Tier]; ok {
+		return user.Tier
+	}
+	return cfg.DefaultTier
+}
+
+// accountLimiters holds a token bucket per account that has made requests
+// since the last session cleanup. Buckets follow config reloads.
+var accountLimiters = struct {
+	sync.Mutex
+	limiters map[string]*rate.Limiter
+}{limiters: make(map[string]*rate.Limiter)}
+
+// allowAccount takes a token from an account's bucket, returning how long to
+// wait when it's empty.
+func allowAccount(email string, limits TierLimits) (bool, time.Duration) {
+	if limits.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+	burst := max(limits.Burst, 1)
+
+	accountLimiters.Lock()
+	limiter := accountLimiters.limiters[email]
+	if limiter == nil {
+		limiter = rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)
+		accountLimiters.limiters[email] = limiter
+	}
+	accountLimiters.Unlock()
+
+	now := time.Now()
+	if limiter.Limit() != rate.Limit(limits.RequestsPerSecond) || limiter.Burst() != burst {
+		limiter.SetLimitAt(now, rate.Limit(limits.RequestsPerSecond))
+		limiter.SetBurstAt(now, burst)
+	}
+	if limiter.AllowN(now, 1) {
+		return true, 0
+	}
+	wait := (1 - math.Max(limiter.TokensAt(now), 0)) / limits.RequestsPerSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// pruneAccountLimiters drops buckets that have refilled, which lose nothing
+// by being recreated.
+func pruneAccountLimiters() {
+	accountLimiters.Lock()
+	defer accountLimiters.Unlock()
+	now := time.Now()
+	for email, limiter := range accountLimiters.limiters {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(accountLimiters.limiters, email)
+		}
+	}
+}
+
+// tierRestricted applies the account's tier: 429 past its request rate, and
+// 507 for resumable upload chunks that would take it past its storage. Sync
+// writes are measured when they commit, by checkTierStorage, once the state
+// they leave is known. It writes the response itself.
+func tierRestricted(w http.ResponseWriter, r *http.Request, user *User) bool {
+	cfg := currentConfig()
+	tier := userTier(cfg, user)
+	limits := cfg.Tiers[tier]
+
+	if ok, wait := allowAccount(user.Email, limits); !ok {
+		metrics.rateLimitRejected()
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+		http.Error(w, fmt.Sprintf("Too many requests - the %s tier allows %g requests per second", tier, limits.RequestsPerSecond), http.StatusTooManyRequests)
+		return true
+	}
+
+	if limits.StorageMB <= 0 {
+		return false
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return false
+	}
+	// Uploads can't be made into someone else's file sets, so they're
+	// charged to the caller
+	if r.Pattern != "/uploads" && !strings.HasPrefix(r.Pattern, "/uploads/") {
+		return false
+	}
+	if userStorageBytes(user.Email)+max(r.ContentLength, 0) <= int64(limits.StorageMB)<<20 {
+		return false
+	}
+	http.Error(w, (&storageFullError{tier: tier, storageMB: limits.StorageMB}).Error(), http.StatusInsufficientStorage)
+	return true
+}
+
+// storageFullError refuses a write that would take an account past its
+// tier's storage.
+type storageFullError struct {
+	tier      string
+	storageMB int
+}
+
+func (e *storageFullError) Error() string {
+	return fmt.Sprintf("Insufficient storage - the %s tier can store %d MB", e.tier, e.storageMB)
+}
+
+// checkTierStorage refuses replacing current with next if that grows the
+// account past its tier's storage. The account is the owner of the data, so
+// members writing to a shared file set use the owner's storage. Writes that
+// don't grow the data always go through, so an account over its limit can
+// still delete files.
+func checkTierStorage(email string, current, next *SyncData) error {
+	growth := syncDataSize(next) - syncDataSize(current)
+	if growth <= 0 {
+		return nil
+	}
+	user, err := loadUser(email)
+	if err != nil {
+		return nil
+	}
+	cfg := currentConfig()
+	tier := userTier(cfg, user)
+	limits := cfg.Tiers[tier]
+	if limits.StorageMB <= 0 {
+		return nil
+	}
+	// A finished upload's bytes are staged in the data directory until this
+	// commit, and they're counted in growth already
+	stored := userStorageBytes(email) - dirBytes(getUploadsDir(email))
+	if stored+growth <= int64(limits.StorageMB)<<20 {
+		return nil
+	}
+	return &storageFullError{tier: tier, storageMB: limits.StorageMB}
+}
+
+// syncDataSize approximates the bytes syncData takes to store.
+func syncDataSize(syncData *SyncData) int64 {
+	var size int64
+	for path, content := range syncData.Files {
+		size += int64(len(path) + len(content))
+	}
+	for _, pkg := range syncData.Packages {
+		size += int64(len(pkg.Name))
+		if pkg.Version != nil {
+			size += int64(len(*pkg.Version))
+		}
+	}
+	return size
+}
+
+// handleUserTier moves an account to another tier.
+func handleUserTier(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TierRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := currentConfig().Tiers[req.Tier]; req.Tier != "" && !ok {
+		http.Error(w, "Tier must be one of "+strings.Join(tierNames, ", "), http.StatusBadRequest)
+		return
+	}
+
+	if !adminTarget(w, r, r.PathValue("email")) {
+		return
+	}
+	user, ok := updateUser(w, r.PathValue("email"), func(user *User) {
+		user.Tier = req.Tier
+	})
+	if !ok {
+		return
+	}
+	log.Printf("Moved %s to the %s tier", user.Email, userTier(currentConfig(), user))
+	audit(r, AuditEvent{Actor: adminActor(r), Action: "user.tier", Target: user.Email, Detail: req.Tier})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAdminUser(*user))
+}
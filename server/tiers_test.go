@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckTierStorage(t *testing.T) {
+	useTempStorage(t)
+	cfg := *currentConfig()
+	cfg.Tiers = map[string]TierLimits{tierFree: {StorageMB: 1}}
+	cfg.DefaultTier = tierFree
+	applyConfig(&cfg)
+	if err := saveUser(&User{Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := func(sizes ...int) *SyncData {
+		data := &SyncData{Files: map[string]string{}}
+		for i, size := range sizes {
+			data.Files[string(rune('a'+i))] = strings.Repeat("x", size)
+		}
+		return data
+	}
+	// 600 KB stored, on a 1 MB tier
+	stored := files(600 << 10)
+	if err := saveSyncData("alice@example.com", stored); err != nil {
+		t.Fatal(err)
+	}
+	over := files(600<<10, 600<<10)
+
+	tests := []struct {
+		name          string
+		current, next *SyncData
+		full          bool
+	}{
+		{"same state again", stored, files(600 << 10), false},
+		{"small growth", stored, files(600<<10, 100<<10), false},
+		{"past the limit", stored, over, true},
+		{"shrinking while over", over, files(600 << 10), false},
+		{"deleting everything", over, files(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTierStorage("alice@example.com", tt.current, tt.next)
+			var full *storageFullError
+			if got := errors.As(err, &full); got != tt.full {
+				t.Errorf("checkTierStorage = %v, want storage full %v", err, tt.full)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Every API route gets a time budget from its class in routeTimeoutClass;
+// unlisted routes use the default. The budget covers reading the body and
+// writing the response, replacing the server-wide timeouts for that request,
+// so downloads can run for minutes while logins stay short. A client that
+// sends its body too slowly gets 408. A handler that overruns the budget
+// gets 503 only if it changed nothing: reads, and writes that gave up at
+// beginCommit. Once a write has been committed its real response is sent
+// however late, so clients don't retry work that landed.
+const timeoutGrace = 5 * time.Second
+
+var routeTimeoutClass = map[string]string{
+	"/register":       "auth",
+	"/login":          "auth",
+	"/reset-password": "auth",
+	"/invite":         "auth",
+	"/trial":          "auth",
+
+	"/sync":          "sync",
+	"/sync/batch":    "sync",
+	"/sync/delta":    "sync",
+	"/sync/merge":    "sync",
+	"/sync/manifest": "sync",
+
+	"/sync/files/{path...}":                   "transfer",
+	"/sync/blobs/{hash}":                      "transfer",
+	"/sync/transactions/{id}/files/{path...}": "transfer",
+	"/uploads/{id}":                           "transfer",
+	"/s/{token}":                              "transfer",
+	"/u/{username}/{path...}":                 "transfer",
+
+	// Hijacked; the WebSocket code manages its own deadlines
+	"/sync/ws": "none",
+}
+
+func routeTimeout(cfg *Config, pattern string) time.Duration {
+	switch routeTimeoutClass[pattern] {
+	case "auth":
+		return cfg.TimeoutAuth
+	case "sync":
+		return cfg.TimeoutSync
+	case "transfer":
+		return cfg.TimeoutTransfer
+	case "none":
+		return 0
+	}
+	return cfg.TimeoutDefault
+}
+
+// timedBody notes when reading the request body hit the read deadline.
+type timedBody struct {
+	io.ReadCloser
+	timedOut bool
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		b.timedOut = true
+	}
+	return n, err
+}
+
+// commitGuard records whether a handler committed a write, or gave up on
+// one because the budget ran out.
+type commitGuard struct {
+	committed bool
+	aborted   bool
+}
+
+type commitGuardKey struct{}
+
+// beginCommit is called right before a handler writes state. It fails once
+// the request's budget has run out, so the handler can give up with nothing
+// changed and the client is told to retry.
+func beginCommit(ctx context.Context) error {
+	g, _ := ctx.Value(commitGuardKey{}).(*commitGuard)
+	if err := ctx.Err(); errors.Is(err, context.DeadlineExceeded) {
+		if g != nil {
+			g.aborted = true
+		}
+		return err
+	}
+	if g != nil {
+		g.committed = true
+	}
+	return nil
+}
+
+// timeoutWriter swaps the handler's response for a 408 or 503 when the
+// budget ran out before it started writing and nothing was committed.
+type timeoutWriter struct {
+	http.ResponseWriter
+	deadline    time.Time
+	body        *timedBody
+	guard       *commitGuard
+	method      string
+	wroteHeader bool
+	discard     bool
+}
+
+// retryable reports whether an overrun can be answered with 503: the handler
+// committed nothing and either only read or gave up before writing.
+func (tw *timeoutWriter) retryable() bool {
+	if tw.guard.committed {
+		return false
+	}
+	return tw.guard.aborted || tw.method == http.MethodGet || tw.method == http.MethodHead
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+
+	switch {
+	case tw.body.timedOut:
+		tw.replace()
+		tw.Header().Set("Connection", "close")
+		http.Error(tw.ResponseWriter, "Request timeout - the request body arrived too slowly", http.StatusRequestTimeout)
+	case time.Now().After(tw.deadline) && tw.retryable():
+		tw.replace()
+		tw.Header().Set("Retry-After", "5")
+		http.Error(tw.ResponseWriter, "Request took too long to process", http.StatusServiceUnavailable)
+	default:
+		tw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// replace drops what the handler set up for its own response.
+func (tw *timeoutWriter) replace() {
+	tw.discard = true
+	for _, name := range []string{"Content-Encoding", "Content-Disposition", "Content-Range", "ETag", "Last-Modified", "X-Kiwi-Revision"} {
+		tw.Header().Del(name)
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.discard {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// timeoutMiddleware applies route budgets to the API mux. It looks the
+// route up itself since the mux only sets r.Pattern once it dispatches.
+func timeoutMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		// The mux would set this on our copy below, out of instrument's sight
+		r.Pattern = pattern
+		budget := routeTimeout(currentConfig(), pattern)
+		if budget <= 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		deadline := time.Now().Add(budget)
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline)
+		// Leave time to send the 503 when the handler overruns
+		rc.SetWriteDeadline(deadline.Add(timeoutGrace))
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		guard := &commitGuard{}
+		ctx = context.WithValue(ctx, commitGuardKey{}, guard)
+		body := &timedBody{ReadCloser: r.Body}
+		r.Body = body
+		tw := &timeoutWriter{ResponseWriter: w, deadline: deadline, body: body, guard: guard, method: r.Method}
+
+		mux.ServeHTTP(tw, r.WithContext(ctx))
+		if !tw.wroteHeader {
+			tw.WriteHeader(http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutMiddlewareOverruns(t *testing.T) {
+	old := currentConfig()
+	cfg := *old
+	cfg.TimeoutDefault = 20 * time.Millisecond
+	activeConfig.Store(&cfg)
+	t.Cleanup(func() { activeConfig.Store(old) })
+
+	tests := []struct {
+		name    string
+		method  string
+		handler func(w http.ResponseWriter, r *http.Request)
+		want    int
+	}{
+		{"read overruns", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(40 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusServiceUnavailable},
+		{"write committed before the deadline", http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			if err := beginCommit(r.Context()); err != nil {
+				t.Errorf("beginCommit before the deadline: %v", err)
+			}
+			time.Sleep(40 * time.Millisecond)
+			w.WriteHeader(http.StatusCreated)
+		}, http.StatusCreated},
+		{"write gives up after the deadline", http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(40 * time.Millisecond)
+			if err := beginCommit(r.Context()); err == nil {
+				t.Error("beginCommit after the deadline succeeded")
+			}
+			http.Error(w, "Failed to save sync data", http.StatusInternalServerError)
+		}, http.StatusServiceUnavailable},
+		{"write without a guard", http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(40 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusOK},
+		{"read within budget", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/test", tt.handler)
+			rec := httptest.NewRecorder()
+			timeoutMiddleware(mux).ServeHTTP(rec, httptest.NewRequest(tt.method, "/test", nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("503 without Retry-After")
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A transaction stages file updates across many requests and applies them
+// in a single commit, so a push that dies halfway never becomes visible.
+const transactionTTL = time.Hour
+
+type Transaction struct {
+	ID           string             `json:"id"`
+	BaseRevision int64              `json:"base_revision"`
+	CreatedAt    time.Time          `json:"created_at"`
+	ExpiresAt    time.Time          `json:"expires_at"`
+	Files        map[string]*string `json:"files"`
+	Packages     []Package          `json:"packages,omitempty"`
+}
+
+type TransactionResponse struct {
+	ID           string    `json:"id"`
+	BaseRevision int64     `json:"base_revision"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Updated      []string  `json:"updated"`
+	Deleted      []string  `json:"deleted"`
+	Packages     bool      `json:"packages"`
+}
+
+func getTransactionPath(email, id string) string {
+	return filepath.Join(getUserDataDir(email), "transactions", id+".json")
+}
+
+func lockTransaction(email, id string) func() {
+	return lockUserData(email + "\x00txn\x00" + id)
+}
+
+func loadTransaction(email, id string) (*Transaction, error) {
+	data, err := os.ReadFile(getTransactionPath(email, id))
+	if err != nil {
+		return nil, err
+	}
+	var txn Transaction
+	if err := json.Unmarshal(data, &txn); err != nil {
+		return nil, err
+	}
+	if expired(txn.ExpiresAt) {
+		os.Remove(getTransactionPath(email, id))
+		return nil, os.ErrNotExist
+	}
+	if txn.Files == nil {
+		txn.Files = make(map[string]*string)
+	}
+	return &txn, nil
+}
+
+func saveTransaction(email string, txn *Transaction) error {
+	if err := os.MkdirAll(filepath.Dir(getTransactionPath(email, txn.ID)), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getTransactionPath(email, txn.ID), data, 0600)
+}
+
+func writeTransaction(w http.ResponseWriter, status int, txn *Transaction) {
+	resp := TransactionResponse{
+		ID:           txn.ID,
+		BaseRevision: txn.BaseRevision,
+		ExpiresAt:    txn.ExpiresAt,
+		Updated:      make([]string, 0),
+		Deleted:      make([]string, 0),
+		Packages:     txn.Packages != nil,
+	}
+	for path, content := range txn.Files {
+		if content == nil {
+			resp.Deleted = append(resp.Deleted, path)
+		} else {
+			resp.Updated = append(resp.Updated, path)
+		}
+	}
+	sort.Strings(resp.Updated)
+	sort.Strings(resp.Deleted)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleTransactions begins a transaction. Its base revision comes from
+// If-Match, defaulting to the current revision, and the commit is rejected
+// if it would overwrite changes made after it.
+func handleTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	base, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, "Invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+	if base == nil {
+		state, err := loadSyncState(userEmail)
+		if err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+		base = &state.Revision
+	}
+
+	id, err := generateID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	txn := &Transaction{
+		ID:           id,
+		BaseRevision: *base,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(transactionTTL),
+		Files:        make(map[string]*string),
+	}
+	if err := saveTransaction(userEmail, txn); err != nil {
+		http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/sync/transactions/"+id)
+	writeTransaction(w, http.StatusCreated, txn)
+}
+
+// withTransaction loads the transaction named in the URL under its lock.
+func withTransaction(w http.ResponseWriter, r *http.Request, fn func(email string, txn *Transaction)) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.PathValue("id")
+	if !idRegex.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	unlock := lockTransaction(userEmail, id)
+	defer unlock()
+
+	txn, err := loadTransaction(userEmail, id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Transaction not found or expired", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read transaction", http.StatusInternalServerError)
+		return
+	}
+	fn(userEmail, txn)
+}
+
+func handleTransaction(w http.ResponseWriter, r *http.Request) {
+	withTransaction(w, r, func(email string, txn *Transaction) {
+		switch r.Method {
+		case http.MethodGet:
+			writeTransaction(w, http.StatusOK, txn)
+
+		case http.MethodDelete:
+			os.Remove(getTransactionPath(email, txn.ID))
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func handleTransactionFile(w http.ResponseWriter, r *http.Request) {
+	withTransaction(w, r, func(email string, txn *Transaction) {
+		path, err := normalizeFilePath(r.PathValue("path"))
+		if err != nil {
+			http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+			if err != nil {
+				http.Error(w, "File exceeds maximum size", http.StatusRequestEntityTooLarge)
+				return
+			}
+			content := string(data)
+			txn.Files[path] = &content
+
+		case http.MethodDelete:
+			txn.Files[path] = nil
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := saveTransaction(email, txn); err != nil {
+			http.Error(w, "Failed to save transaction", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleTransactionPackages(w http.ResponseWriter, r *http.Request) {
+	withTransaction(w, r, func(email string, txn *Transaction) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		packages := make([]Package, 0)
+		if err := json.NewDecoder(r.Body).Decode(&packages); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		txn.Packages = packages
+
+		if err := saveTransaction(email, txn); err != nil {
+			http.Error(w, "Failed to save transaction", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleTransactionCommit(w http.ResponseWriter, r *http.Request) {
+	withTransaction(w, r, func(email string, txn *Transaction) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		unlock := lockUserData(email)
+		defer unlock()
+
+		syncData, err := loadSyncData(email)
+		if err != nil {
+			http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+			return
+		}
+		for path, content := range txn.Files {
+			if content == nil {
+				delete(syncData.Files, path)
+			} else {
+				syncData.Files[path] = *content
+			}
+		}
+		if txn.Packages != nil {
+			syncData.Packages = txn.Packages
+		}
+
+		// A conflicting transaction stays open so the client can inspect it
+		// and abort
+		state, conflict, err := commitSyncData(r.Context(), email, syncData, &txn.BaseRevision)
+		if err != nil {
+			writeCommitError(w, err)
+			return
+		}
+		if conflict != nil {
+			writeConflict(w, state, conflict)
+			return
+		}
+		os.Remove(getTransactionPath(email, txn.ID))
+
+		setRevisionHeaders(w, state)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BatchResponse{
+			Status:   "ok",
+			Revision: state.Revision,
+			Applied:  len(txn.Files),
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Trial accounts let someone try push and pull without signing up. POST
+// /trial hands out a token for a throwaway account with no email or
+// password, named trial-<id>, that works for trial.days and holds at most
+// trial.max_mb. After that its token stops working, and the snapshot GC job
+// deletes it along with its data.
+const trialAccountPrefix = "trial-"
+
+func isTrialAccount(user *User) bool {
+	return user.TrialExpiresAt != nil
+}
+
+// trialRestricted refuses requests from expired trial accounts, and uploads
+// that would take a trial account over its storage limit, writing the
+// response itself.
+func trialRestricted(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if !isTrialAccount(user) {
+		return false
+	}
+	if expired(*user.TrialExpiresAt) {
+		metrics.authFailed("trial_expired")
+		http.Error(w, "Unauthorized - this trial account has expired; register to keep using kiwi", http.StatusUnauthorized)
+		return true
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return false
+	}
+	if r.Pattern != "/sync" && !strings.HasPrefix(r.Pattern, "/sync/") && r.Pattern != "/uploads" && !strings.HasPrefix(r.Pattern, "/uploads/") {
+		return false
+	}
+	limit := int64(currentConfig().TrialMaxMB) << 20
+	if userStorageBytes(user.Email)+max(r.ContentLength, 0) <= limit {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Insufficient storage - trial accounts can store %d MB; register for more", currentConfig().TrialMaxMB), http.StatusInsufficientStorage)
+	return true
+}
+
+// handleTrial creates a trial account and returns it with its token, like
+// /register.
+func handleTrial(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := currentConfig()
+	if !cfg.TrialEnabled {
+		http.Error(w, "Trial accounts are disabled on this server", http.StatusNotFound)
+		return
+	}
+	tenant, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unknown tenant", http.StatusBadRequest)
+		return
+	}
+	if tenantFull(tenant) {
+		http.Error(w, "Forbidden - this tenant has reached its account limit", http.StatusForbidden)
+		return
+	}
+
+	id, err := generateID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(cfg.TrialDays) * 24 * time.Hour).UTC()
+	user := &User{
+		Email:          trialAccountPrefix + id[:16],
+		Token:          token,
+		CreatedAt:      now,
+		Tenant:         tenant,
+		TrialExpiresAt: &expiresAt,
+	}
+	if err := saveUser(user); err != nil {
+		http.Error(w, "Failed to save user", http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(getUserDataDir(user.Email), 0755); err != nil {
+		http.Error(w, "Failed to create user directory", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created trial account %s, expiring %s", user.Email, expiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// purgeExpiredTrials deletes trial accounts past their expiry, for the
+// snapshot GC job.
+func purgeExpiredTrials(ctx context.Context, users []User) int {
+	purged := 0
+	for _, user := range users {
+		if ctx.Err() != nil {
+			break
+		}
+		if user.TrialExpiresAt == nil || !expired(*user.TrialExpiresAt) {
+			continue
+		}
+		if err := deleteAccount(user.Email); err != nil {
+			log.Printf("Failed to purge expired trial %s: %v", user.Email, err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
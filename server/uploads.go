@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads implement the tus 1.0.0 core protocol with the creation,
+// termination and expiration extensions. A finished upload is committed as a
+// file in the user's sync data.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	maxUploadSize = 64 << 20
+	uploadTTL     = 24 * time.Hour
+)
+
+var idRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type Upload struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	Offset int64  `json:"offset"`
+	// Completed is set once the bytes are committed and the staged copy is
+	// gone
+	Completed bool      `json:"completed,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func getUploadsDir(email string) string {
+	return filepath.Join(getUserDataDir(email), "uploads")
+}
+
+func loadUpload(email, id string) (*Upload, error) {
+	data, err := os.ReadFile(filepath.Join(getUploadsDir(email), id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	if expired(upload.ExpiresAt) {
+		removeUpload(email, id)
+		return nil, os.ErrNotExist
+	}
+	return &upload, nil
+}
+
+func saveUpload(email string, upload *Upload) error {
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(getUploadsDir(email), upload.ID+".json"), data, 0600)
+}
+
+func removeUpload(email, id string) {
+	os.Remove(filepath.Join(getUploadsDir(email), id+".json"))
+	os.Remove(filepath.Join(getUploadsDir(email), id+".bin"))
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header: comma-separated
+// "key base64value" pairs.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	setTusHeaders(w)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPost:
+		if !checkTusResumable(w, r) {
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		if length > maxUploadSize {
+			http.Error(w, "Upload exceeds maximum size", http.StatusRequestEntityTooLarge)
+			return
+		}
+		meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil || meta["path"] == "" {
+			http.Error(w, "Upload-Metadata must include a path", http.StatusBadRequest)
+			return
+		}
+		path, err := normalizeFilePath(meta["path"])
+		if err != nil {
+			http.Error(w, "Invalid file path - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, err := generateID()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now().UTC()
+		upload := &Upload{
+			ID:        id,
+			Path:      path,
+			Length:    length,
+			CreatedAt: now,
+			ExpiresAt: now.Add(uploadTTL),
+		}
+
+		if err := os.MkdirAll(getUploadsDir(userEmail), 0755); err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(getUploadsDir(userEmail), upload.ID+".bin"), nil, 0600); err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		if err := saveUpload(userEmail, upload); err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+
+		// Zero-length files are complete as soon as they're created
+		if length == 0 {
+			if err := completeUpload(userEmail, upload); err != nil {
+				writeCommitError(w, err)
+				return
+			}
+		}
+
+		w.Header().Set("Location", "/uploads/"+upload.ID)
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	setTusHeaders(w)
+
+	id := r.PathValue("id")
+	if !idRegex.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	unlock := lockUserData(userEmail + "\x00upload\x00" + id)
+	defer unlock()
+
+	upload, err := loadUpload(userEmail, id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if !checkTusResumable(w, r) {
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset {
+			http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+			return
+		}
+		// A client resuming after losing the final response learns the upload
+		// is done, and a commit that failed is tried again
+		if upload.Offset == upload.Length {
+			if !upload.Completed {
+				if err := completeUpload(userEmail, upload); err != nil {
+					writeCommitError(w, err)
+					return
+				}
+			}
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		f, err := os.OpenFile(filepath.Join(getUploadsDir(userEmail), id+".bin"), os.O_WRONLY, 0600)
+		if err != nil {
+			http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+			return
+		}
+		// Discard anything a previous interrupted PATCH left past the offset
+		if err := f.Truncate(upload.Offset); err != nil {
+			f.Close()
+			http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+			return
+		}
+		if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+			f.Close()
+			http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+			return
+		}
+
+		// Whatever arrives before the connection drops is kept, which is what
+		// lets an interrupted upload resume from its last offset.
+		n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-upload.Offset))
+		syncErr := f.Sync()
+		f.Close()
+		if syncErr != nil {
+			http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+			return
+		}
+		upload.Offset += n
+		if err := saveUpload(userEmail, upload); err != nil {
+			http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+			return
+		}
+		if copyErr != nil {
+			return
+		}
+
+		if upload.Offset == upload.Length {
+			if err := completeUpload(userEmail, upload); err != nil {
+				writeCommitError(w, err)
+				return
+			}
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !checkTusResumable(w, r) {
+			return
+		}
+		removeUpload(userEmail, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// completeUpload commits the uploaded bytes as a synced file. The upload
+// record is kept, marked completed, until it expires so clients can still
+// HEAD or PATCH it and get its final offset.
+func completeUpload(email string, upload *Upload) error {
+	content, err := os.ReadFile(filepath.Join(getUploadsDir(email), upload.ID+".bin"))
+	if err != nil {
+		return err
+	}
+
+	unlock := lockUserData(email)
+	defer unlock()
+
+	syncData, err := loadSyncData(email)
+	if err != nil {
+		return err
+	}
+	syncData.Files[upload.Path] = string(content)
+	// The bytes are already stored, so the commit goes ahead even past the
+	// request's budget
+	if _, _, err := commitSyncData(context.Background(), email, syncData, nil); err != nil {
+		return err
+	}
+	// Unmarked, a retry commits the same bytes again, which changes nothing
+	upload.Completed = true
+	if saveUpload(email, upload) == nil {
+		os.Remove(filepath.Join(getUploadsDir(email), upload.ID+".bin"))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func tusRequest(method, target, offset, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("X-User-Email", "alice@example.com")
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	if offset != "" {
+		r.Header.Set("Upload-Offset", offset)
+	}
+	if id, ok := strings.CutPrefix(target, "/uploads/"); ok {
+		r.SetPathValue("id", id)
+	}
+	return r
+}
+
+func TestUploadAfterCompletion(t *testing.T) {
+	useTempStorage(t)
+	r := tusRequest(http.MethodPost, "/uploads", "", "")
+	r.Header.Set("Upload-Length", "5")
+	r.Header.Set("Upload-Metadata", "path "+base64.StdEncoding.EncodeToString([]byte(".vimrc")))
+	rec := httptest.NewRecorder()
+	handleUploads(rec, r)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+
+	rec = httptest.NewRecorder()
+	handleUpload(rec, tusRequest(http.MethodPatch, location, "0", "hello"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("final PATCH: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// The client lost that response and resumes from what it last knew
+	tests := []struct {
+		method, offset string
+		status         int
+	}{
+		{http.MethodHead, "", http.StatusOK},
+		{http.MethodPatch, "5", http.StatusNoContent},
+		{http.MethodPatch, "0", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleUpload(rec, tusRequest(tt.method, location, tt.offset, ""))
+		if rec.Code != tt.status {
+			t.Errorf("%s at offset %q: status = %d, want %d: %s", tt.method, tt.offset, rec.Code, tt.status, rec.Body)
+		}
+		if tt.status != http.StatusConflict && rec.Header().Get("Upload-Offset") != "5" {
+			t.Errorf("%s: Upload-Offset = %q, want 5", tt.method, rec.Header().Get("Upload-Offset"))
+		}
+	}
+
+	syncData, err := loadSyncData("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syncData.Files[".vimrc"] != "hello" {
+		t.Errorf(".vimrc = %q, want hello", syncData.Files[".vimrc"])
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Per-user usage is counted per UTC day. Counters accumulate in memory and
+// are merged into each user's usage.json by the metrics_rollup job and at
+// shutdown, which also records the account's storage size for that day.
+const (
+	usageRetentionDays = 90
+	usageDefaultDays   = 30
+	adminUsageLimit    = 50
+)
+
+type UsageDay struct {
+	Date         string `json:"date"`
+	SyncRequests int64  `json:"sync_requests"`
+	Pushes       int64  `json:"pushes"`
+	BytesIn      int64  `json:"bytes_in"`
+	BytesOut     int64  `json:"bytes_out"`
+	// StorageBytes is the account's size when the day was last flushed, or
+	// zero if it hasn't been yet
+	StorageBytes int64 `json:"storage_bytes,omitempty"`
+}
+
+func (d *UsageDay) add(o *UsageDay) {
+	d.SyncRequests += o.SyncRequests
+	d.Pushes += o.Pushes
+	d.BytesIn += o.BytesIn
+	d.BytesOut += o.BytesOut
+}
+
+type UsageTotals struct {
+	SyncRequests int64 `json:"sync_requests"`
+	Pushes       int64 `json:"pushes"`
+	BytesIn      int64 `json:"bytes_in"`
+	BytesOut     int64 `json:"bytes_out"`
+}
+
+type UsageResponse struct {
+	Email        string      `json:"email"`
+	StorageBytes int64       `json:"storage_bytes"`
+	Totals       UsageTotals `json:"totals"`
+	Days         []UsageDay  `json:"days"`
+}
+
+type UserUsage struct {
+	Email string `json:"email"`
+	UsageTotals
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+type AdminUsageResponse struct {
+	Days  int         `json:"days"`
+	Users []UserUsage `json:"users"`
+}
+
+type usageTracker struct {
+	mu      sync.Mutex
+	pending map[string]map[string]*UsageDay
+}
+
+var usage = &usageTracker{pending: make(map[string]map[string]*UsageDay)}
+
+func usageDate(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+func getUsagePath(email string) string {
+	return filepath.Join(getUserDataDir(email), "usage.json")
+}
+
+func (u *usageTracker) record(email string, push bool, in, out int64) {
+	date := usageDate(time.Now())
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	days := u.pending[email]
+	if days == nil {
+		days = make(map[string]*UsageDay)
+		u.pending[email] = days
+	}
+	day := days[date]
+	if day == nil {
+		day = &UsageDay{Date: date}
+		days[date] = day
+	}
+	day.SyncRequests++
+	if push {
+		day.Pushes++
+	}
+	day.BytesIn += in
+	day.BytesOut += out
+}
+
+// forget drops a deleted account's unflushed counters, so a flush doesn't
+// recreate its data directory.
+func (u *usageTracker) forget(email string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.pending, email)
+}
+
+// pendingFor returns a copy of the unflushed counters for a user.
+func (u *usageTracker) pendingFor(email string) map[string]*UsageDay {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	days := make(map[string]*UsageDay, len(u.pending[email]))
+	for date, day := range u.pending[email] {
+		copied := *day
+		days[date] = &copied
+	}
+	return days
+}
+
+func loadUsage(email string) (map[string]*UsageDay, error) {
+	days := make(map[string]*UsageDay)
+	data, err := os.ReadFile(getUsagePath(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return days, nil
+		}
+		return nil, err
+	}
+	var list []UsageDay
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for i := range list {
+		days[list[i].Date] = &list[i]
+	}
+	return days, nil
+}
+
+// sortedUsageDays returns the days since cutoff, oldest first.
+func sortedUsageDays(days map[string]*UsageDay, cutoff string) []UsageDay {
+	list := make([]UsageDay, 0, len(days))
+	for date, day := range days {
+		if date >= cutoff {
+			list = append(list, *day)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Date < list[j].Date
+	})
+	return list
+}
+
+// userStorageBytes sums the size of a user's data directory, leaving out
+// the usage file itself.
+func userStorageBytes(email string) int64 {
+	return dirBytes(getUserDataDir(email)) - fileBytes(getUsagePath(email))
+}
+
+// dirBytes adds up the sizes of the files under dir.
+func dirBytes(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func fileBytes(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// flush merges the pending counters into each user's usage file. Counters
+// that can't be written are put back for the next flush.
+func (u *usageTracker) flush() (int, error) {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[string]map[string]*UsageDay)
+	u.mu.Unlock()
+
+	cutoff := usageDate(time.Now().AddDate(0, 0, -usageRetentionDays))
+	today := usageDate(time.Now())
+	var errs []error
+	for email, days := range pending {
+		if err := flushUserUsage(email, days, cutoff, today); err != nil {
+			errs = append(errs, err)
+			u.mu.Lock()
+			for date, day := range days {
+				if u.pending[email] == nil {
+					u.pending[email] = make(map[string]*UsageDay)
+				}
+				if current := u.pending[email][date]; current != nil {
+					current.add(day)
+				} else {
+					u.pending[email][date] = day
+				}
+			}
+			u.mu.Unlock()
+		}
+	}
+	return len(pending), errors.Join(errs...)
+}
+
+func flushUserUsage(email string, pending map[string]*UsageDay, cutoff, today string) error {
+	unlock := lockUserData(email + "\x00usage")
+	defer unlock()
+
+	days, err := loadUsage(email)
+	if err != nil {
+		return err
+	}
+	for date, day := range pending {
+		if stored := days[date]; stored != nil {
+			stored.add(day)
+		} else {
+			days[date] = day
+		}
+	}
+	if days[today] == nil {
+		days[today] = &UsageDay{Date: today}
+	}
+	days[today].StorageBytes = userStorageBytes(email)
+
+	data, err := json.Marshal(sortedUsageDays(days, cutoff))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(getUserDataDir(email), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(getUsagePath(email), data, 0644)
+}
+
+// usageSince returns a user's stored and pending usage for days since cutoff.
+func usageSince(email, cutoff string) ([]UsageDay, UsageTotals, error) {
+	days, err := loadUsage(email)
+	if err != nil {
+		return nil, UsageTotals{}, err
+	}
+	for date, day := range usage.pendingFor(email) {
+		if stored := days[date]; stored != nil {
+			stored.add(day)
+		} else {
+			days[date] = day
+		}
+	}
+	list := sortedUsageDays(days, cutoff)
+	var totals UsageTotals
+	for _, day := range list {
+		totals.SyncRequests += day.SyncRequests
+		totals.Pushes += day.Pushes
+		totals.BytesIn += day.BytesIn
+		totals.BytesOut += day.BytesOut
+	}
+	return list, totals, nil
+}
+
+func parseUsageDays(r *http.Request) (int, bool) {
+	days := usageDefaultDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > usageRetentionDays {
+			return 0, false
+		}
+		days = n
+	}
+	return days, true
+}
+
+func usageCutoff(days int) string {
+	return usageDate(time.Now().AddDate(0, 0, 1-days))
+}
+
+func handleAccountUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	days, ok := parseUsageDays(r)
+	if !ok {
+		http.Error(w, "Invalid days - must be between 1 and "+strconv.Itoa(usageRetentionDays), http.StatusBadRequest)
+		return
+	}
+
+	list, totals, err := usageSince(userEmail, usageCutoff(days))
+	if err != nil {
+		http.Error(w, "Failed to read usage", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UsageResponse{
+		Email:        userEmail,
+		StorageBytes: userStorageBytes(userEmail),
+		Totals:       totals,
+		Days:         list,
+	})
+}
+
+// handleAdminUsage ranks accounts by sync requests over the window, to spot
+// heavy or abusive clients.
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	days, ok := parseUsageDays(r)
+	if !ok {
+		http.Error(w, "Invalid days - must be between 1 and "+strconv.Itoa(usageRetentionDays), http.StatusBadRequest)
+		return
+	}
+	users, err := listAdminUsers(r)
+	if err != nil {
+		http.Error(w, "Failed to read users", http.StatusInternalServerError)
+		return
+	}
+
+	cutoff := usageCutoff(days)
+	ranked := make([]UserUsage, 0, len(users))
+	for _, user := range users {
+		list, totals, err := usageSince(user.Email, cutoff)
+		if err != nil {
+			continue
+		}
+		entry := UserUsage{Email: user.Email, UsageTotals: totals}
+		// The latest recorded size; walking every account here would be slow
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i].StorageBytes > 0 {
+				entry.StorageBytes = list[i].StorageBytes
+				break
+			}
+		}
+		ranked = append(ranked, entry)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].SyncRequests != ranked[j].SyncRequests {
+			return ranked[i].SyncRequests > ranked[j].SyncRequests
+		}
+		return ranked[i].BytesIn > ranked[j].BytesIn
+	})
+	if len(ranked) > adminUsageLimit {
+		ranked = ranked[:adminUsageLimit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdminUsageResponse{Days: days, Users: ranked})
+}
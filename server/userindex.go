@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Account files are named by a hash of the email, so finding one means
+// reading every file. userIndex keeps the email, username and tenant of each
+// account in memory, loaded on first use and kept current by saveUser and
+// deleteAccount, so admin searches don't touch the disk until they have
+// their matches.
+type userIndexEntry struct {
+	email    string
+	username string
+	tenant   string
+	// lower is the email and username lowercased for substring matching
+	lower string
+}
+
+type userIndex struct {
+	mu      sync.RWMutex
+	loaded  bool
+	entries map[string]userIndexEntry
+}
+
+var accountIndex = &userIndex{}
+
+// AdminUserMatch is an account found by an admin search, with the hash its
+// files are stored under.
+type AdminUserMatch struct {
+	AdminUser
+	UserHash string `json:"user_hash"`
+}
+
+type AdminUserSearchResponse struct {
+	Users []AdminUserMatch `json:"users"`
+}
+
+func newUserIndexEntry(user *User) userIndexEntry {
+	return userIndexEntry{
+		email:    user.Email,
+		username: user.Username,
+		tenant:   user.Tenant,
+		lower:    strings.ToLower(user.Email + "\x00" + user.Username),
+	}
+}
+
+func (x *userIndex) load() error {
+	x.mu.RLock()
+	loaded := x.loaded
+	x.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	all, err := listUsers()
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loaded {
+		return nil
+	}
+	x.entries = make(map[string]userIndexEntry, len(all))
+	for i := range all {
+		x.entries[all[i].Email] = newUserIndexEntry(&all[i])
+	}
+	x.loaded = true
+	return nil
+}
+
+// put records a saved account. Until the index is loaded there is nothing
+// to update; loading reads the saved file.
+func (x *userIndex) put(user *User) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loaded {
+		x.entries[user.Email] = newUserIndexEntry(user)
+	}
+}
+
+func (x *userIndex) remove(email string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, email)
+}
+
+// search returns the emails of accounts visible in tenant (all of them
+// when scoped is false) whose email is email, ignoring case, or whose email
+// or username contains q, ignoring case. Results are ordered by email.
+func (x *userIndex) search(email, q, tenant string, scoped bool) ([]string, error) {
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	q = strings.ToLower(q)
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	visible := func(entry userIndexEntry) bool {
+		return !scoped || entry.tenant == tenant
+	}
+	var matched []string
+	if email != "" {
+		if entry, ok := x.entries[email]; ok {
+			if visible(entry) && (q == "" || strings.Contains(entry.lower, q)) {
+				matched = append(matched, entry.email)
+			}
+			return matched, nil
+		}
+	}
+	for _, entry := range x.entries {
+		if !visible(entry) {
+			continue
+		}
+		if email != "" && !strings.EqualFold(entry.email, email) {
+			continue
+		}
+		if q != "" && !strings.Contains(entry.lower, q) {
+			continue
+		}
+		matched = append(matched, entry.email)
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// handleAdminUserSearch finds accounts by exact email or by part of the
+// email or username, answering from the user index.
+func handleAdminUserSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	email := strings.TrimSpace(query.Get("email"))
+	q := strings.TrimSpace(query.Get("q"))
+	if email == "" && q == "" {
+		http.Error(w, "email or q is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultAdminUserLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAdminUserLimit)
+	}
+
+	tenant, scoped := adminTenant(r)
+	emails, err := accountIndex.search(email, q, tenant, scoped)
+	if err != nil {
+		http.Error(w, "Failed to read users", http.StatusInternalServerError)
+		return
+	}
+
+	resp := AdminUserSearchResponse{Users: make([]AdminUserMatch, 0, min(len(emails), limit))}
+	for _, email := range emails {
+		if len(resp.Users) == limit {
+			break
+		}
+		// The index can trail a file removed behind the server's back
+		user, err := loadUser(email)
+		if err != nil || !adminCanSee(r, user) {
+			continue
+		}
+		resp.Users = append(resp.Users, AdminUserMatch{AdminUser: newAdminUser(*user), UserHash: userHash(email)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
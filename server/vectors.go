@@ -0,0 +1,115 @@
+package main
+
+// VersionVector counts the edits each device has made to a file. Devices
+// increment their own entry when they change a file locally and send the
+// vector along with the content, which lets the server order pushes without
+// relying on when they arrive.
+type VersionVector map[string]int64
+
+// Writes made without a vector, e.g. by older clients, are counted under
+// this entry so they still order against vector-aware pushes.
+const serverVectorKey = "server"
+
+type vectorOrder int
+
+const (
+	vectorEqual vectorOrder = iota
+	vectorBefore
+	vectorAfter
+	vectorConcurrent
+)
+
+func compareVectors(a, b VersionVector) vectorOrder {
+	aAhead, bAhead := false, false
+	for key, n := range a {
+		if n > b[key] {
+			aAhead = true
+		}
+	}
+	for key, n := range b {
+		if n > a[key] {
+			bAhead = true
+		}
+	}
+	switch {
+	case aAhead && bAhead:
+		return vectorConcurrent
+	case aAhead:
+		return vectorAfter
+	case bAhead:
+		return vectorBefore
+	}
+	return vectorEqual
+}
+
+func mergeVectors(a, b VersionVector) VersionVector {
+	merged := make(VersionVector, len(a)+len(b))
+	for key, n := range a {
+		merged[key] = n
+	}
+	for key, n := range b {
+		merged[key] = max(merged[key], n)
+	}
+	return merged
+}
+
+// nextVector is the vector recorded for a new version of a file.
+func nextVector(previous, pushed VersionVector) VersionVector {
+	if pushed != nil {
+		return mergeVectors(previous, pushed)
+	}
+	next := mergeVectors(previous, nil)
+	next[serverVectorKey]++
+	return next
+}
+
+// settleVersionVectors handles the files a write carried vectors for. A
+// version the server's vector dominates is a stale push that arrived out of
+// order, so next keeps the server's copy instead. Concurrent versions with
+// different content are real conflicts. The returned paths are exempt from
+// revision-based conflict detection.
+func settleVersionVectors(state *SyncState, current, next *SyncData, vectors map[string]VersionVector) (map[string]bool, []FileConflict) {
+	settled := make(map[string]bool, len(vectors))
+	var conflicts []FileConflict
+	for path, vector := range vectors {
+		settled[path] = true
+		fs, known := state.Files[path]
+		if !known {
+			continue
+		}
+		content, present := next.Files[path]
+		sameContent := present && !fs.Deleted && hashContent(content) == fs.Hash || !present && fs.Deleted
+
+		switch compareVectors(vector, fs.Vector) {
+		case vectorBefore:
+			if fs.Deleted {
+				delete(next.Files, path)
+			} else {
+				next.Files[path] = current.Files[path]
+			}
+		case vectorConcurrent:
+			if sameContent {
+				continue
+			}
+			updatedAt := fs.UpdatedAt
+			yours := FileVersion{Deleted: !present, Vector: vector}
+			if present {
+				yours.Hash = hashContent(content)
+				yours.Size = len(content)
+			}
+			conflicts = append(conflicts, FileConflict{
+				Path: path,
+				Theirs: FileVersion{
+					Hash:      fs.Hash,
+					Size:      fs.Size,
+					UpdatedAt: &updatedAt,
+					Revision:  fs.Revision,
+					Deleted:   fs.Deleted,
+					Vector:    fs.Vector,
+				},
+				Yours: yours,
+			})
+		}
+	}
+	return settled, conflicts
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The API is served under /v{N}/ for every supported version. Unprefixed
+// paths are aliases for legacyAPIVersion so CLI builds from before
+// versioning keep working; a breaking protocol change ships as a new
+// version next to the old one rather than replacing it.
+const (
+	currentAPIVersion = 1
+	legacyAPIVersion  = 1
+)
+
+var supportedAPIVersions = []int{1}
+
+type APIVersions struct {
+	Current   int   `json:"current"`
+	Supported []int `json:"supported"`
+}
+
+// withAPIVersion tags responses with the API version that served them, so
+// clients can tell a versioned route from a legacy alias.
+func withAPIVersion(version int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Kiwi-API-Version", strconv.Itoa(version))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAPIVersions lets a client pick the newest version both sides speak
+// before making any other request.
+func handleAPIVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIVersions{Current: currentAPIVersion, Supported: supportedAPIVersions})
+}
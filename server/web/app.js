@@ -0,0 +1,298 @@
+// The kiwi dashboard. It talks to the same /v1 API as the CLI, signing in
+// with a browser session (or the admin token) kept in sessionStorage, so
+// closing the tab signs out.
+"use strict";
+
+const api = "/v1";
+const store = window.sessionStorage;
+
+function token() {
+  return store.getItem("kiwi.token");
+}
+
+function isAdmin() {
+  return store.getItem("kiwi.admin") === "1";
+}
+
+async function call(method, path, body) {
+  const headers = {};
+  if (token()) {
+    headers["Authorization"] = "Bearer " + token();
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const resp = await fetch(api + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (resp.status === 401 && token()) {
+    signOut();
+    throw new Error("Your session has expired");
+  }
+  if (!resp.ok) {
+    throw new Error((await resp.text()).trim() || resp.statusText);
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  const type = resp.headers.get("Content-Type") || "";
+  return type.startsWith("application/json") ? resp.json() : resp.text();
+}
+
+function el(tag, text, attrs) {
+  const node = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    node.textContent = String(text);
+  }
+  Object.assign(node, attrs || {});
+  return node;
+}
+
+function row(tbody, cells) {
+  const tr = el("tr");
+  for (const cell of cells) {
+    const td = el("td");
+    if (cell instanceof Node) {
+      td.append(cell);
+    } else {
+      td.textContent = cell === undefined || cell === null ? "" : String(cell);
+    }
+    tr.append(td);
+  }
+  tbody.append(tr);
+}
+
+function when(value) {
+  return value ? new Date(value).toLocaleString() : "never";
+}
+
+function bytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function showError(err) {
+  const p = document.getElementById("error");
+  p.textContent = err ? err.message || String(err) : "";
+  p.hidden = !err;
+}
+
+function show(id) {
+  for (const section of document.querySelectorAll("main > section")) {
+    section.hidden = section.id !== id;
+  }
+  const nav = document.getElementById("nav");
+  nav.hidden = id === "login";
+  for (const link of nav.querySelectorAll("[data-user]")) {
+    link.hidden = isAdmin();
+  }
+  for (const link of nav.querySelectorAll("[data-admin]")) {
+    link.hidden = !isAdmin();
+  }
+  return document.getElementById(id);
+}
+
+// paged wires a section's "Load more" button to a loader that appends rows
+// and returns the next cursor, or nothing at the end.
+async function paged(section, load) {
+  const tbody = section.querySelector("tbody");
+  const more = section.querySelector(".more");
+  tbody.replaceChildren();
+  let cursor = await load(tbody, "");
+  more.hidden = !cursor;
+  more.onclick = async () => {
+    try {
+      cursor = await load(tbody, cursor);
+      more.hidden = !cursor;
+    } catch (err) {
+      showError(err);
+    }
+  };
+}
+
+function encodePath(path) {
+  return path.split("/").map(encodeURIComponent).join("/");
+}
+
+async function viewFile(title, path) {
+  const section = show("viewer");
+  section.querySelector("h2").textContent = title;
+  section.querySelector("pre").textContent = await call("GET", path);
+}
+
+const views = {
+  async files() {
+    const section = show("files");
+    await paged(section, async (tbody, cursor) => {
+      const page = await call("GET", "/sync/files?limit=100&cursor=" + encodeURIComponent(cursor));
+      for (const file of page.files) {
+        const link = el("a", file.path, { href: "#files" });
+        link.onclick = (e) => {
+          e.preventDefault();
+          viewFile(file.path, "/sync/files/" + encodePath(file.path)).catch(showError);
+        };
+        row(tbody, [link, bytes(file.size)]);
+      }
+      return page.next_cursor;
+    });
+  },
+
+  async history() {
+    const section = show("history");
+    await paged(section, async (tbody, cursor) => {
+      const page = await call("GET", "/sync/changes?limit=100&since=" + encodeURIComponent(cursor));
+      for (const change of page.changes) {
+        let path = change.path || "";
+        if (change.hash) {
+          path = el("a", change.path, { href: "#history" });
+          path.onclick = (e) => {
+            e.preventDefault();
+            viewFile(change.path + " @ " + change.revision, "/sync/blobs/" + change.hash).catch(showError);
+          };
+        }
+        row(tbody, [change.revision, change.type, path, when(change.updated_at)]);
+      }
+      return page.has_more ? page.cursor : "";
+    });
+  },
+
+  async devices() {
+    const section = show("devices");
+    const tbody = section.querySelector("tbody");
+    const devices = await call("GET", "/devices");
+    tbody.replaceChildren();
+    for (const device of devices) {
+      const remove = el("button", "Remove", { type: "button" });
+      remove.onclick = async () => {
+        if (confirm("Remove " + device.name + "? It can register again later.")) {
+          await call("DELETE", "/devices/" + encodeURIComponent(device.id)).catch(showError);
+          route();
+        }
+      };
+      row(tbody, [device.name, device.hostname, device.os, when(device.last_seen_at), remove]);
+    }
+  },
+
+  async sessions() {
+    const section = show("sessions");
+    const tbody = section.querySelector("tbody");
+    const sessions = await call("GET", "/sessions");
+    tbody.replaceChildren();
+    for (const session of sessions) {
+      let action = el("span", "This browser");
+      if (!session.current) {
+        action = el("button", "Revoke", { type: "button" });
+        action.onclick = async () => {
+          await call("DELETE", "/sessions/" + session.id).catch(showError);
+          route();
+        };
+      }
+      row(tbody, [session.user_agent, session.remote_addr, when(session.created_at), when(session.expires_at), action]);
+    }
+  },
+
+  async admin() {
+    const section = show("admin");
+    const stats = await call("GET", "/admin/stats");
+    const dl = document.getElementById("stats");
+    dl.replaceChildren();
+    for (const [label, value] of [
+      ["Users", stats.users],
+      ["Active in 7 days", stats.active_users_7d],
+      ["Active in 30 days", stats.active_users_30d],
+      ["Storage", bytes(stats.storage_bytes)],
+      ["Snapshots", stats.snapshots],
+      ["Sync requests, last hour", stats.sync_requests.last_hour],
+      ["Sync requests, last day", stats.sync_requests.last_day],
+    ]) {
+      dl.append(el("dt", label), el("dd", value));
+    }
+
+    const search = document.getElementById("user-search");
+    const load = () => paged(section, async (tbody, cursor) => {
+      const q = encodeURIComponent(search.elements.q.value);
+      const page = await call("GET", "/admin/users?limit=50&q=" + q + "&cursor=" + encodeURIComponent(cursor));
+      for (const user of page.users) {
+        const status = user.suspension ? "Suspended: " + user.suspension.reason : "Active";
+        row(tbody, [user.email, when(user.created_at), when(user.last_sync_at), bytes(user.storage_bytes), status]);
+      }
+      return page.next_cursor;
+    });
+    search.onsubmit = (e) => {
+      e.preventDefault();
+      load().catch(showError);
+    };
+    await load();
+  },
+};
+
+function signOut() {
+  store.removeItem("kiwi.token");
+  store.removeItem("kiwi.admin");
+  location.hash = "";
+  route();
+}
+
+async function route() {
+  showError(null);
+  if (!token()) {
+    show("login");
+    return;
+  }
+  let name = location.hash.slice(1);
+  if (!views[name] || (name === "admin") !== isAdmin()) {
+    name = isAdmin() ? "admin" : "files";
+  }
+  try {
+    await views[name]();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  document.getElementById("login-form").onsubmit = async (e) => {
+    e.preventDefault();
+    const form = e.target;
+    try {
+      const session = await call("POST", "/sessions", {
+        email: form.elements.email.value,
+        password: form.elements.password.value,
+      });
+      form.reset();
+      store.setItem("kiwi.token", session.token);
+      store.removeItem("kiwi.admin");
+      location.hash = "files";
+      route();
+    } catch (err) {
+      showError(err);
+    }
+  };
+
+  document.getElementById("admin-form").onsubmit = async (e) => {
+    e.preventDefault();
+    const form = e.target;
+    store.setItem("kiwi.token", form.elements.token.value);
+    store.setItem("kiwi.admin", "1");
+    form.reset();
+    location.hash = "admin";
+    route();
+  };
+
+  document.getElementById("logout").onclick = async () => {
+    if (!isAdmin()) {
+      await call("DELETE", "/sessions/current").catch(() => {});
+    }
+    signOut();
+  };
+
+  window.addEventListener("hashchange", route);
+  route();
+});
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	wsPingInterval   = 30 * time.Second
+	wsPongTimeout    = 15 * time.Second
+	wsWriteTimeout   = 10 * time.Second
+	wsMaxMessageSize = 64 << 10
+	wsSendQueueSize  = 16
+)
+
+// SyncEvent is pushed to a user's connected devices whenever their sync data
+// changes.
+type SyncEvent struct {
+	Type      string    `json:"type"`
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Files     []string  `json:"files,omitempty"`
+	Packages  bool      `json:"packages,omitempty"`
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+	send chan []byte
+	once sync.Once
+	done chan struct{}
+}
+
+type wsHub struct {
+	mu   sync.Mutex
+	subs map[string]map[*wsConn]struct{}
+}
+
+var syncHub = &wsHub{subs: make(map[string]map[*wsConn]struct{})}
+
+func (h *wsHub) subscribe(email string, c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[email] == nil {
+		h.subs[email] = make(map[*wsConn]struct{})
+	}
+	h.subs[email][c] = struct{}{}
+}
+
+func (h *wsHub) unsubscribe(email string, c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[email], c)
+	if len(h.subs[email]) == 0 {
+		delete(h.subs, email)
+	}
+}
+
+// publish fans an event out to every connection of a user. Connections that
+// can't keep up are dropped rather than blocking the writer.
+func (h *wsHub) publish(email string, event interface{}) {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs[email] {
+		select {
+		case c.send <- msg:
+		default:
+			c.close()
+		}
+	}
+}
+
+// connections returns the number of open WebSocket connections.
+func (h *wsHub) connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, conns := range h.subs {
+		n += len(conns)
+	}
+	return n
+}
+
+func (h *wsHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conns := range h.subs {
+		for c := range conns {
+			c.closeWith(websocket.StatusGoingAway)
+		}
+	}
+}
+
+// closeUser disconnects a user's connections, telling clients not to retry
+// straight away.
+func (h *wsHub) closeUser(email string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs[email] {
+		c.closeWith(websocket.StatusPolicyViolation)
+	}
+}
+
+func (c *wsConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.CloseNow()
+	})
+}
+
+// closeWith sends a close frame with the given status. The handshake runs in
+// the background so callers holding the hub lock don't wait on the client.
+func (c *wsConn) closeWith(code websocket.StatusCode) {
+	c.once.Do(func() {
+		close(c.done)
+		go c.conn.Close(code, "")
+	})
+}
+
+func (c *wsConn) write(msg []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wsWriteTimeout)
+	defer cancel()
+	return c.conn.Write(ctx, websocket.MessageText, msg)
+}
+
+// ping waits for the client's pong, so a dead peer is noticed even though
+// the server never expects data from it.
+func (c *wsConn) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), wsPongTimeout)
+	defer cancel()
+	return c.conn.Ping(ctx)
+}
+
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func handleSyncWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userEmail := r.Header.Get("X-User-Email")
+	if userEmail == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	state, err := loadSyncState(userEmail)
+	if err != nil {
+		http.Error(w, "Failed to read sync data", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return // Accept has already answered the request
+	}
+	conn.SetReadLimit(wsMaxMessageSize)
+
+	c := &wsConn{
+		conn: conn,
+		send: make(chan []byte, wsSendQueueSize),
+		done: make(chan struct{}),
+	}
+	syncHub.subscribe(userEmail, c)
+	defer syncHub.unsubscribe(userEmail, c)
+	defer c.close()
+
+	hello, _ := json.Marshal(SyncEvent{Type: "hello", Revision: state.Revision, UpdatedAt: state.UpdatedAt})
+	c.send <- hello
+	go c.writeLoop()
+
+	// The channel is push-only, so data messages from the client are
+	// dropped; reading keeps pings, pongs and close frames answered.
+	for {
+		if _, _, err := conn.Read(context.Background()); err != nil {
+			return
+		}
+	}
+}
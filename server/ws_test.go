@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// dialSyncWS connects to handleSyncWS as email and reads the hello event.
+func dialSyncWS(t *testing.T, email string) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-User-Email", email)
+		handleSyncWS(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+
+	if event := readSyncEvent(t, conn); event.Type != "hello" {
+		t.Fatalf("first event = %q, want hello", event.Type)
+	}
+	return conn
+}
+
+func readSyncEvent(t *testing.T, conn *websocket.Conn) SyncEvent {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, msg, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event SyncEvent
+	if err := json.Unmarshal(msg, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func readCloseStatus(t *testing.T, conn *websocket.Conn) websocket.StatusCode {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			return websocket.CloseStatus(err)
+		}
+	}
+}
+
+func TestSyncWSPublish(t *testing.T) {
+	useTempStorage(t)
+	conn := dialSyncWS(t, "ws-publish@example.com")
+
+	syncHub.publish("ws-publish@example.com", SyncEvent{Type: "sync", Revision: 7, Files: []string{".vimrc"}})
+	event := readSyncEvent(t, conn)
+	if event.Type != "sync" || event.Revision != 7 || len(event.Files) != 1 {
+		t.Errorf("got %+v", event)
+	}
+}
+
+func TestSyncWSCloseUser(t *testing.T) {
+	useTempStorage(t)
+	conn := dialSyncWS(t, "ws-close@example.com")
+
+	syncHub.closeUser("ws-close@example.com")
+	if got := readCloseStatus(t, conn); got != websocket.StatusPolicyViolation {
+		t.Errorf("close status = %v, want %v", got, websocket.StatusPolicyViolation)
+	}
+}
+
+func TestSyncWSReadLimit(t *testing.T) {
+	useTempStorage(t)
+	conn := dialSyncWS(t, "ws-limit@example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn.Write(ctx, websocket.MessageText, []byte(strings.Repeat("a", wsMaxMessageSize+1)))
+	if got := readCloseStatus(t, conn); got != websocket.StatusMessageTooBig {
+		t.Errorf("close status = %v, want %v", got, websocket.StatusMessageTooBig)
+	}
+}
+
+func TestSyncWSRejectsPlainRequest(t *testing.T) {
+	useTempStorage(t)
+	req := httptest.NewRequest(http.MethodGet, "/sync/ws", nil)
+	req.Header.Set("X-User-Email", "ws-plain@example.com")
+	rec := httptest.NewRecorder()
+	handleSyncWS(rec, req)
+	if rec.Code != http.StatusUpgradeRequired {
+		t.Errorf("status = %d, want 426", rec.Code)
+	}
+}
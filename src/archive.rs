@@ -0,0 +1,167 @@
+use std::fs::{self, File};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use crate::homebrew::Package;
+use crate::sync::relative_key;
+use crate::{KiwiError, Result};
+use clap::ValueEnum;
+use flate2::write::GzEncoder;
+use flate2::Compression;
+use serde::Serialize;
+
+/// Archive formats `kiwi export` writes.
+#[derive(Debug, Copy, Clone, PartialEq, Eq, ValueEnum)]
+pub enum Format {
+    /// gzip-compressed tarball
+    Tar,
+    Zip,
+}
+
+impl Format {
+    pub fn extension(&self) -> &'static str {
+        match self {
+            Format::Tar => "tar.gz",
+            Format::Zip => "zip",
+        }
+    }
+}
+
+/// Describes an export, saved in it as manifest.json.
+#[derive(Debug, Serialize)]
+pub struct Manifest {
+    pub kiwi_version: &'static str,
+    pub exported_at: String,
+    pub hostname: String,
+    /// Paths relative to the home directory, as stored under home/
+    pub files: Vec<String>,
+    pub packages: Vec<String>,
+}
+
+/// An archive of tracked files and the package manifest that needs nothing
+/// but tar or unzip to use. Files sit under home/ as they do in the home
+/// directory, beside a Brewfile for `brew bundle`, kiwi's packages.json and
+/// manifest.json.
+pub struct Export {
+    files: Vec<(String, PathBuf)>,
+    packages: Vec<Package>,
+}
+
+impl Export {
+    /// Collects tracked files; ones outside the home directory are skipped,
+    /// as they are by a push.
+    pub fn new(home: &Path, tracked: &[PathBuf], packages: Vec<Package>) -> Self {
+        let files = tracked.iter()
+            .filter_map(|path| Some((relative_key(home, path)?, path.clone())))
+            .collect();
+        Self { files, packages }
+    }
+
+    pub fn manifest(&self, hostname: String) -> Manifest {
+        Manifest {
+            kiwi_version: env!("CARGO_PKG_VERSION"),
+            exported_at: chrono::Local::now().to_rfc3339(),
+            hostname,
+            files: self.files.iter().map(|(key, _)| key.clone()).collect(),
+            packages: self.packages.iter().map(|package| package.name.clone()).collect(),
+        }
+    }
+
+    /// Writes the archive to `output`.
+    pub fn write(&self, format: Format, output: &Path, manifest: &Manifest) -> Result<()> {
+        let extras = [
+            ("manifest.json", serde_json::to_vec_pretty(manifest)?),
+            ("packages.json", serde_json::to_vec_pretty(&self.packages)?),
+            ("Brewfile", brewfile(&self.packages).into_bytes()),
+        ];
+        let result = match format {
+            Format::Tar => self.write_tar(output, &extras),
+            Format::Zip => self.write_zip(output, &extras),
+        };
+        // Don't leave half an archive behind
+        if result.is_err() {
+            let _ = fs::remove_file(output);
+        }
+        result
+    }
+
+    fn write_tar(&self, output: &Path, extras: &[(&str, Vec<u8>)]) -> Result<()> {
+        let mut builder = tar::Builder::new(GzEncoder::new(File::create(output)?, Compression::default()));
+        for (key, path) in &self.files {
+            builder.append_path_with_name(path, format!("home/{}", key))?;
+        }
+        let now = chrono::Utc::now().timestamp() as u64;
+        for (name, contents) in extras {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(contents.len() as u64);
+            header.set_mode(0o644);
+            header.set_mtime(now);
+            header.set_cksum();
+            builder.append_data(&mut header, name, contents.as_slice())?;
+        }
+        builder.into_inner()?.finish()?.sync_all()?;
+        Ok(())
+    }
+
+    fn write_zip(&self, output: &Path, extras: &[(&str, Vec<u8>)]) -> Result<()> {
+        let mut zip = zip::ZipWriter::new(File::create(output)?);
+        let options = zip::write::FileOptions::default().compression_method(zip::CompressionMethod::Deflated);
+        for (key, path) in &self.files {
+            zip.start_file(format!("home/{}", key), options.unix_permissions(mode(path)))
+                .map_err(zip_error)?;
+            zip.write_all(&fs::read(path)?)?;
+        }
+        for (name, contents) in extras {
+            zip.start_file(*name, options.unix_permissions(0o644)).map_err(zip_error)?;
+            zip.write_all(contents)?;
+        }
+        zip.finish().map_err(zip_error)?.sync_all()?;
+        Ok(())
+    }
+}
+
+/// A Brewfile listing the packages, for `brew bundle`.
+pub fn brewfile(packages: &[Package]) -> String {
+    let mut brewfile = String::new();
+    for package in packages {
+        let kind = if package.is_cask { "cask" } else { "brew" };
+        brewfile.push_str(&format!("{} \"{}\"\n", kind, package.name));
+    }
+    brewfile
+}
+
+/// The file's permissions, so executables stay executable.
+fn mode(path: &Path) -> u32 {
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        if let Ok(metadata) = fs::metadata(path) {
+            return metadata.permissions().mode() & 0o777;
+        }
+    }
+    0o644
+}
+
+fn zip_error(e: zip::result::ZipError) -> KiwiError {
+    KiwiError::Dotfiles(format!("Failed to write the archive: {}", e))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn brewfile_lists_formulae_and_casks() {
+        let package = |name: &str, is_cask| Package {
+            name: name.to_string(),
+            version: None,
+            installed: true,
+            dependencies: Vec::new(),
+            install_time: None,
+            last_update: None,
+            size: None,
+            is_cask,
+        };
+        let packages = [package("ripgrep", false), package("iterm2", true)];
+        assert_eq!(brewfile(&packages), "brew \"ripgrep\"\ncask \"iterm2\"\n");
+    }
+}
@@ -0,0 +1,181 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime};
+use crate::git_remote::{self, GitRemote};
+use crate::local_remote::{self, LocalRemote};
+use crate::Result;
+use serde::Serialize;
+
+/// How old a staged file or directory must be before it's taken to be left
+/// over from a run that died, rather than one still going.
+const STALE_AFTER: Duration = Duration::from_secs(24 * 60 * 60);
+
+#[derive(Debug, Clone, Copy, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Kind {
+    /// Copies in ~/.kiwi/backups older than the retention window
+    Backup,
+    /// Clones in ~/.kiwi/git of repositories no longer synced with
+    Clone,
+    /// Staging left by an import, update or snapshot that didn't finish
+    Temp,
+}
+
+impl Kind {
+    pub fn label(&self) -> &'static str {
+        match self {
+            Kind::Backup => "backup",
+            Kind::Clone => "clone",
+            Kind::Temp => "temp",
+        }
+    }
+}
+
+/// Something `kiwi clean` can remove, and the space it takes.
+#[derive(Debug, Serialize)]
+pub struct Leftover {
+    pub kind: Kind,
+    pub path: PathBuf,
+    pub bytes: u64,
+}
+
+/// Finds what can be removed: backups older than `retention`, clones other
+/// than the one for `sync_url`, and staging under `temp_dir`, beside the
+/// kiwi binary and in a snapshot directory older than a day.
+pub fn find(home: &Path, temp_dir: &Path, sync_url: Option<&str>, retention: Duration) -> Result<Vec<Leftover>> {
+    let mut found = Vec::new();
+    let now = SystemTime::now();
+
+    for path in entries(&home.join(".kiwi/backups"))? {
+        let taken = path.file_name()
+            .and_then(|name| backup_time(&name.to_string_lossy()))
+            .or_else(|| modified(&path));
+        if taken.map_or(false, |taken| older_than(now, taken, retention)) {
+            found.push(leftover(Kind::Backup, path));
+        }
+    }
+
+    let checkouts = home.join(".kiwi/git");
+    let current = sync_url
+        .filter(|url| git_remote::is_git_url(url))
+        .map(|url| GitRemote::new(url, &checkouts).dir().to_path_buf());
+    for path in entries(&checkouts)? {
+        if Some(&path) != current.as_ref() {
+            found.push(leftover(Kind::Clone, path));
+        }
+    }
+
+    let mut staged = stale(temp_dir, now, |name| name.starts_with("kiwi-import-"))?;
+    if let Some(dir) = std::env::current_exe().ok().as_deref().and_then(Path::parent) {
+        staged.extend(stale(dir, now, |name| name.starts_with('.') && name.contains(".update-"))?);
+    }
+    if let Some(url) = sync_url.filter(|url| local_remote::is_local_path(url)) {
+        let snapshots = LocalRemote::new(url, home).dir().join("snapshots");
+        staged.extend(stale(&snapshots, now, |name| name.starts_with('.') && name.contains(".json."))?);
+    }
+    found.extend(staged.into_iter().map(|path| leftover(Kind::Temp, path)));
+    Ok(found)
+}
+
+/// Removes what `find` found, returning the bytes reclaimed.
+pub fn remove(leftovers: &[Leftover]) -> Result<u64> {
+    let mut reclaimed = 0;
+    for leftover in leftovers {
+        if leftover.path.is_dir() {
+            fs::remove_dir_all(&leftover.path)?;
+        } else {
+            fs::remove_file(&leftover.path)?;
+        }
+        reclaimed += leftover.bytes;
+    }
+    Ok(reclaimed)
+}
+
+/// The entries of `dir`, or none when it doesn't exist.
+fn entries(dir: &Path) -> Result<Vec<PathBuf>> {
+    if !dir.is_dir() {
+        return Ok(Vec::new());
+    }
+    let mut paths = Vec::new();
+    for entry in fs::read_dir(dir)? {
+        paths.push(entry?.path());
+    }
+    paths.sort();
+    Ok(paths)
+}
+
+/// Entries of `dir` matching `name` that haven't changed in a day.
+fn stale(dir: &Path, now: SystemTime, name: impl Fn(&str) -> bool) -> Result<Vec<PathBuf>> {
+    Ok(entries(dir)?
+        .into_iter()
+        .filter(|path| path.file_name().map_or(false, |n| name(&n.to_string_lossy())))
+        .filter(|path| modified(path).map_or(false, |changed| older_than(now, changed, STALE_AFTER)))
+        .collect())
+}
+
+/// When a backup was taken, from its directory's name, which is the local
+/// time as 20240131-235959.
+fn backup_time(name: &str) -> Option<SystemTime> {
+    let time = chrono::NaiveDateTime::parse_from_str(name, "%Y%m%d-%H%M%S").ok()?;
+    let time = time.and_local_timezone(chrono::Local).earliest()?;
+    Some(SystemTime::from(time))
+}
+
+fn modified(path: &Path) -> Option<SystemTime> {
+    fs::symlink_metadata(path).and_then(|metadata| metadata.modified()).ok()
+}
+
+fn older_than(now: SystemTime, time: SystemTime, age: Duration) -> bool {
+    now.duration_since(time).map_or(false, |elapsed| elapsed > age)
+}
+
+fn leftover(kind: Kind, path: PathBuf) -> Leftover {
+    let bytes = size(&path);
+    Leftover { kind, path, bytes }
+}
+
+/// The size of a file, or of everything under a directory. Symlinks aren't
+/// followed.
+fn size(path: &Path) -> u64 {
+    let metadata = match fs::symlink_metadata(path) {
+        Ok(metadata) => metadata,
+        Err(_) => return 0,
+    };
+    if !metadata.is_dir() {
+        return metadata.len();
+    }
+    fs::read_dir(path)
+        .map(|entries| entries.flatten().map(|entry| size(&entry.path())).sum())
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn old_backups_and_unused_clones_are_found() {
+        let home = std::env::temp_dir().join(format!("kiwi-clean-{}", std::process::id()));
+        let old = home.join(".kiwi/backups/20200101-120000");
+        let recent = home.join(".kiwi/backups").join(chrono::Local::now().format("%Y%m%d-%H%M%S").to_string());
+        for dir in [&old, &recent] {
+            fs::create_dir_all(dir).unwrap();
+            fs::write(dir.join(".zshrc"), "export EDITOR=vim\n").unwrap();
+        }
+        let url = "git@github.com:me/dotfiles.git";
+        let checkouts = home.join(".kiwi/git");
+        let current = GitRemote::new(url, &checkouts).dir().to_path_buf();
+        let unused = checkouts.join("0123456789abcdef");
+        fs::create_dir_all(&current).unwrap();
+        fs::create_dir_all(&unused).unwrap();
+
+        let found = find(&home, &home, Some(url), Duration::from_secs(30 * 24 * 60 * 60)).unwrap();
+        let paths: Vec<_> = found.iter().map(|leftover| (leftover.kind, leftover.path.clone())).collect();
+        assert_eq!(paths, vec![(Kind::Backup, old.clone()), (Kind::Clone, unused)]);
+        assert_eq!(found[0].bytes, 18);
+
+        assert_eq!(remove(&found).unwrap(), 18);
+        assert!(!old.exists() && recent.exists() && current.exists());
+        fs::remove_dir_all(&home).unwrap();
+    }
+}
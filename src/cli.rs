@@ -1,15 +1,40 @@
 use clap::{Parser, Subcommand, ValueEnum};
-use crate::{Result, Config, Homebrew, Dotfiles, Sync};
-use std::path::PathBuf;
+use crate::{Result, Config, Homebrew, Dotfiles, Sync, KiwiError};
+use crate::archive::{self, Export};
+use crate::clean;
+use crate::dotfiles::Dotfile;
+use crate::encryption::Encryption;
+use crate::hooks::{Hook, Hooks};
+use crate::import::{self, Mapping};
+use crate::credentials::CredentialStore;
+use crate::deploy;
+use crate::diff::{self, FileDiff};
+use crate::doctor;
+use crate::kiwiignore::KiwiIgnore;
+use crate::profiles::{self, Profiles};
+use crate::progress::Progress;
+use crate::queue::Queue;
+use crate::schedule::{self, Scheduler};
+use crate::secrets::{Allowlist, SecretScan};
+use crate::sync::{Backend, Conflict, Device, Mirror, SyncConfig, SyncStatus, SyncSummary};
+use crate::template::{hostname, TemplateContext};
+use crate::update::{self, Channel, UpdateCheck};
+use std::collections::BTreeSet;
+use std::path::{Path, PathBuf};
 use colored::*;
-use std::io::{self, Write};
-use indicatif::{ProgressBar, ProgressStyle, MultiProgress};
+use std::io::{self, IsTerminal, Write};
+use indicatif::{HumanBytes, ProgressBar, ProgressStyle, MultiProgress};
 use std::fmt;
 use std::time::Duration;
+use dialoguer::{Confirm, Editor, MultiSelect, Password, Select, theme::ColorfulTheme};
+use notify::{RecursiveMode, Watcher};
 
 const SPINNER_TEMPLATE: &str = "{spinner:.green} {prefix:.bold.dim} {wide_msg}";
 const PROGRESS_TEMPLATE: &str = "{spinner:.green} [{elapsed_precise}] {bar:40.cyan/blue} {pos:>7}/{len:7} {wide_msg}";
 const PROGRESS_CHARS: &str = "█▉▊▋▌▍▎▏  ";
+/// How often `kiwi watch` retries pushes queued while the server was
+/// unreachable.
+const QUEUE_RETRY_INTERVAL: Duration = Duration::from_secs(30);
 
 #[derive(Debug, Copy, Clone, PartialEq, Eq, PartialOrd, Ord, ValueEnum)]
 pub enum EnvType {
@@ -37,6 +62,22 @@ pub enum ListType {
     All,
 }
 
+#[derive(Debug, Copy, Clone, PartialEq, Eq, ValueEnum)]
+pub enum CompletionShell {
+    Bash,
+    Zsh,
+    Fish,
+}
+
+/// What the completion scripts ask kiwi for as you type.
+#[derive(Debug, Copy, Clone, PartialEq, Eq, ValueEnum)]
+pub enum CompletionValues {
+    /// Tracked files and directories
+    Paths,
+    /// Profile names
+    Profiles,
+}
+
 #[derive(Parser)]
 #[command(name = "kiwi")]
 #[command(about = "🥝 Kiwi - The Ultimate macOS Environment Manager", long_about = "A powerful CLI tool for seamlessly managing your macOS environment, including dotfiles, Homebrew packages, and cloud sync.")]
@@ -46,13 +87,28 @@ pub struct Cli {
     #[command(subcommand)]
     pub command: Commands,
 
-    /// Enable verbose output
-    #[arg(short, long, global = true)]
-    pub verbose: bool,
+    /// Log each HTTP request and response to stderr: method, URL, status,
+    /// timing, request ID and headers, with credentials redacted
+    #[arg(short = 'v', long, alias = "verbose", global = true)]
+    pub trace: bool,
 
-    /// Suppress all output
+    /// Only print errors: no progress bars or summaries, for scripts
     #[arg(short, long, global = true)]
     pub quiet: bool,
+
+    /// Only sync the files and packages in this profile (defaults to the
+    /// configured one)
+    #[arg(long, global = true, env = "KIWI_PROFILE")]
+    pub profile: Option<String>,
+
+    /// Print JSON instead of text, for status, diff, history, devices,
+    /// whoami and list
+    #[arg(short, long, global = true)]
+    pub json: bool,
+
+    /// Don't run the pre-push, post-pull or post-restore hooks
+    #[arg(long, global = true)]
+    pub no_hooks: bool,
 }
 
 #[derive(Subcommand)]
@@ -74,6 +130,12 @@ pub enum Commands {
         /// Skip interactive prompts
         #[arg(short = 'y', long)]
         yes: bool,
+        /// Don't look for common dotfiles to track
+        #[arg(long)]
+        skip_detect: bool,
+        /// Name to register this device under (defaults to the hostname)
+        #[arg(long)]
+        device_name: Option<String>,
     },
     /// Sync configuration files between local and cloud
     Sync {
@@ -93,9 +155,172 @@ pub enum Commands {
         #[arg(short, long)]
         diff: bool,
     },
-    /// Add a dotfile or configuration to sync
+    /// Upload tracked files and packages to the server
+    Push {
+        /// Show what would be pushed without pushing
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+        /// Overwrite the remote even if it changed since the last pull
+        #[arg(short, long)]
+        force: bool,
+        /// Push even if files look like they contain secrets
+        #[arg(long)]
+        allow_secrets: bool,
+    },
+    /// Download files and packages from the server
+    Pull {
+        /// Only pull these files or directories
+        paths: Vec<String>,
+        /// Keep local files that differ from the remote
+        #[arg(short, long)]
+        prefer_local: bool,
+        /// Show what would be pulled without writing anything
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+    },
+    /// Set up a new machine: pull every file, track it and install the packages
+    Restore {
+        /// API token to sign in with, instead of the saved one
+        #[arg(long, env = "KIWI_TOKEN", hide_env_values = true)]
+        token: Option<String>,
+        /// Server to restore from, instead of the configured one
+        #[arg(long, env = "KIWI_SERVER")]
+        server: Option<String>,
+        /// Keep local files that differ from the remote
+        #[arg(short, long)]
+        prefer_local: bool,
+        /// Don't install the Homebrew packages
+        #[arg(long)]
+        skip_packages: bool,
+        /// Name to register this device under (defaults to the hostname)
+        #[arg(long)]
+        device_name: Option<String>,
+        /// Key to decrypt files with, when encryption is on
+        #[arg(long, env = "KIWI_AGE_KEY", hide_env_values = true)]
+        age_key: Option<String>,
+        /// Show what would be written and installed without changing anything
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+    },
+    /// Find likely secrets in synced files, and allow the false alarms
+    Secrets {
+        #[command(subcommand)]
+        action: SecretsAction,
+    },
+    /// Encrypt files with age before they're pushed
+    Encrypt {
+        #[command(subcommand)]
+        action: EncryptAction,
+    },
+    /// Assign files and packages to profiles such as work or home
+    Profile {
+        #[command(subcommand)]
+        action: ProfileAction,
+    },
+    /// Render dotfiles differently per machine from templates
+    Template {
+        #[command(subcommand)]
+        action: TemplateAction,
+    },
+    /// Show how tracked files and packages differ from the server
+    Status {
+        /// Only compare files, skipping the Homebrew package check
+        #[arg(short = 'F', long)]
+        files_only: bool,
+    },
+    /// Watch tracked files and push changes automatically
+    Watch {
+        /// Seconds to wait for changes to settle before pushing
+        #[arg(short, long, default_value_t = 2)]
+        debounce: u64,
+    },
+    /// Show a unified diff between local files and the remote, or between snapshots
+    Diff {
+        /// Only diff this file
+        path: Option<String>,
+        /// Compare from this remote revision instead of the local files
+        #[arg(long)]
+        from: Option<i64>,
+        /// Compare against this remote revision instead of the latest
+        #[arg(long, requires = "from")]
+        to: Option<i64>,
+        /// Only list the files that differ
+        #[arg(long)]
+        name_only: bool,
+    },
+    /// Show the latest change to each file on the server
+    History {
+        /// How many changes to show
+        #[arg(short = 'n', long, default_value_t = 20)]
+        limit: usize,
+    },
+    /// Put local files back as they were in a snapshot on the server
+    Rollback {
+        /// Revision to roll back to, as shown by `kiwi history`
+        revision: i64,
+        /// Only roll back these files
+        paths: Vec<String>,
+        /// Show what would change without changing anything
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+        /// Roll back without asking
+        #[arg(short = 'y', long)]
+        yes: bool,
+    },
+    /// Write tracked files and the package list to an archive that needs no server
+    Export {
+        /// Archive format
+        #[arg(short, long, value_enum, default_value_t = archive::Format::Tar)]
+        format: archive::Format,
+        /// File to write; kiwi-export-<date> in the current directory by default
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+    /// Track and push the files in a dotfiles repository or archive
+    Import {
+        /// Git URL, archive (.tar.gz, .tgz, .tar or .zip) or directory
+        source: String,
+        /// Use the suggested paths without asking
+        #[arg(short = 'y', long)]
+        yes: bool,
+        /// Show where files would go without writing anything
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+        /// Track the files without pushing them
+        #[arg(long)]
+        no_push: bool,
+    },
+    /// List, rename and revoke the machines registered to this account
+    Devices {
+        #[command(subcommand)]
+        action: Option<DeviceAction>,
+    },
+    /// Show the account you're signed in as: server, token, this device and
+    /// storage used
+    Whoami,
+    /// Remove old backups, unused repository clones and files left by
+    /// interrupted runs, and report the space reclaimed
+    Clean {
+        /// Keep backups from the last this many days; backup_retention_days
+        /// in the config by default
+        #[arg(long)]
+        keep_days: Option<u32>,
+        /// Show what would be removed without removing anything
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+    },
+    /// Print shell completions, e.g. `source <(kiwi completion zsh)`
+    Completion {
+        /// Shell to complete for
+        #[arg(value_enum, required_unless_present = "values")]
+        shell: Option<CompletionShell>,
+        /// Print the tracked paths or profile names to complete, one per line
+        #[arg(long, value_enum, hide = true)]
+        values: Option<CompletionValues>,
+    },
+    /// Add a dotfile, or a whole directory, to sync
     Add {
-        /// Path to the file to add
+        /// Path to the file or directory to add
         path: String,
         /// Alias for the file
         #[arg(short, long)]
@@ -107,12 +332,16 @@ pub enum Commands {
         #[arg(short = 'B', long)]
         no_backup: bool,
     },
-    /// Remove a dotfile or configuration from sync
+    /// Stop syncing a dotfile or directory and delete the local copy
+    #[command(visible_alias = "rm")]
     Remove {
-        /// Path to the file to remove
+        /// Path to the file or directory to remove
         path: String,
-        /// Remove the actual file as well
+        /// Only stop syncing; leave the file on disk
         #[arg(short, long)]
+        keep_local: bool,
+        /// Deleting is now the default; kept so older scripts still work
+        #[arg(short, long, hide = true, conflicts_with = "keep_local")]
         delete: bool,
         /// Skip confirmation prompt
         #[arg(short, long)]
@@ -155,15 +384,15 @@ pub enum Commands {
         /// Show detailed information
         #[arg(short, long)]
         detailed: bool,
-        /// Output in JSON format
-        #[arg(short, long)]
-        json: bool,
     },
-    /// Manage global configuration
+    /// Manage global configuration, kept in ~/.config/kiwi/config.toml
+    #[command(args_conflicts_with_subcommands = true)]
     Config {
-        /// Configuration key
+        #[command(subcommand)]
+        action: Option<ConfigAction>,
+        /// Configuration key, as with `kiwi config get`
         key: Option<String>,
-        /// Configuration value
+        /// Configuration value, as with `kiwi config set`
         value: Option<String>,
         /// Reset configuration to defaults
         #[arg(short, long)]
@@ -175,6 +404,11 @@ pub enum Commands {
         #[arg(short, long)]
         import: Option<PathBuf>,
     },
+    /// Manage backup servers that pushes are copied to and pulls fall back on
+    Remote {
+        #[command(subcommand)]
+        action: RemoteAction,
+    },
     /// Check system health and configuration status
     Doctor {
         /// Fix detected issues automatically
@@ -184,9 +418,286 @@ pub enum Commands {
         #[arg(short, long)]
         report: bool,
     },
+    /// Pull on a schedule with a systemd timer or launchd agent
+    Schedule {
+        #[command(subcommand)]
+        action: ScheduleAction,
+    },
+    /// Update kiwi to the newest release
+    SelfUpdate {
+        /// Release channel, stable or beta; update_channel in the config by default
+        #[arg(long)]
+        channel: Option<Channel>,
+        /// Only say whether there's an update
+        #[arg(long)]
+        check: bool,
+        /// Update without asking
+        #[arg(short = 'y', long)]
+        yes: bool,
+    },
+}
+
+#[derive(Subcommand)]
+pub enum ScheduleAction {
+    /// Write and load the timer or agent, replacing one installed before
+    Install {
+        /// How often to pull, like 30m, 2h or 1d
+        #[arg(long, default_value = "30m", value_parser = schedule::parse_interval)]
+        every: Duration,
+    },
+    /// Show whether scheduled pulls are set up
+    Status,
+    /// Unload and delete the timer or agent
+    #[command(alias = "rm")]
+    Remove,
+}
+
+#[derive(Subcommand)]
+pub enum ConfigAction {
+    /// Print a setting
+    Get {
+        key: String,
+    },
+    /// Change a setting
+    Set {
+        key: String,
+        /// New value; empty to unset
+        value: String,
+    },
+    /// Print every setting
+    List,
+    /// Print where the config file is
+    Path,
+}
+
+#[derive(Subcommand)]
+pub enum SecretsAction {
+    /// Scan every synced file, not just the changes a push would scan
+    Scan,
+    /// Stop flagging a file or directory, or one finding
+    Allow {
+        /// File or directory to allow
+        #[arg(required_unless_present = "finding")]
+        path: Option<String>,
+        /// Fingerprint of a finding to allow, as shown by a push or scan
+        #[arg(long, conflicts_with = "path")]
+        finding: Option<String>,
+    },
+    /// Flag a file or finding again
+    Disallow {
+        /// File or directory to flag again
+        #[arg(required_unless_present = "finding")]
+        path: Option<String>,
+        /// Fingerprint of a finding to flag again
+        #[arg(long, conflicts_with = "path")]
+        finding: Option<String>,
+    },
+    /// List what's allowed
+    List,
+}
+
+#[derive(Subcommand)]
+pub enum EncryptAction {
+    /// Turn encryption on, creating a key if this machine has none
+    Enable,
+    /// Turn encryption off; the next push uploads plain files
+    Disable,
+    /// Show whether encryption is on and this machine's key
+    Status,
+    /// Print the secret key, to import on another machine
+    ExportKey,
+    /// Store a key exported from another machine
+    ImportKey {
+        /// The secret key (AGE-SECRET-KEY-1...); read from stdin when omitted
+        key: Option<String>,
+    },
+}
+
+#[derive(Subcommand)]
+pub enum RemoteAction {
+    /// Add a backup server
+    Add {
+        /// Name to refer to it by
+        name: String,
+        /// Server URL
+        url: String,
+        /// API token for the server (asked for when not given)
+        #[arg(long, env = "KIWI_REMOTE_TOKEN", hide_env_values = true)]
+        token: Option<String>,
+    },
+    /// Remove a backup server and forget its token
+    #[command(visible_alias = "rm")]
+    Remove {
+        /// Name of the remote
+        name: String,
+    },
+    /// List the servers, in the order pulls try them
+    List,
+}
+
+#[derive(Subcommand)]
+pub enum DeviceAction {
+    /// List the machines registered to this account (the default)
+    #[command(visible_alias = "ls")]
+    List,
+    /// Give a device a new name
+    Rename {
+        /// Device ID, name or hostname
+        device: String,
+        /// New name
+        name: String,
+    },
+    /// Cut a device off, say one that was lost or handed back. This replaces
+    /// the account's token, so other machines need the new one
+    Revoke {
+        /// Device ID, name or hostname
+        device: String,
+        /// Revoke without asking
+        #[arg(short = 'y', long)]
+        yes: bool,
+    },
+}
+
+#[derive(Subcommand)]
+pub enum ProfileAction {
+    /// Add files, directories or packages to a profile
+    Add {
+        /// Profile name
+        profile: String,
+        /// Files or directories to add
+        paths: Vec<String>,
+        /// Homebrew packages to add
+        #[arg(short, long = "package")]
+        packages: Vec<String>,
+    },
+    /// Take files, directories or packages out of a profile
+    #[command(visible_alias = "rm")]
+    Remove {
+        /// Profile name
+        profile: String,
+        /// Files or directories to take out
+        paths: Vec<String>,
+        /// Homebrew packages to take out
+        #[arg(short, long = "package")]
+        packages: Vec<String>,
+    },
+    /// List profiles and what's in them
+    List,
+}
+
+#[derive(Subcommand)]
+pub enum TemplateAction {
+    /// Turn a dotfile into a template, starting from its current contents
+    Add {
+        /// Path to the dotfile
+        path: String,
+    },
+    /// Stop rendering a dotfile from a template, keeping the file as it is
+    #[command(visible_alias = "rm")]
+    Remove {
+        /// Path to the dotfile
+        path: String,
+    },
+    /// Render every template into place after editing one
+    Render {
+        /// Show what would be rendered without writing anything
+        #[arg(short = 'n', long)]
+        dry_run: bool,
+    },
+    /// Show the values templates see on this machine
+    Vars,
 }
 
 impl Cli {
+    /// Returns the server and token given to `kiwi restore`, which replace
+    /// the saved ones so a new machine can be set up without signing in.
+    pub fn restore_credentials(&self) -> (Option<&str>, Option<&str>) {
+        match &self.command {
+            Commands::Restore { server, token, .. } => (server.as_deref(), token.as_deref()),
+            _ => (None, None),
+        }
+    }
+
+    /// Prints shell completions, if that's the command. It runs on every tab
+    /// press, so it only reads local files, and doesn't sign in.
+    pub fn complete(&self) -> Option<Result<()>> {
+        match &self.command {
+            Commands::Completion { shell, values } => Some(Self::print_completion(*shell, *values)),
+            _ => None,
+        }
+    }
+
+    fn print_completion(shell: Option<CompletionShell>, values: Option<CompletionValues>) -> Result<()> {
+        let config = Config::load_settings()?;
+        let candidates: BTreeSet<String> = match values {
+            Some(CompletionValues::Paths) => {
+                let dotfiles = Dotfiles::new(config.dotfiles_dir.clone(), config.dotfiles_dir.join("dotfiles.json"));
+                let home = dirs::home_dir().unwrap_or_default();
+                dotfiles.list()?
+                    .into_iter()
+                    .map(|dotfile| dotfile.path)
+                    .chain(dotfiles.tracked_files()?)
+                    .map(|path| match path.strip_prefix(&home) {
+                        Ok(relative) => format!("~/{}", relative.display()),
+                        Err(_) => path.display().to_string(),
+                    })
+                    .collect()
+            }
+            Some(CompletionValues::Profiles) => {
+                let mut names = Profiles::load(&config.dotfiles_dir.join("profiles.json"))?.names();
+                names.extend(config.profile);
+                names
+            }
+            None => {
+                let shell = match shell {
+                    Some(CompletionShell::Bash) | None => clap_complete::Shell::Bash,
+                    Some(CompletionShell::Zsh) => clap_complete::Shell::Zsh,
+                    Some(CompletionShell::Fish) => clap_complete::Shell::Fish,
+                };
+                return crate::completion::generate(shell, &mut io::stdout());
+            }
+        };
+        for candidate in candidates {
+            println!("{}", candidate);
+        }
+        Ok(())
+    }
+
+    /// Returns whether the command needs to be signed in. `kiwi doctor` runs
+    /// without, so it can say what's wrong with signing in, and so do
+    /// managing backup servers, which have their own tokens, exporting,
+    /// importing without pushing, updating, looking at or removing the pull
+    /// schedule, and `kiwi whoami`, which says when you aren't signed in.
+    pub fn needs_account(&self) -> bool {
+        !matches!(
+            self.command,
+            Commands::Doctor { .. }
+                | Commands::Export { .. }
+                | Commands::Import { no_push: true, .. }
+                | Commands::Remote { .. }
+                | Commands::SelfUpdate { .. }
+                | Commands::Schedule { action: ScheduleAction::Status | ScheduleAction::Remove }
+                | Commands::Whoami
+                | Commands::Clean { .. }
+        )
+    }
+
+    /// Returns whether this is a `kiwi restore --dry-run`, which uses the
+    /// credentials it's given without saving them.
+    pub fn is_dry_run_restore(&self) -> bool {
+        matches!(self.command, Commands::Restore { dry_run: true, .. })
+    }
+
+    /// Transfer progress is drawn for the commands that push or pull in the
+    /// foreground, and for an update's download; restore has its own
+    /// spinners.
+    fn shows_progress(&self, config: &Config) -> bool {
+        matches!(self.command, Commands::Push { .. } | Commands::Pull { .. } | Commands::Sync { .. } | Commands::SelfUpdate { .. })
+            && !self.quiet
+            && !self.json
+            && config.preferences.show_progress_bars
+    }
+
     pub async fn execute(&self) -> Result<()> {
         let mut config = Config::load()?;
         let mut homebrew = Homebrew::new(config.dotfiles_dir.join("packages.json"));
@@ -206,22 +717,81 @@ impl Cli {
             .unwrap()
             .progress_chars(PROGRESS_CHARS);
 
+        // main() saves a restore's credentials, except on a dry run
+        if self.is_dry_run_restore() {
+            let (server, token) = self.restore_credentials();
+            if let Some(server) = server {
+                config.sync_url = Some(server.to_string());
+            }
+            if let Some(token) = token {
+                config.sync_token = Some(token.to_string());
+            }
+        }
+
         // Clone the values we need before creating sync
         let sync_url = config.sync_url.clone();
-        let sync_token = config.sync_token.clone();
+        // A git remote is signed in to with git's own credentials, and a
+        // snapshot directory needs no signing in
+        let sync_token = config.sync_token.clone().or_else(|| config.is_serverless().then(String::new));
         let dotfiles_dir = config.dotfiles_dir.clone();
 
+        let profile = self.profile.clone().or_else(|| config.profile.clone());
+        if let Some(profile) = &profile {
+            if !profiles::is_valid_name(profile) {
+                return Err(KiwiError::InvalidConfig {
+                    key: "profile".to_string(),
+                    message: "Profile name can only contain alphanumeric characters, underscores, and hyphens".to_string(),
+                });
+            }
+        }
+
+        let hooks = Hooks::new(config.hooks_dir()?, profile.clone());
+        let queue = Queue::new(config.dotfiles_dir.join("push_queue.json"));
+
+        // A restore brings the key along so the files can be decrypted; a
+        // dry run only borrows it
+        let encryption = match &self.command {
+            Commands::Restore { age_key: Some(key), dry_run: true, .. } => Some(Encryption::parse(key)?),
+            Commands::Restore { age_key: Some(key), .. } => {
+                let (encryption, _) = Encryption::import(key)?;
+                config.set("encrypt", "true".to_string())?;
+                Some(encryption)
+            }
+            _ => Encryption::load()?,
+        };
+
+        // Backups without a saved token are left out
+        let mut mirrors = Vec::new();
+        for remote in &config.remotes {
+            if let Some(token) = config.remote_token(remote)? {
+                mirrors.push(Mirror {
+                    name: remote.name.clone(),
+                    config: SyncConfig { url: remote.url.clone(), token, device_id: None },
+                });
+            }
+        }
+
         let sync = if let (Some(url), Some(token)) = (sync_url, sync_token) {
             Some(Sync::new(
-                crate::sync::SyncConfig { url, token },
+                SyncConfig { url, token, device_id: config.device_id.clone() },
                 dotfiles_dir,
-            ))
+            )
+            .with_mirrors(mirrors)
+            .with_hooks_dir(config.hooks_dir()?)
+            .with_profile(profile.clone())
+            .with_encryption(encryption, config.encrypt)
+            .with_deploy(config.deploy, Config::store_dir()?)
+            .with_progress(Progress::new(self.shows_progress(&config)))
+            .with_secret_scan(match &self.command {
+                Commands::Push { allow_secrets: true, .. } => SecretScan::Warn,
+                _ => config.secret_scan,
+            }))
         } else {
             None
         };
 
         match &self.command {
-            Commands::Init { restore, env, env_name, sync_homebrew, yes } => {
+            Commands::Init { restore, env, env_name, sync_homebrew, yes, skip_detect, device_name } => {
                 println!("{}", "🥝 Welcome to Kiwi - The Ultimate macOS Environment Manager".green().bold());
                 let spinner = multi_progress.add(ProgressBar::new_spinner());
                 spinner.set_style(spinner_style.clone());
@@ -241,6 +811,19 @@ impl Cli {
                     spinner.tick();
                 }
 
+                if !*skip_detect {
+                    spinner.set_message("Looking for dotfiles...");
+                    let tracked = self.track_detected(&dotfiles, &spinner, *yes)?;
+                    if tracked > 0 {
+                        spinner.println(format!("{} Tracking {} file(s)", "✓".green(), tracked));
+                    }
+                }
+
+                if let Some(sync) = &sync {
+                    spinner.set_message("Registering this device...");
+                    self.register_device(sync, &mut config, device_name.as_deref(), &spinner).await?;
+                }
+
                 if *sync_homebrew {
                     spinner.set_message("Scanning Homebrew packages...");
                     let packages = homebrew.list_installed()?;
@@ -281,7 +864,8 @@ impl Cli {
                 if *restore {
                     spinner.set_message("Restoring from backup...");
                     if let Some(sync) = &sync {
-                        sync.pull(true).await?;
+                        let summary = sync.pull(true, false).await?;
+                        self.track_pulled(&dotfiles, &summary)?;
                         spinner.finish_with_message("✓ Restore completed successfully".green().to_string());
                     }
                 }
@@ -323,8 +907,10 @@ impl Cli {
                         
                         homebrew.save_packages(&packages)?;
                         
+                        self.run_hook(&hooks, Hook::PrePush, &[])?;
                         println!("{}", "\nPushing to remote...".yellow());
-                        sync.push().await?;
+                        let summary = sync.push(&dotfiles.tracked_files()?, false, *force).await?;
+                        self.print_summary(&summary);
                         println!("{}", "✓ Push complete".green());
                     } else if *pull {
                         if *diff {
@@ -339,7 +925,12 @@ impl Cli {
                             println!("{}", "Force pulling (overwriting local changes)...".yellow());
                         }
                         
-                        sync.pull(*prefer_local).await?;
+                        let summary = sync.pull(*prefer_local, false).await?;
+                        self.print_summary(&summary);
+                        self.track_pulled(&dotfiles, &summary)?;
+                        if summary.has_changes() {
+                            self.run_hook(&hooks, Hook::PostPull, &Self::changed_files(&summary))?;
+                        }
                         println!("{}", "✓ Pull complete".green());
                     } else {
                         println!("{}", "Please specify --push or --pull".red());
@@ -348,136 +939,815 @@ impl Cli {
                     println!("{}", "Sync not configured. Please set sync_url and sync_token in config.".red());
                 }
             },
-            Commands::Add { path, alias, symlink, no_backup } => {
-                println!("{} {}", "Adding file:".blue().bold(), path);
-                
-                let path = PathBuf::from(path);
-                if !*no_backup && path.exists() {
-                    let backup_path = path.with_extension("backup");
-                    println!("{} {}", "Creating backup:".yellow(), backup_path.display());
-                    std::fs::copy(&path, &backup_path)?;
+            Commands::Push { dry_run, force, .. } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                match self.push(sync, &dotfiles, &hooks, &queue, *dry_run, *force).await {
+                    Err(e) if !*dry_run && e.is_offline() => self.queue_push(sync, &dotfiles, &queue)?,
+                    result => result?,
                 }
-                
-                dotfiles.add(path.as_path(), alias.clone())?;
-                
-                if *symlink {
-                    println!("{}", "Creating symlink...".yellow());
-                    // TODO: Implement symlink creation
-                }
-                
-                println!("{}", "✓ File added successfully".green());
             },
-            Commands::Remove { path, delete, force } => {
-                println!("{} {}", "Removing file:".blue().bold(), path);
-                
-                let path = PathBuf::from(path);
-                
-                if *delete {
-                    if !*force {
-                        print!("{}", "Are you sure you want to delete the file? [y/N]: ".red());
-                        io::stdout().flush()?;
-                        let mut input = String::new();
-                        io::stdin().read_line(&mut input)?;
-                        if !input.trim().eq_ignore_ascii_case("y") {
-                            println!("{}", "Deletion cancelled".yellow());
+            Commands::Pull { paths, prefer_local, dry_run } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                let only: Vec<_> = paths.iter().map(|p| sync.key_for(p)).collect();
+                let mut prefer_local = *prefer_local;
+                if !prefer_local && !*dry_run {
+                    match self.settle_conflicts(sync, &dotfiles, &only).await? {
+                        None => {
+                            println!("{}", "Pull cancelled".yellow());
                             return Ok(());
                         }
-                    }
-                    
-                    if path.exists() {
-                        std::fs::remove_file(&path)?;
-                        println!("{}", "File deleted".yellow());
+                        // Conflicts skipped for now keep the local copy
+                        Some(skipped) => prefer_local = skipped > 0,
                     }
                 }
-                
-                dotfiles.remove(path.as_path())?;
-                println!("{}", "✓ File removed successfully".green());
-            },
-            Commands::Update { all: update_all, package, force, changelog } => {
-                println!("{}", "Updating packages...".blue().bold());
-                
-                if *force {
-                    println!("{}", "Force updating (skipping checks)...".yellow());
+                if !self.quiet {
+                    println!("{}", "Pulling from remote...".blue().bold());
                 }
-                
-                if *update_all {
-                    println!("{}", "Updating all packages...".yellow());
-                    homebrew.update(None)?;
-                } else if let Some(pkg) = package {
-                    println!("{} {}", "Updating package:".yellow(), pkg);
-                    homebrew.update(Some(pkg))?;
+
+                let summary = sync.pull_only(&only, prefer_local, *dry_run).await?;
+                if !self.quiet {
+                    self.print_summary(&summary);
                 }
-                
-                if *changelog {
-                    println!("{}", "\nFetching changelogs...".blue());
-                    // TODO: Implement changelog fetching
+                if *dry_run {
+                    if !self.quiet {
+                        println!("{} {}", "Dry run - nothing was written".yellow(), "(+ write, ~ overwrite)".dimmed());
+                    }
+                } else {
+                    self.track_pulled(&dotfiles, &summary)?;
+                    if !self.quiet {
+                        println!("{} {}", "✓ Pull complete:".green(), Self::summary_counts(&summary));
+                        println!("  {}", format!("↓ {}", summary.downloaded).dimmed());
+                    }
+                    if summary.has_changes() {
+                        self.run_hook(&hooks, Hook::PostPull, &Self::changed_files(&summary))?;
+                    }
                 }
-                
-                println!("{}", "✓ Update complete".green());
             },
-            Commands::Install { package, no_deps, tap, version } => {
-                println!("{} {}", "Installing package:".blue().bold(), package);
-                
-                if let Some(tap_name) = tap {
-                    println!("{} {}", "Using tap:".yellow(), tap_name);
-                    // TODO: Implement tap handling
+            Commands::Restore { prefer_local, skip_packages, device_name, dry_run, .. } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                if *dry_run {
+                    println!("{}", "Checking what a restore would change...".blue().bold());
+                    let preview = sync.pull(*prefer_local, true).await?;
+                    self.print_summary(&preview);
+                    if config.preferences.backup_before_change && !preview.updated.is_empty() {
+                        println!("  {} file(s) would be backed up first", preview.updated.len());
+                    }
+                    if !*skip_packages {
+                        // Without Homebrew, every package would be installed
+                        let installed: Vec<_> = homebrew.list_installed()
+                            .unwrap_or_default()
+                            .into_iter()
+                            .map(|p| p.name)
+                            .collect();
+                        for name in preview.packages.iter().filter(|name| !installed.contains(name)) {
+                            println!("  {} {} (install)", "↓".cyan(), name);
+                        }
+                    }
+                    println!("{} {}", "Dry run - nothing was written or installed".yellow(), "(+ write, ~ overwrite)".dimmed());
+                    return Ok(());
                 }
-                
-                if let Some(ver) = version {
-                    println!("{} {}", "Installing version:".yellow(), ver);
-                    // TODO: Implement version-specific installation
+                println!("{}", "🥝 Restoring this machine...".green().bold());
+                let spinner = multi_progress.add(ProgressBar::new_spinner());
+                spinner.set_style(spinner_style.clone());
+                spinner.set_prefix("[Restore]");
+                spinner.enable_steady_tick(Duration::from_millis(100));
+
+                spinner.set_message("Registering this device...");
+                self.register_device(sync, &mut config, device_name.as_deref(), &spinner).await?;
+                // Later pulls on this machine stick to the profile it was set up with
+                if let Some(profile) = &self.profile {
+                    config.set("profile", profile.clone())?;
                 }
-                
-                if *no_deps {
-                    println!("{}", "Installing without dependencies...".yellow());
-                    // TODO: Implement no-deps installation
+
+                spinner.set_message("Checking what will change...");
+                let preview = sync.pull(*prefer_local, true).await?;
+                if config.preferences.backup_before_change && !preview.updated.is_empty() {
+                    let backup_dir = self.back_up(&preview.updated)?;
+                    spinner.println(format!("{} Backed up {} file(s) to {}", "✓".green(), preview.updated.len(), backup_dir.display()));
                 }
-                
-                homebrew.install(package)?;
-                println!("{}", "✓ Installation complete".green());
-            },
-            Commands::List { type_, detailed, json } => {
-                if *json {
-                    // TODO: Implement JSON output
-                    println!("{}", "JSON output not yet implemented".yellow());
-                    return Ok(());
+
+                spinner.set_message("Pulling files...");
+                let summary = sync.pull(*prefer_local, false).await?;
+                self.track_pulled(&dotfiles, &summary)?;
+                spinner.println(format!("{} Files: {}", "✓".green(), Self::summary_counts(&summary)));
+
+                if !*skip_packages {
+                    let profiles = Profiles::load(&config.dotfiles_dir.join("profiles.json"))?;
+                    self.install_packages(&mut homebrew, &profiles, profile.as_deref(), &spinner)?;
                 }
-                
-                println!("{}", "Listing items...".blue().bold());
-                match type_ {
-                    ListType::Dotfiles => {
-                        println!("{}", "Managed dotfiles:".yellow());
-                        let dotfiles = dotfiles.list()?;
-                        for dotfile in dotfiles {
-                            if *detailed {
-                                println!("  Path: {}", dotfile.path.display());
-                                // TODO: Add more detailed information
-                            } else {
-                                println!("  {}", dotfile.path.display());
-                            }
+
+                spinner.finish_with_message("✨ Restore complete! This machine is ready.".green().bold().to_string());
+                self.run_hook(&hooks, Hook::PostRestore, &Self::changed_files(&summary))?;
+            },
+            Commands::Secrets { action } => {
+                let allowlist_path = config.dotfiles_dir.join("secrets_allowlist.json");
+                let mut allowlist = Allowlist::load(&allowlist_path)?;
+                match action {
+                    SecretsAction::Scan => {
+                        let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                        let findings = sync.scan_secrets(&dotfiles.tracked_files()?)?;
+                        if findings.is_empty() {
+                            println!("{}", "✓ No likely secrets found".green());
+                            return Ok(());
                         }
-                    },
-                    ListType::Packages => {
-                        println!("{}", "Installed packages:".yellow());
-                        let packages = homebrew.list_installed()?;
-                        for package in packages {
-                            if *detailed {
-                                let version = package.version.unwrap_or_else(|| "latest".to_string());
-                                println!("  {} ({})", package.name, version);
-                                // TODO: Add more package details
-                            } else {
-                                println!("  {}", package.name);
+                        for finding in &findings {
+                            println!("  {} {}:{} looks like a {} ({})", "⚠".red(), finding.path, finding.line, finding.rule, finding.fingerprint.dimmed());
+                        }
+                        println!("\n{} line(s) look like secrets", findings.len());
+                        println!("Allow false alarms with `kiwi secrets allow --finding <fingerprint>`, or a whole file with `kiwi secrets allow <path>`");
+                    }
+                    SecretsAction::Allow { path, finding } => {
+                        match (path, finding) {
+                            (Some(path), _) => {
+                                let key = Self::home_key(path)?;
+                                println!("{} {} won't be scanned for secrets", "✓".green(), key);
+                                allowlist.paths.insert(key);
                             }
+                            (None, Some(finding)) => {
+                                println!("{} {} won't be flagged again", "✓".green(), finding);
+                                allowlist.fingerprints.insert(finding.clone());
+                            }
+                            (None, None) => unreachable!("clap requires a path or --finding"),
                         }
-                    },
-                    ListType::All => {
-                        println!("{}", "Listing all items...".yellow());
-                        let dotfiles = dotfiles.list()?;
-                        let packages = homebrew.list_installed()?;
-                        
-                        println!("\n{}", "Dotfiles:".blue());
-                        for dotfile in dotfiles {
-                            if *detailed {
+                        allowlist.save(&allowlist_path)?;
+                    }
+                    SecretsAction::Disallow { path, finding } => {
+                        let removed = match (path, finding) {
+                            (Some(path), _) => allowlist.paths.remove(&Self::home_key(path)?),
+                            (None, Some(finding)) => allowlist.fingerprints.remove(finding),
+                            (None, None) => unreachable!("clap requires a path or --finding"),
+                        };
+                        if !removed {
+                            println!("{}", "That wasn't allowed".yellow());
+                            return Ok(());
+                        }
+                        allowlist.save(&allowlist_path)?;
+                        println!("{}", "✓ It will be flagged again".green());
+                    }
+                    SecretsAction::List => {
+                        println!("{} {}", "Secret scanning:".blue().bold(), config.secret_scan.as_str());
+                        if allowlist.paths.is_empty() && allowlist.fingerprints.is_empty() {
+                            println!("Nothing is allowed");
+                        }
+                        for path in &allowlist.paths {
+                            println!("  {}", path);
+                        }
+                        for finding in &allowlist.fingerprints {
+                            println!("  {} {}", finding, "(finding)".dimmed());
+                        }
+                    }
+                }
+            },
+            Commands::Encrypt { action } => {
+                match action {
+                    EncryptAction::Enable => {
+                        if let Some(encryption) = Encryption::load()? {
+                            println!("{} {}", "Using this machine's key:".blue(), encryption.recipient());
+                        } else {
+                            let (encryption, store) = Encryption::generate()?;
+                            println!("{} {}", "✓ Created key".green(), encryption.recipient());
+                            match store {
+                                CredentialStore::Keychain => println!("🔐 Saved it in the OS keychain"),
+                                CredentialStore::EncryptedFile => println!("🔐 Saved it in ~/.kiwi/age.key"),
+                            }
+                            println!("{}", "Keep a copy somewhere safe: without it your files can't be decrypted. `kiwi encrypt export-key` prints it.".yellow());
+                        }
+                        config.set("encrypt", "true".to_string())?;
+                        println!("{}", "✓ Encryption on; run `kiwi push` to encrypt the files on the server".green());
+                    }
+                    EncryptAction::Disable => {
+                        config.set("encrypt", "false".to_string())?;
+                        println!("{}", "✓ Encryption off; the next `kiwi push` stores plain files".green());
+                    }
+                    EncryptAction::Status => {
+                        let state = if config.encrypt { "on".green() } else { "off".yellow() };
+                        println!("{} {}", "Encryption:".blue().bold(), state);
+                        match Encryption::load()? {
+                            Some(encryption) => println!("{} {}", "Key:".blue().bold(), encryption.recipient()),
+                            None => println!("{} {}", "Key:".blue().bold(), "none on this machine".dimmed()),
+                        }
+                    }
+                    EncryptAction::ExportKey => {
+                        let encryption = Encryption::load()?.ok_or_else(|| {
+                            KiwiError::Encryption("This machine has no key; run `kiwi encrypt enable` first".to_string())
+                        })?;
+                        println!("{}", encryption.secret());
+                    }
+                    EncryptAction::ImportKey { key } => {
+                        let key = match key {
+                            Some(key) => key.clone(),
+                            None => {
+                                let mut input = String::new();
+                                io::stdin().read_line(&mut input)?;
+                                input
+                            }
+                        };
+                        let (encryption, store) = Encryption::import(&key)?;
+                        println!("{} {}", "✓ Imported key".green(), encryption.recipient());
+                        match store {
+                            CredentialStore::Keychain => println!("🔐 Saved it in the OS keychain"),
+                            CredentialStore::EncryptedFile => println!("🔐 Saved it in ~/.kiwi/age.key"),
+                        }
+                        config.set("encrypt", "true".to_string())?;
+                    }
+                }
+            },
+            Commands::Profile { action } => {
+                let profiles_path = config.dotfiles_dir.join("profiles.json");
+                let mut profiles = Profiles::load(&profiles_path)?;
+                match action {
+                    ProfileAction::Add { profile, paths, packages } => {
+                        if !profiles::is_valid_name(profile) {
+                            return Err(KiwiError::InvalidConfig {
+                                key: "profile".to_string(),
+                                message: "Profile name can only contain alphanumeric characters, underscores, and hyphens".to_string(),
+                            });
+                        }
+                        let keys = paths.iter().map(|p| Self::home_key(p)).collect::<Result<Vec<_>>>()?;
+                        profiles.assign(profile, &keys, packages);
+                        profiles.save(&profiles_path)?;
+                        println!("{} {} file(s) and {} package(s) to {}", "✓ Added".green(), keys.len(), packages.len(), profile.bold());
+                        println!("{}", "Run `kiwi push` to share the change with your other machines".dimmed());
+                    }
+                    ProfileAction::Remove { profile, paths, packages } => {
+                        let keys = paths.iter().map(|p| Self::home_key(p)).collect::<Result<Vec<_>>>()?;
+                        profiles.unassign(profile, &keys, packages);
+                        profiles.save(&profiles_path)?;
+                        println!("{} {} file(s) and {} package(s) from {}", "✓ Removed".green(), keys.len(), packages.len(), profile.bold());
+                        println!("{}", "Run `kiwi push` to share the change with your other machines".dimmed());
+                    }
+                    ProfileAction::List => {
+                        let names = profiles.names();
+                        if names.is_empty() {
+                            println!("{}", "No profiles yet; every file and package syncs to every machine.".yellow());
+                            println!("Add some with `kiwi profile add <profile> <path>...`");
+                            return Ok(());
+                        }
+                        println!("{}", "Profiles:".blue().bold());
+                        for name in &names {
+                            let current = if profile.as_deref() == Some(name.as_str()) { " (this machine)" } else { "" };
+                            println!("\n{}{}", name.bold(), current.green());
+                            for (key, _) in profiles.files.iter().filter(|(_, p)| p.contains(name)) {
+                                println!("  {}", key);
+                            }
+                            for (package, _) in profiles.packages.iter().filter(|(_, p)| p.contains(name)) {
+                                println!("  {} {}", package, "(package)".dimmed());
+                            }
+                        }
+                        println!("\n{}", "Anything not listed syncs with every profile.".dimmed());
+                    }
+                }
+            },
+            Commands::Template { action } => {
+                let templates_dir = config.dotfiles_dir.join("templates");
+                match action {
+                    TemplateAction::Add { path } => {
+                        let key = Self::home_key(path)?;
+                        let template = templates_dir.join(&key);
+                        if template.exists() {
+                            return Err(KiwiError::Dotfiles(format!("{} is already a template: {}", key, template.display())));
+                        }
+                        let source = dirs::home_dir().unwrap_or_default().join(&key);
+                        if !source.is_file() {
+                            return Err(KiwiError::FileNotFound { path: source });
+                        }
+                        if let Some(parent) = template.parent() {
+                            std::fs::create_dir_all(parent)?;
+                        }
+                        std::fs::copy(&source, &template)?;
+                        println!("{} {} is now a template", "✓".green(), key);
+                        println!("Edit {} and run `kiwi template render`; `kiwi push` shares it", template.display());
+                    }
+                    TemplateAction::Remove { path } => {
+                        let key = Self::home_key(path)?;
+                        let template = templates_dir.join(&key);
+                        if !template.is_file() {
+                            return Err(KiwiError::Dotfiles(format!("{} isn't a template", key)));
+                        }
+                        std::fs::remove_file(&template)?;
+                        println!("{} {} is no longer rendered from a template", "✓".green(), key);
+                        let tracked = dotfiles.tracked_files()?.iter()
+                            .filter_map(|p| Self::home_key(&p.to_string_lossy()).ok())
+                            .any(|k| k == key);
+                        if !tracked {
+                            println!("Run `kiwi add {}` to keep syncing it as a plain file", path);
+                        }
+                    }
+                    TemplateAction::Render { dry_run } => {
+                        let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                        let summary = sync.render_templates(*dry_run)?;
+                        self.print_summary(&summary);
+                        if *dry_run {
+                            println!("{}", "Dry run - nothing was written".yellow());
+                        } else {
+                            println!("{} {} file(s) rendered", "✓".green(), summary.rendered.len());
+                        }
+                    }
+                    TemplateAction::Vars => {
+                        for (name, value) in TemplateContext::current(profile.as_deref()).fields() {
+                            println!("  {:<10} {}", format!(".{}", name).bold(), value);
+                        }
+                    }
+                }
+            },
+            Commands::Status { files_only } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+
+                let installed = if *files_only {
+                    None
+                } else {
+                    match homebrew.list_installed() {
+                        Ok(packages) => Some(packages),
+                        Err(e) => {
+                            eprintln!("{} {}", "Skipping package check:".yellow(), e);
+                            None
+                        }
+                    }
+                };
+                let mut status = sync.status(&dotfiles.tracked_files()?, installed.as_deref().unwrap_or_default()).await?;
+                if installed.is_none() {
+                    status.packages_not_installed.clear();
+                    status.packages_not_pushed.clear();
+                }
+                if self.json {
+                    return Self::print_json(&status);
+                }
+                self.print_status(&status);
+                let queued = queue.load()?;
+                if !queued.is_empty() {
+                    println!("{} {}", format!("{} push(es) queued while the server was unreachable;", queued.len()).yellow(), "run `kiwi push` to send them".dimmed());
+                }
+            },
+            Commands::Watch { debounce } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                self.watch(sync, &dotfiles, &hooks, &queue, Duration::from_secs((*debounce).max(1))).await?;
+            },
+            Commands::Diff { path, from, to, name_only } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+
+                let only = path.as_deref().map(|p| sync.key_for(p));
+                let diffs = sync.diff(&dotfiles.tracked_files()?, *from, *to, only.as_deref()).await?;
+                if self.json && *name_only {
+                    return Self::print_json(&diffs.iter().map(|file| &file.path).collect::<Vec<_>>());
+                }
+                if self.json {
+                    return Self::print_json(&diffs);
+                }
+                if diffs.is_empty() {
+                    println!("{}", "No differences".green());
+                    return Ok(());
+                }
+
+                let old_label = from.map_or_else(|| "local".to_string(), |r| format!("r{}", r));
+                let new_label = to.map_or_else(|| "remote".to_string(), |r| format!("r{}", r));
+                for file in &diffs {
+                    if *name_only {
+                        println!("{}", file.path);
+                    } else {
+                        diff::print_colored(&diff::unified(file, &old_label, &new_label));
+                    }
+                }
+                if !*name_only {
+                    println!("\n{} file(s) differ", diffs.len());
+                }
+            },
+            Commands::History { limit } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                let changes = sync.history(*limit).await?;
+                if self.json {
+                    return Self::print_json(&changes);
+                }
+                if changes.is_empty() {
+                    println!("{}", "Nothing has been pushed yet".dimmed());
+                    return Ok(());
+                }
+                for change in &changes {
+                    let (marker, what) = match change.kind.as_str() {
+                        "file_deleted" => ("-".red(), change.path.clone().unwrap_or_default()),
+                        "packages_updated" => ("~".yellow(), "Homebrew packages".to_string()),
+                        _ => ("~".yellow(), change.path.clone().unwrap_or_default()),
+                    };
+                    println!(
+                        "{} {} {} {}",
+                        format!("r{:<5}", change.revision).cyan(),
+                        Self::local_time(&change.updated_at).dimmed(),
+                        marker,
+                        what
+                    );
+                }
+            },
+            Commands::Rollback { revision, paths, dry_run, yes } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+
+                let only: Vec<_> = paths.iter().map(|p| sync.key_for(p)).collect();
+                let mut diffs = sync.diff(&dotfiles.tracked_files()?, None, Some(*revision), None).await?;
+                diffs.retain(|file| only.is_empty() || only.contains(&file.path));
+                let (restoring, newer): (Vec<_>, Vec<_>) = diffs.into_iter().partition(|file| file.new.is_some());
+                if self.json && (*dry_run || restoring.is_empty()) {
+                    return Self::print_json(&restoring);
+                }
+                if restoring.is_empty() {
+                    println!("{}", format!("Local files already match r{}", revision).green());
+                    return Ok(());
+                }
+
+                if !self.json {
+                    let label = format!("r{}", revision);
+                    for file in &restoring {
+                        match file.old {
+                            Some(_) => diff::print_colored(&diff::unified(file, "local", &label)),
+                            None => println!("{} {} {}", "+".green(), file.path, "(missing here; will be written)".dimmed()),
+                        }
+                    }
+                    if !newer.is_empty() {
+                        println!("{} {} file(s) weren't in r{} and will be left as they are", "→".blue(), newer.len(), revision);
+                    }
+                }
+                if *dry_run {
+                    println!("{}", "Dry run - nothing was written".yellow());
+                    return Ok(());
+                }
+
+                if !*yes {
+                    if !io::stdin().is_terminal() {
+                        return Err("Pass --yes to roll back without a terminal to confirm on".into());
+                    }
+                    let proceed = Confirm::with_theme(&ColorfulTheme::default())
+                        .with_prompt(format!("Roll back {} file(s) to r{}?", restoring.len(), revision))
+                        .default(false)
+                        .interact()
+                        .map_err(|e| format!("Failed to read answer: {}", e))?;
+                    if !proceed {
+                        println!("{}", "Nothing was changed".yellow());
+                        return Ok(());
+                    }
+                }
+
+                let overwriting: Vec<_> = restoring.iter()
+                    .filter(|file| file.old.is_some())
+                    .map(|file| file.path.clone())
+                    .collect();
+                if config.preferences.backup_before_change && !overwriting.is_empty() {
+                    let backup_dir = self.back_up(&overwriting)?;
+                    println!("{} Backed up {} file(s) to {}", "✓".green(), overwriting.len(), backup_dir.display());
+                }
+                let written = sync.roll_back(&restoring)?;
+                if self.json {
+                    return Self::print_json(&written);
+                }
+                println!("{} {} file(s) to r{}", "✓ Rolled back".green(), written.len(), revision);
+                println!("  Run `kiwi push` to roll the server and your other machines back too");
+            },
+            Commands::Export { format, output } => {
+                let home = dirs::home_dir()
+                    .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+                let output = output.clone().unwrap_or_else(|| {
+                    let stamp = chrono::Local::now().format("%Y%m%d-%H%M%S");
+                    PathBuf::from(format!("kiwi-export-{}.{}", stamp, format.extension()))
+                });
+                let export = Export::new(&home, &dotfiles.tracked_files()?, homebrew.saved());
+                let manifest = export.manifest(hostname());
+                export.write(*format, &output, &manifest)?;
+                if self.json {
+                    return Self::print_json(&manifest);
+                }
+                println!(
+                    "{} {} file(s) and {} package(s) to {}",
+                    "✓ Exported".green(),
+                    manifest.files.len(),
+                    manifest.packages.len(),
+                    output.display()
+                );
+                println!("{}", "Files are stored unencrypted; keep the archive somewhere private.".dimmed());
+            },
+            Commands::Import { source, yes, dry_run, no_push } => {
+                let source = import::Source::parse(source)?;
+                let staging = std::env::temp_dir().join(format!("kiwi-import-{}", std::process::id()));
+                let _ = std::fs::remove_dir_all(&staging);
+                let imported = self.import(&source, &staging, &dotfiles, &config, *yes, *dry_run);
+                let _ = std::fs::remove_dir_all(&staging);
+                if !imported? || *dry_run || *no_push {
+                    return Ok(());
+                }
+                match &sync {
+                    Some(sync) => match self.push(sync, &dotfiles, &hooks, &queue, false, false).await {
+                        Err(e) if e.is_offline() => self.queue_push(sync, &dotfiles, &queue)?,
+                        result => result?,
+                    },
+                    None => println!("{}", "Sync isn't configured, so nothing was pushed; run `kiwi push` once it is".yellow()),
+                }
+            },
+            Commands::Completion { shell, values } => Self::print_completion(*shell, *values)?,
+            Commands::Devices { action } => {
+                let sync = sync.as_ref().ok_or("Sync not configured. Please set sync_url and sync_token in config.")?;
+                let devices = sync.devices().await?;
+                match action {
+                    None | Some(DeviceAction::List) => {
+                        if self.json {
+                            return Self::print_json(&devices);
+                        }
+                        if devices.is_empty() {
+                            println!("{}", "No devices registered yet; run `kiwi init` or `kiwi restore` on each machine".dimmed());
+                            return Ok(());
+                        }
+                        for device in &devices {
+                            let current = config.device_id.as_deref() == Some(device.id.as_str());
+                            let last_seen = device.last_seen_at.as_deref().map_or_else(|| "never".to_string(), Self::local_time);
+                            let state = match &device.revoked_at {
+                                Some(revoked_at) => format!("revoked {}", Self::local_time(revoked_at)).red(),
+                                None => format!("last seen {}", last_seen).dimmed(),
+                            };
+                            println!(
+                                "{} {} {} {} {}",
+                                if current { "*".green() } else { " ".normal() },
+                                device.name.bold(),
+                                format!("({}, {})", device.hostname, device.os).dimmed(),
+                                device.id.dimmed(),
+                                state
+                            );
+                        }
+                    }
+                    Some(DeviceAction::Rename { device, name }) => {
+                        let device = Self::find_device(&devices, device)?;
+                        let renamed = sync.rename_device(&device.id, name).await?;
+                        if self.json {
+                            return Self::print_json(&renamed);
+                        }
+                        println!("{}", format!("✓ Renamed {} to {}", device.name, renamed.name).green());
+                    }
+                    Some(DeviceAction::Revoke { device, yes }) => {
+                        let device = Self::find_device(&devices, device)?;
+                        let current = config.device_id.as_deref() == Some(device.id.as_str());
+                        if !*yes {
+                            if !io::stdin().is_terminal() {
+                                return Err("Pass --yes to revoke a device without a terminal to confirm on".into());
+                            }
+                            let prompt = if current {
+                                format!("Revoke {} ({})? It's this machine, which will stop syncing, and the account's token will be replaced", device.name, device.hostname)
+                            } else {
+                                format!("Revoke {} ({})? The account's token will be replaced on this machine; your others will need it too", device.name, device.hostname)
+                            };
+                            let proceed = Confirm::with_theme(&ColorfulTheme::default())
+                                .with_prompt(prompt)
+                                .default(false)
+                                .interact()
+                                .map_err(|e| format!("Failed to read answer: {}", e))?;
+                            if !proceed {
+                                println!("{}", "Nothing was changed".yellow());
+                                return Ok(());
+                            }
+                        }
+
+                        let revoked = sync.revoke_device(&device.id).await?;
+                        // A machine that was just revoked shouldn't carry on with the new token
+                        if !current {
+                            config.set_token(revoked.token.clone())?;
+                            config.save()?;
+                        }
+                        if self.json {
+                            return Self::print_json(&revoked);
+                        }
+                        println!("{}", format!("✓ Revoked {} and replaced the account's token, so it can't sync any more", device.name).green());
+                        if !current {
+                            println!("{}", "✓ Saved the new token on this machine".green());
+                        }
+                        println!("  Set it on your other machines with `kiwi config set sync_token {}`", revoked.token);
+                    }
+                }
+            },
+            Commands::Clean { keep_days, dry_run } => {
+                let home = dirs::home_dir()
+                    .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+                let days = keep_days.unwrap_or(config.preferences.backup_retention_days);
+                let retention = Duration::from_secs(u64::from(days) * 24 * 60 * 60);
+                let leftovers = clean::find(&home, &std::env::temp_dir(), config.sync_url.as_deref(), retention)?;
+                let bytes = if *dry_run { leftovers.iter().map(|leftover| leftover.bytes).sum() } else { clean::remove(&leftovers)? };
+                if self.json {
+                    return Self::print_json(&serde_json::json!({ "removed": leftovers, "bytes": bytes, "dry_run": dry_run }));
+                }
+
+                if leftovers.is_empty() {
+                    println!("{}", format!("✓ Nothing to clean; backups from the last {} days are kept", days).green());
+                    return Ok(());
+                }
+                for leftover in &leftovers {
+                    println!(
+                        "  {:<6} {} {}",
+                        leftover.kind.label(),
+                        leftover.path.display(),
+                        format!("({})", HumanBytes(leftover.bytes)).dimmed()
+                    );
+                }
+                if *dry_run {
+                    println!("{}", format!("Dry run - {} would be reclaimed", HumanBytes(bytes)).yellow());
+                } else {
+                    println!("{}", format!("✓ Removed {} item(s), reclaiming {}", leftovers.len(), HumanBytes(bytes)).green());
+                }
+            },
+            Commands::Whoami => {
+                let sync = match &sync {
+                    Some(sync) => sync,
+                    None => {
+                        println!("{}", "Not signed in; run `kiwi init` to sign in".yellow());
+                        return Ok(());
+                    }
+                };
+                if let Some(backend) = sync.backend() {
+                    println!("Syncing with {}, which has no account", backend.describe());
+                    return Ok(());
+                }
+                let account = sync.account().await?;
+                let server = config.server_url();
+                if self.json {
+                    return Self::print_json(&serde_json::json!({ "server": server, "account": account }));
+                }
+
+                match &account.username {
+                    Some(username) => println!("{} {}", account.email.bold(), format!("(@{})", username).dimmed()),
+                    None => println!("{}", account.email.bold()),
+                }
+                println!("  {:<8} {}", "server", server);
+                let token = match account.token.kind.as_str() {
+                    "api" => "API token".to_string(),
+                    "session" => "browser session token".to_string(),
+                    kind => format!("{} token", kind),
+                };
+                let access = if account.token.scope == "full" { "full access".to_string() } else { format!("{} only", account.token.scope) };
+                let expiry = match &account.token.expires_at {
+                    Some(expires_at) => format!("expires {}", Self::local_time(expires_at)),
+                    None => "doesn't expire".to_string(),
+                };
+                println!("  {:<8} {}, {}, {}", "token", token, access, expiry);
+                match &account.device {
+                    Some(device) => println!("  {:<8} {} {}", "device", device.name, format!("({}, {})", device.hostname, device.os).dimmed()),
+                    None => println!("  {:<8} {}", "device", "not registered; run `kiwi init` to register this machine".dimmed()),
+                }
+                match &account.tenant {
+                    Some(tenant) => println!("  {:<8} {} {}", "tier", account.tier, format!("(tenant {})", tenant).dimmed()),
+                    None => println!("  {:<8} {}", "tier", account.tier),
+                }
+                if let Some(ends) = &account.trial_expires_at {
+                    println!("  {:<8} {}", "trial", format!("ends {}", Self::local_time(ends)).yellow());
+                }
+                let used = account.storage.used_bytes;
+                match account.storage.limit_bytes {
+                    Some(limit) if limit > 0 => {
+                        let percent = used as f64 / limit as f64 * 100.0;
+                        let usage = format!("{} of {} ({:.0}%)", HumanBytes(used), HumanBytes(limit), percent);
+                        println!("  {:<8} {}", "storage", if percent >= 90.0 { usage.yellow() } else { usage.normal() });
+                    }
+                    _ => println!("  {:<8} {} {}", "storage", HumanBytes(used), "(no limit)".dimmed()),
+                }
+            },
+            Commands::Add { path, alias, symlink, no_backup } => {
+                println!("{} {}", "Adding file:".blue().bold(), path);
+                
+                let path = PathBuf::from(path);
+                if !*no_backup && path.is_file() {
+                    let backup_path = path.with_extension("backup");
+                    println!("{} {}", "Creating backup:".yellow(), backup_path.display());
+                    std::fs::copy(&path, &backup_path)?;
+                }
+                
+                dotfiles.add(path.as_path(), alias.clone())?;
+
+                if path.is_dir() {
+                    let home = dirs::home_dir()
+                        .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+                    let files = Dotfiles::expand(&path, &KiwiIgnore::load(&home)?)?;
+                    println!("{} {} file(s) under {} will sync (see .kiwiignore to exclude some)", "→".blue(), files.len(), path.display());
+                }
+                
+                if *symlink {
+                    println!("{}", "Creating symlink...".yellow());
+                    // TODO: Implement symlink creation
+                }
+                
+                println!("{}", "✓ File added successfully".green());
+            },
+            Commands::Remove { path, keep_local, delete: _, force } => {
+                println!("{} {}", "Removing file:".blue().bold(), path);
+                
+                let path = PathBuf::from(path);
+                let delete_local = !*keep_local && path.exists();
+                
+                if delete_local && !*force {
+                    let what = if path.is_dir() { "directory and everything in it" } else { "file" };
+                    print!("{}", format!("Are you sure you want to delete the {}? [y/N]: ", what).red());
+                    io::stdout().flush()?;
+                    let mut input = String::new();
+                    io::stdin().read_line(&mut input)?;
+                    if !input.trim().eq_ignore_ascii_case("y") {
+                        println!("{}", "Deletion cancelled (use --keep-local to only stop syncing)".yellow());
+                        return Ok(());
+                    }
+                }
+
+                // Untrack first; it needs the file to resolve the path
+                dotfiles.remove(path.as_path())?;
+
+                if delete_local {
+                    if path.is_dir() {
+                        std::fs::remove_dir_all(&path)?;
+                    } else {
+                        std::fs::remove_file(&path)?;
+                    }
+                    println!("{}", "File deleted".yellow());
+                }
+                println!("{}", "✓ File removed successfully".green());
+                println!("{}", "Run `kiwi push` to remove it from the server too".dimmed());
+            },
+            Commands::Update { all: update_all, package, force, changelog } => {
+                println!("{}", "Updating packages...".blue().bold());
+                
+                if *force {
+                    println!("{}", "Force updating (skipping checks)...".yellow());
+                }
+                
+                if *update_all {
+                    println!("{}", "Updating all packages...".yellow());
+                    homebrew.update(None)?;
+                } else if let Some(pkg) = package {
+                    println!("{} {}", "Updating package:".yellow(), pkg);
+                    homebrew.update(Some(pkg))?;
+                }
+                
+                if *changelog {
+                    println!("{}", "\nFetching changelogs...".blue());
+                    // TODO: Implement changelog fetching
+                }
+                
+                println!("{}", "✓ Update complete".green());
+            },
+            Commands::Install { package, no_deps, tap, version } => {
+                println!("{} {}", "Installing package:".blue().bold(), package);
+                
+                if let Some(tap_name) = tap {
+                    println!("{} {}", "Using tap:".yellow(), tap_name);
+                    // TODO: Implement tap handling
+                }
+                
+                if let Some(ver) = version {
+                    println!("{} {}", "Installing version:".yellow(), ver);
+                    // TODO: Implement version-specific installation
+                }
+                
+                if *no_deps {
+                    println!("{}", "Installing without dependencies...".yellow());
+                    // TODO: Implement no-deps installation
+                }
+                
+                homebrew.install(package)?;
+                println!("{}", "✓ Installation complete".green());
+            },
+            Commands::List { type_, detailed } => {
+                if self.json {
+                    let mut listing = serde_json::Map::new();
+                    if matches!(type_, ListType::Dotfiles | ListType::All) {
+                        listing.insert("dotfiles".to_string(), serde_json::to_value(dotfiles.list()?)?);
+                    }
+                    if matches!(type_, ListType::Packages | ListType::All) {
+                        listing.insert("packages".to_string(), serde_json::to_value(homebrew.list_installed()?)?);
+                    }
+                    return Self::print_json(&listing);
+                }
+
+
+                println!("{}", "Listing items...".blue().bold());
+                match type_ {
+                    ListType::Dotfiles => {
+                        println!("{}", "Managed dotfiles:".yellow());
+                        let dotfiles = dotfiles.list()?;
+                        for dotfile in dotfiles {
+                            if *detailed {
+                                println!("  Path: {}", dotfile.path.display());
+                                // TODO: Add more detailed information
+                            } else {
+                                println!("  {}", dotfile.path.display());
+                            }
+                        }
+                    },
+                    ListType::Packages => {
+                        println!("{}", "Installed packages:".yellow());
+                        let packages = homebrew.list_installed()?;
+                        for package in packages {
+                            if *detailed {
+                                let version = package.version.unwrap_or_else(|| "latest".to_string());
+                                println!("  {} ({})", package.name, version);
+                                // TODO: Add more package details
+                            } else {
+                                println!("  {}", package.name);
+                            }
+                        }
+                    },
+                    ListType::All => {
+                        println!("{}", "Listing all items...".yellow());
+                        let dotfiles = dotfiles.list()?;
+                        let packages = homebrew.list_installed()?;
+                        
+                        println!("\n{}", "Dotfiles:".blue());
+                        for dotfile in dotfiles {
+                            if *detailed {
                                 println!("  Path: {}", dotfile.path.display());
                                 // TODO: Add more detailed information
                             } else {
@@ -498,7 +1768,32 @@ impl Cli {
                     },
                 }
             },
-            Commands::Config { key, value, reset, export, import } => {
+            Commands::Config { action, key, value, reset, export, import } => {
+                match action {
+                    Some(ConfigAction::Get { key }) => return Self::print_setting(&config, key),
+                    Some(ConfigAction::Set { key, value }) => {
+                        config.set(key, value.clone())?;
+                        println!("{} {} = {}", "✓ Set".green(), key, value);
+                        return Ok(());
+                    }
+                    Some(ConfigAction::List) => {
+                        let keys = Config::KEYS.iter().copied().chain(config.custom_settings.keys().map(String::as_str));
+                        for key in keys {
+                            // Never print the token
+                            let value = match key {
+                                "sync_token" => config.sync_token.as_ref().map(|_| "(saved)".to_string()),
+                                _ => config.get(key),
+                            };
+                            println!("{} = {}", key.yellow(), value.unwrap_or_default());
+                        }
+                        return Ok(());
+                    }
+                    Some(ConfigAction::Path) => {
+                        println!("{}", Config::config_path()?.display());
+                        return Ok(());
+                    }
+                    None => {}
+                }
                 println!("{}", "Managing configuration...".blue().bold());
                 
                 if *reset {
@@ -510,16 +1805,26 @@ impl Cli {
                 }
                 
                 if *export {
-                    let config_json = serde_json::to_string_pretty(&config)?;
-                    std::fs::write("kiwi-config.json", config_json)?;
-                    println!("{}", "✓ Configuration exported to kiwi-config.json".green());
+                    let contents = toml::to_string_pretty(&config)
+                        .map_err(|e| KiwiError::Config(format!("Failed to serialize config: {}", e)))?;
+                    std::fs::write("kiwi-config.toml", contents)?;
+                    println!("{}", "✓ Configuration exported to kiwi-config.toml".green());
                     return Ok(());
                 }
                 
                 if let Some(import_path) = import {
                     println!("{} {}", "Importing configuration from:".yellow(), import_path.display());
-                    let config_json = std::fs::read_to_string(import_path)?;
-                    config = serde_json::from_str(&config_json)?;
+                    let contents = std::fs::read_to_string(import_path)?;
+                    // Exports from before config.toml are JSON
+                    let mut imported: Config = match import_path.extension().and_then(|ext| ext.to_str()) {
+                        Some("json") => serde_json::from_str(&contents)?,
+                        _ => toml::from_str(&contents)
+                            .map_err(|e| KiwiError::Config(format!("Invalid config file {}: {}", import_path.display(), e)))?,
+                    };
+                    if let Some(token) = imported.sync_token.take() {
+                        imported.set_token(token)?;
+                    }
+                    config = imported;
                     config.save()?;
                     println!("{}", "✓ Configuration imported".green());
                     return Ok(());
@@ -531,48 +1836,189 @@ impl Cli {
                         config.set(k, v.clone())?;
                         println!("{}", "✓ Configuration updated".green());
                     },
-                    (Some(k), None) => {
-                        if let Some(v) = config.get(k) {
-                            println!("{} = {}", k.yellow(), v);
-                        } else {
-                            println!("{} {}", "Config key not found:".red(), k);
-                        }
-                    },
+                    (Some(k), None) => Self::print_setting(&config, k)?,
                     (None, _) => {
                         println!("{}", "Please specify a config key".red());
                     },
                 }
             },
+            Commands::Remote { action } => match action {
+                RemoteAction::Add { name, url, token } => {
+                    let token = match token {
+                        Some(token) => token.clone(),
+                        None if io::stdin().is_terminal() => Password::with_theme(&ColorfulTheme::default())
+                            .with_prompt(format!("API token for {}", url))
+                            .interact()
+                            .map_err(|e| format!("Failed to read token: {}", e))?,
+                        None => return Err("Pass the server's API token with --token or KIWI_REMOTE_TOKEN".into()),
+                    };
+                    let store = config.add_remote(name, url, &token)?;
+                    println!("{} {} ({})", "✓ Added remote".green(), name.bold(), url);
+                    match store {
+                        CredentialStore::Keychain => println!("🔐 Saved its token in the OS keychain"),
+                        CredentialStore::EncryptedFile => println!("🔐 Saved its token in ~/.kiwi/credentials.enc"),
+                    }
+                    println!("{}", "Pushes are copied to it from now on; push now to give it everything.".dimmed());
+                }
+                RemoteAction::Remove { name } => {
+                    config.remove_remote(name)?;
+                    println!("{} {}", "✓ Removed remote".green(), name.bold());
+                }
+                RemoteAction::List => {
+                    if let Some(url) = &config.sync_url {
+                        let name = match sync.as_ref().and_then(Sync::backend) {
+                            Some(Backend::Git(_)) => "git",
+                            Some(Backend::Local(_)) => "local",
+                            None => "server",
+                        };
+                        println!("{} {} {}", name.bold(), url, "(pushed to and pulled from)".dimmed());
+                    }
+                    for remote in &config.remotes {
+                        let note = match config.remote_token(remote)? {
+                            Some(_) => "(backup)".dimmed(),
+                            None => "(backup; no token saved, so it's skipped)".yellow(),
+                        };
+                        println!("{} {} {}", remote.name.bold(), remote.url, note);
+                    }
+                    if config.remotes.is_empty() {
+                        println!("{}", "No backup servers; add one with `kiwi remote add <name> <url>`".dimmed());
+                    }
+                }
+            },
+            Commands::Schedule { action } => {
+                let scheduler = Scheduler::detect()?;
+                match action {
+                    ScheduleAction::Install { every } => {
+                        let files = scheduler.install(&std::env::current_exe()?, *every)?;
+                        println!(
+                            "{} every {} with {}",
+                            "✓ Scheduled kiwi pull".green(),
+                            schedule::format_interval(*every),
+                            scheduler.name()
+                        );
+                        for file in &files {
+                            println!("  {}", file.display().to_string().dimmed());
+                        }
+                        println!("{}", "Conflicts are left for you to settle with `kiwi pull`; output goes to ~/.kiwi/schedule.log".dimmed());
+                    }
+                    ScheduleAction::Status => {
+                        let status = scheduler.status()?;
+                        if self.json {
+                            return Self::print_json(&status);
+                        }
+                        if !status.installed {
+                            println!("{}", "No scheduled pulls; set them up with `kiwi schedule install`".dimmed());
+                            return Ok(());
+                        }
+                        let every = status.every.as_deref().unwrap_or("an unknown interval");
+                        if status.active {
+                            println!("{} every {} ({})", "✓ Pulling".green(), every, status.scheduler);
+                        } else {
+                            println!(
+                                "{} every {}, but {} hasn't loaded it; run `kiwi schedule install` again",
+                                "Scheduled".yellow(),
+                                every,
+                                status.scheduler
+                            );
+                        }
+                        for file in &status.files {
+                            println!("  {}", file.display().to_string().dimmed());
+                        }
+                    }
+                    ScheduleAction::Remove => {
+                        if scheduler.remove()? {
+                            println!("{}", "✓ Removed the pull schedule".green());
+                        } else {
+                            println!("{}", "No scheduled pulls to remove".dimmed());
+                        }
+                    }
+                }
+            },
+            Commands::SelfUpdate { channel, check, yes } => {
+                let channel = channel.unwrap_or(config.update_channel);
+                let current = env!("CARGO_PKG_VERSION");
+                let release = update::check(config.server_url(), channel).await?;
+                let available = release.as_ref().map_or(false, |release| release.is_newer());
+                let mut status = UpdateCheck {
+                    channel,
+                    current: current.to_string(),
+                    latest: release.as_ref().map(|release| release.version.clone()),
+                    available,
+                    installed: false,
+                };
+
+                let release = match release {
+                    Some(release) if available => release,
+                    _ => {
+                        if self.json {
+                            return Self::print_json(&status);
+                        }
+                        match &status.latest {
+                            None => println!("{}", format!("Nothing is published on the {} channel yet", channel.as_str()).yellow()),
+                            Some(_) => println!("{}", format!("✓ kiwi {} is up to date ({})", current, channel.as_str()).green()),
+                        }
+                        return Ok(());
+                    }
+                };
+                if !self.json {
+                    println!("{} {} → {} ({})", "Update available:".blue().bold(), current, release.version.bold(), channel.as_str());
+                    if let Some(notes) = release.notes.as_deref().filter(|notes| !notes.trim().is_empty()) {
+                        println!("{}", notes.trim().dimmed());
+                    }
+                }
+                if *check {
+                    return if self.json { Self::print_json(&status) } else { Ok(()) };
+                }
+
+                if !*yes {
+                    if !io::stdin().is_terminal() {
+                        return Err("Pass --yes to update without a terminal to confirm on".into());
+                    }
+                    let proceed = Confirm::with_theme(&ColorfulTheme::default())
+                        .with_prompt(format!("Install kiwi {}?", release.version))
+                        .default(true)
+                        .interact()
+                        .map_err(|e| format!("Failed to read answer: {}", e))?;
+                    if !proceed {
+                        println!("{}", "Nothing was changed".yellow());
+                        return Ok(());
+                    }
+                }
+
+                let asset = release.asset()?;
+                let exe = update::current_exe()?;
+                let binary = update::download(asset, &Progress::new(self.shows_progress(&config))).await?;
+                update::install(&binary, &exe)?;
+                status.installed = true;
+                if self.json {
+                    return Self::print_json(&status);
+                }
+                println!("{} kiwi {} ({})", "✓ Updated to".green(), release.version, exe.display());
+            },
             Commands::Doctor { fix, report } => {
                 println!("{}", "🏥 Running system health check...".blue().bold());
                 let spinner = ProgressBar::new_spinner();
                 spinner.set_style(spinner_style);
 
-                // Check configuration
                 spinner.set_message("Checking configuration...");
-                let config_issues = self.check_configuration(&config)?;
-
-                // Check Homebrew
-                spinner.set_message("Checking Homebrew installation...");
-                let homebrew_issues = self.check_homebrew(&homebrew)?;
-
-                // Check dotfiles
-                spinner.set_message("Checking dotfiles...");
-                let dotfile_issues = self.check_dotfiles(&dotfiles)?;
-
-                // Check sync setup
-                spinner.set_message("Checking sync configuration...");
-                let sync_issues = self.check_sync(sync.as_ref()).await?;
-
+                let config_issues = doctor::check_config(&config)?;
+                spinner.set_message("Checking the keychain...");
+                let keychain_issues = doctor::check_keychain();
+                spinner.set_message("Checking file permissions...");
+                let permission_issues = doctor::check_permissions(&config, &dotfiles)?;
+                spinner.set_message("Checking Homebrew...");
+                let homebrew_issues = doctor::check_package_manager(&homebrew);
+                spinner.set_message("Checking the server...");
+                let server_issues = doctor::check_server(&config, sync.as_ref()).await;
                 spinner.finish_and_clear();
 
                 let all_issues = vec![
                     ("Configuration", config_issues),
+                    ("Keychain", keychain_issues),
+                    ("Permissions", permission_issues),
                     ("Homebrew", homebrew_issues),
-                    ("Dotfiles", dotfile_issues),
-                    ("Sync", sync_issues),
+                    ("Server", server_issues),
                 ];
-
                 let total_issues: usize = all_issues.iter()
                     .map(|(_, issues)| issues.len())
                     .sum();
@@ -581,148 +2027,706 @@ impl Cli {
                     println!("{}", "✅ All systems operational!".green().bold());
                 } else {
                     println!("\n{} {} issue(s) found:", "⚠️".yellow(), total_issues);
-                    
                     for (category, issues) in &all_issues {
-                        if !issues.is_empty() {
-                            println!("\n{} {}:", "→".blue(), category);
-                            for (i, issue) in issues.iter().enumerate() {
-                                println!("  {}. {}", i + 1, issue);
-                                
-                                if *fix {
-                                    if let Some(fix_msg) = self.try_fix_issue(category, issue, &config).await? {
-                                        println!("     {}", fix_msg.green());
-                                    }
+                        if issues.is_empty() {
+                            continue;
+                        }
+                        println!("\n{} {}:", "→".blue(), category);
+                        for (i, issue) in issues.iter().enumerate() {
+                            println!("  {}. {}", i + 1, issue.problem);
+                            println!("     {} {}", "Fix:".dimmed(), issue.fix);
+                            if let (true, Some(repair)) = (*fix, &issue.repair) {
+                                match repair.apply() {
+                                    Ok(done) => println!("     {} {}", "✓".green(), done),
+                                    Err(e) => println!("     {} {}", "✗".red(), e),
                                 }
                             }
                         }
                     }
 
-                    if *report {
-                        self.generate_health_report(&all_issues)?;
-                        println!("\n{}", "📋 Health report generated: kiwi-health-report.md".green());
+                    let repairable = all_issues.iter().flat_map(|(_, issues)| issues).any(|issue| issue.repair.is_some());
+                    if repairable && !*fix {
+                        println!("\n{}", "Run with --fix to repair what can be repaired automatically".yellow());
                     }
+                }
 
-                    if !*fix {
-                        println!("\n{}", "Run with --fix to attempt automatic repairs".yellow());
-                    }
+                if *report {
+                    doctor::write_report(&all_issues, Path::new("kiwi-health-report.md"))?;
+                    println!("\n{}", "📋 Health report generated: kiwi-health-report.md".green());
                 }
             },
         }
         Ok(())
     }
 
-    fn check_configuration(&self, config: &Config) -> Result<Vec<String>> {
-        let mut issues = Vec::new();
-        
-        if config.dotfiles_dir.to_string_lossy().is_empty() {
-            issues.push("Dotfiles directory not configured".to_string());
+    fn print_summary(&self, summary: &SyncSummary) {
+        if let Some(source) = &summary.source {
+            println!("{} {}", "The server can't be reached; pulled from backup".yellow(), source.bold());
+        }
+        for path in &summary.added {
+            println!("  {} {}", "+".green(), path);
+        }
+        for path in summary.updated.iter().filter(|path| !summary.conflicts.contains(path)) {
+            println!("  {} {}", "~".yellow(), path);
+        }
+        for path in &summary.removed {
+            println!("  {} {}", "-".red(), path);
+        }
+        for path in &summary.rendered {
+            println!("  {} {} (rendered)", "»".cyan(), path);
+        }
+        for path in &summary.conflicts {
+            let outcome = if summary.updated.contains(path) { "took the server's copy" } else { "left out" };
+            println!("  {} {} (changed here and on the server; {})", "C".red(), path, outcome);
+        }
+        for finding in &summary.secrets {
+            println!("  {} {}:{} looks like a {} ({})", "⚠".red(), finding.path, finding.line, finding.rule, finding.fingerprint.dimmed());
+        }
+        for (path, reason) in &summary.skipped {
+            println!("  {} {} ({})", "!".yellow(), path, reason);
+        }
+        if !summary.has_changes() {
+            println!("  {}", "Everything up to date".dimmed());
+        }
+        if !summary.mirrored.is_empty() {
+            println!("  {} {}", "Copied to".dimmed(), summary.mirrored.join(", ").dimmed());
+        }
+        for (name, reason) in &summary.mirror_failures {
+            println!("  {} {} ({})", "Could not copy to".yellow(), name, reason);
+        }
+    }
+
+    fn print_status(&self, status: &SyncStatus) {
+        println!("{} {}", "On remote revision".blue().bold(), status.revision);
+        if status.is_clean() {
+            println!("{}", "✓ Everything up to date".green());
+            return;
+        }
+
+        let sections = [
+            ("Modified locally (run `kiwi push`):", &status.modified_locally, "M".yellow()),
+            ("Newer remotely (run `kiwi pull`):", &status.newer_remotely, "R".cyan()),
+            ("Changed on both sides:", &status.conflicting, "C".red()),
+            ("Not pushed yet:", &status.not_pushed, "+".green()),
+            ("Missing locally:", &status.missing, "D".red()),
+            ("On the server but not tracked here:", &status.untracked, "?".dimmed()),
+            ("Packages not installed here:", &status.packages_not_installed, "↓".cyan()),
+            ("Packages not on the server:", &status.packages_not_pushed, "↑".yellow()),
+        ];
+        for (title, paths, marker) in sections {
+            if paths.is_empty() {
+                continue;
+            }
+            println!("\n{}", title);
+            for path in paths {
+                println!("  {} {}", marker, path);
+            }
+        }
+    }
+
+    /// Runs a hook unless hooks are turned off. Only a failing pre-push hook
+    /// is an error; the others follow changes that are already made, so
+    /// they just warn.
+    fn run_hook(&self, hooks: &Hooks, hook: Hook, changed: &[String]) -> Result<()> {
+        if self.no_hooks {
+            return Ok(());
+        }
+        match hooks.run(hook, changed) {
+            Ok(_) => Ok(()),
+            Err(e) if hook == Hook::PrePush => Err(e),
+            Err(e) => {
+                eprintln!("{} {}", "⚠".yellow(), e);
+                Ok(())
+            }
+        }
+    }
+
+    /// Returns the files a pull wrote, for hooks.
+    fn changed_files(summary: &SyncSummary) -> Vec<String> {
+        let changed: BTreeSet<_> = summary.added.iter()
+            .chain(&summary.updated)
+            .chain(&summary.rendered)
+            .cloned()
+            .collect();
+        changed.into_iter().collect()
+    }
+
+    fn print_setting(config: &Config, key: &str) -> Result<()> {
+        match config.get(key) {
+            Some(value) => println!("{} = {}", key.yellow(), value),
+            None => println!("{} {}", "Config key not found:".red(), key),
+        }
+        Ok(())
+    }
+
+    fn print_json<T: serde::Serialize + ?Sized>(value: &T) -> Result<()> {
+        println!("{}", serde_json::to_string_pretty(value)?);
+        Ok(())
+    }
+
+    /// Formats a timestamp from the server in local time, or leaves it as is
+    /// if it can't be read.
+    /// Finds a device by its ID, or by a name or hostname only one device
+    /// has.
+    fn find_device<'a>(devices: &'a [Device], query: &str) -> Result<&'a Device> {
+        if let Some(device) = devices.iter().find(|device| device.id == query) {
+            return Ok(device);
         }
-        
-        if !config.dotfiles_dir.exists() {
-            issues.push("Dotfiles directory does not exist".to_string());
+        let matches: Vec<_> = devices.iter().filter(|device| device.name == query || device.hostname == query).collect();
+        match matches.as_slice() {
+            [device] => Ok(device),
+            [] => Err(KiwiError::InvalidCommand(format!("No device named {}; `kiwi devices` lists them", query))),
+            _ => Err(KiwiError::InvalidCommand(format!(
+                "{} devices are named {}; give the ID instead: {}",
+                matches.len(),
+                query,
+                matches.iter().map(|device| device.id.as_str()).collect::<Vec<_>>().join(", ")
+            ))),
         }
-        
-        // Check for required configuration values
-        if config.sync_url.is_none() {
-            issues.push("Sync URL not configured".to_string());
+    }
+
+    fn local_time(timestamp: &str) -> String {
+        chrono::DateTime::parse_from_rfc3339(timestamp)
+            .map(|time| time.with_timezone(&chrono::Local).format("%Y-%m-%d %H:%M").to_string())
+            .unwrap_or_else(|_| timestamp.to_string())
+    }
+
+    fn summary_counts(summary: &SyncSummary) -> String {
+        let mut counts = format!(
+            "{} added, {} updated, {} removed, {} unchanged, {} packages",
+            summary.added.len(),
+            summary.updated.len(),
+            summary.removed.len(),
+            summary.unchanged,
+            summary.packages.len(),
+        );
+        if !summary.rendered.is_empty() {
+            counts.push_str(&format!(", {} rendered", summary.rendered.len()));
         }
-        
-        if config.sync_token.is_none() {
-            issues.push("Sync token not configured".to_string());
+        if summary.excluded > 0 {
+            counts.push_str(&format!(", {} in other profiles", summary.excluded));
         }
-        
-        Ok(issues)
+        counts
     }
 
-    fn check_homebrew(&self, homebrew: &Homebrew) -> Result<Vec<String>> {
-        let mut issues = Vec::new();
-        
-        // Check if Homebrew is installed
-        if !std::path::Path::new("/usr/local/bin/brew").exists() 
-            && !std::path::Path::new("/opt/homebrew/bin/brew").exists() {
-            issues.push("Homebrew is not installed".to_string());
+    /// Returns the server's name for a file or directory given to `kiwi
+    /// profile` or `kiwi template`, which needn't exist on this machine.
+    fn home_key(path: &str) -> Result<String> {
+        let home = dirs::home_dir()
+            .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+        let expanded = match path.strip_prefix("~/") {
+            Some(rest) => home.join(rest),
+            None => std::env::current_dir()?.join(path),
+        };
+        let expanded = expanded.canonicalize().map(deploy::unstore).unwrap_or(expanded);
+        let home = home.canonicalize().unwrap_or(home);
+        crate::sync::relative_key(&home, &expanded)
+            .ok_or_else(|| KiwiError::Dotfiles(format!("{} is outside the home directory", path)))
+    }
+
+    /// Registers this machine with the server unless it already is,
+    /// remembering its ID. Failing to register isn't fatal.
+    async fn register_device(&self, sync: &Sync, config: &mut Config, name: Option<&str>, spinner: &ProgressBar) -> Result<()> {
+        if config.device_id.is_some() || sync.backend().is_some() {
+            return Ok(());
         }
-        
-        // Check if packages.json exists and is valid
-        if let Err(_) = homebrew.list_installed() {
-            issues.push("Unable to read Homebrew packages".to_string());
+        let hostname = hostname();
+        let name = name.map_or_else(|| hostname.clone(), |name| name.to_string());
+        match sync.register_device(&name, std::env::consts::OS, &hostname).await {
+            Ok(device) => {
+                config.set("device_id", device.id)?;
+                spinner.println(format!("{} Registered device {}", "✓".green(), device.name));
+            }
+            Err(e) => spinner.println(format!("{} {}", "Could not register this device:".yellow(), e)),
         }
-        
-        Ok(issues)
+        Ok(())
     }
 
-    fn check_dotfiles(&self, dotfiles: &Dotfiles) -> Result<Vec<String>> {
-        let mut issues = Vec::new();
-        
-        // Check if dotfiles.json exists and is valid
-        if let Ok(files) = dotfiles.list() {
-            for file in files {
-                if !file.path.exists() {
-                    issues.push(format!("Dotfile not found: {}", file.path.display()));
+    /// Copies files a restore or rollback is about to overwrite into
+    /// ~/.kiwi/backups/<timestamp>, returning that directory.
+    fn back_up(&self, keys: &[String]) -> Result<PathBuf> {
+        let home = dirs::home_dir()
+            .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+        let backup_dir = home
+            .join(".kiwi/backups")
+            .join(chrono::Local::now().format("%Y%m%d-%H%M%S").to_string());
+        for key in keys {
+            let target = backup_dir.join(key);
+            if let Some(parent) = target.parent() {
+                std::fs::create_dir_all(parent)?;
+            }
+            std::fs::copy(home.join(key), &target)?;
+        }
+        Ok(backup_dir)
+    }
+
+    /// Copies the files from an import's source into the home directory and
+    /// tracks them, after the user has checked where each one goes. Returns
+    /// whether anything was imported.
+    fn import(&self, source: &import::Source, staging: &Path, dotfiles: &Dotfiles, config: &Config, yes: bool, dry_run: bool) -> Result<bool> {
+        let home = dirs::home_dir()
+            .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+        if let import::Source::Git(url) = source {
+            println!("{} {}", "Cloning".blue().bold(), url);
+        }
+        let root = source.fetch(staging)?;
+        let mut mappings = import::plan(&root)?;
+        if mappings.is_empty() {
+            return Err(KiwiError::Dotfiles(format!("No files to import in {}", root.display())));
+        }
+
+        let interactive = io::stdin().is_terminal() && !yes;
+        if interactive {
+            match Editor::new().edit(&import::to_text(&mappings))
+                .map_err(|e| format!("Failed to open the editor: {}", e))? {
+                Some(text) => import::apply_text(&mut mappings, &text)?,
+                None => {
+                    println!("{}", "Import cancelled".yellow());
+                    return Ok(false);
                 }
             }
+        } else if !yes && !dry_run {
+            return Err("Pass --yes to import with the suggested paths without a terminal to confirm on".into());
+        }
+
+        let (mapped, skipped): (Vec<Mapping>, Vec<Mapping>) = mappings.into_iter().partition(|m| m.to.is_some());
+        if mapped.is_empty() {
+            println!("{}", "Nothing to import".yellow());
+            return Ok(false);
+        }
+        let mut overwriting = Vec::new();
+        for mapping in &mapped {
+            let to = mapping.to.as_deref().unwrap_or_default();
+            match std::fs::read(home.join(to)) {
+                Ok(existing) if existing == std::fs::read(&mapping.source)? => {
+                    println!("{} ~/{} {}", "=".dimmed(), to, "(already the same)".dimmed());
+                }
+                Ok(_) => {
+                    println!("{} ~/{} {}", "~".yellow(), to, format!("(overwrites; from {})", mapping.from).dimmed());
+                    overwriting.push(to.to_string());
+                }
+                Err(_) => println!("{} ~/{} {}", "+".green(), to, format!("(from {})", mapping.from).dimmed()),
+            }
+        }
+        if !skipped.is_empty() {
+            println!("{} {} file(s) left out", "→".blue(), skipped.len());
+        }
+        if dry_run {
+            println!("{}", "Dry run - nothing was written".yellow());
+            return Ok(false);
+        }
+        if interactive {
+            let proceed = Confirm::with_theme(&ColorfulTheme::default())
+                .with_prompt(format!("Import {} file(s)?", mapped.len()))
+                .default(true)
+                .interact()
+                .map_err(|e| format!("Failed to read answer: {}", e))?;
+            if !proceed {
+                println!("{}", "Nothing was changed".yellow());
+                return Ok(false);
+            }
+        }
+
+        if config.preferences.backup_before_change && !overwriting.is_empty() {
+            let backup_dir = self.back_up(&overwriting)?;
+            println!("{} Backed up {} file(s) to {}", "✓".green(), overwriting.len(), backup_dir.display());
+        }
+        // Files in a tracked directory are synced with it already
+        let tracked: Vec<_> = dotfiles.list()?.into_iter().map(|dotfile| dotfile.path).collect();
+        for mapping in &mapped {
+            let target = home.join(mapping.to.as_deref().unwrap_or_default());
+            if let Some(parent) = target.parent() {
+                std::fs::create_dir_all(parent)?;
+            }
+            std::fs::copy(&mapping.source, &target)?;
+            let path = deploy::unstore(target.canonicalize()?);
+            if tracked.iter().any(|tracked| path.starts_with(tracked)) {
+                continue;
+            }
+            if let Err(e) = dotfiles.add(&path, None) {
+                println!("{} {}: {}", "Could not track".yellow(), path.display(), e);
+            }
+        }
+        println!("{} {} file(s)", "✓ Imported".green(), mapped.len());
+        Ok(true)
+    }
+
+    /// Installs the packages saved by the last pull that aren't installed.
+    fn install_packages(&self, homebrew: &mut Homebrew, profiles: &Profiles, profile: Option<&str>, spinner: &ProgressBar) -> Result<()> {
+        let wanted: Vec<_> = homebrew.saved_packages()
+            .into_iter()
+            .filter(|name| profiles.includes_package(name, profile))
+            .collect();
+        if wanted.is_empty() {
+            return Ok(());
+        }
+        spinner.set_message("Checking Homebrew packages...");
+        let installed: Vec<_> = homebrew.list_installed()
+            .map_err(|e| KiwiError::Homebrew(format!("{}; install Homebrew or rerun with --skip-packages", e)))?
+            .into_iter()
+            .map(|p| p.name)
+            .collect();
+
+        let missing: Vec<_> = wanted.into_iter()
+            .filter(|name| !installed.contains(name))
+            .collect();
+        let mut failed = 0;
+        for (i, name) in missing.iter().enumerate() {
+            spinner.set_message(format!("Installing {} ({}/{})", name, i + 1, missing.len()));
+            if let Err(e) = homebrew.install(name) {
+                spinner.println(format!("{} {}: {}", "Could not install".yellow(), name, e));
+                failed += 1;
+            }
+        }
+        spinner.println(format!(
+            "{} Packages: {} installed, {} already present, {} failed",
+            "✓".green(),
+            missing.len() - failed,
+            installed.len(),
+            failed
+        ));
+        Ok(())
+    }
+
+    /// Offers the common dotfiles that exist and aren't tracked yet, tracking
+    /// those picked (all of them with `yes`). Returns how many files were
+    /// added.
+    fn track_detected(&self, dotfiles: &Dotfiles, spinner: &ProgressBar, yes: bool) -> Result<usize> {
+        let home = dirs::home_dir()
+            .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+        let tracked = dotfiles.tracked_files()?;
+
+        let ignore = KiwiIgnore::load(&home)?;
+        let mut candidates = Vec::new();
+        for path in Dotfiles::detect(&home) {
+            let files: Vec<_> = Dotfiles::expand(&path, &ignore)?
+                .into_iter()
+                .filter(|file| file.canonicalize().map_or(false, |file| !tracked.contains(&deploy::unstore(file))))
+                .collect();
+            if !files.is_empty() {
+                candidates.push((path, files));
+            }
+        }
+        if candidates.is_empty() {
+            return Ok(0);
+        }
+
+        let labels: Vec<_> = candidates.iter()
+            .map(|(path, files)| {
+                let name = format!("~/{}", path.strip_prefix(&home).unwrap_or(path).display());
+                if path.is_dir() {
+                    format!("{} ({} files)", name, files.len())
+                } else {
+                    name
+                }
+            })
+            .collect();
+        let chosen: Vec<usize> = if yes {
+            (0..candidates.len()).collect()
         } else {
-            issues.push("Unable to read dotfiles configuration".to_string());
+            spinner.suspend(|| {
+                MultiSelect::with_theme(&ColorfulTheme::default())
+                    .with_prompt("Track these dotfiles? (space to toggle, enter to confirm)")
+                    .items(&labels)
+                    .defaults(&vec![true; labels.len()])
+                    .interact()
+            }).map_err(|e| format!("Failed to read selection: {}", e))?
+        };
+
+        let mut added = 0;
+        for i in chosen {
+            for file in &candidates[i].1 {
+                let alias = file.strip_prefix(&home).unwrap_or(file).to_string_lossy().to_string();
+                match dotfiles.add(file, Some(alias)) {
+                    Ok(()) => added += 1,
+                    Err(e) => spinner.println(format!("{} {}: {}", "Could not track".yellow(), file.display(), e)),
+                }
+            }
+        }
+        Ok(added)
+    }
+
+    /// Starts tracking files a pull created, so the next push includes them.
+    fn track_pulled(&self, dotfiles: &Dotfiles, summary: &SyncSummary) -> Result<()> {
+        let tracked = dotfiles.tracked_files()?;
+        for path in &summary.written {
+            let path = deploy::unstore(path.canonicalize()?);
+            if tracked.contains(&path) {
+                continue;
+            }
+            if let Err(e) = dotfiles.add(&path, None) {
+                println!("{} {}: {}", "Could not track".yellow(), path.display(), e);
+            }
         }
-        
-        Ok(issues)
+        Ok(())
     }
 
-    async fn check_sync(&self, sync: Option<&Sync>) -> Result<Vec<String>> {
-        let mut issues = Vec::new();
-        
-        if sync.is_none() {
-            issues.push("Sync is not configured".to_string());
-            return Ok(issues);
+    /// Pushes the tracked files, after offering to resolve conflicts, and
+    /// empties the queue of pushes made while the server was unreachable,
+    /// since this sends what they would have.
+    async fn push(&self, sync: &Sync, dotfiles: &Dotfiles, hooks: &Hooks, queue: &Queue, dry_run: bool, force: bool) -> Result<()> {
+        if !dry_run && !force && self.settle_conflicts(sync, dotfiles, &[]).await?.is_none() {
+            println!("{}", "Push cancelled".yellow());
+            return Ok(());
         }
-        
-        // Check if we can access the remote
-        if let Some(sync) = sync {
-            if let Err(e) = sync.check_remote_access().await {
-                issues.push(format!("Cannot access remote repository: {}", e));
+        if !dry_run {
+            self.run_hook(hooks, Hook::PrePush, &[])?;
+        }
+        if !self.quiet {
+            println!("{}", "Pushing to remote...".blue().bold());
+        }
+
+        let queued = queue.load()?;
+        let summary = sync.push(&dotfiles.tracked_files()?, dry_run, force).await?;
+        if !dry_run {
+            queue.clear()?;
+        }
+        if self.quiet {
+            return Ok(());
+        }
+        self.print_summary(&summary);
+        if dry_run {
+            println!("{} {}", "Dry run - nothing was pushed".yellow(), "(+ add, ~ overwrite, - delete on the server)".dimmed());
+        } else {
+            println!("{} {}", "✓ Push complete:".green(), Self::summary_counts(&summary));
+            println!("  {}", format!("↑ {}", summary.uploaded).dimmed());
+            if !queued.is_empty() {
+                println!("  {}", format!("Sent the {} push(es) queued while the server was unreachable", queued.len()).dimmed());
             }
         }
-        
-        Ok(issues)
+        Ok(())
     }
 
-    async fn try_fix_issue(&self, category: &str, issue: &str, config: &Config) -> Result<Option<String>> {
-        match (category, issue) {
-            ("Configuration", "Dotfiles directory does not exist") => {
-                std::fs::create_dir_all(&config.dotfiles_dir)?;
-                Ok(Some("Created dotfiles directory".to_string()))
-            },
-            ("Homebrew", "Homebrew is not installed") => {
-                // Install Homebrew
-                let install_script = "/bin/bash -c \"$(curl -fsSL https://raw.githubusercontent.com/Homebrew/install/HEAD/install.sh)\"";
-                std::process::Command::new("bash")
-                    .arg("-c")
-                    .arg(install_script)
-                    .output()?;
-                Ok(Some("Installed Homebrew".to_string()))
-            },
-            _ => Ok(None),
+    /// Queues a push that couldn't reach the server, for the next `kiwi
+    /// push`, or `kiwi watch` once the server is back, to send.
+    fn queue_push(&self, sync: &Sync, dotfiles: &Dotfiles, queue: &Queue) -> Result<()> {
+        let changed = sync.changed_locally(&dotfiles.tracked_files()?)?;
+        if changed.is_empty() {
+            println!("{}", "The server can't be reached, but nothing has changed here to push".yellow());
+            return Ok(());
         }
+        let count = changed.len();
+        queue.add(changed)?;
+        println!(
+            "{} {}",
+            format!("The server can't be reached; queued a push of {} file(s)", count).yellow(),
+            "(sent by the next `kiwi push`, or by `kiwi watch` once the server is back)".dimmed()
+        );
+        Ok(())
     }
 
-    fn generate_health_report(&self, issues: &[(&str, Vec<String>)]) -> Result<()> {
-        let mut report = String::new();
-        report.push_str("# Kiwi Health Report\n\n");
-        report.push_str(&format!("Generated on: {}\n\n", chrono::Local::now()));
-        
-        for (category, category_issues) in issues {
-            report.push_str(&format!("## {}\n\n", category));
-            if category_issues.is_empty() {
-                report.push_str("✅ No issues found\n\n");
+    /// Pushes tracked files whenever they change, once changes have settled
+    /// for `debounce`. If the remote changed too, its new files are pulled
+    /// first, and files changed on both sides hold the push back until
+    /// they're resolved, so nothing is overwritten.
+    async fn watch(&self, sync: &Sync, dotfiles: &Dotfiles, hooks: &Hooks, queue: &Queue, debounce: Duration) -> Result<()> {
+        let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+        let mut watcher = notify::recommended_watcher(move |event| {
+            let _ = tx.send(event);
+        }).map_err(|e| format!("Failed to start watching: {}", e))?;
+
+        // Editors often replace files rather than write them in place, so
+        // single files are watched through their directory
+        let tracked = dotfiles.list()?;
+        let mut watched = std::collections::BTreeSet::new();
+        for dotfile in &tracked {
+            let (dir, mode) = if dotfile.path.is_dir() {
+                (dotfile.path.clone(), RecursiveMode::Recursive)
             } else {
-                for issue in category_issues {
-                    report.push_str(&format!("- ⚠️ {}\n", issue));
+                match dotfile.path.parent() {
+                    Some(parent) => (parent.to_path_buf(), RecursiveMode::NonRecursive),
+                    None => continue,
+                }
+            };
+            if watched.insert(dir.clone()) {
+                watcher.watch(&dir, mode).map_err(|e| format!("Failed to watch {}: {}", dir.display(), e))?;
+            }
+        }
+        if watched.is_empty() {
+            println!("{}", "Nothing to watch; track files with `kiwi add` first".yellow());
+            return Ok(());
+        }
+        println!("{} {} location(s); press Ctrl-C to stop", "👀 Watching".blue().bold(), watched.len());
+        let home = dirs::home_dir()
+            .ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))?;
+        let ignore = KiwiIgnore::load(&home)?;
+        // Pushes queued while offline are retried until the server is back,
+        // starting straight away
+        let mut retry = tokio::time::interval(QUEUE_RETRY_INTERVAL);
+        retry.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+
+        loop {
+            // Wait for a change to a synced file, then for things to go quiet
+            let retrying = tokio::select! {
+                event = rx.recv() => match event {
+                    Some(Ok(event)) if Self::is_sync_event(&event, &tracked, &ignore) => false,
+                    Some(Ok(_)) => continue,
+                    Some(Err(e)) => {
+                        println!("{} {}", "Watch error:".red(), e);
+                        continue;
+                    }
+                    None => return Ok(()),
+                },
+                _ = retry.tick(), if !queue.is_empty() => true,
+                _ = tokio::signal::ctrl_c() => return Ok(()),
+            };
+            if !retrying {
+                while let Ok(Some(_)) = tokio::time::timeout(debounce, rx.recv()).await {}
+            }
+
+            match self.sync_changes(sync, dotfiles, hooks, queue).await {
+                Ok(()) => {}
+                // A failed retry is already queued
+                Err(e) if e.is_offline() => {
+                    if !retrying {
+                        self.queue_push(sync, dotfiles, queue)?;
+                    }
                 }
-                report.push_str("\n");
+                Err(e) => println!("{} {}", "Sync failed:".red(), e),
             }
         }
-        
-        std::fs::write("kiwi-health-report.md", report)?;
+    }
+
+    /// Reports whether an event touches a tracked file, or one under a
+    /// tracked directory that isn't ignored.
+    fn is_sync_event(event: &notify::Event, tracked: &[Dotfile], ignore: &KiwiIgnore) -> bool {
+        if event.kind.is_access() {
+            return false;
+        }
+        event.paths.iter().any(|path| {
+            tracked.iter().any(|d| {
+                *path == d.path || (path.starts_with(&d.path) && !ignore.is_ignored(path, path.is_dir()))
+            })
+        })
+    }
+
+    async fn sync_changes(&self, sync: &Sync, dotfiles: &Dotfiles, hooks: &Hooks, queue: &Queue) -> Result<()> {
+        let status = sync.status(&dotfiles.tracked_files()?, &[]).await?;
+        if !status.conflicting.is_empty() {
+            println!(
+                "{} {} ({})",
+                "Not pushing; changed here and on the server:".yellow(),
+                status.conflicting.join(", "),
+                "resolve them with `kiwi push`".dimmed()
+            );
+            // Retrying wouldn't help until they're resolved
+            return queue.clear();
+        }
+        if !status.newer_remotely.is_empty() || !status.untracked.is_empty() {
+            let summary = sync.pull(true, false).await?;
+            self.track_pulled(dotfiles, &summary)?;
+            println!("{} {}", "↓ Pulled remote changes:".cyan(), Self::summary_counts(&summary));
+            if summary.has_changes() {
+                self.run_hook(hooks, Hook::PostPull, &Self::changed_files(&summary))?;
+            }
+        }
+        if status.modified_locally.is_empty() && status.not_pushed.is_empty() && status.missing.is_empty() {
+            // Whatever was queued has been pushed some other way
+            return queue.clear();
+        }
+        self.run_hook(hooks, Hook::PrePush, &[])?;
+        let summary = sync.push(&dotfiles.tracked_files()?, false, false).await?;
+        queue.clear()?;
+        println!(
+            "{} {} {}",
+            chrono::Local::now().format("%H:%M:%S").to_string().dimmed(),
+            "↑ Pushed:".green(),
+            Self::summary_counts(&summary)
+        );
         Ok(())
     }
-} 
\ No newline at end of file
+
+    /// Offers to resolve files changed both here and on the server before a
+    /// push or pull, when there's a terminal to ask in. Only the files `only`
+    /// selects are looked at. Returns how many were skipped, or None if
+    /// resolving was stopped.
+    async fn settle_conflicts(&self, sync: &Sync, dotfiles: &Dotfiles, only: &[String]) -> Result<Option<usize>> {
+        if !io::stdin().is_terminal() || !io::stdout().is_terminal() {
+            return Ok(Some(0));
+        }
+        let mut conflicts = sync.conflicts(&dotfiles.tracked_files()?).await?;
+        conflicts.retain(|conflict| sync.selects(only, &conflict.path));
+        if conflicts.is_empty() {
+            return Ok(Some(0));
+        }
+        println!("{} {}", conflicts.len(), "file(s) changed here and on the server".yellow().bold());
+        self.resolve_conflicts(sync, &conflicts)
+    }
+
+    /// Shows each conflict's two copies side by side and asks which to keep,
+    /// or opens a merge of them in the editor.
+    fn resolve_conflicts(&self, sync: &Sync, conflicts: &[Conflict]) -> Result<Option<usize>> {
+        let width = console::Term::stdout().size().1 as usize;
+        let column = width.saturating_sub(3) / 2;
+        let choices = ["Keep the local copy", "Take the server's copy", "Edit a merge", "Skip for now", "Stop"];
+        let mut skipped = 0;
+        for (i, conflict) in conflicts.iter().enumerate() {
+            let file = FileDiff {
+                path: conflict.path.clone(),
+                old: Some(conflict.local.clone()),
+                new: Some(conflict.remote.clone()),
+            };
+            println!("\n{} {}", format!("[{}/{}]", i + 1, conflicts.len()).dimmed(), conflict.path.bold());
+            println!("{}   {}", format!("{:<width$}", "local", width = column).bold(), "server".bold());
+            for row in diff::side_by_side(&file, width) {
+                println!("{}", row);
+            }
+
+            loop {
+                let choice = Select::with_theme(&ColorfulTheme::default())
+                    .with_prompt(format!("Resolve {}", conflict.path))
+                    .items(&choices)
+                    .default(0)
+                    .interact()
+                    .map_err(|e| format!("Failed to read selection: {}", e))?;
+                let contents = match choice {
+                    0 => conflict.local.clone(),
+                    1 => conflict.remote.clone(),
+                    2 => match self.edit_merge(conflict)? {
+                        Some(merged) => merged,
+                        None => continue,
+                    },
+                    3 => {
+                        skipped += 1;
+                        break;
+                    }
+                    _ => return Ok(None),
+                };
+                sync.resolve(conflict, &contents)?;
+                println!("{} {}", "✓ Resolved".green(), conflict.path);
+                break;
+            }
+        }
+        Ok(Some(skipped))
+    }
+
+    /// Opens both copies of a conflicted file in the editor, with conflict
+    /// markers around where they differ. Returns None if the editor was
+    /// closed without saving.
+    fn edit_merge(&self, conflict: &Conflict) -> Result<Option<String>> {
+        let extension = Path::new(&conflict.path)
+            .extension()
+            .map(|extension| format!(".{}", extension.to_string_lossy()))
+            .unwrap_or_else(|| ".txt".to_string());
+        let mut text = diff::with_markers(&conflict.local, &conflict.remote);
+        loop {
+            let merged = match Editor::new().extension(&extension).edit(&text)
+                .map_err(|e| format!("Failed to open the editor: {}", e))? {
+                Some(merged) => merged,
+                None => return Ok(None),
+            };
+            if !diff::has_markers(&merged) {
+                return Ok(Some(merged));
+            }
+            let keep = Confirm::with_theme(&ColorfulTheme::default())
+                .with_prompt("The merge still has conflict markers. Use it anyway?")
+                .default(false)
+                .interact()
+                .map_err(|e| format!("Failed to read answer: {}", e))?;
+            if keep {
+                return Ok(Some(merged));
+            }
+            text = merged;
+        }
+    }
+}
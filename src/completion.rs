@@ -0,0 +1,85 @@
+use std::io::Write;
+use crate::{Cli, Result};
+use clap::CommandFactory;
+use clap_complete::Shell;
+
+// Each script wraps clap's completion function so tracked paths and profile
+// names, which only kiwi knows, come from `kiwi completion --values`.
+
+const BASH: &str = r#"
+_kiwi_values() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local -a args=()
+    local i kind=""
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        case "${COMP_WORDS[i]}" in
+            --profile) ((i++)) ;;
+            -*) ;;
+            *) args+=("${COMP_WORDS[i]}") ;;
+        esac
+    done
+    if [[ "$prev" == "--profile" ]]; then
+        kind=profiles
+    elif [[ "$cur" != -* ]]; then
+        case "${args[0]}:${#args[@]}" in
+            remove:1|rm:1|diff:1|pull:*) kind=paths ;;
+            profile:2) [[ "${args[1]}" =~ ^(add|remove|rm)$ ]] && kind=profiles ;;
+        esac
+    fi
+    if [[ -n "$kind" ]]; then
+        local IFS=$'\n'
+        COMPREPLY=($(compgen -W "$(kiwi completion --values "$kind" 2>/dev/null)" -- "$cur"))
+        return
+    fi
+    _kiwi "$@"
+}
+complete -F _kiwi_values -o bashdefault -o default kiwi
+"#;
+
+const ZSH: &str = r#"
+_kiwi_values() {
+    local -a args values
+    local i kind
+    for ((i = 2; i < CURRENT; i++)); do
+        case ${words[i]} in
+            --profile) ((i++)) ;;
+            -*) ;;
+            *) args+=(${words[i]}) ;;
+        esac
+    done
+    if [[ ${words[CURRENT-1]} == --profile ]]; then
+        kind=profiles
+    elif [[ ${words[CURRENT]} != -* ]]; then
+        case "${args[1]}:${#args}" in
+            remove:1|rm:1|diff:1|pull:*) kind=paths ;;
+            profile:2) [[ ${args[2]} == (add|remove|rm) ]] && kind=profiles ;;
+        esac
+    fi
+    if [[ -n $kind ]]; then
+        values=(${(f)"$(kiwi completion --values $kind 2>/dev/null)"})
+        compadd -Q -a values
+        return
+    fi
+    _kiwi "$@"
+}
+compdef _kiwi_values kiwi
+"#;
+
+const FISH: &str = r#"
+complete -c kiwi -l profile -x -a '(kiwi completion --values profiles 2>/dev/null)'
+complete -c kiwi -n '__fish_seen_subcommand_from remove rm diff pull' -a '(kiwi completion --values paths 2>/dev/null)'
+complete -c kiwi -n '__fish_seen_subcommand_from profile; and __fish_seen_subcommand_from add remove rm' -a '(kiwi completion --values profiles 2>/dev/null)'
+"#;
+
+/// Writes the completion script for `shell`.
+pub fn generate(shell: Shell, out: &mut dyn Write) -> Result<()> {
+    clap_complete::generate(shell, &mut Cli::command(), "kiwi", out);
+    let values = match shell {
+        Shell::Bash => BASH,
+        Shell::Zsh => ZSH,
+        Shell::Fish => FISH,
+        _ => "",
+    };
+    out.write_all(values.as_bytes())?;
+    Ok(())
+}
@@ -1,6 +1,12 @@
 use serde::{Deserialize, Serialize};
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use crate::{Result, KiwiError};
+use crate::credentials::{self, CredentialStore};
+use crate::deploy::Deploy;
+use crate::git_remote;
+use crate::local_remote;
+use crate::update::Channel;
+use crate::secrets::SecretScan;
 use std::fs;
 use std::collections::HashMap;
 
@@ -10,14 +16,56 @@ const DEFAULT_SYNC_URL: &str = "http://34.41.188.73:8080";
 pub struct Config {
     pub dotfiles_dir: PathBuf,
     pub sync_url: Option<String>,
+    /// Kept in the OS keychain (or the encrypted credentials file), never in
+    /// the config file. It's only read from there to move older configs over.
+    #[serde(default, skip_serializing)]
     pub sync_token: Option<String>,
     pub environment: Option<String>,
+    /// ID the server gave this machine when `kiwi init` registered it
+    #[serde(default)]
+    pub device_id: Option<String>,
+    /// Profile this machine pulls, such as work or home; all files and
+    /// packages when unset
+    #[serde(default)]
+    pub profile: Option<String>,
+    /// Encrypt files with age before pushing them
+    #[serde(default)]
+    pub encrypt: bool,
+    /// Whether a push is blocked, warned about or let through when files
+    /// look like they contain secrets
+    #[serde(default)]
+    pub secret_scan: SecretScan,
+    /// Whether pulled files are copied into place or kept in ~/.kiwi/store
+    /// and symlinked
+    #[serde(default)]
+    pub deploy: Deploy,
+    /// Which releases `kiwi self-update` installs
+    #[serde(default)]
+    pub update_channel: Channel,
+    /// Where hook scripts are kept, ~/.kiwi/hooks when unset
+    #[serde(default)]
+    pub hooks_dir: Option<PathBuf>,
+    /// gitignore-style patterns left out of sync everywhere, on top of
+    /// ~/.kiwi/ignore
+    #[serde(default)]
+    pub ignore: Vec<String>,
+    /// Backup servers pushes are copied to and pulls fall back on, in
+    /// order. Each one's token is kept like the main one's
+    #[serde(default)]
+    pub remotes: Vec<RemoteServer>,
     #[serde(default = "Preferences::default")]
     pub preferences: Preferences,
     #[serde(default)]
     pub custom_settings: HashMap<String, String>,
 }
 
+/// A backup server, added with `kiwi remote add`.
+#[derive(Debug, Serialize, Deserialize, Clone)]
+pub struct RemoteServer {
+    pub name: String,
+    pub url: String,
+}
+
 #[derive(Debug, Serialize, Deserialize, Clone)]
 pub struct Preferences {
     #[serde(default = "default_auto_sync")]
@@ -67,6 +115,15 @@ impl Default for Config {
             sync_url: Some(DEFAULT_SYNC_URL.to_string()),
             sync_token: None,
             environment: None,
+            device_id: None,
+            profile: None,
+            encrypt: false,
+            secret_scan: SecretScan::default(),
+            deploy: Deploy::default(),
+            update_channel: Channel::default(),
+            hooks_dir: None,
+            ignore: Vec::new(),
+            remotes: Vec::new(),
             preferences: Preferences::default(),
             custom_settings: HashMap::new(),
         }
@@ -75,9 +132,29 @@ impl Default for Config {
 
 impl Config {
     pub fn load() -> Result<Self> {
+        let mut config = Self::load_settings()?;
+        match config.sync_token.take() {
+            // Move a plaintext token out of the config file
+            Some(token) => {
+                config.set_token(token)?;
+                config.save()?;
+            }
+            None => config.sync_token = credentials::load_token(config.token_server())?,
+        }
+
+        Ok(config)
+    }
+
+    /// Reads the config file without looking up the token, for commands that
+    /// only need local settings and shouldn't touch the keychain.
+    pub fn load_settings() -> Result<Self> {
         let config_path = Self::config_path()?;
         
         if !config_path.exists() {
+            let legacy_path = Self::legacy_config_path()?;
+            if legacy_path.exists() {
+                return Self::migrate(&legacy_path);
+            }
             let config = Config::default();
             config.save()?;
             return Ok(config);
@@ -87,13 +164,13 @@ impl Config {
             KiwiError::Config(format!("Failed to read config file: {}", e))
         })?;
 
-        let config: Config = serde_json::from_str(&contents).map_err(|e| {
-            KiwiError::Config(format!("Invalid config file format: {}", e))
+        let config: Config = toml::from_str(&contents).map_err(|e| {
+            KiwiError::Config(format!("Invalid config file {}: {}", config_path.display(), e))
         })?;
 
         // Validate and fix any issues
         config.validate()?;
-        
+
         Ok(config)
     }
 
@@ -110,7 +187,7 @@ impl Config {
         // Validate before saving
         self.validate()?;
 
-        let contents = serde_json::to_string_pretty(self).map_err(|e| {
+        let contents = toml::to_string_pretty(self).map_err(|e| {
             KiwiError::Config(format!("Failed to serialize config: {}", e))
         })?;
 
@@ -121,20 +198,180 @@ impl Config {
         Ok(())
     }
 
-    fn config_path() -> Result<PathBuf> {
-        let home = dirs::home_dir().ok_or_else(|| {
-            KiwiError::Config("Could not find home directory".to_string())
+    /// Stores the API token securely and uses it for this session.
+    pub fn set_token(&mut self, token: String) -> Result<CredentialStore> {
+        let store = credentials::store_token(self.token_server(), &token)?;
+        self.sync_token = Some(token);
+        Ok(store)
+    }
+
+    /// The server the token belongs to, which names its keychain entry.
+    fn token_server(&self) -> &str {
+        self.server_url()
+    }
+
+    /// The server to use, the default one when none is set or files are
+    /// synced with a git repository or snapshot directory instead.
+    pub fn server_url(&self) -> &str {
+        match self.sync_url.as_deref() {
+            Some(url) if !is_serverless_url(url) => url,
+            _ => DEFAULT_SYNC_URL,
+        }
+    }
+
+    /// Whether files are synced with a git repository or a snapshot
+    /// directory, which need no account or token, rather than a server.
+    pub fn is_serverless(&self) -> bool {
+        self.sync_url.as_deref().map_or(false, is_serverless_url)
+    }
+
+    /// Adds a backup server, storing its token securely.
+    pub fn add_remote(&mut self, name: &str, url: &str, token: &str) -> Result<CredentialStore> {
+        if !crate::profiles::is_valid_name(name) {
+            return Err(KiwiError::InvalidConfig {
+                key: "remote".to_string(),
+                message: "Remote name can only contain alphanumeric characters, underscores, and hyphens".to_string(),
+            });
+        }
+        if !url.starts_with("http://") && !url.starts_with("https://") {
+            return Err(KiwiError::InvalidConfig {
+                key: "remote".to_string(),
+                message: "URL must start with http:// or https://".to_string(),
+            });
+        }
+        if self.remotes.iter().any(|remote| remote.name == name) {
+            return Err(KiwiError::InvalidConfig {
+                key: "remote".to_string(),
+                message: format!("There's already a remote called {}", name),
+            });
+        }
+        if self.token_server() == url || self.remotes.iter().any(|remote| remote.url == url) {
+            return Err(KiwiError::InvalidConfig {
+                key: "remote".to_string(),
+                message: format!("{} is already configured", url),
+            });
+        }
+        let store = credentials::store_token(url, token)?;
+        self.remotes.push(RemoteServer { name: name.to_string(), url: url.to_string() });
+        self.save()?;
+        Ok(store)
+    }
+
+    /// Removes a backup server and its stored token.
+    pub fn remove_remote(&mut self, name: &str) -> Result<()> {
+        let index = self.remotes.iter().position(|remote| remote.name == name)
+            .ok_or_else(|| KiwiError::Config(format!("No remote called {}", name)))?;
+        let remote = self.remotes.remove(index);
+        credentials::delete_token(&remote.url)?;
+        self.save()
+    }
+
+    /// Returns the token stored for a backup server.
+    pub fn remote_token(&self, remote: &RemoteServer) -> Result<Option<String>> {
+        credentials::load_token(&remote.url)
+    }
+
+    /// Where hook scripts such as post-pull are kept: the hooks_dir setting,
+    /// or ~/.kiwi/hooks.
+    pub fn hooks_dir(&self) -> Result<PathBuf> {
+        match &self.hooks_dir {
+            Some(dir) => Ok(dir.clone()),
+            None => Ok(Self::data_dir()?.join("hooks")),
+        }
+    }
+
+    /// Where pulled files are kept when they're symlinked into place:
+    /// ~/.kiwi/store.
+    pub fn store_dir() -> Result<PathBuf> {
+        Ok(Self::data_dir()?.join("store"))
+    }
+
+    /// The ignore setting's patterns, read without creating a config file
+    /// when there's none, so anything that walks tracked directories can
+    /// use them.
+    pub fn ignore_patterns() -> Vec<String> {
+        let contents = match Self::config_path().and_then(|path| Ok(fs::read_to_string(path)?)) {
+            Ok(contents) => contents,
+            Err(_) => return Vec::new(),
+        };
+        toml::from_str::<Config>(&contents).map_or_else(|_| Vec::new(), |config| config.ignore)
+    }
+
+    /// Where the settings are kept: $XDG_CONFIG_HOME/kiwi/config.toml, or
+    /// ~/.config/kiwi/config.toml.
+    pub fn config_path() -> Result<PathBuf> {
+        Ok(Self::config_home()?.join("kiwi/config.toml"))
+    }
+
+    /// $XDG_CONFIG_HOME, or ~/.config.
+    pub fn config_home() -> Result<PathBuf> {
+        match std::env::var_os("XDG_CONFIG_HOME").map(PathBuf::from) {
+            // The XDG spec has relative paths ignored
+            Some(dir) if dir.is_absolute() => Ok(dir),
+            _ => Ok(home_dir()?.join(".config")),
+        }
+    }
+
+    /// Where settings were kept before they moved to config.toml.
+    fn legacy_config_path() -> Result<PathBuf> {
+        Ok(Self::data_dir()?.join("config.json"))
+    }
+
+    /// kiwi's own files, such as hooks and the store: ~/.kiwi.
+    pub fn data_dir() -> Result<PathBuf> {
+        Ok(home_dir()?.join(".kiwi"))
+    }
+
+    /// Moves settings from ~/.kiwi/config.json into config.toml. A token
+    /// still in the old file is put in the keychain first, so it isn't lost
+    /// with it.
+    fn migrate(legacy_path: &Path) -> Result<Self> {
+        let contents = fs::read_to_string(legacy_path).map_err(|e| {
+            KiwiError::Config(format!("Failed to read config file: {}", e))
         })?;
-        Ok(home.join(".kiwi/config.json"))
+        let config: Config = serde_json::from_str(&contents).map_err(|e| {
+            KiwiError::Config(format!("Invalid config file {}: {}", legacy_path.display(), e))
+        })?;
+        if let Some(token) = &config.sync_token {
+            credentials::store_token(config.token_server(), token)?;
+        }
+        config.save()?;
+        fs::remove_file(legacy_path)?;
+        log::info!("Moved {} to {}", legacy_path.display(), Self::config_path()?.display());
+        Ok(Config { sync_token: None, ..config })
     }
 
-    pub fn get(&self, key: &str) -> Option<&str> {
+    /// The keys `kiwi config get` and `set` know, besides custom settings.
+    pub const KEYS: &'static [&'static str] = &[
+        "dotfiles_dir",
+        "sync_url",
+        "sync_token",
+        "environment",
+        "device_id",
+        "profile",
+        "encrypt",
+        "secret_scan",
+        "deploy",
+        "update_channel",
+        "hooks_dir",
+        "ignore",
+    ];
+
+    pub fn get(&self, key: &str) -> Option<String> {
         match key {
-            "dotfiles_dir" => Some(self.dotfiles_dir.to_str()?),
-            "sync_url" => self.sync_url.as_deref(),
-            "sync_token" => self.sync_token.as_deref(),
-            "environment" => self.environment.as_deref(),
-            _ => self.custom_settings.get(key).map(|s| s.as_str()),
+            "dotfiles_dir" => Some(self.dotfiles_dir.display().to_string()),
+            "sync_url" => self.sync_url.clone(),
+            "sync_token" => self.sync_token.clone(),
+            "environment" => self.environment.clone(),
+            "device_id" => self.device_id.clone(),
+            "profile" => self.profile.clone(),
+            "encrypt" => Some(self.encrypt.to_string()),
+            "secret_scan" => Some(self.secret_scan.as_str().to_string()),
+            "deploy" => Some(self.deploy.as_str().to_string()),
+            "update_channel" => Some(self.update_channel.as_str().to_string()),
+            "hooks_dir" => self.hooks_dir().ok().map(|dir| dir.display().to_string()),
+            "ignore" => Some(self.ignore.join(",")),
+            _ => self.custom_settings.get(key).cloned(),
         }
     }
 
@@ -151,15 +388,18 @@ impl Config {
             }
             "sync_url" => {
                 // Validate URL format
-                if !value.starts_with("http://") && !value.starts_with("https://") {
+                if !is_sync_url(&value) {
                     return Err(KiwiError::InvalidConfig {
                         key: key.to_string(),
-                        message: "URL must start with http:// or https://".to_string(),
+                        message: "URL must start with http:// or https://, or be a git repository or an absolute path".to_string(),
                     });
                 }
                 self.sync_url = Some(value);
             }
-            "sync_token" => self.sync_token = Some(value),
+            "sync_token" => {
+                self.set_token(value)?;
+            }
+            "device_id" => self.device_id = Some(value),
             "environment" => {
                 // Validate environment name
                 if !value.chars().all(|c| c.is_alphanumeric() || c == '_' || c == '-') {
@@ -170,6 +410,60 @@ impl Config {
                 }
                 self.environment = Some(value);
             }
+            "encrypt" => {
+                self.encrypt = value.parse().map_err(|_| KiwiError::InvalidConfig {
+                    key: key.to_string(),
+                    message: "Must be true or false".to_string(),
+                })?;
+            }
+            "secret_scan" => {
+                self.secret_scan = value.parse().map_err(|message| KiwiError::InvalidConfig {
+                    key: key.to_string(),
+                    message,
+                })?;
+            }
+            "deploy" => {
+                self.deploy = value.parse().map_err(|message| KiwiError::InvalidConfig {
+                    key: key.to_string(),
+                    message,
+                })?;
+            }
+            "update_channel" => {
+                self.update_channel = value.parse().map_err(|message| KiwiError::InvalidConfig {
+                    key: key.to_string(),
+                    message,
+                })?;
+            }
+            "hooks_dir" => {
+                // An empty value goes back to ~/.kiwi/hooks
+                self.hooks_dir = if value.is_empty() {
+                    None
+                } else if let Some(rest) = value.strip_prefix("~/") {
+                    Some(home_dir()?.join(rest))
+                } else {
+                    Some(PathBuf::from(value))
+                };
+            }
+            "ignore" => {
+                // Comma-separated; an empty value clears them
+                self.ignore = value.split(',')
+                    .map(|pattern| pattern.trim().to_string())
+                    .filter(|pattern| !pattern.is_empty())
+                    .collect();
+            }
+            "profile" => {
+                // An empty value goes back to syncing everything
+                if value.is_empty() {
+                    self.profile = None;
+                } else if !crate::profiles::is_valid_name(&value) {
+                    return Err(KiwiError::InvalidConfig {
+                        key: key.to_string(),
+                        message: "Profile name can only contain alphanumeric characters, underscores, and hyphens".to_string(),
+                    });
+                } else {
+                    self.profile = Some(value);
+                }
+            }
             _ => {
                 self.custom_settings.insert(key.to_string(), value);
             }
@@ -188,10 +482,10 @@ impl Config {
 
         // Validate sync URL if present
         if let Some(url) = &self.sync_url {
-            if !url.starts_with("http://") && !url.starts_with("https://") {
+            if !is_sync_url(url) {
                 return Err(KiwiError::InvalidConfig {
                     key: "sync_url".to_string(),
-                    message: "URL must start with http:// or https://".to_string(),
+                    message: "URL must start with http:// or https://, or be a git repository or an absolute path".to_string(),
                 });
             }
         }
@@ -237,16 +531,33 @@ impl Config {
         if other.sync_url.is_some() {
             self.sync_url = other.sync_url.clone();
         }
-        if other.sync_token.is_some() {
-            self.sync_token = other.sync_token.clone();
+        if let Some(token) = &other.sync_token {
+            self.set_token(token.clone())?;
         }
         if other.environment.is_some() {
             self.environment = other.environment.clone();
         }
+        if other.profile.is_some() {
+            self.profile = other.profile.clone();
+        }
 
         // Validate the merged config
         self.validate()?;
         self.save()?;
         Ok(())
     }
-} 
\ No newline at end of file
+} 
+
+fn home_dir() -> Result<PathBuf> {
+    dirs::home_dir().ok_or_else(|| KiwiError::Config("Could not find home directory".to_string()))
+}
+
+/// Whether `url` is a server's http(s) URL, a git repository or a
+/// directory.
+fn is_sync_url(url: &str) -> bool {
+    url.starts_with("http://") || url.starts_with("https://") || is_serverless_url(url)
+}
+
+fn is_serverless_url(url: &str) -> bool {
+    git_remote::is_git_url(url) || local_remote::is_local_path(url)
+}
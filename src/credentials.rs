@@ -0,0 +1,253 @@
+use std::path::PathBuf;
+use std::fs;
+use crate::{Result, KiwiError};
+use chacha20poly1305::aead::rand_core::RngCore;
+use chacha20poly1305::aead::{Aead, AeadCore, KeyInit, OsRng};
+use chacha20poly1305::{ChaCha20Poly1305, Key, Nonce};
+use serde::{Deserialize, Serialize};
+use sha2::Sha256;
+
+const KEYRING_SERVICE: &str = "kiwi";
+const PASSPHRASE_ENV: &str = "KIWI_CREDENTIALS_PASSPHRASE";
+const PBKDF2_ROUNDS: u32 = 600_000;
+/// Keychain entry for the age key, which is shared by every server
+const ENCRYPTION_KEY_USER: &str = "age-key";
+/// Keychain entry `kiwi doctor` writes and removes again
+const PROBE_USER: &str = "doctor-probe";
+
+/// Where the API token is kept.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CredentialStore {
+    /// macOS Keychain, Secret Service or Windows Credential Manager
+    Keychain,
+    /// ~/.kiwi/credentials.enc, for machines without a keychain
+    EncryptedFile,
+}
+
+/// The token for one server, encrypted with a key derived from the
+/// passphrase in KIWI_CREDENTIALS_PASSPHRASE. The file holds one of these
+/// per server.
+#[derive(Debug, Serialize, Deserialize)]
+struct EncryptedCredentials {
+    server: String,
+    salt: Vec<u8>,
+    nonce: Vec<u8>,
+    ciphertext: Vec<u8>,
+}
+
+/// Stores the token for `server`, preferring the OS keychain and falling back
+/// to the encrypted file when there isn't one (on a headless machine, say).
+pub fn store_token(server: &str, token: &str) -> Result<CredentialStore> {
+    match keyring::Entry::new(KEYRING_SERVICE, server).and_then(|entry| entry.set_password(token)) {
+        Ok(()) => {
+            // Don't leave an older copy behind in the file
+            let _ = remove_encrypted(server);
+            Ok(CredentialStore::Keychain)
+        }
+        Err(e) => {
+            log::info!("OS keychain unavailable ({}); using the encrypted credentials file", e);
+            write_encrypted(server, token)?;
+            Ok(CredentialStore::EncryptedFile)
+        }
+    }
+}
+
+/// Returns the stored token for `server`, if there is one.
+pub fn load_token(server: &str) -> Result<Option<String>> {
+    if let Ok(token) = keyring::Entry::new(KEYRING_SERVICE, server).and_then(|entry| entry.get_password()) {
+        return Ok(Some(token));
+    }
+    read_encrypted(server)
+}
+
+/// Removes the stored token for `server` from wherever it's kept.
+pub fn delete_token(server: &str) -> Result<()> {
+    if let Ok(entry) = keyring::Entry::new(KEYRING_SERVICE, server) {
+        let _ = entry.delete_password();
+    }
+    remove_encrypted(server)
+}
+
+/// Stores the key files are encrypted with, preferring the OS keychain and
+/// falling back to ~/.kiwi/age.key, readable only by the user, like any
+/// other age key file.
+pub fn store_encryption_key(secret: &str) -> Result<CredentialStore> {
+    match keyring::Entry::new(KEYRING_SERVICE, ENCRYPTION_KEY_USER).and_then(|entry| entry.set_password(secret)) {
+        Ok(()) => {
+            let _ = fs::remove_file(encryption_key_path()?);
+            Ok(CredentialStore::Keychain)
+        }
+        Err(e) => {
+            log::info!("OS keychain unavailable ({}); using ~/.kiwi/age.key", e);
+            let path = encryption_key_path()?;
+            if let Some(parent) = path.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            fs::write(&path, format!("{}\n", secret))?;
+            #[cfg(unix)]
+            {
+                use std::os::unix::fs::PermissionsExt;
+                fs::set_permissions(&path, fs::Permissions::from_mode(0o600))?;
+            }
+            Ok(CredentialStore::EncryptedFile)
+        }
+    }
+}
+
+/// Returns the key files are encrypted with, if this machine has one.
+pub fn load_encryption_key() -> Result<Option<String>> {
+    if let Ok(secret) = keyring::Entry::new(KEYRING_SERVICE, ENCRYPTION_KEY_USER).and_then(|entry| entry.get_password()) {
+        return Ok(Some(secret));
+    }
+    let path = encryption_key_path()?;
+    if !path.exists() {
+        return Ok(None);
+    }
+    // age key files may have comments above the key
+    let contents = fs::read_to_string(path)?;
+    Ok(contents.lines()
+        .map(str::trim)
+        .find(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(str::to_string))
+}
+
+/// Checks the OS keychain can store a secret and read it back.
+pub fn check_keychain() -> std::result::Result<(), keyring::Error> {
+    let entry = keyring::Entry::new(KEYRING_SERVICE, PROBE_USER)?;
+    entry.set_password("probe")?;
+    let read = entry.get_password();
+    let _ = entry.delete_password();
+    read.map(|_| ())
+}
+
+/// Returns whether credentials can fall back to the encrypted file.
+pub fn has_passphrase() -> bool {
+    passphrase().is_ok()
+}
+
+/// Files kiwi keeps secrets in when there's no keychain, which only the user
+/// should be able to read.
+pub fn secret_files() -> Result<Vec<PathBuf>> {
+    Ok(vec![credentials_path()?, encryption_key_path()?])
+}
+
+fn encryption_key_path() -> Result<PathBuf> {
+    Ok(credentials_path()?.with_file_name("age.key"))
+}
+
+fn credentials_path() -> Result<PathBuf> {
+    let home = dirs::home_dir().ok_or_else(|| {
+        KiwiError::Config("Could not find home directory".to_string())
+    })?;
+    Ok(home.join(".kiwi/credentials.enc"))
+}
+
+fn passphrase() -> Result<String> {
+    match std::env::var(PASSPHRASE_ENV) {
+        Ok(passphrase) if !passphrase.is_empty() => Ok(passphrase),
+        _ => Err(KiwiError::AuthError(format!(
+            "No OS keychain is available; set {} to keep credentials in an encrypted file instead",
+            PASSPHRASE_ENV
+        ))),
+    }
+}
+
+fn derive_key(passphrase: &str, salt: &[u8]) -> Key {
+    let mut key = Key::default();
+    pbkdf2::pbkdf2_hmac::<Sha256>(passphrase.as_bytes(), salt, PBKDF2_ROUNDS, &mut key);
+    key
+}
+
+fn write_encrypted(server: &str, token: &str) -> Result<()> {
+    let passphrase = passphrase()?;
+    let mut salt = vec![0u8; 16];
+    OsRng.fill_bytes(&mut salt);
+    let nonce = ChaCha20Poly1305::generate_nonce(&mut OsRng);
+    let cipher = ChaCha20Poly1305::new(&derive_key(&passphrase, &salt));
+    let ciphertext = cipher.encrypt(&nonce, token.as_bytes()).map_err(|_| {
+        KiwiError::AuthError("Failed to encrypt credentials".to_string())
+    })?;
+
+    let mut all = read_all()?;
+    all.retain(|credentials| credentials.server != server);
+    all.push(EncryptedCredentials {
+        server: server.to_string(),
+        salt,
+        nonce: nonce.to_vec(),
+        ciphertext,
+    });
+    write_all(&all)
+}
+
+/// Reads every server's credentials from the file. Files from before it
+/// held more than one have a single entry.
+fn read_all() -> Result<Vec<EncryptedCredentials>> {
+    let path = credentials_path()?;
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    let contents = fs::read_to_string(&path)?;
+    match serde_json::from_str(&contents) {
+        Ok(all) => Ok(all),
+        Err(_) => Ok(vec![serde_json::from_str(&contents)?]),
+    }
+}
+
+fn write_all(all: &[EncryptedCredentials]) -> Result<()> {
+    let path = credentials_path()?;
+    if all.is_empty() {
+        if path.exists() {
+            fs::remove_file(path)?;
+        }
+        return Ok(());
+    }
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    fs::write(&path, serde_json::to_string(all)?)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o600))?;
+    }
+    Ok(())
+}
+
+fn remove_encrypted(server: &str) -> Result<()> {
+    let mut all = read_all()?;
+    let before = all.len();
+    all.retain(|credentials| credentials.server != server);
+    if all.len() == before {
+        return Ok(());
+    }
+    write_all(&all)
+}
+
+fn read_encrypted(server: &str) -> Result<Option<String>> {
+    let credentials = match read_all()?.into_iter().find(|credentials| credentials.server == server) {
+        Some(credentials) if credentials.nonce.len() == 12 => credentials,
+        _ => return Ok(None),
+    };
+
+    let passphrase = passphrase()?;
+    let cipher = ChaCha20Poly1305::new(&derive_key(&passphrase, &credentials.salt));
+    let token = cipher
+        .decrypt(Nonce::from_slice(&credentials.nonce), credentials.ciphertext.as_slice())
+        .map_err(|_| KiwiError::AuthError(format!("Could not decrypt credentials; check {}", PASSPHRASE_ENV)))?;
+    String::from_utf8(token)
+        .map(Some)
+        .map_err(|_| KiwiError::AuthError("Stored credentials are corrupt".to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_derive_key() {
+        let a = derive_key("passphrase", b"salt-one");
+        let b = derive_key("passphrase", b"salt-two");
+        assert_ne!(a, b);
+        assert_eq!(a, derive_key("passphrase", b"salt-one"));
+    }
+}
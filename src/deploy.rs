@@ -0,0 +1,183 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use crate::{Config, Result};
+use serde::{Deserialize, Serialize};
+
+/// How pulled files are put in place in the home directory.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Deploy {
+    /// Write the files themselves
+    #[default]
+    Copy,
+    /// Keep the files in ~/.kiwi/store and link to them, like GNU stow
+    Symlink,
+}
+
+impl std::str::FromStr for Deploy {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "copy" => Ok(Deploy::Copy),
+            "symlink" => Ok(Deploy::Symlink),
+            _ => Err("Must be copy or symlink".to_string()),
+        }
+    }
+}
+
+impl Deploy {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Deploy::Copy => "copy",
+            Deploy::Symlink => "symlink",
+        }
+    }
+}
+
+/// Puts pulled files in place: written into the home directory, or kept in
+/// the store, laid out as they are under home, with links to them.
+pub struct Store {
+    dir: PathBuf,
+    home: PathBuf,
+    deploy: Deploy,
+}
+
+impl Store {
+    pub fn new(dir: PathBuf, home: PathBuf, deploy: Deploy) -> Self {
+        Self { dir, home, deploy }
+    }
+
+    /// The store's copy of the file at `path` in the home directory.
+    fn stored_path(&self, path: &Path) -> Option<PathBuf> {
+        Some(self.dir.join(path.strip_prefix(&self.home).ok()?))
+    }
+
+    /// Whether `path` is a link to the store's copy of it.
+    pub fn is_linked(&self, path: &Path) -> bool {
+        match (fs::read_link(path), self.stored_path(path)) {
+            (Ok(target), Some(stored)) => target == stored,
+            _ => false,
+        }
+    }
+
+    /// Writes a file into place, replacing whatever is there. In copy mode
+    /// a link into the store is replaced by the file; other links are
+    /// written through, as they always were.
+    pub fn write(&self, path: &Path, contents: &str) -> Result<()> {
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        let stored = match (self.deploy, self.stored_path(path)) {
+            (Deploy::Symlink, Some(stored)) => stored,
+            _ => {
+                if self.is_linked(path) {
+                    fs::remove_file(path)?;
+                }
+                fs::write(path, contents)?;
+                return Ok(());
+            }
+        };
+
+        if let Some(parent) = stored.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(&stored, contents)?;
+        if !self.is_linked(path) {
+            if path.symlink_metadata().is_ok() {
+                fs::remove_file(path)?;
+            }
+            std::os::unix::fs::symlink(&stored, path)?;
+        }
+        Ok(())
+    }
+
+    /// Turns a file that's already up to date into a link, or a link back
+    /// into a file, to match the deploy mode. Links that don't point into
+    /// the store are the user's own and are left alone. Returns whether
+    /// anything changed.
+    pub fn settle(&self, path: &Path) -> Result<bool> {
+        let linked = self.is_linked(path);
+        let wanted = self.deploy == Deploy::Symlink;
+        if linked == wanted || (!linked && is_symlink(path)) {
+            return Ok(false);
+        }
+        let contents = fs::read_to_string(path)?;
+        self.write(path, &contents)?;
+        Ok(true)
+    }
+}
+
+fn is_symlink(path: &Path) -> bool {
+    path.symlink_metadata().map_or(false, |metadata| metadata.file_type().is_symlink())
+}
+
+/// Whether `path` is a link into the store, so a file kiwi put in place.
+pub fn is_store_link(path: &Path) -> bool {
+    match (fs::read_link(path), Config::store_dir()) {
+        (Ok(target), Ok(store)) => target.starts_with(store),
+        _ => false,
+    }
+}
+
+/// Maps a path in the store, as canonicalize gives for a linked file, back
+/// to where it's linked from in the home directory. Other paths are
+/// returned as they are.
+pub fn unstore(path: PathBuf) -> PathBuf {
+    let home = dirs::home_dir().and_then(|home| home.canonicalize().ok());
+    let store = Config::store_dir().ok().and_then(|store| store.canonicalize().ok());
+    let rest = match (&home, &store) {
+        (Some(_), Some(store)) => path.strip_prefix(store).ok(),
+        _ => None,
+    };
+    match (home, rest) {
+        (Some(home), Some(rest)) => home.join(rest),
+        _ => path,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("kiwi-deploy-{}-{}", name, std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[test]
+    fn symlink_mode_links_into_the_store() {
+        let dir = temp_dir("symlink");
+        let store = Store::new(dir.join("store"), dir.join("home"), Deploy::Symlink);
+        let path = dir.join("home/.config/app.toml");
+        store.write(&path, "a = 1\n").unwrap();
+
+        assert!(store.is_linked(&path));
+        assert_eq!(fs::read_to_string(dir.join("store/.config/app.toml")).unwrap(), "a = 1\n");
+
+        store.write(&path, "a = 2\n").unwrap();
+        assert_eq!(fs::read_to_string(&path).unwrap(), "a = 2\n");
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn settle_switches_between_modes() {
+        let dir = temp_dir("settle");
+        let path = dir.join("home/.zshrc");
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(&path, "export A=1\n").unwrap();
+
+        let linking = Store::new(dir.join("store"), dir.join("home"), Deploy::Symlink);
+        assert!(linking.settle(&path).unwrap());
+        assert!(linking.is_linked(&path));
+        assert!(!linking.settle(&path).unwrap());
+
+        let copying = Store::new(dir.join("store"), dir.join("home"), Deploy::Copy);
+        assert!(copying.settle(&path).unwrap());
+        assert!(!is_symlink(&path));
+        assert_eq!(fs::read_to_string(&path).unwrap(), "export A=1\n");
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,183 @@
+use colored::*;
+use serde::Serialize;
+use similar::{DiffTag, TextDiff};
+
+/// A file as it is on each side of a diff; `None` where it doesn't exist.
+#[derive(Debug, Serialize)]
+pub struct FileDiff {
+    pub path: String,
+    pub old: Option<String>,
+    pub new: Option<String>,
+}
+
+impl FileDiff {
+    pub fn is_changed(&self) -> bool {
+        self.old != self.new
+    }
+}
+
+/// Renders a unified diff of one file, labelling each side.
+pub fn unified(file: &FileDiff, old_label: &str, new_label: &str) -> String {
+    let old_name = match &file.old {
+        Some(_) => format!("a/{} ({})", file.path, old_label),
+        None => "/dev/null".to_string(),
+    };
+    let new_name = match &file.new {
+        Some(_) => format!("b/{} ({})", file.path, new_label),
+        None => "/dev/null".to_string(),
+    };
+    let old = file.old.as_deref().unwrap_or("");
+    let new = file.new.as_deref().unwrap_or("");
+    TextDiff::from_lines(old, new)
+        .unified_diff()
+        .context_radius(3)
+        .header(&old_name, &new_name)
+        .to_string()
+}
+
+/// Prints a unified diff with additions in green and removals in red.
+pub fn print_colored(diff: &str) {
+    for line in diff.lines() {
+        if line.starts_with("+++") || line.starts_with("---") {
+            println!("{}", line.bold());
+        } else if line.starts_with("@@") {
+            println!("{}", line.cyan());
+        } else if line.starts_with('+') {
+            println!("{}", line.green());
+        } else if line.starts_with('-') {
+            println!("{}", line.red());
+        } else {
+            println!("{}", line);
+        }
+    }
+}
+
+/// Renders the changed parts of a file with the two sides next to each
+/// other, the old one on the left, fitted to `width` columns.
+pub fn side_by_side(file: &FileDiff, width: usize) -> Vec<String> {
+    let old = file.old.as_deref().unwrap_or("");
+    let new = file.new.as_deref().unwrap_or("");
+    let diff = TextDiff::from_lines(old, new);
+    let column = width.saturating_sub(3) / 2;
+    let mut rows = Vec::new();
+    for (i, group) in diff.grouped_ops(3).iter().enumerate() {
+        if i > 0 {
+            rows.push("┄".repeat(column * 2 + 3).dimmed().to_string());
+        }
+        for op in group {
+            let (tag, old_range, new_range) = op.as_tag_tuple();
+            for j in 0..old_range.len().max(new_range.len()) {
+                let left = fit(old_range.clone().nth(j).map_or("", |k| diff.old_slices()[k]), column);
+                let right = fit(new_range.clone().nth(j).map_or("", |k| diff.new_slices()[k]), column);
+                rows.push(match tag {
+                    DiffTag::Equal => format!("{} │ {}", left, right),
+                    _ => format!("{} {} {}", left.red(), "│".yellow(), right.green()),
+                });
+            }
+        }
+    }
+    rows
+}
+
+/// Pads or cuts a line to exactly `width` characters.
+fn fit(line: &str, width: usize) -> String {
+    let line = line.trim_end_matches(&['\n', '\r'][..]).replace('\t', "    ");
+    let mut fitted: String = line.chars().take(width).collect();
+    if line.chars().count() > width && fitted.pop().is_some() {
+        fitted.push('…');
+    }
+    format!("{:<width$}", fitted, width = width)
+}
+
+const MARKER_LOCAL: &str = "<<<<<<< local";
+const MARKER_SPLIT: &str = "=======";
+const MARKER_REMOTE: &str = ">>>>>>> remote";
+
+/// Merges two copies of a file the way git leaves a conflicted one: what
+/// they share as is, and each differing stretch as both versions between
+/// markers, for editing into the final file.
+pub fn with_markers(local: &str, remote: &str) -> String {
+    let diff = TextDiff::from_lines(local, remote);
+    let mut merged = String::new();
+    let (mut ours, mut theirs) = (String::new(), String::new());
+    for op in diff.ops() {
+        let (tag, old_range, new_range) = op.as_tag_tuple();
+        if tag != DiffTag::Equal {
+            old_range.for_each(|i| push_line(&mut ours, diff.old_slices()[i]));
+            new_range.for_each(|i| push_line(&mut theirs, diff.new_slices()[i]));
+            continue;
+        }
+        flush_markers(&mut merged, &mut ours, &mut theirs);
+        old_range.for_each(|i| push_line(&mut merged, diff.old_slices()[i]));
+    }
+    flush_markers(&mut merged, &mut ours, &mut theirs);
+    merged
+}
+
+/// Returns whether a merge still has conflict markers in it.
+pub fn has_markers(contents: &str) -> bool {
+    contents.lines().any(|line| line == MARKER_LOCAL || line == MARKER_REMOTE)
+}
+
+fn flush_markers(merged: &mut String, ours: &mut String, theirs: &mut String) {
+    if ours.is_empty() && theirs.is_empty() {
+        return;
+    }
+    for part in [MARKER_LOCAL, ours.as_str(), MARKER_SPLIT, theirs.as_str(), MARKER_REMOTE] {
+        if !part.is_empty() {
+            push_line(merged, part);
+        }
+    }
+    ours.clear();
+    theirs.clear();
+}
+
+/// Appends text that ends a line, adding the newline if it's missing.
+fn push_line(text: &mut String, line: &str) {
+    text.push_str(line);
+    if !line.ends_with('\n') {
+        text.push('\n');
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_unified() {
+        let file = FileDiff {
+            path: ".zshrc".to_string(),
+            old: Some("a\nb\n".to_string()),
+            new: Some("a\nc\n".to_string()),
+        };
+        let diff = unified(&file, "local", "remote");
+        assert!(diff.starts_with("--- a/.zshrc (local)\n+++ b/.zshrc (remote)\n"));
+        assert!(diff.contains("-b\n+c\n"));
+    }
+
+    #[test]
+    fn test_unified_new_file() {
+        let file = FileDiff {
+            path: ".vimrc".to_string(),
+            old: None,
+            new: Some("set nu\n".to_string()),
+        };
+        assert!(unified(&file, "local", "remote").starts_with("--- /dev/null\n"));
+    }
+
+    #[test]
+    fn test_with_markers() {
+        let merged = with_markers("a\nb\nc\n", "a\nB\nc\nd");
+        assert_eq!(merged, "a\n<<<<<<< local\nb\n=======\nB\n>>>>>>> remote\nc\n<<<<<<< local\n=======\nd\n>>>>>>> remote\n");
+        assert!(has_markers(&merged));
+        assert!(!has_markers("a\n=======\n"));
+    }
+
+    #[test]
+    fn test_fit() {
+        assert_eq!(fit("hello world\n", 5), "hell…");
+        assert_eq!(fit("hi\n", 4), "hi  ");
+        assert_eq!(fit("\tx", 6), "    x ");
+    }
+}
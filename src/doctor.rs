@@ -0,0 +1,272 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use crate::{Result, Config, Dotfiles, Homebrew, Sync};
+use crate::credentials;
+use crate::encryption::Encryption;
+use crate::profiles;
+use crate::sync::Backend;
+use reqwest::StatusCode;
+
+/// Something `kiwi doctor` found wrong, and how to put it right.
+pub struct Issue {
+    pub problem: String,
+    /// What to run or change
+    pub fix: String,
+    /// What `kiwi doctor --fix` can do about it by itself
+    pub repair: Option<Repair>,
+}
+
+impl Issue {
+    fn new(problem: impl Into<String>, fix: impl Into<String>) -> Self {
+        Self { problem: problem.into(), fix: fix.into(), repair: None }
+    }
+
+    fn repair(mut self, repair: Repair) -> Self {
+        self.repair = Some(repair);
+        self
+    }
+}
+
+pub enum Repair {
+    CreateDir(PathBuf),
+    /// Make a file readable and writable only by the user
+    RestrictPermissions(PathBuf),
+    InstallHomebrew,
+}
+
+impl Repair {
+    /// Makes the repair, returning what was done.
+    pub fn apply(&self) -> Result<String> {
+        match self {
+            Repair::CreateDir(path) => {
+                fs::create_dir_all(path)?;
+                Ok(format!("Created {}", path.display()))
+            }
+            Repair::RestrictPermissions(path) => {
+                #[cfg(unix)]
+                {
+                    use std::os::unix::fs::PermissionsExt;
+                    fs::set_permissions(path, fs::Permissions::from_mode(0o600))?;
+                }
+                Ok(format!("Made {} readable only by you", path.display()))
+            }
+            Repair::InstallHomebrew => {
+                let install_script = "/bin/bash -c \"$(curl -fsSL https://raw.githubusercontent.com/Homebrew/install/HEAD/install.sh)\"";
+                let status = Command::new("bash").arg("-c").arg(install_script).status()?;
+                if !status.success() {
+                    return Err("The Homebrew installer failed".into());
+                }
+                Ok("Installed Homebrew".to_string())
+            }
+        }
+    }
+}
+
+/// Checks the settings in config.toml, and that kiwi's own files under the
+/// dotfiles directory can be read.
+pub fn check_config(config: &Config) -> Result<Vec<Issue>> {
+    let mut issues = Vec::new();
+    if !config.dotfiles_dir.exists() {
+        issues.push(
+            Issue::new(
+                format!("The dotfiles directory {} doesn't exist", config.dotfiles_dir.display()),
+                "Run `kiwi doctor --fix` to create it, or `kiwi init` to set kiwi up",
+            )
+            .repair(Repair::CreateDir(config.dotfiles_dir.clone())),
+        );
+    }
+    if config.sync_url.is_none() {
+        issues.push(Issue::new("No server is configured", "Set one with `kiwi config set sync_url <url>`"));
+    }
+    if config.sync_token.is_none() && !config.is_serverless() {
+        issues.push(Issue::new(
+            "No API token is saved",
+            "Sign in by running `kiwi init`, or save a token with `kiwi config set sync_token <token>`",
+        ));
+    }
+    if let Some(profile) = &config.profile {
+        if !profiles::is_valid_name(profile) {
+            issues.push(Issue::new(
+                format!("The profile name {:?} isn't valid", profile),
+                "Use letters, digits, underscores and hyphens: `kiwi config set profile <name>`",
+            ));
+        }
+    }
+    if config.encrypt && Encryption::load()?.is_none() {
+        issues.push(Issue::new(
+            "Encryption is on, but this machine has no key",
+            "Run `kiwi encrypt import-key` with the key from `kiwi encrypt export-key` on another machine",
+        ));
+    }
+
+    for name in ["dotfiles.json", "packages.json", "profiles.json", "sync_state.json"] {
+        let path = config.dotfiles_dir.join(name);
+        let contents = match fs::read_to_string(&path) {
+            Ok(contents) => contents,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => continue,
+            Err(e) => {
+                issues.push(Issue::new(format!("Can't read {}: {}", path.display(), e), "Check its permissions"));
+                continue;
+            }
+        };
+        if let Err(e) = serde_json::from_str::<serde_json::Value>(&contents) {
+            issues.push(Issue::new(
+                format!("{} isn't valid JSON: {}", path.display(), e),
+                "Fix it by hand, or move it aside and run `kiwi pull` to get the server's copy",
+            ));
+        }
+    }
+    Ok(issues)
+}
+
+/// Checks credentials can be stored, in the OS keychain or failing that the
+/// encrypted file.
+pub fn check_keychain() -> Vec<Issue> {
+    match credentials::check_keychain() {
+        Ok(()) => Vec::new(),
+        Err(_) if credentials::has_passphrase() => Vec::new(),
+        Err(e) => vec![Issue::new(
+            format!("The OS keychain can't be used ({})", e),
+            "Unlock or install a keychain (Secret Service on Linux), or set KIWI_CREDENTIALS_PASSPHRASE to keep credentials in an encrypted file instead",
+        )],
+    }
+}
+
+/// Checks files holding secrets are private, and that the dotfiles
+/// directory and tracked files can be used.
+pub fn check_permissions(config: &Config, dotfiles: &Dotfiles) -> Result<Vec<Issue>> {
+    let mut issues = Vec::new();
+
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        for path in credentials::secret_files()? {
+            let shared = fs::metadata(&path).map_or(false, |metadata| metadata.permissions().mode() & 0o077 != 0);
+            if shared {
+                issues.push(
+                    Issue::new(
+                        format!("{} can be read by other users", path.display()),
+                        format!("Run `kiwi doctor --fix`, or `chmod 600 {}`", path.display()),
+                    )
+                    .repair(Repair::RestrictPermissions(path)),
+                );
+            }
+        }
+    }
+
+    if is_read_only(&config.dotfiles_dir) {
+        issues.push(Issue::new(
+            format!("The dotfiles directory {} isn't writable", config.dotfiles_dir.display()),
+            format!("Run `chmod u+w {}`", config.dotfiles_dir.display()),
+        ));
+    }
+
+    match dotfiles.list() {
+        Ok(tracked) => {
+            for dotfile in tracked {
+                if !dotfile.path.exists() {
+                    issues.push(Issue::new(
+                        format!("Tracked file {} is missing", dotfile.path.display()),
+                        "Get it back with `kiwi pull`, or stop tracking it with `kiwi remove --keep-local`",
+                    ));
+                }
+            }
+        }
+        Err(e) => issues.push(Issue::new(format!("Can't read the tracked files list: {}", e), "Check dotfiles.json")),
+    }
+    for path in dotfiles.tracked_files().unwrap_or_default() {
+        if let Err(e) = fs::File::open(&path) {
+            if e.kind() == std::io::ErrorKind::PermissionDenied {
+                issues.push(Issue::new(
+                    format!("Can't read tracked file {}", path.display()),
+                    format!("Run `chmod u+r {}`", path.display()),
+                ));
+            }
+        }
+    }
+    Ok(issues)
+}
+
+fn is_read_only(path: &Path) -> bool {
+    fs::metadata(path).map_or(false, |metadata| metadata.permissions().readonly())
+}
+
+/// Checks Homebrew is installed and can list packages.
+pub fn check_package_manager(homebrew: &Homebrew) -> Vec<Issue> {
+    let found = Command::new("brew")
+        .arg("--version")
+        .output()
+        .map_or(false, |output| output.status.success());
+    if !found {
+        return vec![Issue::new(
+            "Homebrew isn't installed, or isn't on your PATH",
+            "Install it from https://brew.sh (or `kiwi doctor --fix`), or skip packages with `kiwi restore --skip-packages`",
+        )
+        .repair(Repair::InstallHomebrew)];
+    }
+    match homebrew.list_installed() {
+        Ok(_) => Vec::new(),
+        Err(e) => vec![Issue::new(
+            format!("Homebrew can't list installed packages: {}", e),
+            "Run `brew doctor` and follow what it suggests",
+        )],
+    }
+}
+
+/// Checks the server can be reached and accepts the token, or that the git
+/// repository or snapshot directory synced with instead can be read.
+pub async fn check_server(config: &Config, sync: Option<&Sync>) -> Vec<Issue> {
+    let (sync, url) = match (sync, &config.sync_url) {
+        (Some(sync), Some(url)) => (sync, url),
+        // Already reported by check_config
+        _ => return Vec::new(),
+    };
+    if let Some(backend) = sync.backend() {
+        let hint = match backend {
+            Backend::Git(_) => "Check the URL and that git can sign in to it: run `git ls-remote <url>` to see",
+            Backend::Local(_) => "Connect the drive it's on, or point `sync_url` somewhere else",
+        };
+        return match backend.check() {
+            Ok(()) => Vec::new(),
+            Err(e) => vec![Issue::new(format!("Can't read {}: {}", backend.describe(), e), hint)],
+        };
+    }
+    match sync.probe().await {
+        Ok(status) if status.is_success() => Vec::new(),
+        Ok(StatusCode::UNAUTHORIZED) | Ok(StatusCode::FORBIDDEN) => vec![Issue::new(
+            "The server rejected your API token",
+            "Get a new token and save it with `kiwi config set sync_token <token>`",
+        )],
+        Ok(status) => vec![Issue::new(
+            format!("The server at {} answered {}", url, status),
+            "Try again later; if it keeps happening, check the server URL with `kiwi config get sync_url`",
+        )],
+        Err(e) => vec![Issue::new(
+            format!("Can't reach the server at {}: {}", url, e),
+            "Check your network connection and the server URL (`kiwi config get sync_url`)",
+        )],
+    }
+}
+
+/// Writes the findings as a Markdown report.
+pub fn write_report(sections: &[(&str, Vec<Issue>)], path: &Path) -> Result<()> {
+    let mut report = String::new();
+    report.push_str("# Kiwi Health Report\n\n");
+    report.push_str(&format!("Generated on: {}\n\n", chrono::Local::now()));
+
+    for (category, issues) in sections {
+        report.push_str(&format!("## {}\n\n", category));
+        if issues.is_empty() {
+            report.push_str("✅ No issues found\n\n");
+            continue;
+        }
+        for issue in issues {
+            report.push_str(&format!("- ⚠️ {}\n  - Fix: {}\n", issue.problem, issue.fix));
+        }
+        report.push('\n');
+    }
+
+    fs::write(path, report)?;
+    Ok(())
+}
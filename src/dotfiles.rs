@@ -1,6 +1,8 @@
 use std::path::{Path, PathBuf};
 use std::fs;
 use crate::{Result, KiwiError};
+use crate::deploy;
+use crate::kiwiignore::KiwiIgnore;
 use serde::{Deserialize, Serialize};
 
 #[derive(Debug, Serialize, Deserialize)]
@@ -10,6 +12,22 @@ pub struct Dotfile {
     pub synced: bool,
 }
 
+/// Dotfiles `kiwi init` offers to track, relative to the home directory.
+/// Directories are tracked file by file.
+pub const COMMON_DOTFILES: &[&str] = &[
+    ".zshrc",
+    ".zprofile",
+    ".bashrc",
+    ".bash_profile",
+    ".gitconfig",
+    ".gitignore_global",
+    ".vimrc",
+    ".tmux.conf",
+    ".ssh/config",
+    ".config/nvim",
+    ".config/starship.toml",
+];
+
 pub struct Dotfiles {
     dotfiles_dir: PathBuf,
     dotfiles_file: PathBuf,
@@ -24,7 +42,7 @@ impl Dotfiles {
     }
 
     pub fn add(&self, path: &Path, alias: Option<String>) -> Result<()> {
-        let path = path.canonicalize()?;
+        let path = deploy::unstore(path.canonicalize()?);
         
         if !path.exists() {
             return Err(KiwiError::Dotfiles(format!("File does not exist: {}", path.display())));
@@ -35,6 +53,16 @@ impl Dotfiles {
         if dotfiles.iter().any(|d| d.path == path) {
             return Err(KiwiError::Dotfiles(format!("File already tracked: {}", path.display())));
         }
+        if let Some(dir) = dotfiles.iter().find(|d| path.starts_with(&d.path)) {
+            return Err(KiwiError::Dotfiles(format!("File already synced as part of {}", dir.path.display())));
+        }
+
+        // Name the link after where the file sits in the home directory, so
+        // files with the same name in different directories don't collide
+        let alias = alias.or_else(|| {
+            let home = dirs::home_dir()?.canonicalize().ok()?;
+            Some(path.strip_prefix(home).ok()?.to_string_lossy().to_string())
+        });
 
         let dotfile = Dotfile {
             path: path.clone(),
@@ -48,7 +76,7 @@ impl Dotfiles {
             fs::create_dir_all(parent)?;
         }
 
-        if target.exists() {
+        if target.symlink_metadata().is_ok() {
             fs::remove_file(&target)?;
         }
 
@@ -61,26 +89,27 @@ impl Dotfiles {
     }
 
     pub fn remove(&self, path: &Path) -> Result<()> {
-        let path = path.canonicalize()?;
+        let path = deploy::unstore(path.canonicalize()?);
         let mut dotfiles = self.load_dotfiles()?;
 
         if let Some(index) = dotfiles.iter().position(|d| d.path == path) {
             let dotfile = &dotfiles[index];
-            
-            if let Some(alias) = &dotfile.alias {
-                let target = self.dotfiles_dir.join(alias);
-                if target.exists() {
-                    fs::remove_file(target)?;
-                }
-            } else {
-                let target = self.dotfiles_dir.join(path.file_name().unwrap());
-                if target.exists() {
-                    fs::remove_file(target)?;
-                }
+            let target = match &dotfile.alias {
+                Some(alias) => self.dotfiles_dir.join(alias),
+                None => self.dotfiles_dir.join(path.file_name().unwrap()),
+            };
+            if target.symlink_metadata().is_ok() {
+                fs::remove_file(target)?;
             }
 
             dotfiles.remove(index);
             self.save_dotfiles(&dotfiles)?;
+        } else if let Some(dir) = dotfiles.iter().find(|d| path.starts_with(&d.path)) {
+            return Err(KiwiError::Dotfiles(format!(
+                "{} is synced as part of {}; add it to a .kiwiignore to stop syncing it",
+                path.display(),
+                dir.path.display()
+            )));
         } else {
             return Err(KiwiError::Dotfiles(format!("File not tracked: {}", path.display())));
         }
@@ -88,6 +117,59 @@ impl Dotfiles {
         Ok(())
     }
 
+    /// Returns the common dotfiles that exist under `home`.
+    pub fn detect(home: &Path) -> Vec<PathBuf> {
+        COMMON_DOTFILES.iter()
+            .map(|name| home.join(name))
+            .filter(|path| path.exists())
+            .collect()
+    }
+
+    /// Returns the files to sync for `path`: the path itself, or for a
+    /// directory every regular file under it that isn't ignored. Symlinks,
+    /// sockets and the like inside are skipped, except links kiwi made into
+    /// its store.
+    pub fn expand(path: &Path, ignore: &KiwiIgnore) -> Result<Vec<PathBuf>> {
+        if !path.is_dir() {
+            return Ok(vec![path.to_path_buf()]);
+        }
+        let mut files = Vec::new();
+        let mut dirs = vec![path.to_path_buf()];
+        while let Some(dir) = dirs.pop() {
+            for entry in fs::read_dir(&dir)? {
+                let entry = entry?;
+                let file_type = entry.file_type()?;
+                if file_type.is_dir() {
+                    if !ignore.is_ignored(&entry.path(), true) {
+                        dirs.push(entry.path());
+                    }
+                } else if (file_type.is_file() || (file_type.is_symlink() && deploy::is_store_link(&entry.path())))
+                    && !ignore.is_ignored(&entry.path(), false)
+                {
+                    files.push(entry.path());
+                }
+            }
+        }
+        files.sort();
+        Ok(files)
+    }
+
+    /// Returns every file to sync: tracked files, and the files under
+    /// tracked directories minus those .kiwiignore excludes.
+    pub fn tracked_files(&self) -> Result<Vec<PathBuf>> {
+        let home = dirs::home_dir().ok_or_else(|| {
+            KiwiError::Config("Could not find home directory".to_string())
+        })?;
+        let ignore = KiwiIgnore::load(&home)?;
+        let mut files = Vec::new();
+        for dotfile in self.load_dotfiles()? {
+            files.extend(Self::expand(&dotfile.path, &ignore)?);
+        }
+        files.sort();
+        files.dedup();
+        Ok(files)
+    }
+
     pub fn list(&self) -> Result<Vec<Dotfile>> {
         Ok(self.load_dotfiles()?)
     }
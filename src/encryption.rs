@@ -0,0 +1,105 @@
+use std::io::{Read, Write};
+use crate::{Result, KiwiError};
+use crate::credentials::{self, CredentialStore};
+use age::secrecy::ExposeSecret;
+
+const ARMOR_HEADER: &str = "-----BEGIN AGE ENCRYPTED FILE-----";
+
+/// The age key files are encrypted with before they're pushed, so the
+/// server only ever stores ciphertext. Every machine shares the same key;
+/// it's kept in the OS keychain, or ~/.kiwi/age.key without one.
+pub struct Encryption {
+    identity: age::x25519::Identity,
+}
+
+impl Encryption {
+    /// Returns this machine's key, if it has one.
+    pub fn load() -> Result<Option<Self>> {
+        match credentials::load_encryption_key()? {
+            Some(secret) => Self::parse(&secret).map(Some),
+            None => Ok(None),
+        }
+    }
+
+    /// Creates a new key and stores it.
+    pub fn generate() -> Result<(Self, CredentialStore)> {
+        let encryption = Self { identity: age::x25519::Identity::generate() };
+        let store = credentials::store_encryption_key(&encryption.secret())?;
+        Ok((encryption, store))
+    }
+
+    /// Stores a key exported from another machine.
+    pub fn import(secret: &str) -> Result<(Self, CredentialStore)> {
+        let encryption = Self::parse(secret)?;
+        let store = credentials::store_encryption_key(&encryption.secret())?;
+        Ok((encryption, store))
+    }
+
+    /// Reads a key without storing it.
+    pub fn parse(secret: &str) -> Result<Self> {
+        let identity = secret.trim().parse::<age::x25519::Identity>().map_err(|e| {
+            KiwiError::Encryption(format!("Invalid key: {}", e))
+        })?;
+        Ok(Self { identity })
+    }
+
+    /// The public half of the key (age1...), which is safe to share.
+    pub fn recipient(&self) -> String {
+        self.identity.to_public().to_string()
+    }
+
+    /// The secret key (AGE-SECRET-KEY-1...), for `kiwi encrypt export-key`.
+    pub fn secret(&self) -> String {
+        self.identity.to_string().expose_secret().to_string()
+    }
+
+    /// Encrypts contents into an ASCII-armored age file.
+    pub fn encrypt(&self, plaintext: &str) -> Result<String> {
+        let encryptor = age::Encryptor::with_recipients(vec![Box::new(self.identity.to_public())])
+            .ok_or_else(|| KiwiError::Encryption("No recipient to encrypt to".to_string()))?;
+        let mut output = Vec::new();
+        let armor = age::armor::ArmoredWriter::wrap_output(&mut output, age::armor::Format::AsciiArmor)?;
+        let mut writer = encryptor.wrap_output(armor).map_err(|e| KiwiError::Encryption(e.to_string()))?;
+        writer.write_all(plaintext.as_bytes())?;
+        writer.finish().and_then(|armor| armor.finish())?;
+        String::from_utf8(output).map_err(|e| KiwiError::Encryption(e.to_string()))
+    }
+
+    /// Decrypts an ASCII-armored age file.
+    pub fn decrypt(&self, armored: &str) -> Result<String> {
+        let decryptor = match age::Decryptor::new(age::armor::ArmoredReader::new(armored.as_bytes())) {
+            Ok(age::Decryptor::Recipients(decryptor)) => decryptor,
+            Ok(_) => return Err(KiwiError::Encryption("Encrypted with a passphrase rather than a key".to_string())),
+            Err(e) => return Err(KiwiError::Encryption(e.to_string())),
+        };
+        let mut reader = decryptor
+            .decrypt(std::iter::once(&self.identity as &dyn age::Identity))
+            .map_err(|e| KiwiError::Encryption(e.to_string()))?;
+        let mut plaintext = String::new();
+        reader.read_to_string(&mut plaintext)?;
+        Ok(plaintext)
+    }
+}
+
+/// Returns whether contents from the server are encrypted.
+pub fn is_encrypted(contents: &str) -> bool {
+    contents.starts_with(ARMOR_HEADER)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_round_trip() {
+        let encryption = Encryption { identity: age::x25519::Identity::generate() };
+        let encrypted = encryption.encrypt("export EDITOR=vim\n").unwrap();
+        assert!(is_encrypted(&encrypted));
+        assert!(!encrypted.contains("EDITOR"));
+        assert_eq!(encryption.decrypt(&encrypted).unwrap(), "export EDITOR=vim\n");
+
+        let other = Encryption { identity: age::x25519::Identity::generate() };
+        assert!(other.decrypt(&encrypted).is_err());
+        assert_eq!(Encryption::parse(&encryption.secret()).unwrap().recipient(), encryption.recipient());
+    }
+}
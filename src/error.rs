@@ -18,6 +18,18 @@ pub enum KiwiError {
     #[error("Dotfiles error: {0}")]
     Dotfiles(String),
 
+    #[error("Template error: {0}")]
+    Template(String),
+
+    #[error("Encryption error: {0}")]
+    Encryption(String),
+
+    #[error("Push blocked: {0}")]
+    SecretsFound(String),
+
+    #[error("Hook failed: {0}")]
+    Hook(String),
+
     #[error("Invalid command: {0}")]
     InvalidCommand(String),
 
@@ -69,6 +81,12 @@ impl KiwiError {
         )
     }
 
+    /// Whether the server couldn't be reached, rather than that it answered
+    /// with a refusal.
+    pub fn is_offline(&self) -> bool {
+        matches!(self, KiwiError::Network(e) if e.is_connect() || e.is_timeout())
+    }
+
     pub fn suggestion(&self) -> Option<String> {
         match self {
             KiwiError::FileNotFound { path } => {
@@ -78,7 +96,7 @@ impl KiwiError {
                 Some(format!("Try running with sudo or check file permissions at: {}", path.display()))
             }
             KiwiError::InvalidConfig { key, .. } => {
-                Some(format!("Try updating the configuration with: kiwi config {} <value>", key))
+                Some(format!("Try updating the configuration with: kiwi config set {} <value>", key))
             }
             KiwiError::PackageError { name, .. } => {
                 Some(format!("Try running 'brew doctor' or 'brew update' before installing {}", name))
@@ -0,0 +1,303 @@
+use std::collections::{HashMap, HashSet};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use crate::homebrew::Package;
+use crate::sync::{relative_key, Change, SyncData};
+use crate::{KiwiError, Result};
+use sha2::{Digest, Sha256};
+
+/// Branch pushed to when the URL doesn't name one.
+const DEFAULT_BRANCH: &str = "main";
+/// Where files sit in the repository, by their path relative to the home
+/// directory, beside packages.json.
+const FILES_DIR: &str = "files";
+const PACKAGES_FILE: &str = "packages.json";
+
+/// Whether a sync URL names a git repository rather than a kiwi server:
+/// git@host:path, ssh:// and file:// URLs, anything ending in .git, or any
+/// URL prefixed with git+.
+pub fn is_git_url(url: &str) -> bool {
+    let url = url.split('#').next().unwrap_or(url);
+    url.starts_with("git@")
+        || url.starts_with("git+")
+        || url.starts_with("ssh://")
+        || url.starts_with("file://")
+        || url.trim_end_matches('/').ends_with(".git")
+}
+
+/// A git repository used in place of kiwi-server. Each push is a commit on
+/// one branch, and a revision is the number of commits up to it, so the
+/// first push is revision 1 as it is on a server. git does the signing in,
+/// with the SSH keys or credential helper it already uses.
+#[derive(Debug)]
+pub struct GitRemote {
+    url: String,
+    branch: String,
+    /// A clone kept between runs, so a pull only fetches what's new
+    dir: PathBuf,
+}
+
+impl GitRemote {
+    /// `url` can name a branch after a #, like
+    /// git@github.com:me/dotfiles.git#laptop. Clones are kept under
+    /// `checkouts`, one per repository.
+    pub fn new(url: &str, checkouts: &Path) -> Self {
+        let (url, branch) = match url.split_once('#') {
+            Some((url, branch)) if !branch.is_empty() => (url, branch),
+            _ => (url.trim_end_matches('#'), DEFAULT_BRANCH),
+        };
+        let url = url.strip_prefix("git+").unwrap_or(url);
+        let id = format!("{:x}", Sha256::digest(url.as_bytes()));
+        Self {
+            url: url.to_string(),
+            branch: branch.to_string(),
+            dir: checkouts.join(&id[..16]),
+        }
+    }
+
+    pub fn url(&self) -> &str {
+        &self.url
+    }
+
+    pub fn branch(&self) -> &str {
+        &self.branch
+    }
+
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// Checks the repository can be reached and read.
+    pub fn check(&self) -> Result<()> {
+        run(None, &["ls-remote", "--heads", &self.url, &self.branch])?;
+        Ok(())
+    }
+
+    /// Fetches the branch, returning its files and packages, the commit
+    /// they're at, and its revision. A repository nothing was pushed to yet
+    /// has neither.
+    pub fn fetch(&self) -> Result<(SyncData, Option<String>, i64)> {
+        let commit = match self.fetch_branch()? {
+            Some(commit) => commit,
+            None => return Ok((SyncData { files: HashMap::new(), packages: Vec::new() }, None, 0)),
+        };
+        let data = self.read(&commit)?;
+        let revision = self.revision(&commit)?;
+        Ok((data, Some(commit), revision))
+    }
+
+    /// Returns the files and packages as they were at `revision`.
+    pub fn snapshot(&self, revision: i64) -> Result<SyncData> {
+        let commits = match self.fetch_branch()? {
+            Some(tip) => self.commits(&tip)?,
+            None => Vec::new(),
+        };
+        let commit = usize::try_from(revision - 1).ok()
+            .and_then(|index| commits.get(index))
+            .ok_or_else(|| KiwiError::Sync(format!("No revision {} in {}", revision, self.url)))?;
+        self.read(commit)
+    }
+
+    /// Commits the files and packages on top of `parent`, the commit they
+    /// were fetched at, and pushes it. The push is refused when the branch
+    /// moved since, unless `force`. Returns the new revision, or the current
+    /// one when nothing changed.
+    pub fn push(&self, data: &SyncData, parent: Option<&str>, force: bool, message: &str) -> Result<i64> {
+        self.open()?;
+        match parent {
+            Some(commit) => {
+                self.git(&["reset", "--hard", "--quiet", commit])?;
+            }
+            None => {
+                // Start a history of its own
+                let _ = self.git(&["update-ref", "-d", "HEAD"]);
+                self.git(&["rm", "-r", "-q", "--cached", "--ignore-unmatch", "."])?;
+            }
+        }
+
+        let files_dir = self.dir.join(FILES_DIR);
+        if files_dir.exists() {
+            fs::remove_dir_all(&files_dir)?;
+        }
+        for (key, contents) in &data.files {
+            let path = files_dir.join(key);
+            if let Some(parent) = path.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            fs::write(path, contents)?;
+        }
+        fs::write(self.dir.join(PACKAGES_FILE), serde_json::to_vec_pretty(&data.packages)?)?;
+        self.git(&["add", "-A", "--", FILES_DIR, PACKAGES_FILE])?;
+
+        let changed = !self.git(&["status", "--porcelain", "--", FILES_DIR, PACKAGES_FILE])?.trim().is_empty();
+        if !changed && parent.is_some() {
+            return self.revision("HEAD");
+        }
+        self.git(&["commit", "--quiet", "--allow-empty", "-m", message])?;
+
+        let target = format!("HEAD:refs/heads/{}", self.branch);
+        let mut args = vec!["push", "--quiet", "origin", target.as_str()];
+        if force {
+            args.push("--force");
+        }
+        match self.git(&args) {
+            Ok(_) => self.revision("HEAD"),
+            Err(KiwiError::Sync(message)) if message.contains("[rejected]") || message.contains("non-fast-forward") => {
+                Err("The remote changed since it was last pulled; run `kiwi pull` first, or push with --force to overwrite it".into())
+            }
+            Err(e) => Err(e),
+        }
+    }
+
+    /// The latest change to each file and to the package list, oldest
+    /// first, as a server lists them.
+    pub fn changes(&self) -> Result<Vec<Change>> {
+        let tip = match self.fetch_branch()? {
+            Some(tip) => tip,
+            None => return Ok(Vec::new()),
+        };
+        let log = self.git(&["log", "--no-renames", "--name-status", "--format=@%cI", &tip])?;
+        let mut revision = self.revision(&tip)? + 1;
+        let mut updated_at = String::new();
+        let mut seen = HashSet::new();
+        let mut changes = Vec::new();
+        for line in log.lines() {
+            if let Some(date) = line.strip_prefix('@') {
+                revision -= 1;
+                updated_at = date.to_string();
+                continue;
+            }
+            let (status, path) = match line.split_once('\t') {
+                Some(entry) => entry,
+                None => continue,
+            };
+            let (kind, path) = if path == PACKAGES_FILE {
+                ("packages_updated", None)
+            } else if let Some(key) = path.strip_prefix(FILES_DIR).and_then(|rest| rest.strip_prefix('/')) {
+                (if status == "D" { "file_deleted" } else { "file_updated" }, Some(key.to_string()))
+            } else {
+                continue;
+            };
+            if seen.insert(path.clone()) {
+                changes.push(Change {
+                    revision,
+                    kind: kind.to_string(),
+                    path,
+                    updated_at: updated_at.clone(),
+                });
+            }
+        }
+        changes.reverse();
+        Ok(changes)
+    }
+
+    /// Makes the clone if there isn't one. It starts empty so a repository
+    /// nobody pushed to yet works too.
+    fn open(&self) -> Result<()> {
+        if self.dir.join(".git").is_dir() {
+            return Ok(());
+        }
+        fs::create_dir_all(&self.dir)?;
+        self.git(&["init", "--quiet"])?;
+        self.git(&["remote", "add", "origin", &self.url])?;
+        // Commits need an author; git's own settings win when there are any
+        if self.git(&["config", "user.email"]).is_err() {
+            self.git(&["config", "user.name", "kiwi"])?;
+            self.git(&["config", "user.email", &format!("kiwi@{}", crate::template::hostname())])?;
+        }
+        Ok(())
+    }
+
+    /// Fetches the branch, returning the commit at its tip, or None when it
+    /// doesn't exist yet.
+    fn fetch_branch(&self) -> Result<Option<String>> {
+        self.open()?;
+        let refspec = format!("+refs/heads/{0}:refs/remotes/origin/{0}", self.branch);
+        match self.git(&["fetch", "--quiet", "--no-tags", "origin", &refspec]) {
+            Ok(_) => {}
+            Err(KiwiError::Sync(message)) if message.contains("couldn't find remote ref") => return Ok(None),
+            Err(e) => return Err(e),
+        }
+        let tip = self.git(&["rev-parse", &format!("refs/remotes/origin/{}", self.branch)])?;
+        Ok(Some(tip.trim().to_string()))
+    }
+
+    /// Reads the files and packages at a commit without checking it out.
+    fn read(&self, commit: &str) -> Result<SyncData> {
+        let mut files = HashMap::new();
+        let listing = self.git(&["ls-tree", "-r", "-z", "--name-only", commit, "--", FILES_DIR])?;
+        let prefix = Path::new(FILES_DIR);
+        for path in listing.split('\0').filter(|path| !path.is_empty()) {
+            let key = match relative_key(prefix, Path::new(path)) {
+                Some(key) => key,
+                None => continue,
+            };
+            files.insert(key, self.git(&["show", &format!("{}:{}", commit, path)])?);
+        }
+        let packages: Vec<Package> = match self.git(&["show", &format!("{}:{}", commit, PACKAGES_FILE)]) {
+            Ok(json) => serde_json::from_str(&json)?,
+            Err(_) => Vec::new(),
+        };
+        Ok(SyncData { files, packages })
+    }
+
+    /// How many commits lead up to `commit`, counting it.
+    fn revision(&self, commit: &str) -> Result<i64> {
+        let count = self.git(&["rev-list", "--count", commit])?;
+        count.trim().parse().map_err(|_| KiwiError::Sync(format!("Unexpected output from git rev-list: {}", count)))
+    }
+
+    /// Every commit leading up to `tip`, oldest first.
+    fn commits(&self, tip: &str) -> Result<Vec<String>> {
+        Ok(self.git(&["rev-list", "--reverse", tip])?.lines().map(str::to_string).collect())
+    }
+
+    fn git(&self, args: &[&str]) -> Result<String> {
+        run(Some(&self.dir), args)
+    }
+}
+
+/// Runs git, returning what it printed, or failing with its error output.
+fn run(dir: Option<&Path>, args: &[&str]) -> Result<String> {
+    let mut command = Command::new("git");
+    if let Some(dir) = dir {
+        command.current_dir(dir);
+    }
+    // Fail rather than wait on a password prompt nobody may see
+    let output = command
+        .args(args)
+        .env("GIT_TERMINAL_PROMPT", "0")
+        .output()
+        .map_err(|e| KiwiError::Sync(format!("Could not run git: {}", e)))?;
+    if !output.status.success() {
+        return Err(KiwiError::Sync(format!(
+            "git {} failed: {}",
+            args.first().unwrap_or(&""),
+            String::from_utf8_lossy(&output.stderr).trim()
+        )));
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn git_urls_are_told_from_servers() {
+        assert!(is_git_url("git@github.com:me/dotfiles.git"));
+        assert!(is_git_url("https://gitlab.com/me/dotfiles.git#laptop"));
+        assert!(is_git_url("git+https://git.example.com/me/dotfiles"));
+        assert!(is_git_url("ssh://git@example.com/dotfiles"));
+        assert!(!is_git_url("https://kiwi.example.com"));
+    }
+
+    #[test]
+    fn branch_comes_from_the_url() {
+        let remote = GitRemote::new("git+https://example.com/dotfiles#laptop", Path::new("/tmp"));
+        assert_eq!(remote.url(), "https://example.com/dotfiles");
+        assert_eq!(remote.branch(), "laptop");
+        assert_eq!(GitRemote::new("git@github.com:me/dotfiles.git", Path::new("/tmp")).branch(), "main");
+    }
+}
@@ -113,6 +113,25 @@ impl Homebrew {
         Ok(())
     }
 
+    /// Returns the names of the packages in packages.json, rereading it in
+    /// case a pull has replaced it.
+    pub fn saved_packages(&mut self) -> Vec<String> {
+        self.saved().into_iter().map(|package| package.name).collect()
+    }
+
+    /// Returns the packages in packages.json by name, rereading it like
+    /// saved_packages.
+    pub fn saved(&mut self) -> Vec<Package> {
+        if let Ok(contents) = std::fs::read_to_string(&self.packages_file) {
+            if let Ok(cache) = serde_json::from_str(&contents) {
+                self.cache = cache;
+            }
+        }
+        let mut packages: Vec<_> = self.cache.values().cloned().collect();
+        packages.sort_by(|a, b| a.name.cmp(&b.name));
+        packages
+    }
+
     pub fn list_installed(&self) -> Result<Vec<Package>> {
         let output = Command::new("brew")
             .arg("list")
@@ -0,0 +1,83 @@
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use crate::{Result, KiwiError};
+
+/// Points in a sync where a user's script can run.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Hook {
+    /// Before a push reads the tracked files; failing stops the push
+    PrePush,
+    /// After a pull has written files
+    PostPull,
+    /// After `kiwi restore` has set the machine up
+    PostRestore,
+}
+
+impl Hook {
+    pub fn name(&self) -> &'static str {
+        match self {
+            Hook::PrePush => "pre-push",
+            Hook::PostPull => "post-pull",
+            Hook::PostRestore => "post-restore",
+        }
+    }
+}
+
+/// Scripts in ~/.kiwi/hooks named after the hook they're for, like git's.
+/// The hooks directory never syncs, so a hook only runs if it was installed
+/// on this machine, and only once it's been made executable.
+pub struct Hooks {
+    dir: PathBuf,
+    profile: Option<String>,
+}
+
+impl Hooks {
+    pub fn new(dir: PathBuf, profile: Option<String>) -> Self {
+        Self { dir, profile }
+    }
+
+    pub fn path(&self, hook: Hook) -> PathBuf {
+        self.dir.join(hook.name())
+    }
+
+    /// Runs a hook in the home directory if it's installed, telling it which
+    /// files changed (paths relative to the home directory, one per line) in
+    /// KIWI_CHANGED_FILES. Returns whether there was a hook to run; one that
+    /// isn't executable is an error rather than being skipped quietly.
+    pub fn run(&self, hook: Hook, changed: &[String]) -> Result<bool> {
+        let path = self.path(hook);
+        if !path.is_file() {
+            return Ok(false);
+        }
+        if !is_executable(&path) {
+            return Err(KiwiError::Hook(format!("{} isn't executable, so it wasn't run; `chmod +x {}` to turn it on", hook.name(), path.display())));
+        }
+        let mut command = Command::new(&path);
+        command
+            .current_dir(dirs::home_dir().unwrap_or_default())
+            .env("KIWI_HOOK", hook.name())
+            .env("KIWI_CHANGED_FILES", changed.join("\n"));
+        if let Some(profile) = &self.profile {
+            command.env("KIWI_PROFILE", profile);
+        }
+
+        let status = command.status()
+            .map_err(|e| KiwiError::Hook(format!("{} could not be run: {}", hook.name(), e)))?;
+        if !status.success() {
+            let code = status.code().map_or_else(|| "a signal".to_string(), |code| format!("status {}", code));
+            return Err(KiwiError::Hook(format!("{} exited with {}", hook.name(), code)));
+        }
+        Ok(true)
+    }
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> bool {
+    use std::os::unix::fs::PermissionsExt;
+    std::fs::metadata(path).map_or(false, |metadata| metadata.permissions().mode() & 0o111 != 0)
+}
+
+#[cfg(not(unix))]
+fn is_executable(_path: &Path) -> bool {
+    false
+}
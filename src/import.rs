@@ -0,0 +1,276 @@
+use std::fs::{self, File};
+use std::path::{Component, Path, PathBuf};
+use std::process::Command;
+use crate::{KiwiError, Result};
+use flate2::read::GzDecoder;
+
+/// Files at the top of a dotfiles repository that are about the repository
+/// rather than meant for the home directory.
+const REPO_FILES: &[&str] = &[
+    ".git", ".github", ".gitignore", ".gitmodules", ".gitattributes",
+    "README", "README.md", "LICENSE", "LICENSE.md", "Makefile",
+    "install", "install.sh", "bootstrap.sh", "Brewfile",
+];
+
+/// Where `kiwi import` reads dotfiles from.
+pub enum Source {
+    /// A .tar.gz, .tgz, .tar or .zip, such as one `kiwi export` wrote
+    Archive(PathBuf),
+    /// A repository to clone
+    Git(String),
+    /// A directory already on disk, like a cloned repository
+    Dir(PathBuf),
+}
+
+impl Source {
+    pub fn parse(value: &str) -> Result<Self> {
+        if value.contains("://") || value.starts_with("git@") {
+            return Ok(Source::Git(value.to_string()));
+        }
+        let path = PathBuf::from(value);
+        if path.is_dir() {
+            return Ok(Source::Dir(path));
+        }
+        if !path.is_file() {
+            return Err(KiwiError::FileNotFound { path });
+        }
+        if archive_kind(&path).is_none() {
+            return Err(KiwiError::ValidationError(format!(
+                "{} isn't a .tar.gz, .tgz, .tar or .zip archive",
+                path.display()
+            )));
+        }
+        Ok(Source::Archive(path))
+    }
+
+    /// Unpacks or clones the source into `staging`, returning the directory
+    /// files should be mapped from.
+    pub fn fetch(&self, staging: &Path) -> Result<PathBuf> {
+        let root = match self {
+            Source::Dir(dir) => dir.clone(),
+            Source::Git(url) => {
+                let output = Command::new("git")
+                    .args(["clone", "--depth", "1", "--quiet", url])
+                    .arg(staging)
+                    .output()
+                    .map_err(|e| KiwiError::Dotfiles(format!("Could not run git: {}", e)))?;
+                if !output.status.success() {
+                    return Err(KiwiError::Dotfiles(format!(
+                        "git clone {} failed: {}",
+                        url,
+                        String::from_utf8_lossy(&output.stderr).trim()
+                    )));
+                }
+                staging.to_path_buf()
+            }
+            Source::Archive(path) => {
+                unpack(path, staging)?;
+                staging.to_path_buf()
+            }
+        };
+        find_root(&root)
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ArchiveKind {
+    TarGz,
+    Tar,
+    Zip,
+}
+
+fn archive_kind(path: &Path) -> Option<ArchiveKind> {
+    let name = path.file_name()?.to_string_lossy().to_lowercase();
+    if name.ends_with(".tar.gz") || name.ends_with(".tgz") {
+        Some(ArchiveKind::TarGz)
+    } else if name.ends_with(".tar") {
+        Some(ArchiveKind::Tar)
+    } else if name.ends_with(".zip") {
+        Some(ArchiveKind::Zip)
+    } else {
+        None
+    }
+}
+
+/// Extracts an archive. Entries that would land outside `dir` are refused
+/// by tar and skipped for zip.
+fn unpack(path: &Path, dir: &Path) -> Result<()> {
+    fs::create_dir_all(dir)?;
+    match archive_kind(path) {
+        Some(ArchiveKind::TarGz) => tar::Archive::new(GzDecoder::new(File::open(path)?)).unpack(dir)?,
+        Some(ArchiveKind::Tar) => tar::Archive::new(File::open(path)?).unpack(dir)?,
+        Some(ArchiveKind::Zip) => {
+            let mut zip = zip::ZipArchive::new(File::open(path)?).map_err(zip_error)?;
+            for i in 0..zip.len() {
+                let mut entry = zip.by_index(i).map_err(zip_error)?;
+                let target = match entry.enclosed_name() {
+                    Some(name) => dir.join(name),
+                    None => continue,
+                };
+                if entry.is_dir() {
+                    fs::create_dir_all(&target)?;
+                    continue;
+                }
+                if let Some(parent) = target.parent() {
+                    fs::create_dir_all(parent)?;
+                }
+                std::io::copy(&mut entry, &mut File::create(&target)?)?;
+                #[cfg(unix)]
+                {
+                    use std::os::unix::fs::PermissionsExt;
+                    if let Some(mode) = entry.unix_mode() {
+                        fs::set_permissions(&target, fs::Permissions::from_mode(mode & 0o777))?;
+                    }
+                }
+            }
+        }
+        None => return Err(format!("Unknown archive type: {}", path.display()).into()),
+    }
+    Ok(())
+}
+
+fn zip_error(e: zip::result::ZipError) -> KiwiError {
+    KiwiError::Dotfiles(format!("Failed to read the archive: {}", e))
+}
+
+/// Finds where the files start: home/ in an archive `kiwi export` wrote, or
+/// inside the one directory an archive of a repository usually wraps
+/// everything in.
+fn find_root(dir: &Path) -> Result<PathBuf> {
+    if dir.join("manifest.json").is_file() && dir.join("home").is_dir() {
+        return Ok(dir.join("home"));
+    }
+    let entries: Vec<_> = fs::read_dir(dir)?.collect::<std::io::Result<_>>()?;
+    match entries.as_slice() {
+        [only] if only.file_type()?.is_dir() && !only.file_name().to_string_lossy().starts_with('.') => {
+            find_root(&only.path())
+        }
+        _ => Ok(dir.to_path_buf()),
+    }
+}
+
+/// Where one imported file goes, as a path relative to the home directory;
+/// None leaves it out.
+#[derive(Debug, Clone)]
+pub struct Mapping {
+    pub source: PathBuf,
+    pub from: String,
+    pub to: Option<String>,
+}
+
+/// Lists the files under `root` with where each would go.
+pub fn plan(root: &Path) -> Result<Vec<Mapping>> {
+    let mut mappings = Vec::new();
+    collect(root, root, &mut mappings)?;
+    mappings.sort_by(|a, b| a.from.cmp(&b.from));
+    Ok(mappings)
+}
+
+fn collect(root: &Path, dir: &Path, mappings: &mut Vec<Mapping>) -> Result<()> {
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let path = entry.path();
+        let name = entry.file_name().to_string_lossy().into_owned();
+        if name == ".git" || (dir == root && REPO_FILES.contains(&name.as_str())) {
+            continue;
+        }
+        let file_type = entry.file_type()?;
+        if file_type.is_dir() {
+            collect(root, &path, mappings)?;
+        } else if file_type.is_file() {
+            let from = key(path.strip_prefix(root).unwrap_or(&path));
+            mappings.push(Mapping { to: suggest(&from), source: path, from });
+        }
+    }
+    Ok(())
+}
+
+fn key(path: &Path) -> String {
+    path.components()
+        .map(|c| c.as_os_str().to_string_lossy().into_owned())
+        .collect::<Vec<_>>()
+        .join("/")
+}
+
+/// Guesses where a file from a dotfiles repository belongs. Paths that
+/// already start with a dot are kept; stow-style packages like zsh/.zshrc
+/// lose their package directory; a bare file like zshrc gets its dot back.
+/// Anything else is left for the user to place.
+pub fn suggest(from: &str) -> Option<String> {
+    let parts: Vec<_> = from.split('/').collect();
+    match parts.as_slice() {
+        [first, ..] if first.starts_with('.') => Some(from.to_string()),
+        [_, second, ..] if second.starts_with('.') => Some(parts[1..].join("/")),
+        [only] => Some(format!(".{}", only)),
+        _ => None,
+    }
+}
+
+/// The mapping as text to edit, one `from -> to` per line. Files left out
+/// are commented.
+pub fn to_text(mappings: &[Mapping]) -> String {
+    let mut text = String::from(
+        "# Where each file goes, relative to your home directory.\n\
+         # Change a destination to move a file; delete or comment a line to leave it out.\n\n",
+    );
+    for mapping in mappings {
+        match &mapping.to {
+            Some(to) => text.push_str(&format!("{} -> {}\n", mapping.from, to)),
+            None => text.push_str(&format!("# {} -> ?\n", mapping.from)),
+        }
+    }
+    text
+}
+
+/// Reads an edited mapping back. Files without a line are left out.
+pub fn apply_text(mappings: &mut [Mapping], text: &str) -> Result<()> {
+    for mapping in mappings.iter_mut() {
+        mapping.to = None;
+    }
+    for line in text.lines().map(str::trim) {
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let (from, to) = line.split_once("->")
+            .ok_or_else(|| KiwiError::ValidationError(format!("Expected `from -> to`: {}", line)))?;
+        let (from, to) = (from.trim(), to.trim().trim_start_matches("~/"));
+        if !is_relative(to) {
+            return Err(KiwiError::ValidationError(format!("{} must be a path inside your home directory", to)));
+        }
+        let mapping = mappings.iter_mut().find(|mapping| mapping.from == from)
+            .ok_or_else(|| KiwiError::ValidationError(format!("No file {} in the import", from)))?;
+        mapping.to = Some(to.to_string());
+    }
+    Ok(())
+}
+
+/// Whether `path` stays inside the directory it's relative to.
+fn is_relative(path: &str) -> bool {
+    !path.is_empty() && Path::new(path).components().all(|c| matches!(c, Component::Normal(_)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn suggests_home_paths() {
+        assert_eq!(suggest(".config/nvim/init.lua").as_deref(), Some(".config/nvim/init.lua"));
+        assert_eq!(suggest("zsh/.zshrc").as_deref(), Some(".zshrc"));
+        assert_eq!(suggest("git/.config/git/ignore").as_deref(), Some(".config/git/ignore"));
+        assert_eq!(suggest("vimrc").as_deref(), Some(".vimrc"));
+        assert_eq!(suggest("scripts/setup.sh"), None);
+    }
+
+    #[test]
+    fn edited_mappings_are_applied() {
+        let mapping = |from: &str| Mapping { source: PathBuf::from(from), from: from.to_string(), to: suggest(from) };
+        let mut mappings = vec![mapping("vimrc"), mapping("zsh/.zshrc"), mapping("bin/tool")];
+        let text = to_text(&mappings).replace("# bin/tool -> ?", "bin/tool -> ~/.local/bin/tool").replace("vimrc -> .vimrc\n", "");
+
+        apply_text(&mut mappings, &text).unwrap();
+        let targets: Vec<_> = mappings.iter().map(|m| m.to.as_deref()).collect();
+        assert_eq!(targets, [None, Some(".zshrc"), Some(".local/bin/tool")]);
+        assert!(apply_text(&mut mappings, "bin/tool -> ../etc/passwd").is_err());
+    }
+}
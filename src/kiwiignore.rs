@@ -0,0 +1,117 @@
+use std::cell::RefCell;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use crate::{Config, Result, KiwiError};
+use ignore::gitignore::{Gitignore, GitignoreBuilder};
+use ignore::Match;
+
+/// Name of the per-directory ignore files.
+pub const IGNORE_FILE: &str = ".kiwiignore";
+
+/// Decides which files under tracked directories are left out of sync, using
+/// gitignore-style patterns. Patterns in ~/.kiwi/ignore and the ignore setting
+/// apply everywhere and are relative to the home directory; a .kiwiignore
+/// applies to the directory it's in and below. As in git, deeper files win, and `!pattern` brings a
+/// file back.
+pub struct KiwiIgnore {
+    home: PathBuf,
+    global: Gitignore,
+    // .kiwiignore of each directory looked at so far
+    dirs: RefCell<HashMap<PathBuf, Gitignore>>,
+}
+
+impl KiwiIgnore {
+    pub fn load(home: &Path) -> Result<Self> {
+        Self::with_patterns(home, &Config::ignore_patterns())
+    }
+
+    /// Loads the ignore files, adding `patterns` to the global ones.
+    pub fn with_patterns(home: &Path, patterns: &[String]) -> Result<Self> {
+        let mut builder = GitignoreBuilder::new(home);
+        let global_file = home.join(".kiwi/ignore");
+        if global_file.exists() {
+            if let Some(e) = builder.add(&global_file) {
+                return Err(KiwiError::Config(format!("Invalid pattern in {}: {}", global_file.display(), e)));
+            }
+        }
+        for pattern in patterns {
+            builder.add_line(None, pattern).map_err(|e| {
+                KiwiError::InvalidConfig { key: "ignore".to_string(), message: e.to_string() }
+            })?;
+        }
+        let global = builder.build().map_err(|e| {
+            KiwiError::Config(format!("Invalid pattern in {}: {}", global_file.display(), e))
+        })?;
+        Ok(Self {
+            home: home.to_path_buf(),
+            global,
+            dirs: RefCell::new(HashMap::new()),
+        })
+    }
+
+    /// Reports whether `path` is excluded, checking the .kiwiignore of each
+    /// directory from the path's own up to the home directory, then the
+    /// global patterns.
+    pub fn is_ignored(&self, path: &Path, is_dir: bool) -> bool {
+        if !path.starts_with(&self.home) {
+            return false;
+        }
+        let mut dir = path.parent();
+        while let Some(d) = dir {
+            if !d.starts_with(&self.home) {
+                break;
+            }
+            match self.dir_matcher(d).matched_path_or_any_parents(path, is_dir) {
+                Match::Ignore(_) => return true,
+                Match::Whitelist(_) => return false,
+                Match::None => {}
+            }
+            dir = d.parent();
+        }
+        self.global.matched_path_or_any_parents(path, is_dir).is_ignore()
+    }
+
+    fn dir_matcher(&self, dir: &Path) -> Gitignore {
+        if let Some(matcher) = self.dirs.borrow().get(dir) {
+            return matcher.clone();
+        }
+        let ignore_file = dir.join(IGNORE_FILE);
+        let matcher = if ignore_file.is_file() {
+            let (matcher, err) = Gitignore::new(&ignore_file);
+            if let Some(e) = err {
+                log::warn!("Skipping invalid patterns in {}: {}", ignore_file.display(), e);
+            }
+            matcher
+        } else {
+            Gitignore::empty()
+        };
+        self.dirs.borrow_mut().insert(dir.to_path_buf(), matcher.clone());
+        matcher
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    #[test]
+    fn test_is_ignored() {
+        let home = std::env::temp_dir().join(format!("kiwi-ignore-test-{}", std::process::id()));
+        let config = home.join(".config");
+        fs::create_dir_all(config.join("app/cache")).unwrap();
+        fs::create_dir_all(home.join(".kiwi")).unwrap();
+        fs::write(home.join(".kiwi/ignore"), "*.log\n").unwrap();
+        fs::write(config.join(IGNORE_FILE), "cache/\n!keep.log\n").unwrap();
+
+        let ignore = KiwiIgnore::with_patterns(&home, &["*.tmp".to_string()]).unwrap();
+        assert!(ignore.is_ignored(&home.join("debug.log"), false));
+        assert!(ignore.is_ignored(&config.join("app/session.tmp"), false));
+        assert!(ignore.is_ignored(&config.join("app/cache/data"), false));
+        assert!(!ignore.is_ignored(&config.join("keep.log"), false));
+        assert!(!ignore.is_ignored(&config.join("app/settings.json"), false));
+        assert!(!ignore.is_ignored(Path::new("/etc/hosts"), false));
+
+        fs::remove_dir_all(&home).unwrap();
+    }
+}
@@ -1,8 +1,29 @@
+pub mod archive;
+pub mod clean;
 pub mod cli;
+pub mod completion;
 pub mod config;
+pub mod credentials;
+pub mod deploy;
+pub mod diff;
+pub mod doctor;
 pub mod dotfiles;
+pub mod encryption;
+pub mod git_remote;
 pub mod homebrew;
+pub mod hooks;
+pub mod import;
+pub mod kiwiignore;
+pub mod local_remote;
+pub mod profiles;
+pub mod progress;
+pub mod queue;
+pub mod schedule;
+pub mod secrets;
 pub mod sync;
+pub mod template;
+pub mod trace;
+pub mod update;
 pub mod error;
 
 pub use cli::Cli;
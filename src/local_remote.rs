@@ -0,0 +1,204 @@
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use crate::sync::{Change, SyncData};
+use crate::{KiwiError, Result};
+use serde::{Deserialize, Serialize};
+
+/// Whether a sync URL is a directory rather than a server or repository:
+/// an absolute path, or one starting with ~/.
+pub fn is_local_path(url: &str) -> bool {
+    url.starts_with('/') || url.starts_with("~/")
+}
+
+/// A directory, on this disk or an external drive, that snapshots are kept
+/// in for machines that never reach a server. Every push is written whole as
+/// snapshots/<revision>.json, so history and rollbacks work as they do with
+/// a server.
+#[derive(Debug)]
+pub struct LocalRemote {
+    dir: PathBuf,
+}
+
+/// One push, as saved in the directory.
+#[derive(Debug, Serialize, Deserialize)]
+struct Snapshot {
+    revision: i64,
+    created_at: String,
+    hostname: String,
+    #[serde(flatten)]
+    data: SyncData,
+}
+
+impl LocalRemote {
+    pub fn new(path: &str, home_dir: &Path) -> Self {
+        let dir = match path.strip_prefix("~/") {
+            Some(rest) => home_dir.join(rest),
+            None => PathBuf::from(path),
+        };
+        Self { dir }
+    }
+
+    pub fn dir(&self) -> &Path {
+        &self.dir
+    }
+
+    /// Checks the directory is there. It isn't made when it's missing, as
+    /// that's usually a drive that isn't connected.
+    pub fn check(&self) -> Result<()> {
+        if !self.dir.is_dir() {
+            return Err(KiwiError::Sync(format!(
+                "The snapshot directory {} doesn't exist; connect the drive it's on, or create it with `mkdir -p`",
+                self.dir.display()
+            )));
+        }
+        Ok(())
+    }
+
+    /// Returns the latest snapshot's files and packages and its revision,
+    /// which also stands in for a server's ETag. An empty directory has
+    /// neither.
+    pub fn fetch(&self) -> Result<(SyncData, Option<String>, i64)> {
+        match self.revisions()?.last() {
+            Some(&revision) => Ok((self.read(revision)?.data, Some(revision.to_string()), revision)),
+            None => Ok((SyncData { files: HashMap::new(), packages: Vec::new() }, None, 0)),
+        }
+    }
+
+    pub fn snapshot(&self, revision: i64) -> Result<SyncData> {
+        if !self.snapshot_path(revision).is_file() {
+            self.check()?;
+            return Err(KiwiError::Sync(format!("No revision {} in {}", revision, self.dir.display())));
+        }
+        Ok(self.read(revision)?.data)
+    }
+
+    /// Saves the files and packages as the next revision and returns it.
+    /// It's refused when a snapshot was saved since `parent`, the revision
+    /// they were fetched at, unless `force`.
+    pub fn push(&self, data: &SyncData, parent: Option<&str>, force: bool, hostname: &str) -> Result<i64> {
+        let latest = self.revisions()?.last().copied();
+        if !force && latest.map(|revision| revision.to_string()).as_deref() != parent {
+            return Err("The remote changed since it was last pulled; run `kiwi pull` first, or push with --force to overwrite it".into());
+        }
+        let revision = latest.unwrap_or(0) + 1;
+        let snapshot = Snapshot {
+            revision,
+            created_at: chrono::Utc::now().to_rfc3339(),
+            hostname: hostname.to_string(),
+            data: SyncData { files: data.files.clone(), packages: data.packages.clone() },
+        };
+
+        // Written beside it and renamed, so a drive pulled out mid-push
+        // doesn't leave half a snapshot
+        let dir = self.dir.join("snapshots");
+        fs::create_dir_all(&dir)?;
+        let path = self.snapshot_path(revision);
+        let staged = dir.join(format!(".{}.json.{}", revision, std::process::id()));
+        fs::write(&staged, serde_json::to_vec(&snapshot)?)?;
+        if path.exists() {
+            let _ = fs::remove_file(&staged);
+            return Err("The remote changed since it was last pulled; run `kiwi pull` first, or push with --force to overwrite it".into());
+        }
+        fs::rename(&staged, &path)?;
+        Ok(revision)
+    }
+
+    /// The latest change to each file and to the package list, oldest
+    /// first, as a server lists them. Found by comparing each snapshot with
+    /// the one before.
+    pub fn changes(&self) -> Result<Vec<Change>> {
+        let mut latest: HashMap<Option<String>, Change> = HashMap::new();
+        let mut previous: Option<Snapshot> = None;
+        let none = HashMap::new();
+        for revision in self.revisions()? {
+            let snapshot = self.read(revision)?;
+            let change = |kind: &str, path: Option<String>| Change {
+                revision,
+                kind: kind.to_string(),
+                path,
+                updated_at: snapshot.created_at.clone(),
+            };
+            let (old_files, old_packages) = match &previous {
+                Some(previous) => (&previous.data.files, package_names(&previous.data)),
+                None => (&none, Vec::new()),
+            };
+            for (key, contents) in &snapshot.data.files {
+                if old_files.get(key) != Some(contents) {
+                    latest.insert(Some(key.clone()), change("file_updated", Some(key.clone())));
+                }
+            }
+            for key in old_files.keys().filter(|key| !snapshot.data.files.contains_key(*key)) {
+                latest.insert(Some(key.clone()), change("file_deleted", Some(key.clone())));
+            }
+            if package_names(&snapshot.data) != old_packages {
+                latest.insert(None, change("packages_updated", None));
+            }
+            previous = Some(snapshot);
+        }
+        let mut changes: Vec<_> = latest.into_values().collect();
+        changes.sort_by(|a, b| a.revision.cmp(&b.revision).then_with(|| a.path.cmp(&b.path)));
+        Ok(changes)
+    }
+
+    /// The revisions saved, oldest first.
+    fn revisions(&self) -> Result<Vec<i64>> {
+        self.check()?;
+        let dir = self.dir.join("snapshots");
+        if !dir.is_dir() {
+            return Ok(Vec::new());
+        }
+        let mut revisions = Vec::new();
+        for entry in fs::read_dir(dir)? {
+            let name = entry?.file_name();
+            if let Some(revision) = name.to_string_lossy().strip_suffix(".json").and_then(|n| n.parse().ok()) {
+                revisions.push(revision);
+            }
+        }
+        revisions.sort_unstable();
+        Ok(revisions)
+    }
+
+    fn read(&self, revision: i64) -> Result<Snapshot> {
+        Ok(serde_json::from_slice(&fs::read(self.snapshot_path(revision))?)?)
+    }
+
+    fn snapshot_path(&self, revision: i64) -> PathBuf {
+        self.dir.join("snapshots").join(format!("{}.json", revision))
+    }
+}
+
+fn package_names(data: &SyncData) -> Vec<&str> {
+    let mut names: Vec<_> = data.packages.iter().map(|package| package.name.as_str()).collect();
+    names.sort_unstable();
+    names
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pushes_become_revisions() {
+        let dir = std::env::temp_dir().join(format!("kiwi-local-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let remote = LocalRemote::new(&dir.to_string_lossy(), Path::new("/home/kiwi"));
+        let data = |contents: &str| SyncData {
+            files: HashMap::from([(".zshrc".to_string(), contents.to_string())]),
+            packages: Vec::new(),
+        };
+
+        assert_eq!(remote.push(&data("one"), None, false, "laptop").unwrap(), 1);
+        assert_eq!(remote.push(&data("two"), Some("1"), false, "laptop").unwrap(), 2);
+        assert!(remote.push(&data("three"), Some("1"), false, "desktop").is_err());
+
+        let (latest, etag, revision) = remote.fetch().unwrap();
+        assert_eq!((etag.as_deref(), revision), (Some("2"), 2));
+        assert_eq!(latest.files[".zshrc"], "two");
+        assert_eq!(remote.snapshot(1).unwrap().files[".zshrc"], "one");
+        let changes = remote.changes().unwrap();
+        assert_eq!(changes.len(), 1);
+        assert_eq!((changes[0].revision, changes[0].kind.as_str()), (2, "file_updated"));
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
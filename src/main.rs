@@ -5,12 +5,12 @@ use reqwest::Client;
 use dotenv::dotenv;
 use std::env;
 use clap::Parser;
-use serde_json::json;
 use std::process;
 
 use kiwi::{Result, Config, Cli};
+use kiwi::trace;
+use kiwi::credentials::CredentialStore;
 
-const DEFAULT_SYNC_URL: &str = "http://34.41.188.73:8080";
 const MAX_LOGIN_ATTEMPTS: u32 = 3;
 
 #[derive(Debug, Serialize, Deserialize)]
@@ -29,11 +29,7 @@ async fn register_user(email: String, password: String) -> Result<AuthResponse>
     let client = Client::new();
     let request = RegisterRequest { email, password };
     
-    let response = client
-        .post("http://34.41.188.73:8080/register")
-        .json(&request)
-        .send()
-        .await?;
+    let response = trace::send(client.post("http://34.41.188.73:8080/register").json(&request)).await?;
 
     if !response.status().is_success() {
         let status = response.status();
@@ -49,11 +45,7 @@ async fn login_user(email: String, password: String) -> Result<AuthResponse> {
     let client = Client::new();
     let request = RegisterRequest { email, password };
     
-    let response = client
-        .post("http://34.41.188.73:8080/login")
-        .json(&request)
-        .send()
-        .await?;
+    let response = trace::send(client.post("http://34.41.188.73:8080/login").json(&request)).await?;
 
     if !response.status().is_success() {
         let status = response.status();
@@ -156,9 +148,26 @@ async fn main() -> Result<()> {
     env_logger::init();
     dotenv().ok();
     
+    let cli = Cli::parse();
+    if cli.trace {
+        trace::enable();
+    }
+    if let Some(result) = cli.complete() {
+        return result;
+    }
     let mut config = Config::load()?;
-    if config.sync_token.is_some() {
-        let cli = Cli::parse();
+
+    // `kiwi restore --token` sets up a new machine without signing in
+    let (server, token) = cli.restore_credentials();
+    if !cli.is_dry_run_restore() {
+        if let Some(server) = server {
+            config.set("sync_url", server.to_string())?;
+        }
+        if let Some(token) = token {
+            config.set_token(token.to_string())?;
+        }
+    }
+    if config.sync_token.is_some() || token.is_some() || config.is_serverless() || !cli.needs_account() {
         return cli.execute().await;
     }
     
@@ -171,20 +180,13 @@ async fn main() -> Result<()> {
     match authenticate(&theme).await {
         Ok(auth) => {
             // Set up sync configuration
-            config.sync_token = Some(auth.token.clone());
-            
-            // Initialize user's remote storage
-            let client = Client::new();
-            let _ = client
-                .post(format!("{}/sync", config.sync_url.as_deref().unwrap_or(DEFAULT_SYNC_URL)))
-                .header("Authorization", format!("Bearer {}", auth.token))
-                .json(&json!({
-                    "files": {},
-                    "packages": []
-                }))
-                .send()
-                .await?;
+            match config.set_token(auth.token.clone())? {
+                CredentialStore::Keychain => println!("🔐 Saved your token in the OS keychain"),
+                CredentialStore::EncryptedFile => println!("🔐 Saved your token in ~/.kiwi/credentials.enc"),
+            }
 
+            // The server starts new accounts empty, and signing in on another
+            // machine mustn't wipe what's there
             config.save()?;
         }
         Err(e) => {
@@ -194,6 +196,5 @@ async fn main() -> Result<()> {
     }
 
     // After successful login/registration, execute the CLI command
-    let cli = Cli::parse();
     cli.execute().await
 }
@@ -0,0 +1,133 @@
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::path::Path;
+use crate::Result;
+use serde::{Deserialize, Serialize};
+
+/// Which profiles (work, home, server...) each file and package belongs to.
+/// Anything not listed belongs to every profile, and a directory's profiles
+/// apply to the files under it. It's kept in profiles.json beside
+/// packages.json and pushed with the files, so every machine sees the same
+/// assignments.
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct Profiles {
+    /// By path relative to the home directory, with forward slashes
+    #[serde(default)]
+    pub files: BTreeMap<String, BTreeSet<String>>,
+    /// By package name
+    #[serde(default)]
+    pub packages: BTreeMap<String, BTreeSet<String>>,
+}
+
+impl Profiles {
+    pub fn load(path: &Path) -> Result<Self> {
+        if !path.exists() {
+            return Ok(Self::default());
+        }
+        Self::parse(&fs::read_to_string(path)?)
+    }
+
+    pub fn parse(contents: &str) -> Result<Self> {
+        Ok(serde_json::from_str(contents)?)
+    }
+
+    pub fn save(&self, path: &Path) -> Result<()> {
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(path, serde_json::to_string_pretty(self)?)?;
+        Ok(())
+    }
+
+    /// Returns whether a file belongs to `profile`, going by the closest of
+    /// the file and its directories that has profiles. With no profile,
+    /// everything does.
+    pub fn includes_file(&self, key: &str, profile: Option<&str>) -> bool {
+        let profile = match profile {
+            Some(profile) => profile,
+            None => return true,
+        };
+        let mut prefix = key;
+        loop {
+            if let Some(profiles) = self.files.get(prefix) {
+                return profiles.contains(profile);
+            }
+            match prefix.rfind('/') {
+                Some(i) => prefix = &prefix[..i],
+                None => return true,
+            }
+        }
+    }
+
+    pub fn includes_package(&self, name: &str, profile: Option<&str>) -> bool {
+        match (profile, self.packages.get(name)) {
+            (Some(profile), Some(profiles)) => profiles.contains(profile),
+            _ => true,
+        }
+    }
+
+    /// Adds files and packages to `profile`.
+    pub fn assign(&mut self, profile: &str, files: &[String], packages: &[String]) {
+        for key in files {
+            self.files.entry(key.clone()).or_default().insert(profile.to_string());
+        }
+        for name in packages {
+            self.packages.entry(name.clone()).or_default().insert(profile.to_string());
+        }
+    }
+
+    /// Takes files and packages out of `profile`. Those left in no profile
+    /// go back to belonging to all of them.
+    pub fn unassign(&mut self, profile: &str, files: &[String], packages: &[String]) {
+        for (map, names) in [(&mut self.files, files), (&mut self.packages, packages)] {
+            for name in names {
+                if let Some(profiles) = map.get_mut(name) {
+                    profiles.remove(profile);
+                    if profiles.is_empty() {
+                        map.remove(name);
+                    }
+                }
+            }
+        }
+    }
+
+    /// Returns every profile something has been assigned to.
+    pub fn names(&self) -> BTreeSet<String> {
+        self.files.values()
+            .chain(self.packages.values())
+            .flatten()
+            .cloned()
+            .collect()
+    }
+}
+
+/// Profile names are used on the command line and in config.toml, so they
+/// stick to letters, digits, underscores and hyphens.
+pub fn is_valid_name(name: &str) -> bool {
+    !name.is_empty() && name.chars().all(|c| c.is_alphanumeric() || c == '_' || c == '-')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_includes_file() {
+        let mut profiles = Profiles::default();
+        profiles.assign("work", &[".config/nvim".to_string(), ".ssh/config".to_string()], &["awscli".to_string()]);
+        profiles.assign("home", &[".config/nvim/init.lua".to_string()], &[]);
+
+        assert!(profiles.includes_file(".config/nvim/lua/plugins.lua", Some("work")));
+        assert!(!profiles.includes_file(".config/nvim/init.lua", Some("work")));
+        assert!(profiles.includes_file(".config/nvim/init.lua", Some("home")));
+        assert!(!profiles.includes_file(".ssh/config", Some("home")));
+        assert!(profiles.includes_file(".zshrc", Some("home")));
+        assert!(profiles.includes_file(".ssh/config", None));
+        assert!(!profiles.includes_package("awscli", Some("home")));
+        assert!(profiles.includes_package("git", Some("home")));
+
+        profiles.unassign("work", &[".ssh/config".to_string()], &[]);
+        assert!(profiles.includes_file(".ssh/config", Some("home")));
+        assert_eq!(profiles.names().into_iter().collect::<Vec<_>>(), vec!["home", "work"]);
+    }
+}
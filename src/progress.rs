@@ -0,0 +1,81 @@
+use std::fmt;
+use std::time::Duration;
+use indicatif::{HumanBytes, HumanDuration, MultiProgress, ProgressBar, ProgressDrawTarget, ProgressStyle};
+
+const BYTES_TEMPLATE: &str = "{spinner:.green} {prefix:.bold.dim} {bar:30.cyan/blue} {bytes}/{total_bytes} {bytes_per_sec} eta {eta}";
+const BYTES_UNSIZED_TEMPLATE: &str = "{spinner:.green} {prefix:.bold.dim} {bytes} {bytes_per_sec}";
+const FILES_TEMPLATE: &str = "{spinner:.green} {prefix:.bold.dim} {bar:30.cyan/blue} {pos}/{len} {wide_msg}";
+const PROGRESS_CHARS: &str = "█▉▊▋▌▍▎▏  ";
+
+/// Bars for the files a push or pull works through and the bytes it
+/// sends and receives. Nothing is drawn when they're hidden, or when stderr
+/// isn't a terminal.
+#[derive(Clone)]
+pub struct Progress {
+    multi: MultiProgress,
+}
+
+impl Progress {
+    pub fn new(show: bool) -> Self {
+        let multi = MultiProgress::new();
+        if !show {
+            multi.set_draw_target(ProgressDrawTarget::hidden());
+        }
+        Self { multi }
+    }
+
+    pub fn hidden() -> Self {
+        Self::new(false)
+    }
+
+    /// A bar counting bytes, with the speed and time left; just the count
+    /// and speed when the size isn't known up front.
+    pub fn bytes(&self, prefix: &'static str, total: Option<u64>) -> ProgressBar {
+        let bar = match total {
+            Some(total) => ProgressBar::new(total).with_style(style(BYTES_TEMPLATE)),
+            None => ProgressBar::new_spinner().with_style(style(BYTES_UNSIZED_TEMPLATE)),
+        };
+        self.multi.add(bar.with_prefix(prefix))
+    }
+
+    /// A bar counting files, naming the one being worked on.
+    pub fn files(&self, prefix: &'static str, total: usize) -> ProgressBar {
+        let bar = ProgressBar::new(total as u64).with_style(style(FILES_TEMPLATE));
+        self.multi.add(bar.with_prefix(prefix))
+    }
+}
+
+fn style(template: &str) -> ProgressStyle {
+    ProgressStyle::default_bar()
+        .template(template)
+        .unwrap()
+        .progress_chars(PROGRESS_CHARS)
+}
+
+/// How much a push or pull sent or received, and how long it took.
+#[derive(Debug, Default, Clone, Copy)]
+pub struct Transfer {
+    pub bytes: u64,
+    pub elapsed: Duration,
+}
+
+impl Transfer {
+    pub fn bytes_per_sec(&self) -> u64 {
+        match self.elapsed.as_secs_f64() {
+            secs if secs > 0.0 => (self.bytes as f64 / secs) as u64,
+            _ => self.bytes,
+        }
+    }
+}
+
+impl fmt::Display for Transfer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{} in {} ({}/s)",
+            HumanBytes(self.bytes),
+            HumanDuration(self.elapsed),
+            HumanBytes(self.bytes_per_sec())
+        )
+    }
+}
@@ -0,0 +1,69 @@
+use std::fs;
+use std::path::PathBuf;
+use crate::Result;
+use serde::{Deserialize, Serialize};
+
+/// A push made while the server couldn't be reached.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct QueuedPush {
+    /// When it was queued (RFC 3339)
+    pub queued_at: String,
+    /// Files changed here at the time, relative to the home directory
+    pub files: Vec<String>,
+}
+
+/// Pushes waiting for the server, kept in push_queue.json beside
+/// sync_state.json. Only what changed is recorded: sending the queue is an
+/// ordinary push of the files as they are by then, checked against the
+/// server for conflicts like any other.
+pub struct Queue {
+    path: PathBuf,
+}
+
+impl Queue {
+    pub fn new(path: PathBuf) -> Self {
+        Self { path }
+    }
+
+    pub fn load(&self) -> Result<Vec<QueuedPush>> {
+        if !self.path.exists() {
+            return Ok(Vec::new());
+        }
+        let contents = fs::read_to_string(&self.path)?;
+        Ok(serde_json::from_str(&contents)?)
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.load().map_or(true, |queued| queued.is_empty())
+    }
+
+    /// Queues a push of `files`.
+    pub fn add(&self, files: Vec<String>) -> Result<()> {
+        let mut queued = self.load()?;
+        queued.push(QueuedPush {
+            queued_at: chrono::Local::now().to_rfc3339(),
+            files,
+        });
+        if let Some(parent) = self.path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(&self.path, serde_json::to_string_pretty(&queued)?)?;
+        Ok(())
+    }
+
+    /// Empties the queue, once a push has sent everything in it.
+    pub fn clear(&self) -> Result<()> {
+        match fs::remove_file(&self.path) {
+            Err(e) if e.kind() != std::io::ErrorKind::NotFound => Err(e.into()),
+            _ => Ok(()),
+        }
+    }
+
+    /// Every file waiting to be pushed, each once.
+    pub fn files(&self) -> Result<Vec<String>> {
+        let mut files: Vec<_> = self.load()?.into_iter().flat_map(|queued| queued.files).collect();
+        files.sort();
+        files.dedup();
+        Ok(files)
+    }
+}
@@ -0,0 +1,276 @@
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::time::Duration;
+use crate::{Config, KiwiError, Result};
+use serde::Serialize;
+
+/// launchd label and systemd unit name of the scheduled pull.
+const LAUNCHD_LABEL: &str = "com.kiwi.pull";
+const SYSTEMD_UNIT: &str = "kiwi-pull";
+/// Scheduled pulls closer together than this would just hammer the server.
+const MIN_INTERVAL: Duration = Duration::from_secs(60);
+
+/// Runs `kiwi pull --quiet` every so often with the service manager the
+/// machine has: a launchd agent on macOS, a systemd user timer on Linux.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Scheduler {
+    Launchd,
+    Systemd,
+}
+
+/// What `kiwi schedule status` reports.
+#[derive(Debug, Serialize)]
+pub struct Status {
+    pub scheduler: &'static str,
+    pub installed: bool,
+    /// Whether the service manager has it loaded and will run it
+    pub active: bool,
+    pub every: Option<String>,
+    pub files: Vec<PathBuf>,
+}
+
+impl Scheduler {
+    pub fn detect() -> Result<Self> {
+        match std::env::consts::OS {
+            "macos" => Ok(Scheduler::Launchd),
+            "linux" => Ok(Scheduler::Systemd),
+            os => Err(KiwiError::InvalidCommand(format!("Scheduled pulls aren't supported on {}", os))),
+        }
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            Scheduler::Launchd => "launchd",
+            Scheduler::Systemd => "systemd",
+        }
+    }
+
+    /// The files it writes: the agent's plist, or the service and timer.
+    pub fn files(&self) -> Result<Vec<PathBuf>> {
+        match self {
+            Scheduler::Launchd => {
+                let home = dirs::home_dir().ok_or("Could not find home directory")?;
+                Ok(vec![home.join(format!("Library/LaunchAgents/{}.plist", LAUNCHD_LABEL))])
+            }
+            Scheduler::Systemd => {
+                let dir = Config::config_home()?.join("systemd/user");
+                Ok(vec![
+                    dir.join(format!("{}.service", SYSTEMD_UNIT)),
+                    dir.join(format!("{}.timer", SYSTEMD_UNIT)),
+                ])
+            }
+        }
+    }
+
+    /// Writes the units for pulling with `exe` every `every` and loads them,
+    /// replacing any installed before. Returns the files written.
+    pub fn install(&self, exe: &Path, every: Duration) -> Result<Vec<PathBuf>> {
+        let files = self.files()?;
+        let log = Config::data_dir()?.join("schedule.log");
+        let contents = match self {
+            Scheduler::Launchd => vec![launchd_plist(exe, every, &log)],
+            Scheduler::Systemd => vec![systemd_service(exe), systemd_timer(every)],
+        };
+        for (path, contents) in files.iter().zip(contents) {
+            if let Some(parent) = path.parent() {
+                fs::create_dir_all(parent)?;
+            }
+            fs::write(path, contents)?;
+        }
+
+        match self {
+            Scheduler::Launchd => {
+                // Unloading first makes launchd read the new interval
+                let _ = run("launchctl", &["unload", &files[0].to_string_lossy()]);
+                run("launchctl", &["load", "-w", &files[0].to_string_lossy()])?;
+            }
+            Scheduler::Systemd => {
+                let timer = format!("{}.timer", SYSTEMD_UNIT);
+                run("systemctl", &["--user", "daemon-reload"])?;
+                run("systemctl", &["--user", "enable", &timer])?;
+                run("systemctl", &["--user", "restart", &timer])?;
+            }
+        }
+        Ok(files)
+    }
+
+    /// Unloads and deletes the units. Returns whether any were installed.
+    pub fn remove(&self) -> Result<bool> {
+        let files: Vec<_> = self.files()?.into_iter().filter(|path| path.exists()).collect();
+        if files.is_empty() {
+            return Ok(false);
+        }
+        match self {
+            Scheduler::Launchd => {
+                let _ = run("launchctl", &["unload", "-w", &files[0].to_string_lossy()]);
+            }
+            Scheduler::Systemd => {
+                let _ = run("systemctl", &["--user", "disable", "--now", &format!("{}.timer", SYSTEMD_UNIT)]);
+            }
+        }
+        for path in &files {
+            fs::remove_file(path)?;
+        }
+        if *self == Scheduler::Systemd {
+            run("systemctl", &["--user", "daemon-reload"])?;
+        }
+        Ok(true)
+    }
+
+    pub fn status(&self) -> Result<Status> {
+        let files = self.files()?;
+        let installed = files.iter().all(|path| path.exists());
+        let active = installed && match self {
+            Scheduler::Launchd => run("launchctl", &["list", LAUNCHD_LABEL]).is_ok(),
+            Scheduler::Systemd => {
+                run("systemctl", &["--user", "is-active", "--quiet", &format!("{}.timer", SYSTEMD_UNIT)]).is_ok()
+            }
+        };
+        // The interval is read back from what was written
+        let every = match self {
+            Scheduler::Launchd => fs::read_to_string(&files[0]).ok().and_then(|plist| launchd_interval(&plist)),
+            Scheduler::Systemd => fs::read_to_string(&files[1]).ok().and_then(|timer| systemd_interval(&timer)),
+        };
+        Ok(Status {
+            scheduler: self.name(),
+            installed,
+            active,
+            every: every.map(format_interval),
+            files,
+        })
+    }
+}
+
+/// Reads an interval like 90s, 30m, 2h or 1d; a bare number is minutes.
+pub fn parse_interval(value: &str) -> std::result::Result<Duration, String> {
+    let value = value.trim();
+    let split = value.find(|c: char| !c.is_ascii_digit()).unwrap_or(value.len());
+    let (number, unit) = value.split_at(split);
+    let number: u64 = number.parse().map_err(|_| format!("Expected a number and a unit, like 30m: {}", value))?;
+    let seconds = match unit {
+        "s" => number,
+        "" | "m" => number * 60,
+        "h" => number * 60 * 60,
+        "d" => number * 24 * 60 * 60,
+        _ => return Err(format!("Unknown unit {}; use s, m, h or d", unit)),
+    };
+    let interval = Duration::from_secs(seconds);
+    if interval < MIN_INTERVAL {
+        return Err("Pull at most once a minute".to_string());
+    }
+    Ok(interval)
+}
+
+/// Writes an interval in the largest unit that divides it, like 30m.
+pub fn format_interval(interval: Duration) -> String {
+    let seconds = interval.as_secs();
+    for (unit, size) in [("d", 24 * 60 * 60), ("h", 60 * 60), ("m", 60)] {
+        if seconds >= size && seconds % size == 0 {
+            return format!("{}{}", seconds / size, unit);
+        }
+    }
+    format!("{}s", seconds)
+}
+
+fn launchd_plist(exe: &Path, every: Duration, log: &Path) -> String {
+    format!(
+        r#"<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{label}</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>{exe}</string>
+        <string>pull</string>
+        <string>--quiet</string>
+    </array>
+    <key>StartInterval</key>
+    <integer>{seconds}</integer>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>StandardOutPath</key>
+    <string>{log}</string>
+    <key>StandardErrorPath</key>
+    <string>{log}</string>
+</dict>
+</plist>
+"#,
+        label = LAUNCHD_LABEL,
+        exe = escape_xml(&exe.to_string_lossy()),
+        seconds = every.as_secs(),
+        log = escape_xml(&log.to_string_lossy()),
+    )
+}
+
+fn systemd_service(exe: &Path) -> String {
+    // Quoted for paths with spaces; % starts a specifier in unit files
+    let exe = exe.to_string_lossy().replace('%', "%%").replace('"', "\\\"");
+    format!(
+        "[Unit]\nDescription=Pull dotfiles with kiwi\n\n[Service]\nType=oneshot\nExecStart=\"{}\" pull --quiet\n",
+        exe
+    )
+}
+
+fn systemd_timer(every: Duration) -> String {
+    format!(
+        "[Unit]\nDescription=Pull dotfiles with kiwi every {}\n\n[Timer]\nOnBootSec=2min\nOnUnitActiveSec={}s\n\n[Install]\nWantedBy=timers.target\n",
+        format_interval(every),
+        every.as_secs()
+    )
+}
+
+fn launchd_interval(plist: &str) -> Option<Duration> {
+    let rest = &plist[plist.find("<key>StartInterval</key>")?..];
+    let start = rest.find("<integer>")? + "<integer>".len();
+    let end = rest.find("</integer>")?;
+    Some(Duration::from_secs(rest.get(start..end)?.trim().parse().ok()?))
+}
+
+fn systemd_interval(timer: &str) -> Option<Duration> {
+    let line = timer.lines().find_map(|line| line.strip_prefix("OnUnitActiveSec="))?;
+    Some(Duration::from_secs(line.trim().trim_end_matches('s').parse().ok()?))
+}
+
+fn escape_xml(value: &str) -> String {
+    value.replace('&', "&amp;").replace('<', "&lt;").replace('>', "&gt;")
+}
+
+/// Runs a service manager command, failing with what it printed.
+fn run(program: &str, args: &[&str]) -> Result<()> {
+    let output = Command::new(program)
+        .args(args)
+        .output()
+        .map_err(|e| KiwiError::InvalidCommand(format!("Could not run {}: {}", program, e)))?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        return Err(KiwiError::InvalidCommand(format!("{} {} failed: {}", program, args.join(" "), stderr.trim())));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn intervals_round_trip() {
+        assert_eq!(parse_interval("30m").unwrap(), Duration::from_secs(1800));
+        assert_eq!(parse_interval("2h").unwrap(), Duration::from_secs(7200));
+        assert_eq!(parse_interval("15").unwrap(), Duration::from_secs(900));
+        assert!(parse_interval("30s").is_err());
+        assert!(parse_interval("5w").is_err());
+        assert_eq!(format_interval(Duration::from_secs(86400)), "1d");
+        assert_eq!(format_interval(Duration::from_secs(5400)), "90m");
+    }
+
+    #[test]
+    fn intervals_are_read_back_from_units() {
+        let every = Duration::from_secs(1800);
+        let plist = launchd_plist(Path::new("/usr/local/bin/kiwi"), every, Path::new("/tmp/kiwi.log"));
+        assert_eq!(launchd_interval(&plist), Some(every));
+        assert_eq!(systemd_interval(&systemd_timer(every)), Some(every));
+    }
+}
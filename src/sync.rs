@@ -1,42 +1,456 @@
-use std::path::PathBuf;
-use crate::Result;
-use reqwest::Client;
+use std::path::{Path, PathBuf};
+use crate::{Result, KiwiError};
+use crate::deploy::{Deploy, Store};
+use crate::diff::FileDiff;
+use crate::dotfiles::Dotfiles;
+use crate::encryption::{self, Encryption};
+use crate::git_remote::{self, GitRemote};
+use crate::local_remote::{self, LocalRemote};
+use crate::homebrew::Package;
+use crate::kiwiignore::KiwiIgnore;
+use crate::profiles::Profiles;
+use crate::progress::{Progress, Transfer};
+use crate::secrets::{self, Allowlist, Finding, SecretScan};
+use crate::template::{self, TemplateContext};
+use crate::trace;
+use reqwest::{Client, StatusCode};
 use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
 use std::fs;
+use std::time::Instant;
+
+/// Size of the pieces a push is uploaded in, so its progress can be shown.
+const UPLOAD_CHUNK_SIZE: usize = 64 * 1024;
 
 #[derive(Debug, Serialize, Deserialize)]
 pub struct SyncConfig {
     pub url: String,
     pub token: String,
+    /// Sent as X-Kiwi-Device once this machine is registered
+    #[serde(default)]
+    pub device_id: Option<String>,
+}
+
+/// A backup server: pushes are copied to it, and pulls fall back on it when
+/// the server can't be reached.
+#[derive(Debug)]
+pub struct Mirror {
+    pub name: String,
+    pub config: SyncConfig,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Device {
+    pub id: String,
+    pub name: String,
+    #[serde(default)]
+    pub os: String,
+    pub hostname: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub registered_at: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_seen_at: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_push_at: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_pull_at: Option<String>,
+    /// Set once the device is revoked; the server refuses requests from it
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub revoked_at: Option<String>,
+}
+
+/// A revoked device, with the account token that replaced the one it held.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct RevokedDevice {
+    #[serde(flatten)]
+    pub device: Device,
+    pub token: String,
+}
+
+/// Who the token signs in as, for `kiwi whoami`.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Account {
+    pub email: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub username: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tenant: Option<String>,
+    pub tier: String,
+    pub created_at: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub trial_expires_at: Option<String>,
+    pub token: AccountToken,
+    /// This machine, once it's registered
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub device: Option<Device>,
+    pub storage: AccountStorage,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct AccountToken {
+    /// api, session or impersonation
+    pub kind: String,
+    /// full, or an impersonation token's read or sync
+    pub scope: String,
+    /// None for API tokens, which last until replaced
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expires_at: Option<String>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct AccountStorage {
+    pub used_bytes: u64,
+    /// The tier's limit; None when there's none
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub limit_bytes: Option<u64>,
+}
+
+/// Where files are synced when it isn't a kiwi server, chosen by the sync
+/// URL. Both keep whole snapshots numbered like a server's revisions, and
+/// need no account.
+#[derive(Debug)]
+pub enum Backend {
+    /// A git repository, a commit per push
+    Git(GitRemote),
+    /// A directory, for machines that never reach a server
+    Local(LocalRemote),
+}
+
+impl Backend {
+    fn from_url(url: &str, home_dir: &Path) -> Option<Self> {
+        if git_remote::is_git_url(url) {
+            Some(Backend::Git(GitRemote::new(url, &home_dir.join(".kiwi/git"))))
+        } else if local_remote::is_local_path(url) {
+            Some(Backend::Local(LocalRemote::new(url, home_dir)))
+        } else {
+            None
+        }
+    }
+
+    /// Names it for messages, like "the git repository at <url>".
+    pub fn describe(&self) -> String {
+        match self {
+            Backend::Git(git) => format!("the git repository at {}", git.url()),
+            Backend::Local(local) => format!("the snapshot directory {}", local.dir().display()),
+        }
+    }
+
+    /// Checks it can be read.
+    pub fn check(&self) -> Result<()> {
+        match self {
+            Backend::Git(git) => git.check(),
+            Backend::Local(local) => local.check(),
+        }
+    }
+
+    /// Returns the latest files and packages, a tag for the revision they're
+    /// at that a push hands back, and the revision.
+    fn fetch(&self) -> Result<(SyncData, Option<String>, i64)> {
+        match self {
+            Backend::Git(git) => git.fetch(),
+            Backend::Local(local) => local.fetch(),
+        }
+    }
+
+    fn snapshot(&self, revision: i64) -> Result<SyncData> {
+        match self {
+            Backend::Git(git) => git.snapshot(revision),
+            Backend::Local(local) => local.snapshot(revision),
+        }
+    }
+
+    fn push(&self, data: &SyncData, parent: Option<&str>, force: bool) -> Result<i64> {
+        let hostname = template::hostname();
+        match self {
+            Backend::Git(git) => git.push(data, parent, force, &format!("Push from {}", hostname)),
+            Backend::Local(local) => local.push(data, parent, force, &hostname),
+        }
+    }
+
+    fn changes(&self) -> Result<Vec<Change>> {
+        match self {
+            Backend::Git(git) => git.changes(),
+            Backend::Local(local) => local.changes(),
+        }
+    }
+}
+
+/// The latest change to a file, or to the package list, on the server.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Change {
+    pub revision: i64,
+    /// file_updated, file_deleted or packages_updated
+    #[serde(rename = "type")]
+    pub kind: String,
+    /// Path relative to the home directory; none for the package list
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub path: Option<String>,
+    pub updated_at: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct ChangesPage {
+    changes: Vec<Change>,
+    cursor: String,
+    #[serde(default)]
+    has_more: bool,
 }
 
 #[derive(Debug, Serialize, Deserialize)]
 pub struct SyncData {
-    pub files: std::collections::HashMap<String, String>,
-    pub packages: Vec<crate::homebrew::Package>,
+    pub files: HashMap<String, String>,
+    pub packages: Vec<Package>,
+}
+
+/// What a push or pull changed, by file path relative to the home directory.
+#[derive(Debug, Default)]
+pub struct SyncSummary {
+    pub added: Vec<String>,
+    pub updated: Vec<String>,
+    pub removed: Vec<String>,
+    /// Files left alone, with the reason
+    pub skipped: Vec<(String, String)>,
+    pub unchanged: usize,
+    /// Names of the packages pushed, or pulled for this machine's profile
+    pub packages: Vec<String>,
+    /// Remote files left alone because they belong to other profiles
+    pub excluded: usize,
+    /// Files rendered from templates
+    pub rendered: Vec<String>,
+    /// Likely secrets in the files a push adds or changes
+    pub secrets: Vec<Finding>,
+    /// Files changed both here and on the server since the last sync. A
+    /// push leaves them out; a pull without `prefer_local` overwrites them
+    pub conflicts: Vec<String>,
+    /// Local files a pull wrote
+    pub written: Vec<PathBuf>,
+    /// What was received from the server
+    pub downloaded: Transfer,
+    /// What a push sent to the server
+    pub uploaded: Transfer,
+    /// Backup servers a push was copied to
+    pub mirrored: Vec<String>,
+    /// Backup servers a push couldn't be copied to, with the reason
+    pub mirror_failures: Vec<(String, String)>,
+    /// The backup server a pull came from, when the server couldn't be
+    /// reached
+    pub source: Option<String>,
+}
+
+impl SyncSummary {
+    pub fn has_changes(&self) -> bool {
+        !self.added.is_empty() || !self.updated.is_empty() || !self.removed.is_empty() || !self.rendered.is_empty()
+    }
+}
+
+/// How this machine's files and packages differ from the server's, by file
+/// path relative to the home directory.
+#[derive(Debug, Default, Serialize)]
+pub struct SyncStatus {
+    pub revision: i64,
+    /// Changed here since the last push or pull
+    pub modified_locally: Vec<String>,
+    /// Changed on the server since the last push or pull
+    pub newer_remotely: Vec<String>,
+    /// Changed on both sides, or never synced and different
+    pub conflicting: Vec<String>,
+    /// Tracked here but not on the server
+    pub not_pushed: Vec<String>,
+    /// On the server but not tracked here
+    pub untracked: Vec<String>,
+    /// Tracked here but deleted from disk
+    pub missing: Vec<String>,
+    /// Packages on the server that aren't installed here
+    pub packages_not_installed: Vec<String>,
+    /// Installed packages that aren't on the server
+    pub packages_not_pushed: Vec<String>,
+}
+
+impl SyncStatus {
+    pub fn is_clean(&self) -> bool {
+        self.modified_locally.is_empty()
+            && self.newer_remotely.is_empty()
+            && self.conflicting.is_empty()
+            && self.not_pushed.is_empty()
+            && self.untracked.is_empty()
+            && self.missing.is_empty()
+            && self.packages_not_installed.is_empty()
+            && self.packages_not_pushed.is_empty()
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct Manifest {
+    revision: i64,
+    files: HashMap<String, ManifestEntry>,
+}
+
+#[derive(Debug, Deserialize)]
+struct ManifestEntry {
+    hash: String,
+}
+
+/// What this machine last pushed or pulled, so status can tell which side
+/// changed a file. It's kept in sync_state.json beside packages.json.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct SyncState {
+    #[serde(default)]
+    revision: i64,
+    /// SHA-256 of each file as last synced
+    #[serde(default)]
+    files: HashMap<String, String>,
+    /// SHA-256 of each file as last rendered from its template
+    #[serde(default)]
+    rendered: HashMap<String, String>,
+    /// SHA-256 of each file as stored on the server, where that differs
+    /// because it's encrypted
+    #[serde(default)]
+    stored: HashMap<String, String>,
+}
+
+impl SyncState {
+    fn record(&mut self, key: String, hash: String, stored: Option<String>) {
+        match stored {
+            Some(stored) => self.stored.insert(key.clone(), stored),
+            None => self.stored.remove(&key),
+        };
+        self.files.insert(key, hash);
+    }
+
+    /// Returns the hash of a file's contents given the server's manifest
+    /// hash, which only matches the contents when it isn't encrypted. An
+    /// encrypted file that's changed since it was synced keeps its manifest
+    /// hash, which matches nothing.
+    fn content_hash<'a>(&'a self, key: &str, manifest_hash: &'a str) -> &'a str {
+        match (self.stored.get(key), self.files.get(key)) {
+            (Some(stored), Some(hash)) if stored == manifest_hash => hash,
+            _ => manifest_hash,
+        }
+    }
+}
+
+/// A file changed both here and on the server since the last sync.
+#[derive(Debug)]
+pub struct Conflict {
+    /// Path relative to the home directory
+    pub path: String,
+    pub local: String,
+    pub remote: String,
+    /// Hash of the server's copy as stored, when it's encrypted
+    stored: Option<String>,
+}
+
+/// Remote sync data along with the revision it was served at. Files are
+/// decrypted, with the server's copies of encrypted ones kept alongside.
+struct Remote {
+    data: SyncData,
+    encrypted: HashMap<String, String>,
+    etag: Option<String>,
+    revision: Option<i64>,
+    transfer: Transfer,
 }
 
 pub struct Sync {
     client: Client,
     config: SyncConfig,
     base_dir: PathBuf,
+    home_dir: PathBuf,
+    profile: Option<String>,
+    encryption: Option<Encryption>,
+    encrypt: bool,
+    secret_scan: SecretScan,
+    store: Store,
+    progress: Progress,
+    mirrors: Vec<Mirror>,
+    /// Hook scripts run code, so nothing in here is pushed or pulled
+    hooks_dir: PathBuf,
+    /// Set when the sync URL isn't a server
+    backend: Option<Backend>,
 }
 
 impl Sync {
     pub fn new(config: SyncConfig, base_dir: PathBuf) -> Self {
+        let home_dir = dirs::home_dir().unwrap_or_default();
+        let backend = Backend::from_url(&config.url, &home_dir);
+        let hooks_dir = home_dir.join(".kiwi/hooks");
         Self {
             client: Client::new(),
             config,
             base_dir,
+            store: Store::new(home_dir.join(".kiwi/store"), home_dir.clone(), Deploy::default()),
+            home_dir,
+            profile: None,
+            encryption: None,
+            encrypt: false,
+            secret_scan: SecretScan::default(),
+            progress: Progress::hidden(),
+            mirrors: Vec::new(),
+            hooks_dir,
+            backend,
         }
     }
 
+    /// What's synced with in place of a server, if it isn't one.
+    pub fn backend(&self) -> Option<&Backend> {
+        self.backend.as_ref()
+    }
+
+    /// Sets the backup servers pushes are copied to and pulls fall back on,
+    /// in the order they're tried.
+    pub fn with_mirrors(mut self, mirrors: Vec<Mirror>) -> Self {
+        self.mirrors = mirrors;
+        self
+    }
+
+    /// Sets the hooks directory, which is left out of pushes and pulls so a
+    /// hook can't arrive from another machine, or anyone who can write to
+    /// the server, and run here.
+    pub fn with_hooks_dir(mut self, hooks_dir: PathBuf) -> Self {
+        self.hooks_dir = hooks_dir;
+        self
+    }
+
+    /// Shows the progress of pushes and pulls on `progress`.
+    pub fn with_progress(mut self, progress: Progress) -> Self {
+        self.progress = progress;
+        self
+    }
+
+    /// Sets whether pulls copy files into place or keep them in `store_dir`
+    /// and symlink them.
+    pub fn with_deploy(mut self, deploy: Deploy, store_dir: PathBuf) -> Self {
+        self.store = Store::new(store_dir, self.home_dir.clone(), deploy);
+        self
+    }
+
+    /// Sets what a push does about likely secrets in the files it adds or
+    /// changes.
+    pub fn with_secret_scan(mut self, secret_scan: SecretScan) -> Self {
+        self.secret_scan = secret_scan;
+        self
+    }
+
+    /// Sets the key encrypted files from the server are decrypted with, and
+    /// whether pushes encrypt files with it.
+    pub fn with_encryption(mut self, encryption: Option<Encryption>, encrypt: bool) -> Self {
+        self.encryption = encryption;
+        self.encrypt = encrypt;
+        self
+    }
+
+    /// Limits pulls, status and diffs to the files and packages in
+    /// `profile`, and keeps pushes from removing those in other profiles.
+    pub fn with_profile(mut self, profile: Option<String>) -> Self {
+        self.profile = profile;
+        self
+    }
+
     pub async fn check_remote_access(&self) -> Result<()> {
-        let response = self.client
-            .head(&self.config.url)
-            .header("Authorization", self.get_auth_header())
-            .send()
-            .await?;
+        if let Some(backend) = &self.backend {
+            return backend.check();
+        }
+        let response = trace::send(self.authorize(self.client.head(&self.config.url))).await?;
 
         if !response.status().is_success() {
             return Err(format!("Failed to access remote: {}", response.status()).into());
@@ -44,77 +458,1123 @@ impl Sync {
         Ok(())
     }
 
-    pub async fn push(&self) -> Result<()> {
-        let url = &self.config.url;
-        
-        let packages_file = self.base_dir.join("packages.json");
-        let packages = if packages_file.exists() {
-            let contents = fs::read_to_string(&packages_file)?;
-            serde_json::from_str(&contents)?
-        } else {
-            Vec::new()
+    /// Asks the server for the manifest, which needs a valid token, and
+    /// returns how it answered. Fails only when it can't be reached.
+    pub async fn probe(&self) -> std::result::Result<StatusCode, reqwest::Error> {
+        let request = self.authorize(self.client.get(format!("{}/sync/manifest", self.config.url.trim_end_matches('/'))))
+            .timeout(std::time::Duration::from_secs(10));
+        let response = trace::send(request).await?;
+        Ok(response.status())
+    }
+
+    /// Registers this machine with the server. Registering the same name and
+    /// hostname again returns the existing device.
+    pub async fn register_device(&self, name: &str, os: &str, hostname: &str) -> Result<Device> {
+        if let Some(backend) = &self.backend {
+            return Err(KiwiError::InvalidCommand(format!("Devices are registered with a kiwi server, not {}", backend.describe())));
+        }
+        let request = self.authorize(self.client.post(format!("{}/devices/register", self.config.url.trim_end_matches('/'))))
+            .json(&serde_json::json!({ "name": name, "os": os, "hostname": hostname }));
+        let response = trace::send(request).await?;
+
+        if !response.status().is_success() {
+            return Err(format!("Failed to register device: {}", response.status()).into());
+        }
+        Ok(response.json().await?)
+    }
+
+    /// Uploads the tracked files and the saved package list, replacing what's
+    /// on the server, except for files and packages in other profiles. Files
+    /// only the server changed since the last sync, and files only it has,
+    /// are kept as they are there, and the push is refused if any file
+    /// changed on both sides. `force` overwrites the server regardless.
+    pub async fn push(&self, tracked: &[PathBuf], dry_run: bool, force: bool) -> Result<SyncSummary> {
+        if self.encrypt && self.encryption.is_none() {
+            return Err(KiwiError::Encryption("Encryption is on, but this machine has no key; run `kiwi encrypt import-key` with the key from another machine".to_string()));
+        }
+        let remote = self.fetch().await?;
+        let mut summary = SyncSummary { downloaded: remote.transfer, ..Default::default() };
+        let profiles = self.load_profiles()?;
+        let profile = self.profile.as_deref();
+        let mut state = self.load_state()?;
+
+        let mut files = HashMap::new();
+        let mut kept = HashMap::new();
+        let local_files = self.local_files(tracked)?;
+        let reading = self.progress.files("Reading", local_files.len());
+        for path in &local_files {
+            reading.inc(1);
+            reading.set_message(path.display().to_string());
+            let key = match self.sync_key(path) {
+                Some(key) => key,
+                None => {
+                    summary.skipped.push((path.display().to_string(), "outside the home directory".to_string()));
+                    continue;
+                }
+            };
+            let contents = match fs::read_to_string(path) {
+                Ok(contents) => contents,
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                    summary.skipped.push((key, "missing locally".to_string()));
+                    continue;
+                }
+                Err(e) if e.kind() == std::io::ErrorKind::InvalidData => {
+                    summary.skipped.push((key, "not a text file".to_string()));
+                    continue;
+                }
+                Err(e) => return Err(e.into()),
+            };
+            match remote.data.files.get(&key) {
+                None => summary.added.push(key.clone()),
+                Some(existing) if *existing == contents => summary.unchanged += 1,
+                Some(existing) => {
+                    // Whichever side changed since the last sync wins
+                    let base = state.files.get(&key);
+                    if force || base == Some(&hash_content(existing)) {
+                        summary.updated.push(key.clone());
+                    } else {
+                        if base == Some(&hash_content(&contents)) {
+                            summary.skipped.push((key.clone(), "newer on the server".to_string()));
+                        } else {
+                            summary.conflicts.push(key.clone());
+                        }
+                        kept.insert(key.clone(), remote.encrypted.get(&key).unwrap_or(existing).clone());
+                        continue;
+                    }
+                }
+            }
+            files.insert(key, contents);
+        }
+        reading.finish_and_clear();
+        // Other profiles' files are kept as they're stored, and so are the
+        // assignments, which a machine that never pulled them doesn't know
+        // about. So are files another machine added since the last sync
+        let profiles_key = self.sync_key(&self.profiles_path());
+        for (key, contents) in &remote.data.files {
+            if files.contains_key(key) || kept.contains_key(key) {
+                continue;
+            }
+            let stored = remote.encrypted.get(key).unwrap_or(contents).clone();
+            if !profiles.includes_file(self.profile_key(key), profile) || Some(key) == profiles_key.as_ref() {
+                summary.excluded += 1;
+            } else if force || state.files.contains_key(key) {
+                summary.removed.push(key.clone());
+                continue;
+            } else {
+                summary.skipped.push((key.clone(), "new on the server".to_string()));
+            }
+            kept.insert(key.clone(), stored);
+        }
+        summary.added.sort();
+        summary.updated.sort();
+        summary.removed.sort();
+        summary.conflicts.sort();
+
+        // Only what's new is scanned, so a secret that's allowed or already
+        // on the server doesn't hold up every push
+        if self.secret_scan != SecretScan::Off {
+            let allowlist = Allowlist::load(&self.allowlist_path())?;
+            for key in summary.added.iter().chain(&summary.updated) {
+                summary.secrets.extend(secrets::scan(key, &files[key], &allowlist));
+            }
+        }
+
+        // Keep the server's packages when none have been saved locally
+        let packages = match self.load_packages()? {
+            Some(mut packages) => {
+                for package in &remote.data.packages {
+                    if !profiles.includes_package(&package.name, profile) && !packages.iter().any(|p| p.name == package.name) {
+                        packages.push(package.clone());
+                    }
+                }
+                packages
+            }
+            None => remote.data.packages.clone(),
         };
+        summary.packages = packages.iter().map(|p| p.name.clone()).collect();
+
+        if dry_run {
+            return Ok(summary);
+        }
+        if !summary.conflicts.is_empty() {
+            return Err(format!(
+                "These files changed here and on the server, so nothing was pushed: {}\n\
+                 Resolve them with `kiwi push` in a terminal or `kiwi pull`, or push with --force to overwrite the server's",
+                summary.conflicts.join(", ")
+            ).into());
+        }
+        if self.secret_scan == SecretScan::Block && !summary.secrets.is_empty() {
+            let found: Vec<_> = summary.secrets.iter()
+                .map(|f| format!("  {}:{} looks like a {} ({})", f.path, f.line, f.rule, f.fingerprint))
+                .collect();
+            return Err(KiwiError::SecretsFound(format!(
+                "these files look like they contain secrets, so nothing was pushed:\n{}\n\
+                 Remove them, or if they're safe, allow them with `kiwi secrets allow` or a `{}` comment on the line",
+                found.join("\n"),
+                secrets::INLINE_ALLOW
+            )));
+        }
+
+        // Kept files stay as last synced, so they still show as changed
+        // remotely
+        let mut upload = kept;
+        state.files.retain(|key, _| upload.contains_key(key));
+        state.stored.retain(|key, _| upload.contains_key(key));
+        let sealing = self.progress.files(if self.encrypt { "Encrypting" } else { "Preparing" }, files.len());
+        for (key, contents) in files {
+            sealing.inc(1);
+            sealing.set_message(key.clone());
+            let sealed = self.seal(&key, &contents, &remote)?;
+            let stored = (sealed != contents).then(|| hash_content(&sealed));
+            state.record(key.clone(), hash_content(&contents), stored);
+            upload.insert(key, sealed);
+        }
+        sealing.finish_and_clear();
 
-        let sync_data = SyncData {
-            files: std::collections::HashMap::new(),
-            packages,
+        let data = SyncData { files: upload, packages };
+        let body = serde_json::to_vec(&data)?;
+        let (revision, uploaded) = match &self.backend {
+            Some(backend) => {
+                let started = Instant::now();
+                let revision = backend.push(&data, remote.etag.as_deref(), force)?;
+                (revision, Transfer { bytes: body.len() as u64, elapsed: started.elapsed() })
+            }
+            None => self.upload(&body, &remote, force).await?,
         };
+        summary.uploaded = uploaded;
+        state.revision = revision;
+        self.save_state(&state)?;
 
-        let response = self.client
-            .post(url)
-            .header("Authorization", self.get_auth_header())
-            .json(&sync_data)
-            .send()
-            .await?;
-        
+        // Backups get a copy of what the server now has, without the
+        // checks: they follow the server rather than being synced with
+        for mirror in &self.mirrors {
+            let request = self.authorize_for(&mirror.config, self.client.post(endpoint(&mirror.config)))
+                .header(reqwest::header::CONTENT_TYPE, "application/json")
+                .body(body.clone());
+            let response = trace::send(request).await;
+            match response {
+                Ok(response) if response.status().is_success() => summary.mirrored.push(mirror.name.clone()),
+                Ok(response) => summary.mirror_failures.push((mirror.name.clone(), response.status().to_string())),
+                Err(e) => summary.mirror_failures.push((mirror.name.clone(), e.to_string())),
+            }
+        }
+        Ok(summary)
+    }
+
+    /// Uploads a push to the server, returning the revision it saved and
+    /// how long that took. It's refused if the server changed since
+    /// `remote` was fetched, unless `force`.
+    async fn upload(&self, body: &[u8], remote: &Remote, force: bool) -> Result<(i64, Transfer)> {
+        // Sent in pieces so the upload's progress can be followed
+        let size = body.len() as u64;
+        let sending = self.progress.bytes("Uploading", Some(size));
+        let sent = sending.clone();
+        let chunks: Vec<Vec<u8>> = body.chunks(UPLOAD_CHUNK_SIZE).map(<[u8]>::to_vec).collect();
+        let stream = futures_util::stream::iter(chunks.into_iter().map(move |chunk| {
+            sent.inc(chunk.len() as u64);
+            Ok::<_, std::io::Error>(chunk)
+        }));
+        let mut request = self.authorize(self.client.post(self.endpoint()))
+            .header(reqwest::header::CONTENT_TYPE, "application/json")
+            .header(reqwest::header::CONTENT_LENGTH, size)
+            .body(reqwest::Body::wrap_stream(stream));
+        if let (false, Some(etag)) = (force, &remote.etag) {
+            request = request.header("If-Match", etag);
+        }
+        let started = Instant::now();
+        let response = trace::send(request).await;
+        sending.finish_and_clear();
+        let response = response?;
+        let transfer = Transfer { bytes: size, elapsed: started.elapsed() };
+
+        if response.status() == StatusCode::CONFLICT {
+            return Err("The remote changed since it was last pulled; run `kiwi pull` first, or push with --force to overwrite it".into());
+        }
         if !response.status().is_success() {
             return Err(format!("Failed to push: {}", response.status()).into());
         }
+        Ok((revision_header(&response).unwrap_or_default(), transfer))
+    }
+
+    /// Writes the server's files in this machine's profile into the home
+    /// directory, renders its templates, and saves its package list. Files
+    /// changed only here since the last sync are kept. With `prefer_local`,
+    /// so are files changed on both sides, and files deleted here since the
+    /// last sync stay deleted. In symlink mode files are kept in the store
+    /// and linked into place, and files already up to date are switched to
+    /// or from links to match the mode.
+    pub async fn pull(&self, prefer_local: bool, dry_run: bool) -> Result<SyncSummary> {
+        self.pull_only(&[], prefer_local, dry_run).await
+    }
+
+    /// Pulls like `pull`, but only the files at or under the paths in
+    /// `only` (relative to the home directory), or every file when it's
+    /// empty. The package list is left alone unless everything is pulled.
+    pub async fn pull_only(&self, only: &[String], prefer_local: bool, dry_run: bool) -> Result<SyncSummary> {
+        let (remote, source) = self.fetch_any().await?;
+        let mut summary = SyncSummary { downloaded: remote.transfer, source, ..Default::default() };
+        let mut state = self.load_state()?;
+        state.files.retain(|key, _| remote.data.files.contains_key(key));
+        state.stored.retain(|key, _| remote.data.files.contains_key(key));
+        // A backup's revisions are its own
+        if only.is_empty() && summary.source.is_none() {
+            state.revision = remote.revision.unwrap_or_default();
+        }
+
+        // The server's assignments are the ones to go by, even before
+        // they've been pulled
+        let profiles_key = self.sync_key(&self.profiles_path());
+        let profiles = match profiles_key.as_ref().and_then(|key| remote.data.files.get(key)) {
+            Some(contents) => Profiles::parse(contents)?,
+            None => self.load_profiles()?,
+        };
+        let profile = self.profile.as_deref();
+
+        // Templates are rendered once they're all settled, from whichever
+        // side's copy is kept
+        let mut templates = BTreeMap::new();
+        let files: BTreeMap<_, _> = remote.data.files.into_iter().collect();
+        let writing = self.progress.files("Writing", files.len());
+        let mut selected = 0;
+        for (key, contents) in files {
+            writing.inc(1);
+            if !self.selects(only, &key) {
+                continue;
+            }
+            writing.set_message(key.clone());
+            if !profiles.includes_file(self.profile_key(&key), profile) {
+                summary.excluded += 1;
+                continue;
+            }
+            selected += 1;
+            let rendered_key = self.rendered_key(&key).map(str::to_string);
+            let hash = hash_content(&contents);
+            let stored = remote.encrypted.get(&key).map(|sealed| hash_content(sealed));
+            let path = match self.local_path(&key) {
+                Some(path) => path,
+                None => {
+                    summary.skipped.push((key, "not a safe path".to_string()));
+                    continue;
+                }
+            };
+            let existing = match fs::read_to_string(&path) {
+                Ok(existing) => Some(existing),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+                Err(e) => return Err(e.into()),
+            };
+            match existing {
+                Some(existing) if existing == contents => {
+                    let own = Some(&key) == profiles_key.as_ref() || rendered_key.is_some();
+                    if !dry_run && !own {
+                        self.store.settle(&path)?;
+                    }
+                    if let Some(rendered_key) = rendered_key {
+                        templates.insert(rendered_key, contents);
+                    }
+                    state.record(key, hash, stored);
+                    summary.unchanged += 1;
+                    continue;
+                }
+                Some(existing) => {
+                    let base = state.files.get(&key);
+                    let changed_here = base != Some(&hash_content(&existing));
+                    if changed_here && (prefer_local || base == Some(&hash)) {
+                        if let Some(rendered_key) = rendered_key {
+                            templates.insert(rendered_key, existing);
+                        }
+                        summary.skipped.push((key, "kept local changes".to_string()));
+                        continue;
+                    }
+                    if changed_here {
+                        summary.conflicts.push(key.clone());
+                    }
+                    summary.updated.push(key.clone());
+                }
+                None if prefer_local && state.files.get(&key) == Some(&hash) => {
+                    summary.skipped.push((key, "deleted locally".to_string()));
+                    continue;
+                }
+                None => summary.added.push(key.clone()),
+            }
+            // profiles.json and templates are kiwi's own, not files to track
+            let own = Some(&key) == profiles_key.as_ref() || rendered_key.is_some();
+            if let Some(rendered_key) = rendered_key {
+                templates.insert(rendered_key, contents.clone());
+            }
+            state.record(key, hash, stored);
+            if !dry_run {
+                if own {
+                    if let Some(parent) = path.parent() {
+                        fs::create_dir_all(parent)?;
+                    }
+                    fs::write(&path, contents)?;
+                } else {
+                    self.store.write(&path, &contents)?;
+                    summary.written.push(path);
+                }
+            }
+        }
+        writing.finish_and_clear();
+        if !only.is_empty() && selected == 0 {
+            return Err(KiwiError::Sync(format!("Nothing on the server for this profile matches {}", only.join(", "))));
+        }
+        self.render(templates, &mut state, &mut summary, prefer_local, dry_run)?;
+        summary.conflicts.sort();
+        if !only.is_empty() {
+            if !dry_run {
+                self.save_state(&state)?;
+            }
+            return Ok(summary);
+        }
+
+        // The whole list is saved so a later push doesn't drop the packages
+        // of other profiles; only this profile's are installed
+        summary.packages = remote.data.packages.iter()
+            .filter(|p| profiles.includes_package(&p.name, profile))
+            .map(|p| p.name.clone())
+            .collect();
+        if !dry_run {
+            if !remote.data.packages.is_empty() {
+                self.save_packages(&remote.data.packages)?;
+            }
+            self.save_state(&state)?;
+        }
+
+        Ok(summary)
+    }
+
+    /// Scans every file that syncs for likely secrets, including those
+    /// already on the server.
+    pub fn scan_secrets(&self, tracked: &[PathBuf]) -> Result<Vec<Finding>> {
+        let allowlist = Allowlist::load(&self.allowlist_path())?;
+        let mut findings = Vec::new();
+        for path in self.local_files(tracked)? {
+            let key = match self.sync_key(&path) {
+                Some(key) => key,
+                None => continue,
+            };
+            match fs::read_to_string(&path) {
+                Ok(contents) => findings.extend(secrets::scan(&key, &contents, &allowlist)),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => continue,
+                Err(e) if e.kind() == std::io::ErrorKind::InvalidData => continue,
+                Err(e) => return Err(e.into()),
+            }
+        }
+        findings.sort_by(|a, b| (&a.path, a.line).cmp(&(&b.path, b.line)));
+        Ok(findings)
+    }
+
+    /// Renders the templates in ~/.kiwi/dotfiles/templates into place, after
+    /// they've been edited here.
+    pub fn render_templates(&self, dry_run: bool) -> Result<SyncSummary> {
+        let mut summary = SyncSummary::default();
+        let mut state = self.load_state()?;
+        let profiles = self.load_profiles()?;
+        let mut templates = BTreeMap::new();
+        for path in self.template_files()? {
+            let key = match self.sync_key(&path) {
+                Some(key) => key,
+                None => continue,
+            };
+            if let Some(rendered_key) = self.rendered_key(&key) {
+                if profiles.includes_file(rendered_key, self.profile.as_deref()) {
+                    templates.insert(rendered_key.to_string(), fs::read_to_string(&path)?);
+                }
+            }
+        }
+        self.render(templates, &mut state, &mut summary, false, dry_run)?;
+        if !dry_run {
+            self.save_state(&state)?;
+        }
+        Ok(summary)
+    }
+
+    /// Renders each template, by the path of the file it renders to, and
+    /// writes the files that changed. With `prefer_local`, files edited
+    /// since they were last rendered are left alone. A template that fails
+    /// to render is skipped.
+    fn render(&self, templates: BTreeMap<String, String>, state: &mut SyncState, summary: &mut SyncSummary, prefer_local: bool, dry_run: bool) -> Result<()> {
+        if templates.is_empty() {
+            return Ok(());
+        }
+        let context = TemplateContext::current(self.profile.as_deref());
+        for (key, source) in templates {
+            let path = match self.local_path(&key) {
+                Some(path) => path,
+                None => {
+                    summary.skipped.push((key, "not a safe path".to_string()));
+                    continue;
+                }
+            };
+            let rendered = match template::render(&key, &source, &context) {
+                Ok(rendered) => rendered,
+                Err(e) => {
+                    summary.skipped.push((key, e.to_string()));
+                    continue;
+                }
+            };
+            let hash = hash_content(&rendered);
+            let existing = match fs::read(&path) {
+                Ok(existing) => Some(hash_bytes(&existing)),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+                Err(e) => return Err(e.into()),
+            };
+            match existing {
+                Some(existing) if existing == hash => {
+                    if !dry_run {
+                        self.store.settle(&path)?;
+                    }
+                    state.rendered.insert(key, hash);
+                    continue;
+                }
+                Some(existing) if prefer_local && state.rendered.get(&key) != Some(&existing) => {
+                    summary.skipped.push((key, "edited since it was rendered".to_string()));
+                    continue;
+                }
+                _ => {}
+            }
+            if !dry_run {
+                self.store.write(&path, &rendered)?;
+            }
+            state.rendered.insert(key.clone(), hash);
+            summary.rendered.push(key);
+        }
         Ok(())
     }
 
-    pub async fn pull(&self, prefer_local: bool) -> Result<()> {
-        if !self.base_dir.exists() && !prefer_local {
-            return Err("Base directory does not exist".into());
+    /// Compares the tracked files and installed packages with the server's
+    /// manifest, using what was last pushed or pulled to tell which side
+    /// changed. Nothing is downloaded but hashes and package names.
+    pub async fn status(&self, tracked: &[PathBuf], installed: &[Package]) -> Result<SyncStatus> {
+        let (manifest, remote_packages) = match &self.backend {
+            Some(backend) => {
+                let (data, _, revision) = backend.fetch()?;
+                let files = data.files.iter()
+                    .map(|(key, contents)| (key.clone(), ManifestEntry { hash: hash_content(contents) }))
+                    .collect();
+                (Manifest { revision, files }, data.packages)
+            }
+            None => (self.get_json::<Manifest>("/sync/manifest").await?, self.get_json::<Vec<Package>>("/sync/packages").await?),
+        };
+        let state = self.load_state()?;
+        let profiles = self.load_profiles()?;
+        let profile = self.profile.as_deref();
+        let mut status = SyncStatus { revision: manifest.revision, ..Default::default() };
+
+        let mut seen = BTreeSet::new();
+        for path in &self.local_files(tracked)? {
+            let key = match self.sync_key(path) {
+                Some(key) => key,
+                None => continue,
+            };
+            seen.insert(key.clone());
+            let local = match fs::read(path) {
+                Ok(contents) => hash_bytes(&contents),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                    status.missing.push(key);
+                    continue;
+                }
+                Err(e) => return Err(e.into()),
+            };
+            let remote = match manifest.files.get(&key) {
+                Some(entry) => state.content_hash(&key, &entry.hash),
+                None => {
+                    status.not_pushed.push(key);
+                    continue;
+                }
+            };
+            let base = state.files.get(&key).map(String::as_str);
+            if local == remote {
+                continue;
+            } else if base == Some(remote) {
+                status.modified_locally.push(key);
+            } else if base == Some(local.as_str()) {
+                status.newer_remotely.push(key);
+            } else {
+                status.conflicting.push(key);
+            }
+        }
+        for (key, entry) in &manifest.files {
+            if seen.contains(key) || !profiles.includes_file(self.profile_key(key), profile) {
+                continue;
+            }
+            // Synced before and unchanged remotely, but gone from here: it was
+            // deleted locally, likely from inside a tracked directory
+            let deleted = state.files.get(key).map(String::as_str) == Some(state.content_hash(key, &entry.hash))
+                && self.local_path(key).map_or(false, |path| !path.exists());
+            if deleted {
+                status.missing.push(key.clone());
+            } else {
+                status.untracked.push(key.clone());
+            }
+        }
+
+        let installed: BTreeSet<_> = installed.iter().map(|p| p.name.clone()).collect();
+        let remote: BTreeSet<_> = remote_packages.into_iter().map(|p| p.name).collect();
+        status.packages_not_installed = remote.difference(&installed)
+            .filter(|name| profiles.includes_package(name, profile))
+            .cloned()
+            .collect();
+        status.packages_not_pushed = installed.difference(&remote).cloned().collect();
+
+        for list in [
+            &mut status.modified_locally,
+            &mut status.newer_remotely,
+            &mut status.conflicting,
+            &mut status.not_pushed,
+            &mut status.untracked,
+            &mut status.missing,
+        ] {
+            list.sort();
+        }
+        Ok(status)
+    }
+
+    /// Returns the machines registered to this account, oldest first.
+    pub async fn devices(&self) -> Result<Vec<Device>> {
+        if let Some(backend) = &self.backend {
+            return Err(KiwiError::InvalidCommand(format!("Devices are registered with a kiwi server, not {}", backend.describe())));
+        }
+        self.get_json("/devices").await
+    }
+
+    pub async fn rename_device(&self, id: &str, name: &str) -> Result<Device> {
+        if let Some(backend) = &self.backend {
+            return Err(KiwiError::InvalidCommand(format!("Devices are registered with a kiwi server, not {}", backend.describe())));
+        }
+        let request = self.authorize(self.client.patch(format!("{}/devices/{}", self.config.url.trim_end_matches('/'), id)))
+            .json(&serde_json::json!({ "name": name }));
+        let response = trace::send(request).await?;
+
+        if !response.status().is_success() {
+            return Err(format!("Failed to rename device: {}", response.status()).into());
         }
+        Ok(response.json().await?)
+    }
 
-        let url = &self.config.url;
-        let response = self.client
-            .get(url)
-            .header("Authorization", self.get_auth_header())
-            .send()
-            .await?;
+    /// Cuts a device off: the server refuses requests that name it from
+    /// then on, and replaces the account's token, which the device could
+    /// otherwise keep syncing with. Returns the new token.
+    pub async fn revoke_device(&self, id: &str) -> Result<RevokedDevice> {
+        if let Some(backend) = &self.backend {
+            return Err(KiwiError::InvalidCommand(format!("Devices are registered with a kiwi server, not {}", backend.describe())));
+        }
+        let request = self.authorize(self.client.post(format!("{}/devices/{}/revoke", self.config.url.trim_end_matches('/'), id)));
+        let response = trace::send(request).await?;
+
+        if !response.status().is_success() {
+            return Err(format!("Failed to revoke device: {}", response.status()).into());
+        }
+        Ok(response.json().await?)
+    }
+
+    /// Returns the account the token signs in as, with this machine's
+    /// device when it's registered.
+    pub async fn account(&self) -> Result<Account> {
+        if let Some(backend) = &self.backend {
+            return Err(KiwiError::InvalidCommand(format!("There's no account when syncing with {}", backend.describe())));
+        }
+        self.get_json("/account").await
+    }
+
+    /// Returns the latest change to each file in this machine's profile, and
+    /// to the package list, newest first. Up to `limit` are returned.
+    pub async fn history(&self, limit: usize) -> Result<Vec<Change>> {
+        let mut changes = Vec::new();
+        match &self.backend {
+            Some(backend) => changes = backend.changes()?,
+            None => {
+                let mut cursor = String::new();
+                loop {
+                    let page: ChangesPage = self.get_json(&format!("/sync/changes?since={}", cursor)).await?;
+                    changes.extend(page.changes);
+                    if !page.has_more {
+                        break;
+                    }
+                    cursor = page.cursor;
+                }
+            }
+        }
+
+        let profiles = self.load_profiles()?;
+        changes.retain(|change| {
+            change.path.as_deref().map_or(true, |path| profiles.includes_file(self.profile_key(path), self.profile.as_deref()))
+        });
+        changes.reverse();
+        changes.truncate(limit);
+        Ok(changes)
+    }
+
+    /// Pairs up each file on two sides for diffing: snapshot `from` against
+    /// `to` (the current remote when `None`), or without `from`, the tracked
+    /// local files against the remote. `only` limits it to one path.
+    pub async fn diff(&self, tracked: &[PathBuf], from: Option<i64>, to: Option<i64>, only: Option<&str>) -> Result<Vec<FileDiff>> {
+        let mut new = match to {
+            Some(revision) => self.snapshot_files(revision).await?,
+            None => self.fetch().await?.data.files,
+        };
+        let old = match from {
+            Some(revision) => self.snapshot_files(revision).await?,
+            None => {
+                // Files in other profiles aren't expected here
+                let profiles = self.load_profiles()?;
+                new.retain(|key, _| profiles.includes_file(self.profile_key(key), self.profile.as_deref()));
+                let mut files = HashMap::new();
+                for path in &self.local_files(tracked)? {
+                    let key = match self.sync_key(path) {
+                        Some(key) => key,
+                        None => continue,
+                    };
+                    match fs::read_to_string(path) {
+                        Ok(contents) => {
+                            files.insert(key, contents);
+                        }
+                        Err(e) if e.kind() == std::io::ErrorKind::NotFound => continue,
+                        Err(e) if e.kind() == std::io::ErrorKind::InvalidData => continue,
+                        Err(e) => return Err(e.into()),
+                    }
+                }
+                files
+            }
+        };
+
+        let paths: BTreeSet<_> = old.keys().chain(new.keys()).cloned().collect();
+        let diffs = paths.into_iter()
+            .filter(|path| only.map_or(true, |only| path == only))
+            .map(|path| FileDiff {
+                old: old.get(&path).cloned(),
+                new: new.get(&path).cloned(),
+                path,
+            })
+            .filter(|diff| diff.is_changed())
+            .collect();
+        Ok(diffs)
+    }
+
+    /// Returns the tracked files changed both here and on the server since
+    /// the last sync, with both copies.
+    pub async fn conflicts(&self, tracked: &[PathBuf]) -> Result<Vec<Conflict>> {
+        let remote = self.fetch().await?;
+        let state = self.load_state()?;
+        let mut conflicts = Vec::new();
+        for path in &self.local_files(tracked)? {
+            let key = match self.sync_key(path) {
+                Some(key) => key,
+                None => continue,
+            };
+            let theirs = match remote.data.files.get(&key) {
+                Some(contents) => contents,
+                None => continue,
+            };
+            let local = match fs::read_to_string(path) {
+                Ok(contents) => contents,
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => continue,
+                Err(e) if e.kind() == std::io::ErrorKind::InvalidData => continue,
+                Err(e) => return Err(e.into()),
+            };
+            let base = state.files.get(&key);
+            if local == *theirs || base == Some(&hash_content(&local)) || base == Some(&hash_content(theirs)) {
+                continue;
+            }
+            conflicts.push(Conflict {
+                stored: remote.encrypted.get(&key).map(|sealed| hash_content(sealed)),
+                remote: theirs.clone(),
+                path: key,
+                local,
+            });
+        }
+        conflicts.sort_by(|a, b| a.path.cmp(&b.path));
+        Ok(conflicts)
+    }
+
+    /// Settles a conflict with `contents`, which may be either copy or a
+    /// merge of the two. It's written here and recorded as synced against
+    /// the server's copy, so the next push sends it unless it's the
+    /// server's.
+    pub fn resolve(&self, conflict: &Conflict, contents: &str) -> Result<()> {
+        let path = self.local_path(&conflict.path)
+            .ok_or_else(|| format!("{} is not a safe path", conflict.path))?;
+        if contents != conflict.local {
+            self.store.write(&path, contents)?;
+        }
+        let mut state = self.load_state()?;
+        state.record(conflict.path.clone(), hash_content(&conflict.remote), conflict.stored.clone());
+        self.save_state(&state)
+    }
+
+    /// Writes the snapshot's copy of each file in `files`, as paired up by
+    /// `diff` against a snapshot, and renders any templates among them.
+    /// Files the snapshot didn't have are left alone. Nothing is recorded
+    /// as synced, so the next push sends the older copies to the server.
+    /// Returns the paths written.
+    pub fn roll_back(&self, files: &[FileDiff]) -> Result<Vec<String>> {
+        let mut written = Vec::new();
+        let mut templates = false;
+        for file in files {
+            let contents = match &file.new {
+                Some(contents) => contents,
+                None => continue,
+            };
+            let path = self.local_path(&file.path)
+                .ok_or_else(|| format!("{} is not a safe path", file.path))?;
+            let template = self.rendered_key(&file.path).is_some();
+            templates |= template;
+            // profiles.json and templates are kiwi's own, not files to link
+            if template || path == self.profiles_path() {
+                if let Some(parent) = path.parent() {
+                    fs::create_dir_all(parent)?;
+                }
+                fs::write(&path, contents)?;
+            } else {
+                self.store.write(&path, contents)?;
+            }
+            written.push(file.path.clone());
+        }
+        if templates {
+            self.render_templates(false)?;
+        }
+        Ok(written)
+    }
+
+    /// Returns the files changed here since they were last pushed or pulled,
+    /// edited, new or deleted, without asking the server.
+    pub fn changed_locally(&self, tracked: &[PathBuf]) -> Result<Vec<String>> {
+        let state = self.load_state()?;
+        let mut changed = Vec::new();
+        for path in &self.local_files(tracked)? {
+            let key = match self.sync_key(path) {
+                Some(key) => key,
+                None => continue,
+            };
+            let synced = state.files.get(&key);
+            match fs::read(path) {
+                Ok(contents) if synced == Some(&hash_bytes(&contents)) => {}
+                Ok(_) => changed.push(key),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound && synced.is_some() => changed.push(key),
+                Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+                Err(e) => return Err(e.into()),
+            }
+        }
+        changed.sort();
+        Ok(changed)
+    }
+
+    /// Whether a file is at or under one of the paths in `only`, or `only`
+    /// is empty. Templates are picked by the file they render to.
+    pub fn selects(&self, only: &[String], key: &str) -> bool {
+        let key = self.profile_key(key);
+        only.is_empty() || only.iter().any(|path| {
+            let path = path.trim_end_matches('/');
+            key == path || key.strip_prefix(path).map_or(false, |rest| rest.starts_with('/'))
+        })
+    }
+
+    /// Returns the server's name for a path given on the command line, which
+    /// may be relative to the current directory or already a server path.
+    pub fn key_for(&self, path: &str) -> String {
+        let expanded = match path.strip_prefix("~/") {
+            Some(rest) => self.home_dir.join(rest),
+            None => std::env::current_dir().unwrap_or_default().join(path),
+        };
+        self.sync_key(&expanded).unwrap_or_else(|| path.to_string())
+    }
+
+    async fn snapshot_files(&self, revision: i64) -> Result<HashMap<String, String>> {
+        let data: SyncData = match &self.backend {
+            Some(backend) => backend.snapshot(revision)?,
+            None => self.get_json(&format!("/sync/snapshots/{}", revision)).await?,
+        };
+        Ok(self.open(data.files)?.0)
+    }
+
+    async fn get_json<T: serde::de::DeserializeOwned>(&self, path: &str) -> Result<T> {
+        let response = trace::send(self.authorize(self.client.get(format!("{}{}", self.config.url.trim_end_matches('/'), path)))).await?;
+
+        if !response.status().is_success() {
+            return Err(format!("Failed to read {}: {}", path, response.status()).into());
+        }
+        Ok(response.json().await?)
+    }
+
+    async fn fetch(&self) -> Result<Remote> {
+        match &self.backend {
+            Some(backend) => self.fetch_backend(backend),
+            None => self.fetch_from(&self.config).await,
+        }
+    }
+
+    /// Fetches from a git repository or snapshot directory. Its tag (a
+    /// commit, or the revision) stands in for the server's ETag, so a push
+    /// is refused if another was made since.
+    fn fetch_backend(&self, backend: &Backend) -> Result<Remote> {
+        let started = Instant::now();
+        let (mut data, tag, revision) = backend.fetch()?;
+        let transfer = Transfer {
+            bytes: data.files.values().map(|contents| contents.len() as u64).sum(),
+            elapsed: started.elapsed(),
+        };
+        let (files, encrypted) = self.open(data.files)?;
+        data.files = files;
+        Ok(Remote { data, encrypted, etag: tag, revision: Some(revision), transfer })
+    }
+
+    /// Fetches from the server, or if it can't be reached, the first backup
+    /// that can, returning the backup's name.
+    async fn fetch_any(&self) -> Result<(Remote, Option<String>)> {
+        let error = match self.fetch().await {
+            Ok(remote) => return Ok((remote, None)),
+            Err(e) if e.is_offline() => e,
+            Err(e) => return Err(e),
+        };
+        for mirror in &self.mirrors {
+            if let Ok(remote) = self.fetch_from(&mirror.config).await {
+                return Ok((remote, Some(mirror.name.clone())));
+            }
+        }
+        Err(error)
+    }
+
+    async fn fetch_from(&self, server: &SyncConfig) -> Result<Remote> {
+        let started = Instant::now();
+        let mut response = trace::send(self.authorize_for(server, self.client.get(endpoint(server)))).await?;
 
         if !response.status().is_success() {
             return Err(format!("Failed to pull: {}", response.status()).into());
         }
 
-        let sync_data: SyncData = response.json().await?;
-        
-        if !sync_data.packages.is_empty() {
-            let packages_file = self.base_dir.join("packages.json");
-            fs::write(
-                &packages_file,
-                serde_json::to_string_pretty(&sync_data.packages)?,
-            )?;
+        let etag = response.headers()
+            .get(reqwest::header::ETAG)
+            .and_then(|v| v.to_str().ok())
+            .map(|v| v.to_string());
+        let revision = revision_header(&response);
+
+        // Read in pieces so the download's progress can be followed; the
+        // size isn't known when the server compresses it
+        let receiving = self.progress.bytes("Downloading", response.content_length());
+        let mut body = Vec::new();
+        while let Some(chunk) = response.chunk().await? {
+            receiving.inc(chunk.len() as u64);
+            body.extend_from_slice(&chunk);
         }
+        receiving.finish_and_clear();
+        let transfer = Transfer { bytes: body.len() as u64, elapsed: started.elapsed() };
 
-        Ok(())
+        let mut data: SyncData = serde_json::from_slice(&body)?;
+        let (files, encrypted) = self.open(data.files)?;
+        data.files = files;
+        Ok(Remote { data, encrypted, etag, revision, transfer })
+    }
+
+    /// Decrypts the encrypted files from the server, returning all the
+    /// files and, separately, the encrypted originals.
+    fn open(&self, files: HashMap<String, String>) -> Result<(HashMap<String, String>, HashMap<String, String>)> {
+        let mut opened = HashMap::new();
+        let mut encrypted = HashMap::new();
+        for (key, contents) in files {
+            if !encryption::is_encrypted(&contents) {
+                opened.insert(key, contents);
+                continue;
+            }
+            let encryption = self.encryption.as_ref().ok_or_else(|| {
+                KiwiError::Encryption("Files on the server are encrypted, but this machine has no key; run `kiwi encrypt import-key` with the key from another machine".to_string())
+            })?;
+            let plaintext = encryption.decrypt(&contents)
+                .map_err(|e| KiwiError::Encryption(format!("Could not decrypt {} ({}); is this the right key?", key, e)))?;
+            opened.insert(key.clone(), plaintext);
+            encrypted.insert(key, contents);
+        }
+        Ok((opened, encrypted))
     }
 
-    pub async fn sync_dotfiles(&self, _prefer_local: bool) -> Result<()> {
+    /// Returns what to upload for a file: encrypted when encryption is on,
+    /// reusing the server's copy when the contents haven't changed so an
+    /// unchanged file doesn't look changed.
+    fn seal(&self, key: &str, contents: &str, remote: &Remote) -> Result<String> {
+        let encryption = match (&self.encryption, self.encrypt) {
+            (Some(encryption), true) => encryption,
+            _ => return Ok(contents.to_string()),
+        };
+        if let (Some(existing), Some(sealed)) = (remote.data.files.get(key), remote.encrypted.get(key)) {
+            if existing == contents {
+                return Ok(sealed.clone());
+            }
+        }
+        encryption.encrypt(contents)
+    }
+
+    fn endpoint(&self) -> String {
+        endpoint(&self.config)
+    }
+
+    fn sync_key(&self, path: &Path) -> Option<String> {
+        relative_key(&self.home_dir, path)
+    }
+
+    /// Returns where a file from the server belongs locally, refusing paths
+    /// that would land outside the home directory or among the hooks.
+    fn local_path(&self, key: &str) -> Option<PathBuf> {
+        let mut path = self.home_dir.clone();
+        for part in key.split('/') {
+            match part {
+                "" | "." => continue,
+                ".." => return None,
+                part => path.push(part),
+            }
+        }
+        if path == self.home_dir || path.starts_with(&self.hooks_dir) {
+            return None;
+        }
+        Some(path)
+    }
+
+    fn load_packages(&self) -> Result<Option<Vec<Package>>> {
+        let packages_file = self.base_dir.join("packages.json");
+        if !packages_file.exists() {
+            return Ok(None);
+        }
+        let contents = fs::read_to_string(&packages_file)?;
+        let packages: HashMap<String, Package> = serde_json::from_str(&contents)?;
+        let mut packages: Vec<_> = packages.into_values().collect();
+        packages.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(Some(packages))
+    }
+
+    fn save_packages(&self, packages: &[Package]) -> Result<()> {
+        fs::create_dir_all(&self.base_dir)?;
+        let packages: HashMap<_, _> = packages.iter()
+            .map(|p| (p.name.clone(), p.clone()))
+            .collect();
+        fs::write(
+            self.base_dir.join("packages.json"),
+            serde_json::to_string_pretty(&packages)?,
+        )?;
         Ok(())
     }
 
-    pub async fn sync_packages(&self) -> Result<()> {
+    fn profiles_path(&self) -> PathBuf {
+        self.base_dir.join("profiles.json")
+    }
+
+    fn load_profiles(&self) -> Result<Profiles> {
+        Profiles::load(&self.profiles_path())
+    }
+
+    fn allowlist_path(&self) -> PathBuf {
+        self.base_dir.join("secrets_allowlist.json")
+    }
+
+    fn templates_dir(&self) -> PathBuf {
+        self.base_dir.join("templates")
+    }
+
+    fn template_files(&self) -> Result<Vec<PathBuf>> {
+        let dir = self.templates_dir();
+        if !dir.is_dir() {
+            return Ok(Vec::new());
+        }
+        Dotfiles::expand(&dir, &KiwiIgnore::load(&self.home_dir)?)
+    }
+
+    /// Returns the file a template renders to, when `key` is a template.
+    fn rendered_key<'a>(&self, key: &'a str) -> Option<&'a str> {
+        let prefix = self.sync_key(&self.templates_dir())?;
+        key.strip_prefix(&prefix)?.strip_prefix('/')
+    }
+
+    /// Templates belong to the profiles of the file they render to.
+    fn profile_key<'a>(&self, key: &'a str) -> &'a str {
+        self.rendered_key(key).unwrap_or(key)
+    }
+
+    /// Returns the local files that sync: the tracked files, except those
+    /// rendered from a template or in the hooks directory, plus the
+    /// templates and profiles.json.
+    fn local_files(&self, tracked: &[PathBuf]) -> Result<Vec<PathBuf>> {
+        let templates_dir = self.templates_dir();
+        let mut files: Vec<_> = tracked.iter()
+            .filter(|path| !path.starts_with(&self.hooks_dir))
+            .filter(|path| match self.sync_key(path) {
+                Some(key) => !templates_dir.join(key).is_file(),
+                None => true,
+            })
+            .cloned()
+            .collect();
+        for path in self.template_files()?.into_iter().chain([self.profiles_path()]) {
+            if path.is_file() && !files.contains(&path) {
+                files.push(path);
+            }
+        }
+        Ok(files)
+    }
+
+    fn load_state(&self) -> Result<SyncState> {
+        let state_file = self.base_dir.join("sync_state.json");
+        if !state_file.exists() {
+            return Ok(SyncState::default());
+        }
+        let contents = fs::read_to_string(&state_file)?;
+        Ok(serde_json::from_str(&contents)?)
+    }
+
+    fn save_state(&self, state: &SyncState) -> Result<()> {
+        fs::create_dir_all(&self.base_dir)?;
+        fs::write(
+            self.base_dir.join("sync_state.json"),
+            serde_json::to_string_pretty(state)?,
+        )?;
         Ok(())
     }
 
-    fn get_auth_header(&self) -> String {
-        format!("Bearer {}", self.config.token)
+    fn authorize(&self, request: reqwest::RequestBuilder) -> reqwest::RequestBuilder {
+        self.authorize_for(&self.config, request)
+    }
+
+    fn authorize_for(&self, server: &SyncConfig, request: reqwest::RequestBuilder) -> reqwest::RequestBuilder {
+        let request = request.header("Authorization", auth_header(server));
+        match &server.device_id {
+            Some(id) => request.header("X-Kiwi-Device", id),
+            None => request,
+        }
     }
 }
 
+fn auth_header(server: &SyncConfig) -> String {
+    format!("Bearer {}", server.token)
+}
+
+fn endpoint(server: &SyncConfig) -> String {
+    format!("{}/sync", server.url.trim_end_matches('/'))
+}
+
+/// Returns the server's name for a local file: its path relative to the
+/// home directory, with forward slashes.
+pub fn relative_key(home: &Path, path: &Path) -> Option<String> {
+    let relative = path.strip_prefix(home).ok()?;
+    let parts: Vec<_> = relative.components()
+        .map(|c| c.as_os_str().to_string_lossy().into_owned())
+        .collect();
+    if parts.is_empty() {
+        return None;
+    }
+    Some(parts.join("/"))
+}
+
+/// Hashes file contents the way the server's manifest does.
+fn hash_content(contents: &str) -> String {
+    hash_bytes(contents.as_bytes())
+}
+
+fn hash_bytes(contents: &[u8]) -> String {
+    format!("{:x}", Sha256::digest(contents))
+}
+
+fn revision_header(response: &reqwest::Response) -> Option<i64> {
+    response.headers()
+        .get("X-Kiwi-Revision")
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse().ok())
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -124,8 +1584,36 @@ mod tests {
         let config = SyncConfig {
             url: "https://api.example.com".to_string(),
             token: "test-token".to_string(),
+            device_id: None,
         };
         let sync = Sync::new(config, PathBuf::from("/tmp"));
-        assert_eq!(sync.get_auth_header(), "Bearer test-token");
+        assert_eq!(auth_header(&sync.config), "Bearer test-token");
     }
-} 
\ No newline at end of file
+
+    #[test]
+    fn test_sync_paths() {
+        let config = SyncConfig {
+            url: "https://api.example.com/".to_string(),
+            token: "test-token".to_string(),
+            device_id: None,
+        };
+        let mut sync = Sync::new(config, PathBuf::from("/tmp"));
+        sync.home_dir = PathBuf::from("/home/kiwi");
+        assert_eq!(sync.endpoint(), "https://api.example.com/sync");
+        assert_eq!(sync.sync_key(Path::new("/home/kiwi/.config/nvim/init.lua")).as_deref(), Some(".config/nvim/init.lua"));
+        assert_eq!(sync.sync_key(Path::new("/etc/hosts")), None);
+        assert_eq!(sync.local_path(".zshrc"), Some(PathBuf::from("/home/kiwi/.zshrc")));
+        assert_eq!(sync.local_path("../etc/passwd"), None);
+        sync.hooks_dir = PathBuf::from("/home/kiwi/.kiwi/hooks");
+        assert_eq!(sync.local_path(".kiwi/hooks/post-pull"), None);
+        assert_eq!(sync.local_path("./.kiwi//hooks/pre-push"), None);
+    }
+
+    #[test]
+    fn test_hash_content() {
+        assert_eq!(
+            hash_content("hello"),
+            "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+        );
+    }
+}
@@ -0,0 +1,397 @@
+use crate::{Result, KiwiError};
+
+/// What templates can refer to, as `{{ .Hostname }}` and so on. OS and Arch
+/// use Go's names (darwin, linux, arm64, amd64) to match the syntax.
+#[derive(Debug, Clone)]
+pub struct TemplateContext {
+    pub hostname: String,
+    pub os: String,
+    pub arch: String,
+    pub user: String,
+    pub home: String,
+    pub profile: String,
+}
+
+const FIELDS: &[&str] = &["Hostname", "OS", "Arch", "User", "Home", "Profile"];
+
+impl TemplateContext {
+    /// Describes this machine, using `profile` for `.Profile`.
+    pub fn current(profile: Option<&str>) -> Self {
+        let os = match std::env::consts::OS {
+            "macos" => "darwin",
+            os => os,
+        };
+        let arch = match std::env::consts::ARCH {
+            "aarch64" => "arm64",
+            "x86_64" => "amd64",
+            "x86" => "386",
+            arch => arch,
+        };
+        Self {
+            hostname: hostname(),
+            os: os.to_string(),
+            arch: arch.to_string(),
+            user: std::env::var("USER").or_else(|_| std::env::var("USERNAME")).unwrap_or_default(),
+            home: dirs::home_dir().map(|h| h.display().to_string()).unwrap_or_default(),
+            profile: profile.unwrap_or_default().to_string(),
+        }
+    }
+
+    /// Returns each field with its value, for `kiwi template vars`.
+    pub fn fields(&self) -> Vec<(&'static str, &str)> {
+        FIELDS.iter().map(|name| (*name, self.field(name).unwrap_or_default())).collect()
+    }
+
+    fn field(&self, name: &str) -> Option<&str> {
+        match name {
+            "Hostname" => Some(&self.hostname),
+            "OS" => Some(&self.os),
+            "Arch" => Some(&self.arch),
+            "User" => Some(&self.user),
+            "Home" => Some(&self.home),
+            "Profile" => Some(&self.profile),
+            _ => None,
+        }
+    }
+}
+
+/// Returns this machine's hostname, or "unknown".
+pub fn hostname() -> String {
+    std::process::Command::new("hostname")
+        .output()
+        .ok()
+        .and_then(|out| String::from_utf8(out.stdout).ok())
+        .map(|name| name.trim().to_string())
+        .filter(|name| !name.is_empty())
+        .unwrap_or_else(|| "unknown".to_string())
+}
+
+/// Renders a template for this machine. The syntax is a small subset of
+/// Go's text/template:
+///
+/// - `{{ .Hostname }}` inserts a field
+/// - `{{ if eq .OS "darwin" }}...{{ else if ne .Arch "arm64" }}...{{ else }}...{{ end }}`
+///   includes text conditionally; `eq` matches any of several values, and
+///   `not .Profile` or a bare `.Profile` tests for an empty field
+/// - `{{/* comment */}}` is dropped
+/// - `{{-` and `-}}` trim the whitespace before or after an action
+///
+/// `name` is only used in error messages.
+pub fn render(name: &str, source: &str, context: &TemplateContext) -> Result<String> {
+    let fail = |line: usize, message: String| KiwiError::Template(format!("{} line {}: {}", name, line, message));
+    let tokens = tokenize(source).map_err(|(line, message)| fail(line, message))?;
+    let mut parser = Parser { tokens, pos: 0 };
+    let (nodes, stop) = parser.parse_nodes().map_err(|(line, message)| fail(line, message))?;
+    if let Some((stop, line)) = stop {
+        return Err(fail(line, format!("{} without a matching if", stop.describe())));
+    }
+    let mut out = String::with_capacity(source.len());
+    render_nodes(&nodes, context, &mut out);
+    Ok(out)
+}
+
+/// Errors while parsing carry the line they were found on.
+type ParseResult<T> = std::result::Result<T, (usize, String)>;
+
+enum Token {
+    Text(String),
+    Action { body: String, line: usize },
+}
+
+fn tokenize(source: &str) -> ParseResult<Vec<Token>> {
+    let mut tokens = Vec::new();
+    let mut rest = source;
+    let mut line = 1;
+    let mut trim_next = false;
+    while let Some(start) = rest.find("{{") {
+        let mut text = &rest[..start];
+        if trim_next {
+            text = text.trim_start();
+        }
+        let after = &rest[start + 2..];
+        let end = after.find("}}").ok_or_else(|| (line + rest[..start].matches('\n').count(), "unclosed {{".to_string()))?;
+        let mut body = &after[..end];
+        if body.starts_with('-') {
+            text = text.trim_end();
+            body = &body[1..];
+        }
+        trim_next = body.ends_with('-');
+        if trim_next {
+            body = &body[..body.len() - 1];
+        }
+
+        line += rest[..start].matches('\n').count();
+        if !text.is_empty() {
+            tokens.push(Token::Text(text.to_string()));
+        }
+        let body = body.trim();
+        if !(body.starts_with("/*") && body.ends_with("*/")) {
+            tokens.push(Token::Action { body: body.to_string(), line });
+        }
+        line += after[..end].matches('\n').count();
+        rest = &after[end + 2..];
+    }
+    let text = if trim_next { rest.trim_start() } else { rest };
+    if !text.is_empty() {
+        tokens.push(Token::Text(text.to_string()));
+    }
+    Ok(tokens)
+}
+
+enum Operand {
+    Field(String),
+    Literal(String),
+}
+
+enum Condition {
+    /// The first operand equals any of the rest
+    Eq(Operand, Vec<Operand>),
+    Ne(Operand, Operand),
+    Not(Operand),
+    Truthy(Operand),
+}
+
+enum Node {
+    Text(String),
+    Value(Operand),
+    If { branches: Vec<(Condition, Vec<Node>)>, otherwise: Vec<Node> },
+}
+
+/// The actions that end a block.
+enum Stop {
+    ElseIf(Condition),
+    Else,
+    End,
+}
+
+impl Stop {
+    fn describe(&self) -> &'static str {
+        match self {
+            Stop::ElseIf(_) => "{{ else if }}",
+            Stop::Else => "{{ else }}",
+            Stop::End => "{{ end }}",
+        }
+    }
+}
+
+struct Parser {
+    tokens: Vec<Token>,
+    pos: usize,
+}
+
+impl Parser {
+    /// Parses nodes up to the end of the template or the next action that
+    /// ends a block, which is returned with its line.
+    fn parse_nodes(&mut self) -> ParseResult<(Vec<Node>, Option<(Stop, usize)>)> {
+        let mut nodes = Vec::new();
+        while self.pos < self.tokens.len() {
+            let (body, line) = match &self.tokens[self.pos] {
+                Token::Text(text) => {
+                    nodes.push(Node::Text(text.clone()));
+                    self.pos += 1;
+                    continue;
+                }
+                Token::Action { body, line } => (body.clone(), *line),
+            };
+            self.pos += 1;
+
+            let words = split_words(&body).map_err(|message| (line, message))?;
+            match words.first().map(String::as_str) {
+                Some("if") => {
+                    let condition = parse_condition(&words[1..]).map_err(|message| (line, message))?;
+                    nodes.push(self.parse_if(condition, line)?);
+                }
+                Some("else") if words.len() == 1 => return Ok((nodes, Some((Stop::Else, line)))),
+                Some("else") if words[1] == "if" => {
+                    let condition = parse_condition(&words[2..]).map_err(|message| (line, message))?;
+                    return Ok((nodes, Some((Stop::ElseIf(condition), line))));
+                }
+                Some("end") if words.len() == 1 => return Ok((nodes, Some((Stop::End, line)))),
+                Some(_) if words.len() == 1 => {
+                    nodes.push(Node::Value(parse_operand(&words[0]).map_err(|message| (line, message))?));
+                }
+                _ => return Err((line, format!("unknown action {{{{ {} }}}}", body))),
+            }
+        }
+        Ok((nodes, None))
+    }
+
+    fn parse_if(&mut self, condition: Condition, line: usize) -> ParseResult<Node> {
+        let mut branches = Vec::new();
+        let mut condition = condition;
+        loop {
+            let (body, stop) = self.parse_nodes()?;
+            branches.push((condition, body));
+            match stop {
+                Some((Stop::ElseIf(next), _)) => condition = next,
+                Some((Stop::Else, _)) => {
+                    let (otherwise, stop) = self.parse_nodes()?;
+                    return match stop {
+                        Some((Stop::End, _)) => Ok(Node::If { branches, otherwise }),
+                        Some((stop, line)) => Err((line, format!("{} after {{{{ else }}}}", stop.describe()))),
+                        None => Err((line, "{{ if }} without a matching {{ end }}".to_string())),
+                    };
+                }
+                Some((Stop::End, _)) => return Ok(Node::If { branches, otherwise: Vec::new() }),
+                None => return Err((line, "{{ if }} without a matching {{ end }}".to_string())),
+            }
+        }
+    }
+}
+
+/// Splits an action into words, keeping quoted strings (with their quotes)
+/// together.
+fn split_words(body: &str) -> std::result::Result<Vec<String>, String> {
+    let mut words = Vec::new();
+    let mut chars = body.chars().peekable();
+    while let Some(&c) = chars.peek() {
+        if c.is_whitespace() {
+            chars.next();
+            continue;
+        }
+        let mut word = String::new();
+        if c == '"' {
+            word.push(chars.next().unwrap());
+            loop {
+                match chars.next() {
+                    Some('\\') => {
+                        word.push('\\');
+                        word.extend(chars.next());
+                    }
+                    Some('"') => {
+                        word.push('"');
+                        break;
+                    }
+                    Some(c) => word.push(c),
+                    None => return Err("unterminated string".to_string()),
+                }
+            }
+        } else {
+            while let Some(&c) = chars.peek() {
+                if c.is_whitespace() {
+                    break;
+                }
+                word.push(c);
+                chars.next();
+            }
+        }
+        words.push(word);
+    }
+    Ok(words)
+}
+
+fn parse_operand(word: &str) -> std::result::Result<Operand, String> {
+    if let Some(name) = word.strip_prefix('.') {
+        if !FIELDS.contains(&name) {
+            return Err(format!("unknown field .{}; expected one of .{}", name, FIELDS.join(", .")));
+        }
+        return Ok(Operand::Field(name.to_string()));
+    }
+    if word.len() >= 2 && word.starts_with('"') && word.ends_with('"') {
+        let mut literal = String::new();
+        let mut chars = word[1..word.len() - 1].chars();
+        while let Some(c) = chars.next() {
+            match c {
+                '\\' => match chars.next() {
+                    Some('n') => literal.push('\n'),
+                    Some('t') => literal.push('\t'),
+                    Some(c) => literal.push(c),
+                    None => {}
+                },
+                c => literal.push(c),
+            }
+        }
+        return Ok(Operand::Literal(literal));
+    }
+    Err(format!("expected a field like .OS or a quoted string, found {}", word))
+}
+
+fn parse_condition(words: &[String]) -> std::result::Result<Condition, String> {
+    let operands = |words: &[String]| words.iter().map(|w| parse_operand(w)).collect::<std::result::Result<Vec<_>, _>>();
+    match words.first().map(String::as_str) {
+        Some("eq") => {
+            let mut operands = operands(&words[1..])?;
+            if operands.len() < 2 {
+                return Err("eq needs at least two values".to_string());
+            }
+            let first = operands.remove(0);
+            Ok(Condition::Eq(first, operands))
+        }
+        Some("ne") => {
+            let mut operands = operands(&words[1..])?;
+            if operands.len() != 2 {
+                return Err("ne needs two values".to_string());
+            }
+            let second = operands.pop().unwrap();
+            Ok(Condition::Ne(operands.pop().unwrap(), second))
+        }
+        Some("not") if words.len() == 2 => Ok(Condition::Not(parse_operand(&words[1])?)),
+        Some(_) if words.len() == 1 => Ok(Condition::Truthy(parse_operand(&words[0])?)),
+        _ => Err("expected a condition like eq .OS \"darwin\"".to_string()),
+    }
+}
+
+fn value<'a>(operand: &'a Operand, context: &'a TemplateContext) -> &'a str {
+    match operand {
+        Operand::Field(name) => context.field(name).unwrap_or_default(),
+        Operand::Literal(literal) => literal,
+    }
+}
+
+fn holds(condition: &Condition, context: &TemplateContext) -> bool {
+    match condition {
+        Condition::Eq(first, rest) => rest.iter().any(|other| value(first, context) == value(other, context)),
+        Condition::Ne(a, b) => value(a, context) != value(b, context),
+        Condition::Not(operand) => value(operand, context).is_empty(),
+        Condition::Truthy(operand) => !value(operand, context).is_empty(),
+    }
+}
+
+fn render_nodes(nodes: &[Node], context: &TemplateContext, out: &mut String) {
+    for node in nodes {
+        match node {
+            Node::Text(text) => out.push_str(text),
+            Node::Value(operand) => out.push_str(value(operand, context)),
+            Node::If { branches, otherwise } => {
+                let body = branches.iter()
+                    .find(|(condition, _)| holds(condition, context))
+                    .map_or(otherwise, |(_, body)| body);
+                render_nodes(body, context, out);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn context() -> TemplateContext {
+        TemplateContext {
+            hostname: "work-laptop".to_string(),
+            os: "darwin".to_string(),
+            arch: "arm64".to_string(),
+            user: "kiwi".to_string(),
+            home: "/Users/kiwi".to_string(),
+            profile: String::new(),
+        }
+    }
+
+    #[test]
+    fn test_render() {
+        let source = "[user]\n  name = {{ .User }}\n{{- if eq .OS \"linux\" \"windows\" }}\n  editor = nano\n{{- else if ne .Arch \"arm64\" }}\n  editor = vi\n{{- else }}\n  editor = \"code --wait\"\n{{- end }}\n{{/* host */}}# {{ .Hostname }}{{ if not .Profile }} (all profiles){{ end }}\n";
+        assert_eq!(
+            render(".gitconfig", source, &context()).unwrap(),
+            "[user]\n  name = kiwi\n  editor = \"code --wait\"\n# work-laptop (all profiles)\n"
+        );
+    }
+
+    #[test]
+    fn test_render_errors() {
+        let err = |source| render(".zshrc", source, &context()).unwrap_err().to_string();
+        assert!(err("a\n{{ if .OS }}b").contains(".zshrc line 2"));
+        assert!(err("{{ end }}").contains("without a matching if"));
+        assert!(err("{{ .Shell }}").contains("unknown field .Shell"));
+        assert!(err("{{ .OS").contains("unclosed"));
+    }
+}
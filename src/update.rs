@@ -0,0 +1,324 @@
+use std::cmp::Ordering;
+use std::collections::HashMap;
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use crate::progress::Progress;
+use crate::trace;
+use crate::{KiwiError, Result};
+use ed25519_dalek::{Signature, VerifyingKey};
+use reqwest::{Client, StatusCode};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+/// The hex Ed25519 public key release manifests are signed with, built into
+/// release binaries. Builds without one can't update themselves.
+const RELEASE_KEY: Option<&str> = option_env!("KIWI_RELEASE_KEY");
+
+/// Which releases `kiwi self-update` follows.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Channel {
+    #[default]
+    Stable,
+    /// Release candidates, ahead of stable
+    Beta,
+}
+
+impl std::str::FromStr for Channel {
+    type Err = String;
+
+    fn from_str(s: &str) -> std::result::Result<Self, Self::Err> {
+        match s {
+            "stable" => Ok(Channel::Stable),
+            "beta" => Ok(Channel::Beta),
+            _ => Err("Must be stable or beta".to_string()),
+        }
+    }
+}
+
+impl Channel {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Channel::Stable => "stable",
+            Channel::Beta => "beta",
+        }
+    }
+}
+
+/// What `kiwi self-update --json` reports.
+#[derive(Debug, Serialize)]
+pub struct UpdateCheck {
+    pub channel: Channel,
+    pub current: String,
+    pub latest: Option<String>,
+    pub available: bool,
+    pub installed: bool,
+}
+
+/// The newest kiwi published on a channel, as the server describes it.
+#[derive(Debug, Clone, Deserialize)]
+pub struct Release {
+    pub version: String,
+    #[serde(default)]
+    pub notes: Option<String>,
+    /// Binaries by target triple
+    pub assets: HashMap<String, Asset>,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct Asset {
+    pub url: String,
+    pub sha256: String,
+    /// Hex Ed25519 signature of `signed_message` by the release key
+    #[serde(default)]
+    pub signature: String,
+    #[serde(default)]
+    pub size: Option<u64>,
+}
+
+impl Release {
+    /// Whether this release is newer than the running binary.
+    pub fn is_newer(&self) -> bool {
+        compare_versions(&self.version, env!("CARGO_PKG_VERSION")) == Ordering::Greater
+    }
+
+    /// The binary for the machine kiwi is running on, once its signature
+    /// checks out against the built-in release key. The server only relays
+    /// releases, so its word alone isn't enough to install one.
+    pub fn asset(&self) -> Result<&Asset> {
+        let key = RELEASE_KEY.ok_or_else(|| {
+            KiwiError::Sync("This build of kiwi has no release key to check updates with; update it the way you installed it".to_string())
+        })?;
+        let target = target();
+        let asset = self.assets.get(&target).ok_or_else(|| {
+            KiwiError::Sync(format!("Release {} has no build for {}", self.version, target))
+        })?;
+        verify_signature(key, &self.version, &target, asset)?;
+        Ok(asset)
+    }
+}
+
+/// What the release key signs for each asset. Naming the version and target
+/// keeps a signed binary from being offered as some other release.
+pub fn signed_message(version: &str, target: &str, sha256: &str) -> String {
+    format!("kiwi {} {} {}", version, target, sha256.to_ascii_lowercase())
+}
+
+fn verify_signature(key: &str, version: &str, target: &str, asset: &Asset) -> Result<()> {
+    let key = decode_hex::<32>(key)
+        .and_then(|bytes| VerifyingKey::from_bytes(&bytes).ok())
+        .ok_or_else(|| KiwiError::Sync("This build's release key is invalid".to_string()))?;
+    let signature = decode_hex::<64>(&asset.signature).map(|bytes| Signature::from_bytes(&bytes));
+    match signature {
+        Some(signature) if key.verify_strict(signed_message(version, target, &asset.sha256).as_bytes(), &signature).is_ok() => Ok(()),
+        _ => Err(KiwiError::Sync(format!(
+            "Release {} for {} isn't signed with kiwi's release key; nothing was installed",
+            version, target
+        ))),
+    }
+}
+
+fn decode_hex<const N: usize>(hex: &str) -> Option<[u8; N]> {
+    if hex.len() != N * 2 || !hex.bytes().all(|b| b.is_ascii_hexdigit()) {
+        return None;
+    }
+    let mut bytes = [0u8; N];
+    for (i, byte) in bytes.iter_mut().enumerate() {
+        *byte = u8::from_str_radix(&hex[i * 2..i * 2 + 2], 16).ok()?;
+    }
+    Some(bytes)
+}
+
+/// The target triple releases are built for, such as aarch64-apple-darwin.
+pub fn target() -> String {
+    let os = match std::env::consts::OS {
+        "macos" => "apple-darwin",
+        "linux" => "unknown-linux-gnu",
+        other => other,
+    };
+    format!("{}-{}", std::env::consts::ARCH, os)
+}
+
+/// Asks the server for the current release on a channel; None when nothing
+/// is published on it.
+pub async fn check(server: &str, channel: Channel) -> Result<Option<Release>> {
+    let url = format!("{}/releases/{}", server.trim_end_matches('/'), channel.as_str());
+    let response = trace::send(Client::new().get(url)).await?;
+    match response.status() {
+        StatusCode::NOT_FOUND => Ok(None),
+        status if status.is_success() => Ok(Some(response.json().await?)),
+        status => Err(format!("Failed to check for updates: {}", status).into()),
+    }
+}
+
+/// Downloads a release binary, refusing it unless its SHA-256 matches the
+/// signed one in the asset.
+pub async fn download(asset: &Asset, progress: &Progress) -> Result<Vec<u8>> {
+    if !asset.url.starts_with("https://") {
+        return Err(format!("Refusing to download an update over plain HTTP: {}", asset.url).into());
+    }
+    let mut response = trace::send(Client::new().get(&asset.url)).await?;
+    if !response.status().is_success() {
+        return Err(format!("Failed to download the update: {}", response.status()).into());
+    }
+
+    let receiving = progress.bytes("Downloading", response.content_length().or(asset.size));
+    let mut body = Vec::new();
+    while let Some(chunk) = response.chunk().await? {
+        receiving.inc(chunk.len() as u64);
+        body.extend_from_slice(&chunk);
+    }
+    receiving.finish_and_clear();
+
+    let digest = format!("{:x}", Sha256::digest(&body));
+    if !digest.eq_ignore_ascii_case(&asset.sha256) {
+        return Err(format!(
+            "The download doesn't match the published checksum (expected {}, got {}); nothing was installed",
+            asset.sha256, digest
+        )
+        .into());
+    }
+    Ok(body)
+}
+
+/// The binary that's running, following links so a linked install (as
+/// Homebrew makes) replaces the real file rather than the link.
+pub fn current_exe() -> Result<PathBuf> {
+    Ok(std::env::current_exe()?.canonicalize()?)
+}
+
+/// Replaces the binary at `exe`. The new one is written beside it and
+/// renamed over it, so an interrupted update leaves the old binary in
+/// place.
+pub fn install(binary: &[u8], exe: &Path) -> Result<()> {
+    let name = exe.file_name().map(|name| name.to_string_lossy().into_owned()).unwrap_or_default();
+    let staged = exe.with_file_name(format!(".{}.update-{}", name, std::process::id()));
+    let result = stage(binary, &staged).and_then(|_| Ok(fs::rename(&staged, exe)?));
+    if result.is_err() {
+        let _ = fs::remove_file(&staged);
+    }
+    match result {
+        Err(KiwiError::Io(e)) if e.kind() == std::io::ErrorKind::PermissionDenied => {
+            Err(KiwiError::PermissionDenied { path: exe.to_path_buf() })
+        }
+        result => result,
+    }
+}
+
+fn stage(binary: &[u8], path: &Path) -> Result<()> {
+    let mut file = fs::File::create(path)?;
+    file.write_all(binary)?;
+    file.sync_all()?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        fs::set_permissions(path, fs::Permissions::from_mode(0o755))?;
+    }
+    Ok(())
+}
+
+/// Orders versions like 1.2.10 and 1.3.0-beta.1 by their numbers, with a
+/// pre-release before the release it leads up to.
+pub fn compare_versions(a: &str, b: &str) -> Ordering {
+    let (a_core, a_pre) = split_version(a);
+    let (b_core, b_pre) = split_version(b);
+    let length = a_core.len().max(b_core.len());
+    for i in 0..length {
+        let ordering = a_core.get(i).unwrap_or(&0).cmp(b_core.get(i).unwrap_or(&0));
+        if ordering != Ordering::Equal {
+            return ordering;
+        }
+    }
+    match (a_pre, b_pre) {
+        (None, None) => Ordering::Equal,
+        (None, Some(_)) => Ordering::Greater,
+        (Some(_), None) => Ordering::Less,
+        (Some(a), Some(b)) => compare_pre_releases(a, b),
+    }
+}
+
+fn split_version(version: &str) -> (Vec<u64>, Option<&str>) {
+    let version = version.trim().trim_start_matches('v');
+    let version = version.split('+').next().unwrap_or(version);
+    let (core, pre) = match version.split_once('-') {
+        Some((core, pre)) => (core, Some(pre)),
+        None => (version, None),
+    };
+    (core.split('.').map(|part| part.parse().unwrap_or(0)).collect(), pre)
+}
+
+fn compare_pre_releases(a: &str, b: &str) -> Ordering {
+    let mut a_parts = a.split('.');
+    let mut b_parts = b.split('.');
+    loop {
+        let ordering = match (a_parts.next(), b_parts.next()) {
+            (None, None) => return Ordering::Equal,
+            (None, Some(_)) => return Ordering::Less,
+            (Some(_), None) => return Ordering::Greater,
+            (Some(a), Some(b)) => match (a.parse::<u64>(), b.parse::<u64>()) {
+                (Ok(a), Ok(b)) => a.cmp(&b),
+                _ => a.cmp(b),
+            },
+        };
+        if ordering != Ordering::Equal {
+            return ordering;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn versions_compare_numerically() {
+        assert_eq!(compare_versions("0.10.0", "0.9.3"), Ordering::Greater);
+        assert_eq!(compare_versions("v1.2", "1.2.0"), Ordering::Equal);
+        assert_eq!(compare_versions("1.2.0", "1.2.1"), Ordering::Less);
+    }
+
+    #[test]
+    fn pre_releases_come_before_the_release() {
+        assert_eq!(compare_versions("1.0.0-beta.2", "1.0.0"), Ordering::Less);
+        assert_eq!(compare_versions("1.0.0-beta.10", "1.0.0-beta.2"), Ordering::Greater);
+        assert_eq!(compare_versions("1.0.0-beta.1", "0.9.0"), Ordering::Greater);
+    }
+
+    #[test]
+    fn signatures_are_checked_against_the_key() {
+        use ed25519_dalek::{Signer, SigningKey};
+
+        let signing = SigningKey::from_bytes(&[7; 32]);
+        let key: String = signing.verifying_key().to_bytes().iter().map(|b| format!("{:02x}", b)).collect();
+        let sha256 = "ab".repeat(32);
+        let signature = signing.sign(signed_message("1.2.0", "x86_64-unknown-linux-gnu", &sha256).as_bytes());
+        let asset = Asset {
+            url: "https://example.com/kiwi".to_string(),
+            sha256,
+            signature: signature.to_bytes().iter().map(|b| format!("{:02x}", b)).collect(),
+            size: None,
+        };
+
+        assert!(verify_signature(&key, "1.2.0", "x86_64-unknown-linux-gnu", &asset).is_ok());
+        assert!(verify_signature(&key, "1.3.0", "x86_64-unknown-linux-gnu", &asset).is_err());
+        assert!(verify_signature(&key, "1.2.0", "aarch64-apple-darwin", &asset).is_err());
+        let tampered = Asset { sha256: "cd".repeat(32), ..asset.clone() };
+        assert!(verify_signature(&key, "1.2.0", "x86_64-unknown-linux-gnu", &tampered).is_err());
+        let unsigned = Asset { signature: String::new(), ..asset };
+        assert!(verify_signature(&key, "1.2.0", "x86_64-unknown-linux-gnu", &unsigned).is_err());
+    }
+
+    #[test]
+    fn install_replaces_the_binary() {
+        let dir = std::env::temp_dir().join(format!("kiwi-update-{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let exe = dir.join("kiwi");
+        fs::write(&exe, "old").unwrap();
+
+        install(b"new", &exe).unwrap();
+        assert_eq!(fs::read(&exe).unwrap(), b"new");
+        assert_eq!(fs::read_dir(&dir).unwrap().count(), 1);
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}